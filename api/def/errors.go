@@ -98,13 +98,18 @@ func (e ErrWarehouseUnavailable) Error() string {
 	requiring further unbounded polymorphism shenanigans,
 	so we keep it simple: string.
 
+	`Transient` marks problems that might go away if asked again (e.g. a
+	dropped connection, or an http 503); most (e.g. a missing LFS object)
+	won't, and aren't worth retrying.
+
 	REVIEW: undecided if this should be exported as an API error at all.
 */
 type ErrWarehouseProblem struct {
-	Msg    string         `json:"msg"`
-	During string         `json:"during"` // 'fetch' or 'save'
-	Ware   Ware           `json:"ware,omitEmpty"`
-	From   WarehouseCoord `json:"from,omitEmpty"`
+	Msg       string         `json:"msg"`
+	During    string         `json:"during"` // 'fetch' or 'save'
+	Ware      Ware           `json:"ware,omitEmpty"`
+	From      WarehouseCoord `json:"from,omitEmpty"`
+	Transient bool           `json:"transient,omitempty"`
 }
 
 func (e ErrWarehouseProblem) Error() string {
@@ -175,3 +180,30 @@ type ErrWareCorrupt struct {
 func (e ErrWareCorrupt) Error() string {
 	return fmt.Sprintf("Ware Corrupt: %s, while working on %q from %s", e.Msg, e.Ware.Hash, e.From)
 }
+
+/*
+	Raised when a formula gave the hash it expects of a conjectured output,
+	and the run produced something else.
+
+	This isn't a problem with storage or transport (the output was saved
+	just fine); it means the formula didn't reproduce.  The `Warehouses`
+	are where the actual output was saved; nothing says where the expected
+	ware is, so the suggested diff looks for it in the local cache.
+*/
+type ErrOutputMismatch struct {
+	Output     string          `json:"output"`
+	Expected   Ware            `json:"expected"`
+	Actual     Ware            `json:"actual"`
+	Warehouses WarehouseCoords `json:"silo,omitempty"`
+}
+
+func (e ErrOutputMismatch) Error() string {
+	msg := fmt.Sprintf("Output Mismatch: output %q was expected to be %q, got %q", e.Output, e.Expected.Hash, e.Actual.Hash)
+	if len(e.Warehouses) > 0 {
+		msg += fmt.Sprintf(" (to see what changed, try `repeatr examine diff %s:%s %s:%s@%s`)",
+			e.Expected.Type, e.Expected.Hash,
+			e.Actual.Type, e.Actual.Hash, e.Warehouses[0],
+		)
+	}
+	return msg
+}
@@ -43,6 +43,7 @@ func (f Formula) Hash() string {
 	for _, spec := range f2.Outputs {
 		spec.Hash = ""
 		spec.Warehouses = nil
+		spec.Compress = ""
 	}
 	// Hash the rest, and thar we be.
 	hasher := sha512.New384()
@@ -12,6 +12,8 @@ type Action struct {
 	Policy     Policy   `json:"policy,omitempty"`   // policy naming user level and security mode.
 	Cradle     *bool    `json:"cradle,omitempty"`   // default/nil interpreted as true; set to false to disable ensuring cradle during setup.
 	Escapes    Escapes  `json:"escapes,omitempty"`
+
+	EnvRotation int `json:"-"` // executors pass env sorted by key, rotated this many places.  not serialized; only `repeatr verify` sets it.
 }
 
 type Env map[string]string
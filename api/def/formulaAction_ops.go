@@ -1,5 +1,7 @@
 package def
 
+import "sort"
+
 func (a Action) Clone() Action {
 	cpyEntrypoint := make([]string, len(a.Entrypoint))
 	copy(cpyEntrypoint, a.Entrypoint)
@@ -16,6 +18,25 @@ func (e Env) Clone() Env {
 	return r
 }
 
+/*
+	Returns the env as "KEY=value" strings, the way executors hand it to
+	processes: sorted by key, then rotated left by `rotation` places
+	(so that any nonzero rotation short of the length makes a different order).
+*/
+func (e Env) Slice(rotation int) []string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := make([]string, len(keys))
+	for i := range keys {
+		k := keys[(i+rotation)%len(keys)]
+		r[i] = k + "=" + e[k]
+	}
+	return r
+}
+
 /*
 	Merge given env map into the object.
 	Existing values are preferred, new values are added.
@@ -72,6 +72,11 @@ type Input struct {
 	For other more legacy-oriented systems, this may be a hash of the
 	of the working filesystem right before before export.)
 
+	If a conjectured output's `Hash` is already set in the formula given to
+	repeatr, it's taken as an expectation: a run that produces anything else
+	fails, with an `ErrOutputMismatch`.  This makes a formula a regression
+	test for its own reproducibility.
+
 	Whether or not to include an `Output` in the overall `Formula`'s conjecture
 	is up to you!  Many things in the world are not deterministic; repeatr
 	is here to help you with the ones that should be, and stay out of the way
@@ -92,6 +97,11 @@ type Input struct {
 	(One typical example, which is engaged by default for you when an output
 	is configured to be included in the conjecture, is setting all the file
 	modification times to a standard value.)
+
+	`Output.Compress` picks how the data is compressed for storage, for
+	those `Type`s that store compressed blobs (e.g. "tar" accepts "none",
+	"gzip", "zstd", or "xz", optionally with a level, like "zstd:19").
+	It never affects the `Output.Hash`, and is not part of the conjecture.
 */
 type Output struct {
 	Type       string          `json:"type"`            // implementation name (repeatr-internal).  included in the conjecture (iff the whole output is).
@@ -99,6 +109,7 @@ type Output struct {
 	Warehouses WarehouseCoords `json:"silo,omitempty"`  // where to ship the output data.  not considered part of the conjecture.
 	MountPath  string          `json:"mount,omitempty"` // filepath where this output will be yanked from the job when it reaches completion.  included in the conjecture (iff the whole output is).
 	Filters    *Filters        `json:"filters,omitempty"`
+	Compress   string          `json:"compress,omitempty"`
 	Conjecture bool            `json:"cnj,omitempty"` // whether or not this output is expected to contain the same result, every time, when given the same set of `Input` items.
 }
 
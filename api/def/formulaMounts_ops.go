@@ -2,6 +2,9 @@ package def
 
 import (
 	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/ugorji/go/codec"
 )
@@ -77,3 +80,51 @@ func (f *Filters) InitDefaultsOutput() {
 		f.Mtime = FilterDefaultMtime
 	}
 }
+
+/*
+	The algorithms `Output.Compress` may name, and the levels each accepts
+	(and uses when no level is given).
+*/
+var CompressionLevels = map[string]struct{ Min, Default, Max int }{
+	"none": {0, 0, 0},
+	"gzip": {1, 6, 9},
+	"zstd": {1, 3, 22},
+	"xz":   {0, 6, 9},
+}
+
+/*
+	Parses an `Output.Compress` value: the name of an algorithm from
+	`CompressionLevels`, optionally followed by a colon and a level,
+	e.g. "zstd:19".  Returns the name and level; an empty string
+	returns an empty name, meaning the transmat's default.
+
+	May panic with:
+
+	  - `*ErrConfigValidation` -- if the algorithm is unknown, or the level is out of range
+	    (or missing after a colon).
+*/
+func ParseCompress(spec string) (name string, level int) {
+	if spec == "" {
+		return "", 0
+	}
+	name, levelStr, hasLevel := spec, "", false
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, levelStr, hasLevel = spec[:i], spec[i+1:], true
+	}
+	levels, ok := CompressionLevels[name]
+	if !ok {
+		panic(&ErrConfigValidation{
+			Msg: fmt.Sprintf("unknown compression %q; must be one of \"none\", \"gzip\", \"zstd\", or \"xz\"", name),
+		})
+	}
+	if !hasLevel {
+		return name, levels.Default
+	}
+	level, err := strconv.Atoi(levelStr)
+	if err != nil || level < levels.Min || level > levels.Max {
+		panic(&ErrConfigValidation{
+			Msg: fmt.Sprintf("compression level for %s must be an integer from %d to %d, not %q", name, levels.Min, levels.Max, levelStr),
+		})
+	}
+	return name, level
+}
@@ -85,6 +85,10 @@ func (og *OutputGroup) CodecDecodeSelf(c *codec.Decoder) {
 			v.Filters = &Filters{}
 		}
 	}
+	// Check compression choices now, rather than after the job's run.
+	for _, v := range *og {
+		ParseCompress(v.Compress)
+	}
 }
 
 func (mp OutputGroup) asMappySlice() codec.MapBySlice {
@@ -109,3 +109,33 @@ func TestStringParse(t *testing.T) {
 		})
 	})
 }
+
+func TestFormulaCompressParse(t *testing.T) {
+	Convey("Given a formula with an output compression choice", t, func() {
+		Convey("Valid choices parse", func() {
+			content := []byte(`
+			outputs:
+				"/out":
+					type: tar
+					compress: "zstd:19"
+			`)
+			var formula def.Formula
+			hitch.DecodeYaml(bytes.NewBuffer(content), &formula)
+			So(formula.Outputs["/out"].Compress, ShouldEqual, "zstd:19")
+		})
+		Convey("Invalid choices should be rejected while parsing", func() {
+			for _, spec := range []string{"lz4", "gzip:10", "zstd:fast"} {
+				content := []byte(`
+				outputs:
+					"/out":
+						type: tar
+						compress: "` + spec + `"
+				`)
+				var formula def.Formula
+				So(func() {
+					hitch.DecodeYaml(bytes.NewBuffer(content), &formula)
+				}, ShouldPanic)
+			}
+		})
+	})
+}
@@ -0,0 +1,43 @@
+package def
+
+/*
+	A Pipeline is a set of named formulas -- "steps" -- where the inputs of
+	some steps are the outputs of others.
+
+	Each step's `Wire` maps names of inputs in its formula to outputs of
+	other steps, written "<step>.<output>".  A wired input's hash is left
+	blank in the formula (it can't be known until the other step has run),
+	and is filled in with whatever that output produced; so the pipeline's
+	steps run in dependency order, as a DAG.
+
+	Here's a sketch of a pipeline that builds something, and then tests it:
+
+		steps:
+		  build:
+		    formula:
+		      inputs:
+		        "/": {type: "tar", hash: "...", silo: "..."}
+		      action: {command: ["make"]}
+		      outputs:
+		        "bin": {type: "tar", mount: "/task/bin", silo: "file+ca://wares"}
+		  test:
+		    formula:
+		      inputs:
+		        "/": {type: "tar", hash: "...", silo: "..."}
+		        "bin": {type: "tar", mount: "/task/bin"}
+		      action: {command: ["/task/bin/selftest"]}
+		    wire:
+		      "bin": "build.bin"
+
+	Wired outputs must have warehouses, so that downstream steps can fetch them;
+	and wiring doesn't need to mention them on the downstream inputs -- the
+	upstream output's warehouses are added to the input's.
+*/
+type Pipeline struct {
+	Steps map[string]*Step `json:"steps"`
+}
+
+type Step struct {
+	Formula Formula           `json:"formula"`
+	Wire    map[string]string `json:"wire,omitempty"` // input name -> "<step>.<output>".
+}
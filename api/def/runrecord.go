@@ -1,7 +1,10 @@
 package def
 
 import (
+	"crypto/sha512"
 	"time"
+
+	"github.com/ugorji/go/codec"
 )
 
 /*
@@ -36,6 +39,23 @@ type RunRecord struct {
 	Failure error `json:"failure,omitempty"`
 }
 
+/*
+	Returns the hash ID of the record: a hash covering everything in it
+	(the UID included, so every run's HID is distinct, even for runs of
+	the same formula with the same results), except for the HID itself.
+
+	The hash is computed the same way as `Formula.Hash`, and comes with the
+	same caveats.  The date is hashed in UTC, so a record's HID doesn't
+	depend on the timezone it was serialized in.
+*/
+func (rr RunRecord) Hash() string {
+	rr.HID = ""
+	rr.Date = rr.Date.UTC()
+	hasher := sha512.New384()
+	codec.NewEncoder(hasher, &codec.CborHandle{}).MustEncode(rr)
+	return b58encode(hasher.Sum(nil))
+}
+
 type ResultGroup map[string]*Result
 
 /*
@@ -109,6 +109,8 @@ func failureTypeToString(e error) string {
 		return "ErrHashMismatch"
 	case *ErrWareCorrupt:
 		return "ErrWareCorrupt"
+	case *ErrOutputMismatch:
+		return "ErrOutputMismatch"
 	default:
 		panic(fmt.Errorf("Internal Error type %T not suitable for API.\n\tFull error: %s", e, e))
 	}
@@ -130,6 +132,8 @@ func stringToBlankFailure(typ string) error {
 		return &ErrHashMismatch{}
 	case "ErrWareCorrupt":
 		return &ErrWareCorrupt{}
+	case "ErrOutputMismatch":
+		return &ErrOutputMismatch{}
 	default:
 		panic(&ErrUnmarshalling{
 			Msg: fmt.Sprintf("cannot unmarshal error type: %q is not a known type", typ),
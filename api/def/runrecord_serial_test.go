@@ -2,6 +2,7 @@ package def_test
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 
@@ -31,5 +32,51 @@ func TestRunRecordCodec(t *testing.T) {
 			So(rr2.UID, ShouldResemble, rr.UID)
 			So(rr2.Failure, ShouldResemble, rr.Failure)
 		})
+
+		Convey("Output mismatches should bounce too", func() {
+			rr.Failure = &def.ErrOutputMismatch{
+				Output:     "out",
+				Expected:   def.Ware{"tar", "asdf"},
+				Actual:     def.Ware{"tar", "qwer"},
+				Warehouses: def.WarehouseCoords{"file+ca://wh"},
+			}
+			buf := encodeToJson(rr)
+			var rr2 def.RunRecord
+			decodeFromJson(buf.Bytes(), &rr2)
+			So(rr2.Failure, ShouldResemble, rr.Failure)
+			So(rr2.Failure.Error(), ShouldContainSubstring, "repeatr examine diff tar:asdf tar:qwer@file+ca://wh")
+		})
+	})
+}
+
+func TestRunRecordHash(t *testing.T) {
+	Convey("Given a RunRecord", t, func() {
+		rr := def.RunRecord{
+			UID:        "whee",
+			Date:       time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC),
+			FormulaHID: "frm",
+			Results: def.ResultGroup{
+				"$exitcode": &def.Result{"$exitcode", def.Ware{"exitcode", "0"}},
+			},
+		}
+		hid := rr.Hash()
+
+		Convey("The hash shouldn't depend on the HID field, or the timezone", func() {
+			rr.HID = hid
+			So(rr.Hash(), ShouldEqual, hid)
+			rr.Date = rr.Date.In(time.FixedZone("elsewhere", 3600))
+			So(rr.Hash(), ShouldEqual, hid)
+		})
+
+		Convey("The hash should survive a serialization bounce", func() {
+			var rr2 def.RunRecord
+			decodeFromJson(encodeToJson(rr).Bytes(), &rr2)
+			So(rr2.Hash(), ShouldEqual, hid)
+		})
+
+		Convey("Different runs should have different hashes", func() {
+			rr.UID = "whoo"
+			So(rr.Hash(), ShouldNotEqual, hid)
+		})
 	})
 }
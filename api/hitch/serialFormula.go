@@ -1,6 +1,8 @@
 package hitch
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
 
 	. "go.polydawn.net/meep"
@@ -28,3 +30,48 @@ func LoadFormulaFromFile(path string) *def.Formula {
 	DecodeYaml(f, frm)
 	return frm
 }
+
+/*
+	Loads a pipeline from a file.
+	The format may be json or yaml.
+
+	May panic with:
+
+	  - `*hitch.ErrIO` for any errors in reading the file.
+	  - `*hitch.ErrParsing` for any errors in parsing the raw input.
+	  - `*def.ErrConfig` for semantic violations in the content.
+*/
+func LoadPipelineFromFile(path string) *def.Pipeline {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(Meep(&ErrIO{}, Cause(err)))
+	}
+	defer f.Close()
+	p := &def.Pipeline{}
+	DecodeYaml(f, p)
+	return p
+}
+
+/*
+	Loads a file that may hold either a formula or a pipeline -- which it is
+	is told by whether it has `steps` -- and returns whichever it is,
+	with nil for the other.
+
+	May panic with the same errors as `LoadFormulaFromFile`.
+*/
+func LoadFormulaOrPipelineFromFile(path string) (*def.Formula, *def.Pipeline) {
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(Meep(&ErrIO{}, Cause(err)))
+	}
+	var probe map[string]interface{}
+	DecodeYaml(bytes.NewReader(byts), &probe)
+	if _, ok := probe["steps"]; ok {
+		p := &def.Pipeline{}
+		DecodeYaml(bytes.NewReader(byts), p)
+		return nil, p
+	}
+	frm := &def.Formula{}
+	DecodeYaml(bytes.NewReader(byts), frm)
+	return frm, nil
+}
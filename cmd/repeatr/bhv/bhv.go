@@ -13,6 +13,7 @@ const (
 	EXIT_BADARGS      = 1
 	EXIT_UNKNOWNPANIC = 2  // same code as golang uses when the process dies naturally on an unhandled panic.
 	EXIT_JOB          = 10 // used to indicate a job reported a nonzero exit code (from cli commands that execute a single job).
+	EXIT_DIVERGED     = 11 // used to indicate a formula's conjectured outputs differed between runs (from `repeatr verify`), or from the hashes it expected.
 	EXIT_USER         = 3  // grab bag for general user input errors (try to make a more specific code if possible/useful)
 )
 
@@ -44,6 +45,12 @@ var TryPlanToExit = meep.TryPlan{
 	{ByType: &def.ErrWareCorrupt{}, Handler: func(e error) {
 		panic(&ErrExit{e.Error(), EXIT_USER})
 	}},
+	{ByType: &def.ErrHashMismatch{}, Handler: func(e error) {
+		panic(&ErrExit{e.Error(), EXIT_USER})
+	}},
+	{ByType: &def.ErrOutputMismatch{}, Handler: func(e error) {
+		panic(&ErrExit{e.Error(), EXIT_DIVERGED})
+	}},
 }
 
 type ErrBadArgs struct {
@@ -0,0 +1,131 @@
+package bundleCmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/api/hitch"
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/core/bundle"
+	"go.polydawn.net/repeatr/core/executor/util"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	Fetches every input of a formula, and writes them and the formula into
+	one bundle file.  The file only appears once it's complete.
+*/
+func Create(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr bundle create` requires a path to one formula"}))
+		}
+		outPath := ctx.String("output")
+		if outPath == "" {
+			panic(cmdbhv.ErrMissingParameter("output"))
+		}
+
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+
+		var index *bundle.Index
+		meep.Try(func() {
+			frm := hitch.LoadFormulaFromFile(ctx.Args()[0])
+			scratch, err := ioutil.TempDir("", "repeatr-bundle-")
+			if err != nil {
+				panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+			}
+			defer os.RemoveAll(scratch)
+			partial := outPath + ".partial"
+			f, err := os.Create(partial)
+			if err != nil {
+				panic(meep.Meep(&cmdbhv.ErrBadArgs{Message: fmt.Sprintf("cannot write bundle: %s", err)}))
+			}
+			defer os.Remove(partial)
+			defer f.Close()
+			index = bundle.Create(f, frm, scratch, util.DefaultTransmat(), log)
+			if err := f.Close(); err != nil {
+				panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+			}
+			if err := os.Rename(partial, outPath); err != nil {
+				panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+			}
+		}, tryPlanToExit)
+
+		var size int64
+		for _, entry := range index.Wares {
+			size += entry.Size
+		}
+		fmt.Fprintf(stdout, "bundled %d wares (%d bytes) into %s\n", len(index.Wares), size, outPath)
+		return nil
+	}
+}
+
+/*
+	Unbundles a bundle, checking every ware, into the local caches --
+	or, with `--to`, into a warehouse -- and prints its formula as json.
+	With `--to`, the formula has that warehouse added to its inputs, first.
+*/
+func Import(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr bundle import` requires a path to one bundle"}))
+		}
+		to := rio.SiloURI(ctx.String("to"))
+
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+
+		var frm *def.Formula
+		meep.Try(func() {
+			transmat := util.DefaultTransmat()
+			if to == "" {
+				frm = bundle.LoadFile(ctx.Args()[0], transmat, log).Formula
+				return
+			}
+			f, err := os.Open(ctx.Args()[0])
+			if err != nil {
+				panic(meep.Meep(&bundle.ErrBadBundle{Reason: "unreadable"}, meep.Cause(err)))
+			}
+			defer f.Close()
+			dir, err := ioutil.TempDir("", "repeatr-bundle-")
+			if err != nil {
+				panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+			}
+			defer os.RemoveAll(dir)
+			index, uri := bundle.Open(f, dir, log)
+			frm = bundle.Import(index, uri, to, transmat, log)
+		}, tryPlanToExit)
+
+		if err := codec.NewEncoder(stdout, &codec.JsonHandle{Indent: -1}).Encode(frm); err != nil {
+			panic(meep.Meep(
+				&meep.ErrProgrammer{},
+				meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+			))
+		}
+		stdout.Write([]byte{'\n'})
+		return nil
+	}
+}
+
+var tryPlanToExit = append(meep.TryPlan{
+	{ByType: &hitch.ErrIO{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+	{ByType: &hitch.ErrParsing{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+	{ByType: &bundle.ErrBadBundle{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+}, cmdbhv.TryPlanToExit...)
@@ -0,0 +1,78 @@
+package cacheCmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+	"golang.org/x/crypto/ed25519"
+
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/core/resultcache"
+)
+
+/*
+	Serves a result cache over HTTP, until killed.
+*/
+func Serve(stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) > 0 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr serve-cache` takes no positional arguments"}))
+		}
+		dir := ctx.String("dir")
+		if dir == "" {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr serve-cache` requires a `--dir` to keep entries in"}))
+		}
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+		var trusted []ed25519.PublicKey
+		meep.Try(func() {
+			for _, trustPath := range ctx.StringSlice("trust") {
+				trusted = append(trusted, resultcache.LoadPublicKey(trustPath))
+			}
+		}, tryPlanToExit)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			panic(&cmdbhv.ErrExit{fmt.Sprintf("cannot create cache dir: %s", err), cmdbhv.EXIT_UNKNOWNPANIC})
+		}
+		if len(trusted) == 0 {
+			log.Warn("No `--trust` keys given; accepting entries signed by anyone")
+		}
+		log.Info("Serving result cache", "listen", ctx.String("listen"), "dir", dir)
+		err := http.ListenAndServe(ctx.String("listen"), &resultcache.Server{
+			Dir:     dir,
+			Trusted: trusted,
+			Log:     log,
+		})
+		panic(&cmdbhv.ErrExit{fmt.Sprintf("server stopped: %s", err), cmdbhv.EXIT_UNKNOWNPANIC})
+	}
+}
+
+/*
+	Generates a key for signing result cache entries,
+	and prints the public half.
+*/
+func Keygen(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr cache-keygen` requires a path to write the key to"}))
+		}
+		meep.Try(func() {
+			pub := resultcache.GenerateKey(ctx.Args()[0])
+			fmt.Fprintf(stdout, "%s\n", resultcache.FormatKey(pub))
+		}, tryPlanToExit)
+		return nil
+	}
+}
+
+var tryPlanToExit = meep.TryPlan{
+	{ByType: &resultcache.ErrKey{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+}
@@ -1,16 +1,25 @@
 package examineCmd
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/codegangsta/cli"
 	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
 	"go.polydawn.net/meep"
 
+	"go.polydawn.net/repeatr/api/def"
 	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/core/examine"
 	"go.polydawn.net/repeatr/core/executor/util"
+	"go.polydawn.net/repeatr/lib/fshash"
 	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/mirror"
+	tartrans "go.polydawn.net/repeatr/rio/transmat/impl/tar"
 )
 
 func ExamineWare(stdout, stderr io.Writer) cli.ActionFunc {
@@ -29,21 +38,91 @@ func ExamineWare(stdout, stderr io.Writer) cli.ActionFunc {
 		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
 
 		meep.Try(func() {
+			kind := rio.TransmatKind(ctx.String("kind"))
+			hash := rio.CommitID(ctx.String("hash"))
+			where := rio.SiloURI(ctx.String("where"))
+			// Tarballs can be examined as they stream by; no need to unpack anything.
+			if mirror.TarPacked[kind] {
+				wh := mirror.OpenWarehouse(where)
+				if err := wh.PingReadable(); err != nil {
+					panic(err)
+				}
+				stream := wh.OpenReader(hash)
+				defer stream.Close()
+				bucket, actual := examine.ScanPacked(stream, log)
+				if actual != hash {
+					panic(&def.ErrHashMismatch{
+						Expected: def.Ware{Type: string(kind), Hash: string(hash)},
+						Actual:   def.Ware{Type: string(kind), Hash: string(actual)},
+						From:     def.WarehouseCoord(where),
+					})
+				}
+				examine.Emit(bucket, stdout)
+				return
+			}
 			// Materialize the things.
 			arena := util.DefaultTransmat().Materialize(
-				rio.TransmatKind(ctx.String("kind")),
-				rio.CommitID(ctx.String("hash")),
-				[]rio.SiloURI{rio.SiloURI(ctx.String("where"))},
+				kind,
+				hash,
+				[]rio.SiloURI{where},
 				log,
 			)
 			defer arena.Teardown()
 			// Examine 'em.
-			examinePath(arena.Path(), stdout)
+			examine.Emit(examine.ScanPath(arena.Path()), stdout)
 		}, cmdbhv.TryPlanToExit)
 		return nil
 	}
 }
 
+/*
+	Examines a tarball -- a local file, or stdin given "-" -- without
+	unpacking it.  The manifest is the same one `examine ware` would
+	give for the same ware; its hash is logged to stderr, and if `--hash`
+	is given, the tarball must match it.
+*/
+func ExamineTar(stdin io.Reader, stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr examine tar` requires one tarball to examine (or '-' to read stdin)"}))
+		}
+
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+
+		stream := openInput(ctx.Args()[0], stdin)
+		defer stream.Close()
+		meep.Try(func() {
+			bucket, hash := examine.ScanPacked(stream, log)
+			log.Info("tarball hashed", "hash", hash)
+			if expected := rio.CommitID(ctx.String("hash")); expected != "" && hash != expected {
+				panic(&def.ErrHashMismatch{
+					Expected: def.Ware{Type: string(tartrans.Kind), Hash: string(expected)},
+					Actual:   def.Ware{Type: string(tartrans.Kind), Hash: string(hash)},
+				})
+			}
+			examine.Emit(bucket, stdout)
+		}, cmdbhv.TryPlanToExit)
+		return nil
+	}
+}
+
+/*
+	Opens a file named on the command line, or stdin for "-".
+*/
+func openInput(name string, stdin io.Reader) io.ReadCloser {
+	if name == "-" {
+		return ioutil.NopCloser(stdin)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		panic(meep.Meep(&cmdbhv.ErrBadArgs{
+			Message: fmt.Sprintf("cannot open %q: %s", name, err)}))
+	}
+	return file
+}
+
 func ExamineFile(stdout, stderr io.Writer) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
 		trailing := ctx.Args()
@@ -65,15 +144,74 @@ func ExamineFile(stdout, stderr io.Writer) cli.ActionFunc {
 				Message: "that path does not exist"}))
 		}
 		// Examine the stuff.
-		examinePath(trailing[0], stdout)
+		examine.Emit(examine.ScanPath(trailing[0]), stdout)
 		return nil
 	}
 }
 
+/*
+	Compares two filesystems -- any mix of wares and local paths -- file by
+	file, listing the files added, removed, and changed (and which of their
+	attributes changed).  Wares are written "<kind>:<hash>@<warehouse>",
+	or just "<kind>:<hash>" to look only in the local cache.
+*/
+func ExamineDiff(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 2 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr examine diff` requires two things to compare (paths, or wares like '<kind>:<hash>@<warehouse>')"}))
+		}
+
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+
+		meep.Try(func() {
+			a := scanOperand(ctx.Args()[0], log)
+			b := scanOperand(ctx.Args()[1], log)
+			changes := examine.Diff(a, b)
+			if ctx.Bool("json") {
+				if changes == nil {
+					changes = []examine.Change{}
+				}
+				if err := codec.NewEncoder(stdout, &codec.JsonHandle{Indent: -1}).Encode(changes); err != nil {
+					panic(err)
+				}
+				stdout.Write([]byte{'\n'})
+				return
+			}
+			examine.EmitDiff(changes, stdout)
+		}, cmdbhv.TryPlanToExit)
+		return nil
+	}
+}
+
+/*
+	Scans a diff operand: a local path if there's anything there,
+	else a ware, as "<kind>:<hash>@<warehouse>" (or "<kind>:<hash>", if cached).
+*/
+func scanOperand(arg string, log log15.Logger) *fshash.MemoryBucket {
+	if _, err := os.Lstat(arg); err == nil {
+		return examine.ScanPath(arg)
+	}
+	kindAndHash := strings.SplitN(arg, "@", 2)
+	parts := strings.SplitN(kindAndHash[0], ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || (len(kindAndHash) == 2 && kindAndHash[1] == "") {
+		panic(meep.Meep(&cmdbhv.ErrBadArgs{
+			Message: fmt.Sprintf("%q is neither an existing path nor a ware like '<kind>:<hash>@<warehouse>'", arg)}))
+	}
+	var warehouses def.WarehouseCoords
+	if len(kindAndHash) == 2 {
+		warehouses = def.WarehouseCoords{def.WarehouseCoord(kindAndHash[1])}
+	}
+	return examine.Fetch(
+		def.Ware{Type: parts[0], Hash: parts[1]},
+		warehouses,
+		util.DefaultTransmat(),
+		log,
+	)
+}
+
 // Other kinds of examine sub-command that may come later:
-//   - repeatr examine diff [item1] [item2]
-//        ... see, it's right about here that i start losing it in terms of how we should express object getting.  a bunch of flags named "--hash1" and "--hash2" are the obvious answer, but i pine for a more pleasant mechanism.
 //   - repeatr examine run [formula] [--output=name]
 //        As per `repeatr examine item`, but runs the formula and then immediately explores its output.
-//   - repeatr examine repeat [formula]
-//        Runs the given formula twice.  Checks that all the conjectured outputs are the same, exiting with a 1 and exploring diffs if they exist; exiting 0 if no diffs.
+// (`repeatr examine repeat [formula]` became `repeatr verify`.)
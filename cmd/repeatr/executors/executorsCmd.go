@@ -0,0 +1,39 @@
+package executorsCmd
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+
+	"go.polydawn.net/repeatr/core/executor/dispatch"
+)
+
+/*
+	Lists every executor this build of repeatr knows about, whether it
+	can be used on this host (and if not, why not), and which one
+	`--executor=auto` would pick.
+*/
+func List(stdout io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tPRIORITY\tSTATUS\n")
+		picked := false
+		for _, avail := range executordispatch.Survey() {
+			status := "available"
+			switch {
+			case avail.Err != nil:
+				status = "unavailable: " + avail.Err.Error()
+			case avail.Priority < 0:
+				status = "available (never chosen by auto)"
+			case !picked:
+				status = "available (chosen by auto)"
+				picked = true
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", avail.Name, avail.Priority, status)
+		}
+		tw.Flush()
+		return nil
+	}
+}
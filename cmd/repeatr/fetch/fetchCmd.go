@@ -0,0 +1,84 @@
+package fetchCmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/hitch"
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/core/executor/util"
+	"go.polydawn.net/repeatr/core/fetch"
+	"go.polydawn.net/repeatr/core/pipeline"
+)
+
+/*
+	Fetches every input of a formula, or every unwired input of a pipeline,
+	into the local caches -- reporting each as it finishes -- and exits
+	nonzero listing any that couldn't be obtained.
+*/
+func Fetch(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr fetch` requires a path to one formula or pipeline file"}))
+		}
+		parallel := ctx.Int("parallel")
+		if parallel < 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`--parallel` must be at least 1"}))
+		}
+
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+
+		var wants []fetch.Want
+		meep.Try(func() {
+			frm, p := hitch.LoadFormulaOrPipelineFromFile(ctx.Args()[0])
+			if p != nil {
+				pipeline.Validate(p)
+				wants = fetch.PipelineWants(p)
+			} else {
+				wants = fetch.FormulaWants(frm)
+			}
+		}, tryPlanToExit)
+
+		cached := 0
+		var failed []string
+		fetch.Fetch(wants, util.DefaultTransmat(), util.IsCached, parallel, func(result fetch.Result, done int, total int) {
+			inputs := strings.Join(result.Inputs, ", ")
+			switch {
+			case result.Err != nil:
+				failed = append(failed, fmt.Sprintf("%s (%s:%s): %s", inputs, result.Ware.Type, result.Ware.Hash, result.Err))
+				fmt.Fprintf(stderr, "[%d/%d] FAILED  %s:%s  %s: %s\n", done, total, result.Ware.Type, result.Ware.Hash, inputs, result.Err)
+			case result.ServedBy == "":
+				cached++
+				fmt.Fprintf(stderr, "[%d/%d] cached  %s:%s  %s\n", done, total, result.Ware.Type, result.Ware.Hash, inputs)
+			default:
+				fmt.Fprintf(stderr, "[%d/%d] fetched %s:%s  %s  from %s in %.1fs\n", done, total, result.Ware.Type, result.Ware.Hash, inputs, result.ServedBy, result.Elapsed.Seconds())
+			}
+		}, log)
+
+		if len(failed) > 0 {
+			panic(&cmdbhv.ErrExit{
+				Message: fmt.Sprintf("could not fetch %d of %d wares:\n  %s", len(failed), len(wants), strings.Join(failed, "\n  ")),
+				Code:    cmdbhv.EXIT_USER,
+			})
+		}
+		fmt.Fprintf(stdout, "%d wares ready (%d were already cached)\n", len(wants), cached)
+		return nil
+	}
+}
+
+var tryPlanToExit = append(meep.TryPlan{
+	{ByType: &hitch.ErrIO{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+	{ByType: &hitch.ErrParsing{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+}, cmdbhv.TryPlanToExit...)
@@ -0,0 +1,146 @@
+package historyCmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/ugorji/go/codec"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/api/hitch"
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/core/history"
+)
+
+/*
+	Lists past runs, oldest first, one per line: date, HID, formula HID,
+	and exit code (or "failed"), tab separated.
+*/
+func List(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		query := parseQuery(ctx)
+		meep.Try(func() {
+			store := history.Default()
+			if ctx.String("formula") != "" {
+				query.FormulaHID = store.ResolveFormula(ctx.String("formula"))
+			}
+			emitList(store.Find(query), stdout)
+		}, tryPlanToExit)
+		return nil
+	}
+}
+
+/*
+	Lists past runs of one formula, given either the formula file,
+	or its HID.  Otherwise the same as `List`.
+*/
+func ByFormula(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr history by-formula` requires one formula file, or formula HID"}))
+		}
+		query := parseQuery(ctx)
+		meep.Try(func() {
+			store := history.Default()
+			if _, err := os.Stat(ctx.Args()[0]); err == nil {
+				query.FormulaHID = hitch.LoadFormulaFromFile(ctx.Args()[0]).Hash()
+			} else {
+				query.FormulaHID = store.ResolveFormula(ctx.Args()[0])
+			}
+			emitList(store.Find(query), stdout)
+		}, tryPlanToExit)
+		return nil
+	}
+}
+
+/*
+	Shows a past run: its runrecord, and the formula that was run, as json.
+*/
+func Show(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr history show` requires one run HID"}))
+		}
+		meep.Try(func() {
+			store := history.Default()
+			rr := store.Load(ctx.Args()[0])
+			shown := struct {
+				RunRecord *def.RunRecord `json:"runRecord"`
+				Formula   *def.Formula   `json:"formula"`
+			}{rr, store.FormulaOf(rr.HID)}
+			if err := codec.NewEncoder(stdout, &codec.JsonHandle{Indent: -1}).Encode(shown); err != nil {
+				panic(meep.Meep(
+					&meep.ErrProgrammer{},
+					meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+				))
+			}
+			stdout.Write([]byte{'\n'})
+		}, tryPlanToExit)
+		return nil
+	}
+}
+
+func parseQuery(ctx *cli.Context) history.Query {
+	return history.Query{
+		OutputHash: ctx.String("output"),
+		Since:      parseWhen("since", ctx.String("since")),
+		Until:      parseWhen("until", ctx.String("until")),
+	}
+}
+
+/*
+	Parses a time given either in RFC3339, or as a date (meaning the start
+	of that day, local time).  Blank means no time at all.
+*/
+func parseWhen(flag string, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	if when, err := time.Parse(time.RFC3339, value); err == nil {
+		return when
+	}
+	if when, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return when
+	}
+	panic(meep.Meep(&cmdbhv.ErrBadArgs{
+		Message: fmt.Sprintf("'--%s' must be a date (like 2016-05-01) or an RFC3339 time, not %q", flag, value),
+	}))
+}
+
+func emitList(records []*def.RunRecord, stdout io.Writer) {
+	for _, rr := range records {
+		outcome := "failed"
+		if rr.Failure == nil && rr.Results["$exitcode"] != nil {
+			outcome = rr.Results["$exitcode"].Hash
+		}
+		fmt.Fprintf(stdout, "%s\t%s\t%s\t%s\n",
+			rr.Date.Format(time.RFC3339),
+			rr.HID,
+			rr.FormulaHID,
+			outcome,
+		)
+	}
+}
+
+var tryPlanToExit = append(meep.TryPlan{
+	{ByType: &history.ErrNotFound{}, Handler: func(e error) {
+		err := e.(*history.ErrNotFound)
+		msg := fmt.Sprintf("nothing in history matches %q", err.HID)
+		if err.Candidates > 1 {
+			msg = fmt.Sprintf("%q is ambiguous; %d things in history match it", err.HID, err.Candidates)
+		}
+		panic(&cmdbhv.ErrExit{msg, cmdbhv.EXIT_USER})
+	}},
+	{ByType: &hitch.ErrIO{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+	{ByType: &hitch.ErrParsing{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+}, cmdbhv.TryPlanToExit...)
@@ -11,15 +11,39 @@ import (
 
 	"go.polydawn.net/repeatr/api/def"
 	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/cmd/repeatr/bundle"
+	"go.polydawn.net/repeatr/cmd/repeatr/cache"
 	"go.polydawn.net/repeatr/cmd/repeatr/cfg"
 	"go.polydawn.net/repeatr/cmd/repeatr/examine"
+	"go.polydawn.net/repeatr/cmd/repeatr/executors"
+	"go.polydawn.net/repeatr/cmd/repeatr/fetch"
+	"go.polydawn.net/repeatr/cmd/repeatr/history"
+	"go.polydawn.net/repeatr/cmd/repeatr/mirror"
 	"go.polydawn.net/repeatr/cmd/repeatr/pack"
+	"go.polydawn.net/repeatr/cmd/repeatr/pipeline"
 	"go.polydawn.net/repeatr/cmd/repeatr/run"
 	"go.polydawn.net/repeatr/cmd/repeatr/twerk"
 	"go.polydawn.net/repeatr/cmd/repeatr/unpack"
+	"go.polydawn.net/repeatr/cmd/repeatr/verify"
 	"go.polydawn.net/repeatr/cmd/repeatr/version"
+	"go.polydawn.net/repeatr/cmd/repeatr/warehouse"
 )
 
+var historyQueryFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "since",
+		Usage: "Optional.  Only runs at or after this time (a date, like 2016-05-01, or an RFC3339 time).",
+	},
+	cli.StringFlag{
+		Name:  "until",
+		Usage: "Optional.  Only runs before this time (a date, like 2016-05-01, or an RFC3339 time).",
+	},
+	cli.StringFlag{
+		Name:  "output",
+		Usage: "Optional.  Only runs that produced a ware with this hash.",
+	},
+}
+
 func main() {
 	os.Exit(Main(os.Args, os.Stdin, os.Stdout, os.Stderr))
 }
@@ -52,7 +76,7 @@ func Main(
 					cli.StringFlag{
 						Name:  "executor",
 						Value: "runc",
-						Usage: "Which executor to use",
+						Usage: "Which executor to use (or \"auto\" to pick the best one usable on this host; see `repeatr executors`)",
 					},
 					cli.BoolFlag{
 						Name:  "ignore-job-exit",
@@ -70,9 +94,119 @@ func Main(
 						Name:  "serialize, s",
 						Usage: "serialize output onto stdout",
 					},
+					cli.BoolFlag{
+						Name:  "reuse",
+						Usage: "If a past run of the same formula succeeded, and its conjectured outputs can still be fetched, report its results instead of running again.",
+					},
+					cli.StringFlag{
+						Name:  "bundle",
+						Usage: "Optional.  Run the formula in this bundle (see `repeatr bundle create`) instead of a formula file; its wares are checked and unpacked into a temporary warehouse that the inputs fetch from, so no other warehouse is needed for them.",
+					},
+					cli.BoolFlag{
+						Name:  "plan",
+						Usage: "Dry run: check the formula, whether every input is cached or its warehouses have it, and whether output warehouses are writable; then print the inputs, outputs, assembly order, executor, and placer without running anything (as json with `--serialize`).  Exits nonzero if anything would get in the way.",
+					},
+					cli.StringFlag{
+						Name:  "cache",
+						Usage: "Optional.  URL of a result cache (see `repeatr serve-cache`).  Consulted by `--reuse`, after the local history; successful runs are published to it if there's a `--cache-key`.",
+					},
+					cli.StringFlag{
+						Name:  "cache-key",
+						Usage: "Optional.  Key file (see `repeatr cache-keygen`) to sign published runs with.  Entries signed with it are trusted.",
+					},
+					cli.StringSliceFlag{
+						Name:  "cache-trust",
+						Usage: "Optional.  Public key files of signers whose result cache entries are trusted.",
+					},
 				},
 				Action: runCmd.Run(stdout, stderr),
 			},
+			{
+				Name:   "pipeline",
+				Usage:  "Run pipelines: formulas wired together by their outputs",
+				Action: subcommandHelpThunk,
+				Subcommands: []cli.Command{
+					{
+						Name:      "run",
+						Usage:     "Run every step of a pipeline, in dependency order (independent steps in parallel), and report all their runrecords as json",
+						ArgsUsage: "<pipeline>",
+						Flags: []cli.Flag{
+							cli.StringFlag{
+								Name:  "executor",
+								Value: "runc",
+								Usage: "Which executor to use (or \"auto\" to pick the best one usable on this host; see `repeatr executors`)",
+							},
+						},
+						Action: pipelineCmd.Run(stdout, stderr),
+					},
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "Run a formula several times, checking that its conjectured outputs come out the same every time (and diffing them if not)",
+				ArgsUsage: "<formula>",
+				Flags: []cli.Flag{
+					cli.IntFlag{
+						Name:  "runs, n",
+						Value: 2,
+						Usage: "How many times to run the formula.",
+					},
+					cli.StringSliceFlag{
+						Name:  "perturb",
+						Usage: "Optional, repeatable.  Vary something that shouldn't matter between runs: 'hostname' gives each run its own hostname, even if the formula sets one; 'env-order' passes the environment in a different order; 'cwd-parent' moves the working dir (and the mount holding it, with everything mounted within that) under a different parent path.",
+					},
+					cli.StringFlag{
+						Name:  "executor",
+						Value: "runc",
+						Usage: "Which executor to use (or \"auto\" to pick the best one usable on this host; see `repeatr executors`)",
+					},
+				},
+				Action: verifyCmd.Verify(stdout, stderr),
+			},
+			{
+				Name:      "fetch",
+				Usage:     "Fetch every input of a formula (or every unwired input of a pipeline) into the local caches, without running anything",
+				ArgsUsage: "<formula or pipeline>",
+				Flags: []cli.Flag{
+					cli.IntFlag{
+						Name:  "parallel, j",
+						Value: 4,
+						Usage: "How many wares to fetch at once.",
+					},
+				},
+				Action: fetchCmd.Fetch(stdout, stderr),
+			},
+			{
+				Name:   "bundle",
+				Usage:  "Pack a formula and all its inputs into one file, to run somewhere without access to their warehouses",
+				Action: subcommandHelpThunk,
+				Subcommands: []cli.Command{
+					{
+						Name:      "create",
+						Usage:     "Fetch every input of a formula, and write them and the formula into a bundle file",
+						ArgsUsage: "<formula>",
+						Flags: []cli.Flag{
+							cli.StringFlag{
+								Name:  "output, o",
+								Usage: "Required.  Path to write the bundle to.",
+							},
+						},
+						Action: bundleCmd.Create(stdout, stderr),
+					},
+					{
+						Name:      "import",
+						Usage:     "Check every ware in a bundle, load them into the local caches (or a warehouse, with `--to`), and print the bundle's formula",
+						ArgsUsage: "<bundle>",
+						Flags: []cli.Flag{
+							cli.StringFlag{
+								Name:  "to",
+								Usage: "Optional.  Warehouse URI to copy the wares into, instead of the local caches.  It's added to the printed formula's inputs that can fetch from it.",
+							},
+						},
+						Action: bundleCmd.Import(stdout, stderr),
+					},
+				},
+			},
 			{
 				Name:  "twerk",
 				Usage: "Run one-time-use interactive (thus nonrepeatable!) command.  All the defaults are filled in for you.  Great for experimentation.",
@@ -147,8 +281,43 @@ func Main(
 						Name:  "filter",
 						Usage: "Optional.  Filters to apply when scanning.  If not provided, reasonable defaults (flattening uid, gid, and mtime) will be used.",
 					},
+					cli.StringFlag{
+						Name:  "compress",
+						Usage: "Optional.  Compression for kinds that store compressed data (e.g. tar): \"none\", \"gzip\", \"zstd\", or \"xz\", optionally with a level, like \"zstd:19\".  Never changes the hash.",
+					},
+					cli.StringFlag{
+						Name:  "tarball",
+						Usage: "Optional.  Instead of scanning '--place', adopt an already-packed tarball (or '-' for stdin) of a tar-packed kind: it's hashed and stored verbatim in '--where', in one pass, without unpacking.",
+					},
+				},
+				Action: packCmd.Pack(stdin, stdout, stderr),
+			},
+			{
+				Name:  "mirror",
+				Usage: "Copy wares from one warehouse to another, verifying them on the way; wares the destination already has are skipped",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "kind",
+						Usage: "What kind of data storage format to work with.",
+					},
+					cli.StringFlag{
+						Name:  "hash",
+						Usage: "The ID of the object to copy.",
+					},
+					cli.StringSliceFlag{
+						Name:  "from",
+						Usage: "URLs of warehouses to copy from; the first one that has the object is used.  With '--formula', these are tried before the formula's own.",
+					},
+					cli.StringFlag{
+						Name:  "to",
+						Usage: "A URL giving coordinates to the warehouse to copy into.",
+					},
+					cli.StringFlag{
+						Name:  "formula",
+						Usage: "Optional.  Instead of '--kind' and '--hash', copy every input of this formula.",
+					},
 				},
-				Action: packCmd.Pack(stdout, stderr),
+				Action: mirrorCmd.Mirror(stdout, stderr),
 			},
 			{
 				Name:  "examine",
@@ -156,9 +325,10 @@ func Main(
 				Description: strings.Join([]string{
 					"`repeatr examine` produces a human-readable manifest of every file in the named item",
 					"(either wares or local filesystems may be examined), their properties, and their hashes.",
+					"Tar-packed wares, and tarballs, are examined as they stream in, without unpacking them.",
 					"\n\n  ",
-					"Output is structed as tab-delimited values -- you may feed it to an external `diff` program",
-					"to compare one item with another; or, for easier reading, try piping it to `column -t`",
+					"Output is structed as tab-delimited values -- for easier reading, try piping it to `column -t`.",
+					"To compare one item with another, use `repeatr examine diff`.",
 				}, " "),
 				Subcommands: []cli.Command{
 					{
@@ -185,8 +355,142 @@ func Main(
 						Usage:  "examine a local filesystem",
 						Action: examineCmd.ExamineFile(stdout, stderr),
 					},
+					{
+						Name:      "diff",
+						Usage:     "compare two filesystems file by file: each may be a local path, or a ware written '<kind>:<hash>@<warehouse>'",
+						ArgsUsage: "<A> <B>",
+						Flags: []cli.Flag{
+							cli.BoolFlag{
+								Name:  "json",
+								Usage: "Emit the changes as a json list, instead of for people.",
+							},
+						},
+						Action: examineCmd.ExamineDiff(stdout, stderr),
+					},
+					{
+						Name:  "tar",
+						Usage: "examine a tarball (or '-' for stdin) without unpacking it, logging its ware hash",
+						Flags: []cli.Flag{
+							cli.StringFlag{
+								Name:  "hash",
+								Usage: "Optional.  The ware hash the tarball is expected to have; it's an error if it doesn't.",
+							},
+						},
+						Action: examineCmd.ExamineTar(stdin, stdout, stderr),
+					},
 				},
 			},
+			{
+				Name:  "history",
+				Usage: "look up past runs, recorded by `repeatr run`",
+				Subcommands: []cli.Command{
+					{
+						Name:  "list",
+						Usage: "list past runs, oldest first: date, run HID, formula HID, and exit code, tab separated",
+						Flags: append(historyQueryFlags,
+							cli.StringFlag{
+								Name:  "formula",
+								Usage: "Optional.  Only list runs of the formula with this HID (or a prefix of it).",
+							},
+						),
+						Action: historyCmd.List(stdout, stderr),
+					},
+					{
+						Name:   "show",
+						Usage:  "show the runrecord of a past run (by HID, or a prefix of it), and the formula it ran",
+						Action: historyCmd.Show(stdout, stderr),
+					},
+					{
+						Name:   "by-formula",
+						Usage:  "list past runs of a formula, given the formula file or its HID",
+						Flags:  historyQueryFlags,
+						Action: historyCmd.ByFormula(stdout, stderr),
+					},
+				},
+			},
+			{
+				Name:  "serve-cache",
+				Usage: "serve a result cache over http, so runs on one host can be reused on others (see `repeatr run --cache`)",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "listen",
+						Value: ":8077",
+						Usage: "Address to listen on.",
+					},
+					cli.StringFlag{
+						Name:  "dir",
+						Usage: "Required.  Dir to keep entries in (created if necessary).",
+					},
+					cli.StringSliceFlag{
+						Name:  "trust",
+						Usage: "Optional.  Public key files of signers to accept entries from.  If none, validly signed entries from anyone are accepted.",
+					},
+				},
+				Action: cacheCmd.Serve(stderr),
+			},
+			{
+				Name:      "cache-keygen",
+				Usage:     "generate a key for signing result cache entries: the private key is written to the path, the public key to the path plus \".pub\" (and printed)",
+				ArgsUsage: "<path>",
+				Action:    cacheCmd.Keygen(stdout, stderr),
+			},
+			{
+				Name:   "warehouse",
+				Usage:  "Maintain warehouses",
+				Action: subcommandHelpThunk,
+				Subcommands: []cli.Command{
+					{
+						Name:      "verify",
+						Usage:     "Re-hash every ware in a content-addressable warehouse, reporting any that don't match their names, and any debris from interrupted uploads",
+						ArgsUsage: "<warehouse URI>",
+						Flags: []cli.Flag{
+							cli.BoolFlag{
+								Name:  "quarantine",
+								Usage: "Move bad wares into the warehouse's '.quarantine' dir, so they won't be served.",
+							},
+							cli.BoolFlag{
+								Name:  "verbose, v",
+								Usage: "Report every ware checked, not just the problems.",
+							},
+						},
+						Action: warehouseCmd.Verify(stdout, stderr),
+					},
+					{
+						Name:      "gc",
+						Usage:     "Remove wares from a content-addressable warehouse that aren't referenced by any of the given roots",
+						ArgsUsage: "<warehouse URI>",
+						Flags: []cli.Flag{
+							cli.StringSliceFlag{
+								Name:  "formula",
+								Usage: "Formula files; all their input and output hashes are kept.",
+							},
+							cli.StringSliceFlag{
+								Name:  "runrecord",
+								Usage: "Run record files (as emitted by 'repeatr run'); all their result hashes are kept.",
+							},
+							cli.StringSliceFlag{
+								Name:  "catalog",
+								Usage: "Catalog files; every release on every track is kept.",
+							},
+							cli.StringFlag{
+								Name:  "grace",
+								Value: "168h",
+								Usage: "Unreferenced wares younger than this are kept anyway, in case they're about to be referenced.",
+							},
+							cli.BoolFlag{
+								Name:  "dry-run, n",
+								Usage: "Report what would be deleted, but don't delete anything.",
+							},
+						},
+						Action: warehouseCmd.Gc(stdout, stderr),
+					},
+				},
+			},
+			{
+				Name:   "executors",
+				Usage:  "List the executors available, whether they're usable on this host, and which one 'auto' would choose",
+				Action: executorsCmd.List(stdout),
+			},
 			{
 				Name:   "cfg",
 				Usage:  "Manipulate config and formulas programmatically (parse, validate, etc).",
@@ -0,0 +1,110 @@
+package mirrorCmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/api/hitch"
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/core/executor/util"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/mirror"
+)
+
+func Mirror(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		// args parse
+		to := ctx.String("to")
+		if to == "" {
+			panic(cmdbhv.ErrMissingParameter("to"))
+		}
+		var wares []*def.Input
+		if formulaPath := ctx.String("formula"); formulaPath != "" {
+			if ctx.IsSet("kind") || ctx.IsSet("hash") {
+				panic(meep.Meep(&cmdbhv.ErrBadArgs{
+					Message: "use either --formula, or --kind and --hash; not both",
+				}))
+			}
+			wares = formulaInputs(hitch.LoadFormulaFromFile(formulaPath), ctx.StringSlice("from"))
+		} else {
+			if ctx.String("kind") == "" {
+				panic(cmdbhv.ErrMissingParameter("kind"))
+			}
+			if ctx.String("hash") == "" {
+				panic(cmdbhv.ErrMissingParameter("hash"))
+			}
+			if len(ctx.StringSlice("from")) == 0 {
+				panic(cmdbhv.ErrMissingParameter("from"))
+			}
+			wares = []*def.Input{{
+				Type:       ctx.String("kind"),
+				Hash:       ctx.String("hash"),
+				Warehouses: coords(ctx.StringSlice("from")),
+			}}
+		}
+		// set up logging.
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+		// invoke, reporting each ware as we go
+		transmat := util.DefaultTransmat()
+		enc := codec.NewEncoder(stdout, &codec.JsonHandle{Indent: -1})
+		meep.Try(func() {
+			for _, ware := range wares {
+				siloURIs := make([]rio.SiloURI, len(ware.Warehouses))
+				for i, coord := range ware.Warehouses {
+					siloURIs[i] = rio.SiloURI(coord)
+				}
+				result := mirror.Mirror(
+					rio.TransmatKind(ware.Type),
+					rio.CommitID(ware.Hash),
+					siloURIs,
+					rio.SiloURI(to),
+					transmat,
+					log,
+				)
+				if err := enc.Encode(result); err != nil {
+					panic(meep.Meep(
+						&meep.ErrProgrammer{},
+						meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+					))
+				}
+				stdout.Write([]byte{'\n'})
+			}
+		}, cmdbhv.TryPlanToExit)
+		return nil
+	}
+}
+
+/*
+	Gather a formula's inputs, in name order.
+	Any extra source warehouses are tried before the formula's own.
+*/
+func formulaInputs(frm *def.Formula, extraFrom []string) []*def.Input {
+	names := make([]string, 0, len(frm.Inputs))
+	for name := range frm.Inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	inputs := make([]*def.Input, len(names))
+	for i, name := range names {
+		input := *frm.Inputs[name]
+		input.Warehouses = append(coords(extraFrom), input.Warehouses...)
+		inputs[i] = &input
+	}
+	return inputs
+}
+
+func coords(uris []string) def.WarehouseCoords {
+	whs := make(def.WarehouseCoords, len(uris))
+	for i, uri := range uris {
+		whs[i] = def.WarehouseCoord(uri)
+	}
+	return whs
+}
@@ -1,11 +1,16 @@
 package packCmd
 
 import (
+	"fmt"
+	"io"
+
 	"github.com/inconshreveable/log15"
 
 	"go.polydawn.net/repeatr/api/def"
 	"go.polydawn.net/repeatr/core/executor/util"
 	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/mirror"
+	tartrans "go.polydawn.net/repeatr/rio/transmat/impl/tar"
 )
 
 /*
@@ -28,9 +33,36 @@ func pack(outputSpec def.Output, log log15.Logger) def.Output {
 		outputSpec.MountPath,
 		warehouses,
 		log,
-		rio.ConvertFilterConfig(*outputSpec.Filters)...,
+		append(
+			rio.ConvertFilterConfig(*outputSpec.Filters),
+			rio.UseCompression(outputSpec.Compress),
+		)...,
 	)
 
 	outputSpec.Hash = string(commitID)
 	return outputSpec
 }
+
+/*
+	Like `pack`, but for a tarball that's already packed (by some other
+	tool, say): it's hashed as it streams by, and stored verbatim in the
+	warehouse (if one is given), without ever being unpacked.
+	The result is the same as if its contents had been unpacked and scanned
+	with no filters.
+*/
+func adopt(outputSpec def.Output, tarball io.Reader, log log15.Logger) def.Output {
+	kind := rio.TransmatKind(outputSpec.Type)
+	switch len(outputSpec.Warehouses) {
+	case 0:
+		if !mirror.TarPacked[kind] {
+			panic(&def.ErrConfigValidation{
+				Msg: fmt.Sprintf("only tar-packed kinds can be adopted from a tarball, not %q", kind),
+			})
+		}
+		outputSpec.Hash = string(tartrans.HashPacked(tarball, log))
+	default:
+		result := mirror.Adopt(kind, tarball, rio.SiloURI(outputSpec.Warehouses[0]), log)
+		outputSpec.Hash = result.Ware.Hash
+	}
+	return outputSpec
+}
@@ -3,6 +3,8 @@ package packCmd
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 
 	"github.com/codegangsta/cli"
 	"github.com/inconshreveable/log15"
@@ -13,7 +15,7 @@ import (
 	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
 )
 
-func Pack(stdout, stderr io.Writer) cli.ActionFunc {
+func Pack(stdin io.Reader, stdout, stderr io.Writer) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
 		// args parse
 		var warehouses def.WarehouseCoords
@@ -35,6 +37,7 @@ func Pack(stdout, stderr io.Writer) cli.ActionFunc {
 			Type:       ctx.String("kind"),
 			Warehouses: warehouses,
 			Filters:    filters,
+			Compress:   ctx.String("compress"),
 			MountPath:  ctx.String("place"),
 		}
 		if outputSpec.Type == "" {
@@ -48,9 +51,24 @@ func Pack(stdout, stderr io.Writer) cli.ActionFunc {
 		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
 		// invoke
 		var output def.Output
-		meep.Try(func() {
-			output = pack(outputSpec, log)
-		}, cmdbhv.TryPlanToExit)
+		if ctx.IsSet("tarball") {
+			if ctx.IsSet("filter") || ctx.IsSet("compress") {
+				panic(meep.Meep(&cmdbhv.ErrBadArgs{
+					Message: "'--tarball' is stored verbatim, so '--filter' and '--compress' can't be used with it"}))
+			}
+			// The tarball's contents are taken exactly as they are.
+			outputSpec.Filters = nil
+			outputSpec.MountPath = ""
+			tarball := openTarball(ctx.String("tarball"), stdin)
+			defer tarball.Close()
+			meep.Try(func() {
+				output = adopt(outputSpec, tarball, log)
+			}, cmdbhv.TryPlanToExit)
+		} else {
+			meep.Try(func() {
+				output = pack(outputSpec, log)
+			}, cmdbhv.TryPlanToExit)
+		}
 		// output
 		if err := codec.NewEncoder(stdout, &codec.JsonHandle{Indent: -1}).Encode(output); err != nil {
 			panic(meep.Meep(
@@ -62,3 +80,18 @@ func Pack(stdout, stderr io.Writer) cli.ActionFunc {
 		return nil
 	}
 }
+
+/*
+	Opens the tarball named by `--tarball`, or stdin for "-".
+*/
+func openTarball(name string, stdin io.Reader) io.ReadCloser {
+	if name == "-" {
+		return ioutil.NopCloser(stdin)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		panic(meep.Meep(&cmdbhv.ErrBadArgs{
+			Message: fmt.Sprintf("cannot open tarball %q: %s", name, err)}))
+	}
+	return file
+}
@@ -0,0 +1,123 @@
+package pipelineCmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+	"go.polydawn.net/go-sup"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/api/hitch"
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/core/actors/runner"
+	"go.polydawn.net/repeatr/core/actors/terminal"
+	"go.polydawn.net/repeatr/core/executor/dispatch"
+	"go.polydawn.net/repeatr/core/history"
+	"go.polydawn.net/repeatr/core/pipeline"
+)
+
+/*
+	Runs every step of a pipeline, logging each step's progress to stderr
+	(prefixed by the step name), and emitting a report with every step's
+	runrecord (or why it was skipped) as json on stdout.
+*/
+func Run(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr pipeline run` requires a path to one pipeline file"}))
+		}
+		executor := executordispatch.Get(ctx.String("executor"))
+
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+
+		var report *pipeline.Report
+		meep.Try(func() {
+			p := hitch.LoadPipelineFromFile(ctx.Args()[0])
+			store := history.Default()
+			var stderrMu sync.Mutex
+			report = pipeline.Run(p, func(step string, frm *def.Formula) *def.RunRecord {
+				// Every run is recorded in the local history, as with `repeatr run`.
+				runner := runner.New(runner.Config{
+					Executor: executor,
+					History:  store,
+				})
+				go sup.NewTask().Run(runner.Run)
+				runID := runner.StartRun(frm)
+				out := &lineWriter{prefix: "[" + step + "] ", w: stderr, mu: &stderrMu}
+				defer out.Flush()
+				return terminal.Consume(runner, runID, out)
+			}, log)
+		}, tryPlanToExit)
+
+		if err := codec.NewEncoder(stdout, &codec.JsonHandle{Indent: -1}).Encode(report); err != nil {
+			panic(meep.Meep(
+				&meep.ErrProgrammer{},
+				meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+			))
+		}
+		stdout.Write([]byte{'\n'})
+
+		if failed := report.Failed(); len(failed) > 0 {
+			panic(&cmdbhv.ErrExit{
+				Message: fmt.Sprintf("pipeline steps did not succeed: %s", strings.Join(failed, ", ")),
+				Code:    cmdbhv.EXIT_JOB,
+			})
+		}
+		return nil
+	}
+}
+
+var tryPlanToExit = append(meep.TryPlan{
+	{ByType: &hitch.ErrIO{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+	{ByType: &hitch.ErrParsing{}, Handler: func(e error) {
+		panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+	}},
+}, cmdbhv.TryPlanToExit...)
+
+/*
+	Prefixes every line written through it, and writes only whole lines,
+	so that steps running in parallel can share a terminal legibly.
+*/
+type lineWriter struct {
+	prefix string
+	w      io.Writer
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		lw.emit(lw.buf[:i+1])
+		lw.buf = lw.buf[i+1:]
+	}
+}
+
+func (lw *lineWriter) Flush() {
+	if len(lw.buf) > 0 {
+		lw.emit(append(lw.buf, '\n'))
+		lw.buf = nil
+	}
+}
+
+func (lw *lineWriter) emit(line []byte) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.w.Write([]byte(lw.prefix))
+	lw.w.Write(line)
+}
@@ -3,12 +3,17 @@ package runCmd
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
 	"github.com/ugorji/go/codec"
 	"go.polydawn.net/go-sup"
 	"go.polydawn.net/meep"
+	"golang.org/x/crypto/ed25519"
 
 	"go.polydawn.net/repeatr/api/act/remote/server"
 	"go.polydawn.net/repeatr/api/def"
@@ -16,21 +21,37 @@ import (
 	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
 	"go.polydawn.net/repeatr/core/actors/runner"
 	"go.polydawn.net/repeatr/core/actors/terminal"
+	"go.polydawn.net/repeatr/core/bundle"
+	"go.polydawn.net/repeatr/core/executor"
 	"go.polydawn.net/repeatr/core/executor/dispatch"
+	"go.polydawn.net/repeatr/core/executor/util"
+	"go.polydawn.net/repeatr/core/history"
+	"go.polydawn.net/repeatr/core/memo"
+	"go.polydawn.net/repeatr/core/plan"
+	"go.polydawn.net/repeatr/core/resultcache"
 )
 
 func Run(stdout, stderr io.Writer) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
 		// Parse args
-		executor := executordispatch.Get(ctx.String("executor"))
+		executorName := ctx.String("executor")
 		ignoreJobExit := ctx.Bool("ignore-job-exit")
 		patchPaths := ctx.StringSlice("patch")
 		envArgs := ctx.StringSlice("env")
 		serialize := ctx.Bool("serialize")
-		// One (and only one) formula should follow;
+		reuse := ctx.Bool("reuse")
+		planOnly := ctx.Bool("plan")
+		cache := resultCache(ctx)
+		bundlePath := ctx.String("bundle")
+		// One (and only one) formula should follow -- unless it comes from a bundle;
 		//  we don't have a way to unambiguously output more than one result formula at the moment.
 		var formulaPath string
 		switch l := len(ctx.Args()); {
+		case bundlePath != "" && l > 0:
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr run --bundle` runs the bundle's formula; it takes no other formula",
+			}))
+		case bundlePath != "":
 		case l < 1:
 			panic(meep.Meep(&cmdbhv.ErrBadArgs{
 				Message: "`repeatr run` requires a path to a formula as the last argument",
@@ -42,8 +63,36 @@ func Run(stdout, stderr io.Writer) cli.ActionFunc {
 		case l == 1:
 			formulaPath = ctx.Args()[0]
 		}
-		// Parse formula
-		formula := hitch.LoadFormulaFromFile(formulaPath)
+
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+
+		// Parse formula.
+		//  From a bundle, its wares are unpacked (and checked) into a warehouse
+		//  that's kept until the run is done, so the run needn't contact any other.
+		var formula *def.Formula
+		if bundlePath != "" {
+			bundleDir, err := ioutil.TempDir("", "repeatr-bundle-")
+			if err != nil {
+				panic(err)
+			}
+			defer os.RemoveAll(bundleDir)
+			meep.Try(func() {
+				f, err := os.Open(bundlePath)
+				if err != nil {
+					panic(meep.Meep(&bundle.ErrBadBundle{Reason: "unreadable"}, meep.Cause(err)))
+				}
+				defer f.Close()
+				index, uri := bundle.Open(f, bundleDir, log)
+				formula = bundle.Use(index, uri, util.DefaultTransmat(), log)
+			}, append(meep.TryPlan{
+				{ByType: &bundle.ErrBadBundle{}, Handler: func(e error) {
+					panic(&cmdbhv.ErrExit{e.Error(), cmdbhv.EXIT_BADARGS})
+				}},
+			}, cmdbhv.TryPlanToExit...))
+		} else {
+			formula = hitch.LoadFormulaFromFile(formulaPath)
+		}
 		// Parse patches into formulas as well.
 		//  Apply each one as it's loaded.
 		for _, patchPath := range patchPaths {
@@ -62,10 +111,56 @@ func Run(stdout, stderr io.Writer) cli.ActionFunc {
 			}})
 		}
 
+		store := history.Default()
+
+		if cache != nil {
+			cache.Log = log
+		}
+
+		// If only asked what would happen, say so, and stop there.
+		if planOnly {
+			showPlan(formula, executorName, stdout, serialize, log)
+			return nil
+		}
+		executor := executordispatch.Get(executorName)
+
+		// If asked, look for a past run that did the same work, and answer with that instead.
+		//  Local history is consulted first; then the result cache, if there is one.
+		if reuse {
+			sources := []memo.Source{store}
+			if cache != nil {
+				sources = append(sources, cache)
+			}
+			var runRecord *def.RunRecord
+			meep.Try(func() {
+				runRecord = memo.Lookup(formula, sources, memo.CanFetch(util.DefaultTransmat(), log), log)
+			}, cmdbhv.TryPlanToExit)
+			if runRecord != nil {
+				log.Info("Reusing the results of a past run", "run", runRecord.HID, "when", runRecord.Date)
+				if serialize {
+					encodeOrPanic(stdout, &codec.JsonHandle{}, &def.Event{
+						RunID:     runRecord.UID,
+						RunRecord: runRecord,
+					})
+					return nil
+				}
+				report(runRecord, stdout, ignoreJobExit)
+				return nil
+			}
+			log.Info("No reusable past run found; running")
+		}
+
 		// Create a local formula runner, and power it with a supervisor.
-		runner := runner.New(runner.Config{
+		//  Every run is recorded in the local history;
+		//  successful ones are published to the result cache, if we can sign them.
+		cfg := runner.Config{
 			Executor: executor,
-		})
+			History:  store,
+		}
+		if cache != nil && cache.Key != nil {
+			cfg.Cache = cache
+		}
+		runner := runner.New(cfg)
 		go sup.NewTask().Run(runner.Run)
 
 		// Request run.
@@ -104,29 +199,169 @@ func Run(stdout, stderr io.Writer) cli.ActionFunc {
 		// Else: Okay, human/terminal mode it is!
 		runRecord := terminal.Consume(runner, runID, stderr)
 
-		// Raise the error that got in the way of execution, if any.
-		cmdbhv.TryPlanToExit.MustHandle(runRecord.Failure)
-
-		// Output the results structure.
-		//  This goes on stdout (everything is stderr) and so should be parsable.
-		//  We strip some fields that aren't very useful to single-task manual runs.
-		runRecord.HID = ""
-		runRecord.FormulaHID = ""
-		if err := codec.NewEncoder(stdout, &codec.JsonHandle{Indent: -1}).Encode(runRecord); err != nil {
-			panic(meep.Meep(
-				&meep.ErrProgrammer{},
-				meep.Cause(fmt.Errorf("Transcription error: %s", err)),
-			))
-		}
-		stdout.Write([]byte{'\n'})
-		// Exit nonzero with our own "your job did not report success" indicator code, if applicable.
-		exitCode := runRecord.Results["$exitcode"].Hash
-		if exitCode != "0" && !ignoreJobExit {
-			panic(&cmdbhv.ErrExit{
-				Message: fmt.Sprintf("job finished with non-zero exit status %s", exitCode),
-				Code:    cmdbhv.EXIT_JOB,
-			})
+		report(runRecord, stdout, ignoreJobExit)
+		return nil
+	}
+}
+
+/*
+	Configures a result cache client from the `--cache` flags, or returns nil
+	if there's no cache.  The signing key, if given, is trusted too.
+*/
+func resultCache(ctx *cli.Context) *resultcache.Client {
+	url := ctx.String("cache")
+	keyPath := ctx.String("cache-key")
+	trustPaths := ctx.StringSlice("cache-trust")
+	if url == "" {
+		if keyPath != "" || len(trustPaths) > 0 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`--cache-key` and `--cache-trust` require `--cache`",
+			}))
 		}
 		return nil
 	}
+	if keyPath == "" && len(trustPaths) == 0 {
+		panic(meep.Meep(&cmdbhv.ErrBadArgs{
+			Message: "`--cache` requires a key to sign with (`--cache-key`) or to trust (`--cache-trust`), or both",
+		}))
+	}
+	cache := &resultcache.Client{URL: url}
+	meep.Try(func() {
+		if keyPath != "" {
+			cache.Key = resultcache.LoadPrivateKey(keyPath)
+			cache.Trusted = append(cache.Trusted, cache.Key.Public().(ed25519.PublicKey))
+		}
+		for _, trustPath := range trustPaths {
+			cache.Trusted = append(cache.Trusted, resultcache.LoadPublicKey(trustPath))
+		}
+	}, meep.TryPlan{
+		{ByType: &resultcache.ErrKey{}, Handler: func(e error) {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: e.Error(),
+			}))
+		}},
+	})
+	return cache
+}
+
+/*
+	Checks everything a run of the formula depends on, short of running it,
+	and prints the plan: as json if `serialize`, or else as a table.
+	Exits nonzero if anything would get in the way.
+*/
+func showPlan(formula *def.Formula, executorName string, stdout io.Writer, serialize bool, log log15.Logger) {
+	var problems []string
+	meep.Try(func() {
+		var reg executor.Registration
+		if executorName == executordispatch.Auto {
+			reg = executordispatch.Best()
+		} else if found, ok := executor.Lookup(executorName); ok {
+			reg = found
+		} else {
+			problems = append(problems, fmt.Sprintf("executor: no such executor %q", executorName))
+			return
+		}
+		executorName = reg.Name
+		if err := reg.Usable(); err != nil {
+			problems = append(problems, fmt.Sprintf("executor: %q is not usable on this host: %s", executorName, err))
+		}
+	}, meep.TryPlan{
+		{CatchAny: true, Handler: func(e error) {
+			problems = append(problems, fmt.Sprintf("executor: %s", e))
+		}},
+	})
+	p := plan.Make(formula, executorName, util.BestAssemblerName(), plan.Probe(util.DefaultTransmat(), log))
+	p.Problems = append(problems, p.Problems...)
+
+	if serialize {
+		encodeOrPanic(stdout, &codec.JsonHandle{Indent: -1}, p)
+	} else {
+		tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "formula\t%s\n", p.FormulaHID)
+		fmt.Fprintf(tw, "executor\t%s\n", p.Executor)
+		fmt.Fprintf(tw, "placer\t%s\n", p.Placer)
+		tw.Flush()
+		fmt.Fprintf(stdout, "\ninputs:\n")
+		for _, in := range p.Inputs {
+			cached := ""
+			if in.Cached {
+				cached = "  (cached)"
+			}
+			fmt.Fprintf(tw, "  %s\t%s:%s\tat %s%s\n", in.Name, in.Ware.Type, in.Ware.Hash, in.MountPath, cached)
+			printChecks(tw, in.Warehouses)
+		}
+		tw.Flush()
+		fmt.Fprintf(stdout, "\noutputs:\n")
+		for _, out := range p.Outputs {
+			fmt.Fprintf(tw, "  %s\t%s\tfrom %s\n", out.Name, out.Type, out.MountPath)
+			printChecks(tw, out.Warehouses)
+		}
+		tw.Flush()
+		fmt.Fprintf(stdout, "\nassembly:\n")
+		for _, part := range p.Assembly {
+			mode := "rw"
+			if !part.Writable {
+				mode = "ro"
+			}
+			if part.Input != "" {
+				fmt.Fprintf(tw, "  %s\tinput %s\t%s\n", part.MountPath, part.Input, mode)
+			} else {
+				fmt.Fprintf(tw, "  %s\thost %s\t%s\n", part.MountPath, part.HostPath, mode)
+			}
+		}
+		tw.Flush()
+		if len(p.Problems) > 0 {
+			fmt.Fprintf(stdout, "\nproblems:\n")
+			for _, problem := range p.Problems {
+				fmt.Fprintf(stdout, "  - %s\n", problem)
+			}
+		}
+	}
+	if len(p.Problems) > 0 {
+		panic(&cmdbhv.ErrExit{
+			Message: fmt.Sprintf("plan found %d problem(s); not ready to run", len(p.Problems)),
+			Code:    cmdbhv.EXIT_USER,
+		})
+	}
+}
+
+func printChecks(tw io.Writer, checks []plan.Check) {
+	for _, check := range checks {
+		if check.Reason == "" {
+			fmt.Fprintf(tw, "    %s\t%s\t\n", check.Status, check.URI)
+		} else {
+			fmt.Fprintf(tw, "    %s\t%s\t%s\n", check.Status, check.URI, check.Reason)
+		}
+	}
+}
+
+/*
+	Reports a finished run, in human/terminal mode.
+*/
+func report(runRecord *def.RunRecord, stdout io.Writer, ignoreJobExit bool) {
+	// Raise the error that got in the way of execution, if any.
+	cmdbhv.TryPlanToExit.MustHandle(runRecord.Failure)
+
+	// Output the results structure.
+	//  This goes on stdout (everything is stderr) and so should be parsable.
+	//  The HIDs are kept: they're how to find this run in `repeatr history` later.
+	encodeOrPanic(stdout, &codec.JsonHandle{Indent: -1}, runRecord)
+	// Exit nonzero with our own "your job did not report success" indicator code, if applicable.
+	exitCode := runRecord.Results["$exitcode"].Hash
+	if exitCode != "0" && !ignoreJobExit {
+		panic(&cmdbhv.ErrExit{
+			Message: fmt.Sprintf("job finished with non-zero exit status %s", exitCode),
+			Code:    cmdbhv.EXIT_JOB,
+		})
+	}
+}
+
+func encodeOrPanic(stdout io.Writer, handle codec.Handle, val interface{}) {
+	if err := codec.NewEncoder(stdout, handle).Encode(val); err != nil {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+		))
+	}
+	stdout.Write([]byte{'\n'})
 }
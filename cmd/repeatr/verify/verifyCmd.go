@@ -0,0 +1,208 @@
+package verifyCmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/go-sup"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/api/hitch"
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/core/actors/runner"
+	"go.polydawn.net/repeatr/core/actors/terminal"
+	"go.polydawn.net/repeatr/core/examine"
+	"go.polydawn.net/repeatr/core/executor"
+	"go.polydawn.net/repeatr/core/executor/dispatch"
+	"go.polydawn.net/repeatr/core/executor/util"
+	"go.polydawn.net/repeatr/core/verify"
+	"go.polydawn.net/repeatr/lib/fshash"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	Runs a formula several times, and checks that its conjectured outputs
+	came out the same every time.  Prints a line per conjectured output;
+	for those that diverged, each differing run's ware is diffed file by
+	file against the first run's.
+*/
+func Verify(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		// Parse args
+		if len(ctx.Args()) != 1 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr verify` requires a path to one formula"}))
+		}
+		n := ctx.Int("runs")
+		if n < 2 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "`repeatr verify` needs at least two runs to compare"}))
+		}
+		var perturbations []verify.Perturbation
+		for _, p := range ctx.StringSlice("perturb") {
+			if !knownPerturbation(verify.Perturbation(p)) {
+				panic(meep.Meep(&cmdbhv.ErrBadArgs{
+					Message: fmt.Sprintf("unknown perturbation %q (known: %s)", p, perturbationNames())}))
+			}
+			perturbations = append(perturbations, verify.Perturbation(p))
+		}
+		exec := executordispatch.Get(ctx.String("executor"))
+		formula := hitch.LoadFormulaFromFile(ctx.Args()[0])
+		conjectures := 0
+		for _, output := range formula.Outputs {
+			if output.Conjecture {
+				conjectures++
+			}
+		}
+		if conjectures == 0 {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "formula has no conjectured outputs; there's nothing to verify"}))
+		}
+
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+
+		// Keep every run's outputs in a scratch warehouse (and only there), so they can be diffed.
+		scratch, err := ioutil.TempDir("", "repeatr-verify-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(scratch)
+		formula = verify.Prepare(formula, rio.SiloURI("file+ca://"+scratch))
+		perturbed := make([]*def.Formula, n)
+		meep.Try(func() {
+			for i := range perturbed {
+				perturbed[i] = verify.Perturb(formula, i, perturbations)
+			}
+		}, cmdbhv.TryPlanToExit)
+
+		// Run it, again and again.
+		runs := make([]*def.RunRecord, n)
+		for i := range runs {
+			log.Info(fmt.Sprintf("Verifying: run %d of %d", i+1, n))
+			runs[i] = run(perturbed[i], exec, stderr)
+			cmdbhv.TryPlanToExit.MustHandle(runs[i].Failure)
+			if exitCode := runs[i].Results["$exitcode"].Hash; exitCode != "0" {
+				panic(&cmdbhv.ErrExit{
+					Message: fmt.Sprintf("run %d of %d exited %s; can't verify a failing formula", i+1, n, exitCode),
+					Code:    cmdbhv.EXIT_JOB,
+				})
+			}
+		}
+
+		// Compare, and report.
+		divergences := verify.Compare(formula, runs)
+		diverged := map[string]verify.Divergence{}
+		for _, d := range divergences {
+			diverged[d.Output] = d
+		}
+		for _, name := range sortedConjectures(formula) {
+			d, ok := diverged[name]
+			if !ok {
+				fmt.Fprintf(stdout, "ok\t%s\t%s\n", name, runs[0].Results[name].Hash)
+				continue
+			}
+			fmt.Fprintf(stdout, "DIVERGED\t%s\n", name)
+			for i, ware := range d.Wares {
+				fmt.Fprintf(stdout, "\trun %d:\t%s\n", i+1, ware.Hash)
+			}
+			emitDiffs(d, formula.Outputs[name].Warehouses, stdout, log)
+		}
+		if len(divergences) > 0 {
+			panic(&cmdbhv.ErrExit{
+				Message: fmt.Sprintf("%d of %d conjectured outputs diverged", len(divergences), conjectures),
+				Code:    cmdbhv.EXIT_DIVERGED,
+			})
+		}
+		return nil
+	}
+}
+
+func run(formula *def.Formula, exec executor.Executor, stderr io.Writer) *def.RunRecord {
+	runner := runner.New(runner.Config{
+		Executor: exec,
+	})
+	go sup.NewTask().Run(runner.Run)
+	runID := runner.StartRun(formula)
+	return terminal.Consume(runner, runID, stderr)
+}
+
+/*
+	Diffs each distinct ware against the first run's.
+	Wares that can't be fetched are reported, but don't stop the rest.
+*/
+func emitDiffs(d verify.Divergence, warehouses def.WarehouseCoords, stdout io.Writer, log log15.Logger) {
+	transmat := util.DefaultTransmat()
+	var base *fshash.MemoryBucket
+	meep.Try(func() {
+		base = examine.Fetch(d.Wares[0], warehouses, transmat, log)
+	}, meep.TryPlan{
+		{CatchAny: true, Handler: func(e error) {
+			fmt.Fprintf(stdout, "\tcannot diff: cannot fetch run 1's ware: %s\n", e)
+		}},
+	})
+	if base == nil {
+		return
+	}
+	seen := map[def.Ware]bool{d.Wares[0]: true}
+	for i, ware := range d.Wares {
+		if seen[ware] || ware.Hash == "" {
+			continue
+		}
+		seen[ware] = true
+		meep.Try(func() {
+			changes := examine.Diff(base, examine.Fetch(ware, warehouses, transmat, log))
+			fmt.Fprintf(stdout, "\tdiff run 1 -> run %d:\n", i+1)
+			if len(changes) == 0 {
+				fmt.Fprintf(stdout, "\t\t(no file-level differences)\n")
+				return
+			}
+			var buf bytes.Buffer
+			examine.EmitDiff(changes, &buf)
+			for _, line := range strings.SplitAfter(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+				fmt.Fprintf(stdout, "\t\t%s", line)
+			}
+			fmt.Fprintf(stdout, "\n")
+		}, meep.TryPlan{
+			{CatchAny: true, Handler: func(e error) {
+				fmt.Fprintf(stdout, "\tcannot diff: cannot fetch run %d's ware: %s\n", i+1, e)
+			}},
+		})
+	}
+}
+
+func knownPerturbation(p verify.Perturbation) bool {
+	for _, known := range verify.Perturbations {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+func perturbationNames() string {
+	names := make([]string, len(verify.Perturbations))
+	for i, p := range verify.Perturbations {
+		names[i] = string(p)
+	}
+	return strings.Join(names, ", ")
+}
+
+func sortedConjectures(formula *def.Formula) []string {
+	var names []string
+	for name, output := range formula.Outputs {
+		if output.Conjecture {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,118 @@
+package warehouseCmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/api/hitch"
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/gc"
+	"go.polydawn.net/repeatr/rsrch/model/catalog"
+)
+
+/*
+	Prints a line per object removed -- action and name, tab separated --
+	and a summary on stderr.
+*/
+func Gc(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		// args parse
+		if !ctx.Args().Present() {
+			panic(cmdbhv.ErrMissingParameter("warehouse URI"))
+		}
+		uri := rio.SiloURI(ctx.Args().First())
+		grace, err := time.ParseDuration(ctx.String("grace"))
+		if err != nil {
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{Message: "malformed grace period: " + err.Error()}))
+		}
+		dryRun := ctx.Bool("dry-run")
+		formulaPaths := ctx.StringSlice("formula")
+		runRecordPaths := ctx.StringSlice("runrecord")
+		catalogPaths := ctx.StringSlice("catalog")
+		if len(formulaPaths)+len(runRecordPaths)+len(catalogPaths) == 0 {
+			// An empty root set means everything is garbage.  Nobody means that.
+			panic(meep.Meep(&cmdbhv.ErrBadArgs{
+				Message: "no roots given; at least one '--formula', '--runrecord', or '--catalog' is required",
+			}))
+		}
+		// set up logging.
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+		// gather roots, then sweep
+		var summary gc.Summary
+		meep.Try(func() {
+			live := gc.LiveSet{}
+			for _, pth := range formulaPaths {
+				addFormulaRoots(live, hitch.LoadFormulaFromFile(pth))
+			}
+			for _, pth := range runRecordPaths {
+				rr := &def.RunRecord{}
+				loadFile(pth, rr)
+				addRunRecordRoots(live, rr)
+			}
+			for _, pth := range catalogPaths {
+				book := &catalog.Book{}
+				loadFile(pth, book)
+				addCatalogRoots(live, book)
+			}
+			log.Info("Roots gathered", "live", len(live))
+			inventory := openInventory(uri)
+			action := "deleted"
+			if dryRun {
+				action = "would-delete"
+			}
+			summary = gc.Collect(inventory, live, grace, time.Now(), dryRun, log, func(sweep gc.Sweep) {
+				fmt.Fprintf(stdout, "%s\t%s\n", action, sweep.Name)
+			})
+		}, cmdbhv.TryPlanToExit)
+		// report
+		if dryRun {
+			fmt.Fprintf(stderr, "kept %d live and %d within grace period; would delete %d\n", summary.Live, summary.Young, summary.Swept)
+		} else {
+			fmt.Fprintf(stderr, "kept %d live and %d within grace period; deleted %d\n", summary.Live, summary.Young, summary.Swept)
+		}
+		return nil
+	}
+}
+
+func loadFile(pth string, val interface{}) {
+	f, err := os.Open(pth)
+	if err != nil {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("cannot read root %q: %s", pth, err),
+		})
+	}
+	defer f.Close()
+	hitch.DecodeYaml(f, val)
+}
+
+func addFormulaRoots(live gc.LiveSet, frm *def.Formula) {
+	for _, input := range frm.Inputs {
+		live.Add(rio.CommitID(input.Hash))
+	}
+	for _, output := range frm.Outputs {
+		live.Add(rio.CommitID(output.Hash))
+	}
+}
+
+func addRunRecordRoots(live gc.LiveSet, rr *def.RunRecord) {
+	for _, result := range rr.Results {
+		live.Add(rio.CommitID(result.Hash))
+	}
+}
+
+func addCatalogRoots(live gc.LiveSet, book *catalog.Book) {
+	for _, track := range book.Tracks {
+		for _, sku := range track {
+			live.Add(rio.CommitID(sku.Hash))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package warehouseCmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/codegangsta/cli"
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/cmd/repeatr/bhv"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/fsck"
+	"go.polydawn.net/repeatr/rio/mirror"
+)
+
+/*
+	Prints a line per object checked -- status, name, and detail, tab separated --
+	and a summary on stderr.  Exits nonzero if anything was amiss.
+*/
+func Verify(stdout, stderr io.Writer) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		// args parse
+		if !ctx.Args().Present() {
+			panic(cmdbhv.ErrMissingParameter("warehouse URI"))
+		}
+		uri := rio.SiloURI(ctx.Args().First())
+		quarantine := ctx.Bool("quarantine")
+		// set up logging.
+		log := log15.New()
+		log.SetHandler(log15.StreamHandler(stderr, log15.TerminalFormat()))
+		// invoke
+		var summary fsck.Summary
+		meep.Try(func() {
+			inventory := openInventory(uri)
+			summary = fsck.Verify(inventory, quarantine, log, func(finding fsck.Finding) {
+				if finding.Status == fsck.StatusOK && !ctx.Bool("verbose") {
+					return
+				}
+				detail := finding.Detail
+				if finding.Quarantined {
+					detail += " (quarantined)"
+				}
+				fmt.Fprintf(stdout, "%s\t%s\t%s\n", finding.Status, finding.Name, detail)
+			})
+		}, cmdbhv.TryPlanToExit)
+		// report
+		fmt.Fprintf(stderr, "checked %d wares: %d bad, %d unreadable; %d orphaned uploads\n",
+			summary.Checked, summary.Bad, summary.Unreadable, summary.Orphans)
+		if !summary.Clean() {
+			panic(&cmdbhv.ErrExit{
+				Message: fmt.Sprintf("warehouse %s has problems", uri),
+				Code:    cmdbhv.EXIT_USER,
+			})
+		}
+		return nil
+	}
+}
+
+func openInventory(uri rio.SiloURI) rio.BlobInventory {
+	wh := mirror.OpenWarehouse(uri)
+	inventory, ok := wh.(rio.BlobInventory)
+	if !ok {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("warehouse %s can't be listed; verification is supported for file+ca, http+ca, and s3+ca warehouses", uri),
+		})
+	}
+	return inventory
+}
@@ -15,6 +15,8 @@ import (
 	"go.polydawn.net/repeatr/api/act"
 	"go.polydawn.net/repeatr/api/def"
 	"go.polydawn.net/repeatr/core/executor"
+	"go.polydawn.net/repeatr/core/history"
+	"go.polydawn.net/repeatr/core/resultcache"
 	"go.polydawn.net/repeatr/lib/guid"
 )
 
@@ -40,7 +42,9 @@ type Runner struct {
 
 type Config struct {
 	Executor executor.Executor
-	Stdin    io.Reader // hack for interactive mode.
+	Stdin    io.Reader           // hack for interactive mode.
+	History  *history.Store      // if set, the formula and runrecord are saved here when the run is done.
+	Cache    *resultcache.Client // if set, runrecords of successful runs are published here.
 }
 
 type state struct {
@@ -66,6 +70,7 @@ func (a *Runner) Run(supvr sup.Supervisor) {
 	// (Executor doesn't know about go-sup yet; this may look different
 	//  and have more obvious error flow paths when it's updated for that.)
 	logSetup := evtStreamLogHandler{a.runID, stream}
+	expected := expectedOutputs(a.frm)
 	job := a.cfg.Executor.Start(
 		*a.frm,
 		executor.JobID(a.runID),
@@ -87,7 +92,29 @@ func (a *Runner) Run(supvr sup.Supervisor) {
 
 	// Process final report.
 	// Push log level events in addition to the runRecord
-	rr := jobToRunRecord(job)
+	rr := jobToRunRecord(job, a.frm, expected)
+	// Keep it in the history, if we're keeping one (and it's recordable).
+	//  Failing to isn't worth failing the run over; just say so.
+	if a.cfg.History != nil && rr.HID != "" {
+		meep.Try(func() {
+			a.cfg.History.Save(a.frm, rr)
+		}, meep.TryPlan{
+			{CatchAny: true, Handler: func(e error) {
+				logSetup.NewLogger().Warn("failed to save run to history", "error", e)
+			}},
+		})
+	}
+	// Share it, if we're sharing and it succeeded.
+	//  Again, not worth failing the run over.
+	if a.cfg.Cache != nil && rr.HID != "" && rr.Failure == nil && rr.Results["$exitcode"].Hash == "0" {
+		meep.Try(func() {
+			a.cfg.Cache.Publish(rr)
+		}, meep.TryPlan{
+			{CatchAny: true, Handler: func(e error) {
+				logSetup.NewLogger().Warn("failed to publish run to result cache", "error", e)
+			}},
+		})
+	}
 	stream <- &def.Event{
 		RunID:     a.runID,
 		RunRecord: rr,
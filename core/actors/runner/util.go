@@ -1,9 +1,12 @@
 package runner
 
 import (
+	"sort"
 	"strconv"
 	"time"
 
+	"go.polydawn.net/meep"
+
 	"go.polydawn.net/repeatr/api/def"
 	"go.polydawn.net/repeatr/core/executor"
 )
@@ -11,7 +14,11 @@ import (
 // Bridge method for executor.Job to def.RunRecord.
 // May be a refactor target; can remove if executor just uses RunRecord.
 // (There *is* a long standing comment line in job.go about "almost all of this should be replaced by `def.RunRecord` things" already...)
-func jobToRunRecord(job executor.Job) *def.RunRecord {
+//
+// `expected` are the wares the formula expected of its outputs, as noted by
+// `expectedOutputs` before the run; if the run otherwise succeeded, but an
+// output came out differently, that's its failure.
+func jobToRunRecord(job executor.Job, frm *def.Formula, expected map[string]def.Ware) *def.RunRecord {
 	jr := job.Wait()
 
 	// Temporary: flip results types.  (TODO: keep driving this version deeper.)
@@ -31,10 +38,69 @@ func jobToRunRecord(job executor.Job) *def.RunRecord {
 		def.Ware{"exitcode", strconv.Itoa(jr.ExitCode)},
 	}
 
-	return &def.RunRecord{
-		UID:     def.RunID(job.Id()),
-		Date:    time.Now().Truncate(time.Second), // FIXME elide this translation layer, this should be committed just once
-		Results: results,
-		Failure: jr.Error,
+	failure := jr.Error
+	if failure == nil {
+		failure = checkExpectedOutputs(expected, results, frm)
+	}
+
+	rr := &def.RunRecord{
+		UID:        def.RunID(job.Id()),
+		Date:       time.Now().Truncate(time.Second), // FIXME elide this translation layer, this should be committed just once
+		FormulaHID: frm.Hash(),
+		Results:    results,
+		Failure:    failure,
+	}
+	// Failures of types outside the API's vocabulary can't be serialized,
+	//  so neither can they be hashed; such records are left without a HID.
+	meep.RecoverPanics(func() {
+		rr.HID = rr.Hash()
+	})
+	return rr
+}
+
+/*
+	Notes the wares a formula expects of its conjectured outputs: those
+	with a hash already set.  This has to be done before the run, since
+	running fills in the hashes actually produced.
+*/
+func expectedOutputs(frm *def.Formula) map[string]def.Ware {
+	expected := map[string]def.Ware{}
+	for name, output := range frm.Outputs {
+		if output.Conjecture && output.Hash != "" {
+			expected[name] = def.Ware{output.Type, output.Hash}
+		}
+	}
+	return expected
+}
+
+/*
+	Checks results against the expected wares, returning an
+	`*def.ErrOutputMismatch` for the first output (by name) that differs,
+	or nil if none do.
+*/
+func checkExpectedOutputs(expected map[string]def.Ware, results def.ResultGroup, frm *def.Formula) error {
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var actual def.Ware
+		if result := results[name]; result != nil {
+			actual = result.Ware
+		}
+		if actual != expected[name] {
+			var warehouses def.WarehouseCoords
+			if output := frm.Outputs[name]; output != nil {
+				warehouses = output.Warehouses
+			}
+			return &def.ErrOutputMismatch{
+				Output:     name,
+				Expected:   expected[name],
+				Actual:     actual,
+				Warehouses: warehouses,
+			}
+		}
 	}
+	return nil
 }
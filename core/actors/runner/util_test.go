@@ -0,0 +1,51 @@
+package runner
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"go.polydawn.net/repeatr/api/def"
+)
+
+func TestExpectedOutputs(t *testing.T) {
+	Convey("Given a formula with some expected output hashes", t, func() {
+		frm := &def.Formula{
+			Outputs: def.OutputGroup{
+				"product": &def.Output{Type: "tar", MountPath: "/out", Conjecture: true, Hash: "expected", Warehouses: def.WarehouseCoords{"file+ca://wh"}},
+				"other":   &def.Output{Type: "tar", MountPath: "/other", Conjecture: true},
+				"logs":    &def.Output{Type: "tar", MountPath: "/logs", Hash: "ignored"},
+			},
+		}
+		expected := expectedOutputs(frm)
+
+		Convey("Only conjectures with hashes should be expected", func() {
+			So(expected, ShouldResemble, map[string]def.Ware{"product": {"tar", "expected"}})
+		})
+
+		Convey("Matching results should pass", func() {
+			So(checkExpectedOutputs(expected, def.ResultGroup{
+				"product": &def.Result{"product", def.Ware{"tar", "expected"}},
+				"other":   &def.Result{"other", def.Ware{"tar", "whatever"}},
+				"logs":    &def.Result{"logs", def.Ware{"tar", "whatever"}},
+			}, frm), ShouldBeNil)
+		})
+
+		Convey("Differing results should fail, saying where to look", func() {
+			err := checkExpectedOutputs(expected, def.ResultGroup{
+				"product": &def.Result{"product", def.Ware{"tar", "surprise"}},
+			}, frm)
+			So(err, ShouldResemble, &def.ErrOutputMismatch{
+				Output:     "product",
+				Expected:   def.Ware{"tar", "expected"},
+				Actual:     def.Ware{"tar", "surprise"},
+				Warehouses: def.WarehouseCoords{"file+ca://wh"},
+			})
+		})
+
+		Convey("Missing results should fail too", func() {
+			err := checkExpectedOutputs(expected, def.ResultGroup{}, frm)
+			So(err, ShouldHaveSameTypeAs, &def.ErrOutputMismatch{})
+		})
+	})
+}
@@ -5,6 +5,7 @@
 package assets
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -79,6 +80,25 @@ func Get(assetName string) string {
 	return arena.Path()
 }
 
+/*
+	Checks the named asset is already in the asset cache.
+	Returns nil if so, or an error saying why not.
+
+	Only the local cache is consulted -- no warehouse is asked -- so this
+	is cheap and offline enough for executor probes.  `Get` will still
+	fetch an asset that isn't cached.
+*/
+func Cached(assetName string) error {
+	hash, ok := assets[assetName]
+	if !ok {
+		return fmt.Errorf("no such asset %q", assetName)
+	}
+	if _, err := os.Stat(filepath.Join(jank.Base(), "assets", "cache", "committed", string(hash))); err != nil {
+		return fmt.Errorf("asset %q is not cached (fetch it by running with this executor explicitly)", assetName)
+	}
+	return nil
+}
+
 /*
 	A separate transmat is used for the asset system.
 
@@ -0,0 +1,356 @@
+/*
+	Bundles pack a formula and every ware its inputs need into one file,
+	so it can be carried somewhere without access to the original
+	warehouses -- an air-gapped network, say -- and run there.
+
+	A bundle is an (uncompressed) tar archive.  Its first entry is
+	`index.json`, an `Index` of the formula and the wares; the rest are the
+	wares, each stored packed, verbatim, as `wares/<hash>` -- just as a
+	content-addressable warehouse would store them.  Every ware is checked
+	against its hash both as it's bundled, and as it's unbundled.
+
+	Only kinds sharing the tar packing and hash space can be bundled:
+	`tar`, `s3`, and `gs` wares are copied as they are.  (`dir` wares are
+	refused: they'd have to be repacked as tar, and repacking a filesystem
+	doesn't reliably give back the hash it was saved with.)  Unbundled wares
+	are fetched straight from the unpacked bundle, loaded into the local
+	caches as `tar` -- which those kinds all share -- or copied into a warehouse.
+*/
+package bundle
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/core/fetch"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/mirror"
+	tartrans "go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+const IndexPath = "index.json"
+
+/*
+	Kinds of ware that can be bundled.
+*/
+var Bundleable = map[rio.TransmatKind]bool{
+	"tar": true,
+	"s3":  true,
+	"gs":  true,
+}
+
+type Index struct {
+	Formula *def.Formula `json:"formula"`
+	Wares   []Entry      `json:"wares"`
+}
+
+type Entry struct {
+	Ware   def.Ware `json:"ware"`
+	Path   string   `json:"path"` // of the packed ware, within the bundle.
+	Size   int64    `json:"size"`
+	Inputs []string `json:"inputs"`
+}
+
+/*
+	Raised when a bundle is malformed, or doesn't hold what its index says.
+*/
+type ErrBadBundle struct {
+	meep.TraitAutodescribing
+	meep.TraitCausable
+	Reason string
+}
+
+/*
+	Fetches every input of the formula from its warehouses, and writes a
+	bundle of them all, and the formula, to `w`.  The wares are staged in
+	`scratch` on the way, so it needs room for all of them.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if an input has no hash, or is of a kind that can't be bundled.
+	  - `*def.ErrHashMismatch` -- if a ware doesn't match its hash.
+	  - any of the errors fetching the wares can raise.
+*/
+func Create(w io.Writer, frm *def.Formula, scratch string, transmat rio.Transmat, log log15.Logger) *Index {
+	wants := fetch.FormulaWants(frm)
+	var unbundleable []string
+	for _, want := range wants {
+		switch {
+		case want.Ware.Hash == "":
+			unbundleable = append(unbundleable, fmt.Sprintf("%s (no hash)", strings.Join(want.Inputs, ", ")))
+		case !Bundleable[rio.TransmatKind(want.Ware.Type)]:
+			unbundleable = append(unbundleable, fmt.Sprintf("%s (kind %q)", strings.Join(want.Inputs, ", "), want.Ware.Type))
+		}
+	}
+	if len(unbundleable) > 0 {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("cannot bundle inputs: %s; only tar, s3, and gs wares can be bundled", strings.Join(unbundleable, "; ")),
+		})
+	}
+
+	// Stage every ware, packed, in a content-addressable dir.
+	staging := filepath.Join(scratch, "wares")
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+	}
+	stagingURI := rio.SiloURI("file+ca://" + staging)
+	index := &Index{Formula: frm, Wares: []Entry{}}
+	for _, want := range wants {
+		kind := rio.TransmatKind(want.Ware.Type)
+		hash := rio.CommitID(want.Ware.Hash)
+		from := make([]rio.SiloURI, len(want.Warehouses))
+		for i, wh := range want.Warehouses {
+			from[i] = rio.SiloURI(wh)
+		}
+		journal := log.New("type", kind, "hash", hash)
+		journal.Info("Bundling ware")
+		mirror.Mirror(kind, hash, from, stagingURI, transmat, journal)
+		fi, err := os.Stat(filepath.Join(staging, string(hash)))
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save", Ware: want.Ware})
+		}
+		index.Wares = append(index.Wares, Entry{
+			Ware:   want.Ware,
+			Path:   path.Join("wares", string(hash)),
+			Size:   fi.Size(),
+			Inputs: want.Inputs,
+		})
+	}
+
+	// Write it all out: index first, so readers know what to expect.
+	tw := tar.NewWriter(w)
+	var indexBody []byte
+	if err := codec.NewEncoderBytes(&indexBody, &codec.JsonHandle{Indent: -1}).Encode(index); err != nil {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+		))
+	}
+	writeEntry(tw, IndexPath, int64(len(indexBody)), strings.NewReader(string(indexBody)))
+	for _, entry := range index.Wares {
+		f, err := os.Open(filepath.Join(staging, entry.Ware.Hash))
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save", Ware: entry.Ware})
+		}
+		writeEntry(tw, entry.Path, entry.Size, f)
+		f.Close()
+	}
+	if err := tw.Close(); err != nil {
+		panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+	}
+	return index
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, body io.Reader) {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+	}
+	if _, err := io.Copy(tw, body); err != nil {
+		panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+	}
+}
+
+/*
+	Reads a bundle, unpacking its wares into `dir` as a content-addressable
+	warehouse, and checking every one against its hash on the way.
+	Returns the index, and the URI of the warehouse.
+
+	May panic with:
+
+	  - `*bundle.ErrBadBundle` -- if the bundle is malformed, or lacks wares its formula needs.
+	  - `*def.ErrHashMismatch` -- if a ware doesn't match its hash.
+	  - `*def.ErrWareCorrupt` -- if a ware can't be unpacked.
+*/
+func Open(r io.Reader, dir string, log log15.Logger) (*Index, rio.SiloURI) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+	}
+	uri := rio.SiloURI("file+ca://" + dir)
+	wh := tartrans.NewWarehouse(uri)
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		panic(meep.Meep(&ErrBadBundle{Reason: "unreadable"}, meep.Cause(err)))
+	}
+	if hdr.Name != IndexPath {
+		panic(meep.Meep(&ErrBadBundle{Reason: fmt.Sprintf("expected %q first, found %q", IndexPath, hdr.Name)}))
+	}
+	index := &Index{}
+	if err := codec.NewDecoder(tr, &codec.JsonHandle{}).Decode(index); err != nil {
+		panic(meep.Meep(&ErrBadBundle{Reason: "unparsable index"}, meep.Cause(err)))
+	}
+	if index.Formula == nil {
+		panic(meep.Meep(&ErrBadBundle{Reason: "index has no formula"}))
+	}
+	entries := make(map[string]Entry, len(index.Wares))
+	for _, entry := range index.Wares {
+		entries[entry.Path] = entry
+	}
+	found := map[string]bool{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(meep.Meep(&ErrBadBundle{Reason: "unreadable"}, meep.Cause(err)))
+		}
+		entry, ok := entries[hdr.Name]
+		if !ok {
+			panic(meep.Meep(&ErrBadBundle{Reason: fmt.Sprintf("%q is not in the index", hdr.Name)}))
+		}
+		log.Info("Unbundling ware", "type", entry.Ware.Type, "hash", entry.Ware.Hash)
+		unpack(tr, entry.Ware, wh, def.WarehouseCoord(uri), log)
+		found[entry.Path] = true
+	}
+
+	// Every input the formula needs must have been in there.
+	for _, want := range fetch.FormulaWants(index.Formula) {
+		var entry *Entry
+		for i := range index.Wares {
+			if index.Wares[i].Ware == want.Ware {
+				entry = &index.Wares[i]
+			}
+		}
+		if entry == nil || !found[entry.Path] {
+			panic(meep.Meep(&ErrBadBundle{Reason: fmt.Sprintf("missing ware %s:%s for %s", want.Ware.Type, want.Ware.Hash, strings.Join(want.Inputs, ", "))}))
+		}
+	}
+	return index, uri
+}
+
+/*
+	Copies one packed ware into the warehouse, hashing it as it goes past,
+	and only committing it if the hash checks out.
+*/
+func unpack(r io.Reader, ware def.Ware, wh rio.BlobWarehouse, coord def.WarehouseCoord, log log15.Logger) {
+	wc := wh.OpenWriter()
+	committed := false
+	defer func() {
+		if !committed {
+			wc.Abort()
+		}
+	}()
+	tee := io.TeeReader(r, wc)
+	actualHash := tartrans.HashPacked(tee, log)
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save", Ware: ware, From: coord})
+	}
+	if string(actualHash) != ware.Hash {
+		panic(&def.ErrHashMismatch{
+			Expected: ware,
+			Actual:   def.Ware{Type: ware.Type, Hash: string(actualHash)},
+			From:     coord,
+		})
+	}
+	wc.Commit(actualHash)
+	committed = true
+}
+
+/*
+	Loads every ware of an opened bundle into the caches of `transmat`
+	(which should be `util.DefaultTransmat`, or act like it), so that the
+	bundle's formula can run without contacting any other warehouse.
+	They're materialized as `tar`, which verifies them once more.
+*/
+func Load(index *Index, uri rio.SiloURI, transmat rio.Transmat, log log15.Logger) {
+	for _, entry := range index.Wares {
+		transmat.Materialize(tartrans.Kind, rio.CommitID(entry.Ware.Hash), []rio.SiloURI{uri}, log).Teardown()
+	}
+}
+
+/*
+	Copies every ware of an opened bundle into another warehouse (of any
+	of the schemes `mirror.OpenWarehouse` understands), and returns the
+	bundle's formula with that warehouse added (first) to every input that can
+	fetch from it -- those of the kind the warehouse's scheme is for: `s3`
+	for s3 URIs, `gs` for gs URIs, and `tar` for the rest.
+	(Other inputs can still be loaded from the bundle into caches.)
+
+	May panic with the same errors as `mirror.Mirror`.
+*/
+func Import(index *Index, uri rio.SiloURI, to rio.SiloURI, transmat rio.Transmat, log log15.Logger) *def.Formula {
+	for _, entry := range index.Wares {
+		mirror.Mirror(tartrans.Kind, rio.CommitID(entry.Ware.Hash), []rio.SiloURI{uri}, to, transmat, log)
+	}
+	kind := "tar"
+	switch scheme := strings.SplitN(string(to), ":", 2)[0]; strings.TrimSuffix(scheme, "+ca") {
+	case "s3", "gs":
+		kind = strings.TrimSuffix(scheme, "+ca")
+	}
+	return withWarehouse(index.Formula, kind, to)
+}
+
+/*
+	Readies an opened bundle's formula to run with its wares fetched from
+	the bundle's warehouse at `uri` -- which must be kept until the run is
+	done.  Returns the formula with the warehouse added to every `tar`
+	input.  `s3` and `gs` inputs can't fetch from a file warehouse, so their
+	wares are loaded into the caches of `transmat` instead, as `Load` does
+	(those kinds share the cache with `tar`).
+*/
+func Use(index *Index, uri rio.SiloURI, transmat rio.Transmat, log log15.Logger) *def.Formula {
+	for _, entry := range index.Wares {
+		if entry.Ware.Type != string(tartrans.Kind) {
+			transmat.Materialize(tartrans.Kind, rio.CommitID(entry.Ware.Hash), []rio.SiloURI{uri}, log).Teardown()
+		}
+	}
+	return withWarehouse(index.Formula, string(tartrans.Kind), uri)
+}
+
+/*
+	Returns a copy of the formula with the warehouse added to every input
+	of the kind -- first, so that it's tried before the others (which,
+	where bundles are used, are likely out of reach).
+*/
+func withWarehouse(frm *def.Formula, kind string, uri rio.SiloURI) *def.Formula {
+	frm = frm.Clone()
+	for _, in := range frm.Inputs {
+		if in.Type == kind {
+			in.Warehouses = append(def.WarehouseCoords{def.WarehouseCoord(uri)}, in.Warehouses...)
+		}
+	}
+	return frm
+}
+
+/*
+	Opens the bundle file at `path` (unpacking it in a temp dir, removed
+	afterwards) and loads every ware into the caches of `transmat`, like
+	`Load`.  Returns the index.
+
+	May panic with the same errors as `Open`.
+*/
+func LoadFile(path string, transmat rio.Transmat, log log15.Logger) *Index {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(meep.Meep(&ErrBadBundle{Reason: "unreadable"}, meep.Cause(err)))
+	}
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "repeatr-bundle-")
+	if err != nil {
+		panic(&def.ErrWarehouseProblem{Msg: err.Error(), During: "save"})
+	}
+	defer os.RemoveAll(dir)
+	index, uri := Open(f, dir, log)
+	Load(index, uri, transmat, log)
+	return index
+}
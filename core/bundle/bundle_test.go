@@ -0,0 +1,152 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+	tartrans "go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+func TestBundle(t *testing.T) {
+	Convey("Given a formula with inputs in a warehouse", t, testutil.WithTmpdir(func(c C) {
+		log := testutil.TestLogger(c)
+		cwd, _ := os.Getwd()
+		caURI := "file+ca://" + filepath.Join(cwd, "ca")
+		os.Mkdir("ca", 0755)
+		filefixture.Alpha.Create("alpha")
+		filefixture.Beta.Create("beta")
+		transmat := tartrans.New("work")
+		alpha := transmat.Scan(tartrans.Kind, "alpha", []rio.SiloURI{rio.SiloURI(caURI)}, log)
+		beta := transmat.Scan(tartrans.Kind, "beta", []rio.SiloURI{rio.SiloURI(caURI)}, log)
+		frm := &def.Formula{
+			Inputs: def.InputGroup{
+				"rootfs": &def.Input{Type: "tar", Hash: string(alpha), MountPath: "/", Warehouses: def.WarehouseCoords{def.WarehouseCoord(caURI)}},
+				"data":   &def.Input{Type: "tar", Hash: string(beta), MountPath: "/data", Warehouses: def.WarehouseCoords{def.WarehouseCoord(caURI)}},
+				"again":  &def.Input{Type: "tar", Hash: string(beta), MountPath: "/again", Warehouses: def.WarehouseCoords{def.WarehouseCoord(caURI)}},
+			},
+			Action: def.Action{Entrypoint: []string{"echo"}},
+		}
+
+		Convey("Bundling should pack the formula and each ware once", func() {
+			var buf bytes.Buffer
+			index := Create(&buf, frm, filepath.Join(cwd, "scratch"), transmat, log)
+			So(index.Wares, ShouldHaveLength, 2)
+			So(index.Wares[0].Inputs, ShouldResemble, []string{"again", "data"})
+			So(index.Wares[0].Path, ShouldEqual, "wares/"+string(beta))
+			So(index.Wares[1].Inputs, ShouldResemble, []string{"rootfs"})
+
+			Convey("Which should unbundle into a warehouse", func() {
+				opened, uri := Open(bytes.NewReader(buf.Bytes()), filepath.Join(cwd, "unbundled"), log)
+				So(opened.Formula.Hash(), ShouldEqual, frm.Hash())
+				So(opened.Wares, ShouldResemble, index.Wares)
+				arena := tartrans.New("work2").Materialize(tartrans.Kind, beta, []rio.SiloURI{uri}, log)
+				So(arena.Hash(), ShouldEqual, beta)
+
+				Convey("And run straight from it", func() {
+					used := Use(opened, uri, transmat, log)
+					So(used.Inputs["rootfs"].Warehouses, ShouldResemble, def.WarehouseCoords{def.WarehouseCoord(uri), def.WarehouseCoord(caURI)})
+					So(used.Hash(), ShouldEqual, frm.Hash())
+					// With the original warehouse gone, the bundle's is all there is.
+					So(os.RemoveAll("ca"), ShouldBeNil)
+					from := []rio.SiloURI{rio.SiloURI(used.Inputs["rootfs"].Warehouses[0])}
+					arena := tartrans.New("work4").Materialize(tartrans.Kind, alpha, from, log)
+					So(arena.Hash(), ShouldEqual, alpha)
+				})
+
+				Convey("And import into others", func() {
+					os.Mkdir("elsewhere", 0755)
+					to := rio.SiloURI("file+ca://" + filepath.Join(cwd, "elsewhere"))
+					imported := Import(opened, uri, to, transmat, log)
+					So(imported.Inputs["data"].Warehouses, ShouldResemble, def.WarehouseCoords{def.WarehouseCoord(to), def.WarehouseCoord(caURI)})
+					So(frm.Inputs["data"].Warehouses, ShouldHaveLength, 1)
+					arena := tartrans.New("work3").Materialize(tartrans.Kind, alpha, []rio.SiloURI{to}, log)
+					So(arena.Hash(), ShouldEqual, alpha)
+				})
+			})
+
+			Convey("Tampered bundles should be refused", func() {
+				body := buf.Bytes()
+				// Swap one ware's content for another's, leaving the index claiming otherwise.
+				tampered := rewrite(body, func(name string, content []byte) []byte {
+					if name == index.Wares[1].Path {
+						return index.Wares[0].wareBytes(c, "scratch")
+					}
+					return content
+				})
+				err := meep.RecoverPanics(func() {
+					Open(bytes.NewReader(tampered), filepath.Join(cwd, "tampered"), log)
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrHashMismatch{})
+			})
+
+			Convey("Bundles missing wares should be refused", func() {
+				trimmed := rewrite(buf.Bytes(), func(name string, content []byte) []byte {
+					if name == index.Wares[1].Path {
+						return nil
+					}
+					return content
+				})
+				err := meep.RecoverPanics(func() {
+					Open(bytes.NewReader(trimmed), filepath.Join(cwd, "trimmed"), log)
+				})
+				So(err, ShouldHaveSameTypeAs, &ErrBadBundle{})
+			})
+		})
+
+		Convey("Inputs of kinds that can't be bundled should be refused up front", func() {
+			for _, kind := range []string{"git", "dir"} {
+				frm.Inputs["src"] = &def.Input{Type: kind, Hash: "abcd", MountPath: "/src"}
+				err := meep.RecoverPanics(func() {
+					Create(ioutil.Discard, frm, filepath.Join(cwd, "scratch"), transmat, log)
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrConfigValidation{})
+			}
+		})
+	}))
+}
+
+/*
+	Reads the staged bytes of a ware, as `Create` left them.
+*/
+func (e Entry) wareBytes(c C, scratch string) []byte {
+	body, err := ioutil.ReadFile(filepath.Join(scratch, "wares", e.Ware.Hash))
+	c.So(err, ShouldBeNil)
+	return body
+}
+
+/*
+	Rewrites the entries of a bundle; nil content drops the entry.
+*/
+func rewrite(bundle []byte, fn func(name string, content []byte) []byte) []byte {
+	var out bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(bundle))
+	tw := tar.NewWriter(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		content, _ := ioutil.ReadAll(tr)
+		content = fn(hdr.Name, content)
+		if content == nil {
+			continue
+		}
+		hdr.Size = int64(len(content))
+		tw.WriteHeader(hdr)
+		tw.Write(content)
+	}
+	tw.Close()
+	return out.Bytes()
+}
@@ -0,0 +1,298 @@
+/*
+	Manifests of filesystems: one line per file, giving everything that
+	goes into a ware's hash, so two wares can be compared by eye (or by `Diff`).
+*/
+package examine
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/fshash"
+	"go.polydawn.net/repeatr/lib/treewalk"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/filter"
+	"go.polydawn.net/repeatr/rio/mirror"
+	tartrans "go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+/*
+	Scans the files at a path into a bucket of hashes and metadata.
+*/
+func ScanPath(thePath string) *fshash.MemoryBucket {
+	// Scan the whole arena contents back into a bucket of hashes and metadata.
+	//  (If warehouses exposed their Buckets, that'd be handy.  But of course, not everyone uses those, so.)
+	bucket := &fshash.MemoryBucket{}
+	hasherFactory := sha512.New384
+	filterset := filter.FilterSet{}
+	if err := fshash.FillBucket(thePath, "", bucket, filterset, hasherFactory); err != nil {
+		panic(err)
+	}
+	return bucket
+}
+
+/*
+	Hashes a packed tar stream straight into a bucket, without unpacking it.
+	The bucket gives the same manifest as `ScanPath` would have for the
+	unpacked files.
+*/
+func ScanPacked(stream io.Reader, log log15.Logger) (*fshash.MemoryBucket, rio.CommitID) {
+	bucket := &fshash.MemoryBucket{}
+	hash := tartrans.ScanPacked(stream, bucket, log)
+	return bucket, hash
+}
+
+/*
+	One line of a manifest.
+*/
+type Line struct {
+	Name   string // the file's path.
+	Text   string // the whole line, as `Emit` prints it (sans newline).
+	record fshash.Record
+}
+
+/*
+	Lists the manifest lines of a bucket, in tree order.
+*/
+func Lines(bucket *fshash.MemoryBucket) []Line {
+	var lines []Line
+	preVisit := func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		lines = append(lines, Line{record.Metadata.Name, line(record), record})
+		return nil
+	}
+	if err := treewalk.Walk(bucket.Iterator(), preVisit, nil); err != nil {
+		panic(err)
+	}
+	return lines
+}
+
+/*
+	Prints the manifest of a bucket.
+*/
+func Emit(bucket *fshash.MemoryBucket, stdout io.Writer) {
+	for _, l := range Lines(bucket) {
+		fmt.Fprintf(stdout, "%s\n", l.Text)
+	}
+}
+
+func line(record fshash.Record) string {
+	// Emit TDV.  (We'll quote&escape filenames so null-terminated lines aren't necessary -- this is meant for human consumption after all.)
+	m := record.Metadata
+	// compute optional values
+	var freehandValues []string
+	if m.Linkname != "" {
+		freehandValues = append(freehandValues, fmt.Sprintf("link:%q", m.Linkname))
+	}
+	if m.Typeflag == tar.TypeBlock || m.Typeflag == tar.TypeChar {
+		freehandValues = append(freehandValues, fmt.Sprintf("major:%d", m.Devmajor))
+		freehandValues = append(freehandValues, fmt.Sprintf("minor:%d", m.Devminor))
+	} else if m.Typeflag == tar.TypeReg {
+		freehandValues = append(freehandValues, fmt.Sprintf("hash:%s", base64.URLEncoding.EncodeToString(record.ContentHash)))
+		freehandValues = append(freehandValues, fmt.Sprintf("len:%d", m.Size))
+	}
+	xattrsLen := len(m.Xattrs)
+	if xattrsLen > 0 {
+		sorted := make([]string, 0, xattrsLen)
+		for k, v := range m.Xattrs {
+			sorted = append(sorted, fmt.Sprintf("%q:%q", k, v))
+		}
+		sort.Strings(sorted)
+		freehandValues = append(freehandValues, fmt.Sprintf("xattrs:[%s]", strings.Join(sorted, ",")))
+	}
+	// plug and chug
+	return fmt.Sprintf(
+		"%q\t%c\t%#o\t%d\t%d\t%s\t%s",
+		m.Name,
+		m.Typeflag,
+		m.Mode&07777,
+		m.Uid,
+		m.Gid,
+		m.ModTime.UTC(),
+		strings.Join(freehandValues, ","),
+	)
+}
+
+/*
+	A file that differs between two manifests.
+*/
+type Change struct {
+	Name  string   `json:"name"`
+	Kind  string   `json:"change"`          // "added", "removed", or "changed".
+	Attrs []string `json:"attrs,omitempty"` // for "changed": which attributes differ (see `attrDiffs`).
+	A     string   `json:"a,omitempty"`     // the file's manifest line in A, unless it was added.
+	B     string   `json:"b,omitempty"`     // the file's manifest line in B, unless it was removed.
+}
+
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+/*
+	Compares two manifests, listing the files that differ, sorted by name.
+
+	Both manifests are sorted by name and walked in lockstep, so each
+	file is looked at once, however big the filesystems are.
+*/
+func Diff(a, b *fshash.MemoryBucket) []Change {
+	linesA, linesB := Lines(a), Lines(b)
+	sort.Sort(linesByName(linesA))
+	sort.Sort(linesByName(linesB))
+	var changes []Change
+	i, j := 0, 0
+	for i < len(linesA) || j < len(linesB) {
+		switch {
+		case j == len(linesB) || (i < len(linesA) && linesA[i].Name < linesB[j].Name):
+			changes = append(changes, Change{Name: linesA[i].Name, Kind: Removed, A: linesA[i].Text})
+			i++
+		case i == len(linesA) || linesB[j].Name < linesA[i].Name:
+			changes = append(changes, Change{Name: linesB[j].Name, Kind: Added, B: linesB[j].Text})
+			j++
+		default:
+			if attrs := attrDiffs(linesA[i].record, linesB[j].record); len(attrs) > 0 {
+				changes = append(changes, Change{Name: linesA[i].Name, Kind: Changed, Attrs: attrs, A: linesA[i].Text, B: linesB[j].Text})
+			}
+			i++
+			j++
+		}
+	}
+	return changes
+}
+
+/*
+	Names the attributes that differ between two records of the same file:
+	any of "type", "content" (hash or length), "mode", "uid", "gid",
+	"mtime", "link", "device", and "xattrs".
+*/
+func attrDiffs(a, b fshash.Record) []string {
+	ma, mb := a.Metadata, b.Metadata
+	var attrs []string
+	diff := func(differs bool, attr string) {
+		if differs {
+			attrs = append(attrs, attr)
+		}
+	}
+	diff(ma.Typeflag != mb.Typeflag, "type")
+	diff(!bytes.Equal(a.ContentHash, b.ContentHash) || ma.Size != mb.Size, "content")
+	diff(ma.Mode&07777 != mb.Mode&07777, "mode")
+	diff(ma.Uid != mb.Uid, "uid")
+	diff(ma.Gid != mb.Gid, "gid")
+	diff(!ma.ModTime.Equal(mb.ModTime), "mtime")
+	diff(ma.Linkname != mb.Linkname, "link")
+	diff(ma.Devmajor != mb.Devmajor || ma.Devminor != mb.Devminor, "device")
+	diff(!reflect.DeepEqual(nonNil(ma.Xattrs), nonNil(mb.Xattrs)), "xattrs")
+	return attrs
+}
+
+func nonNil(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+/*
+	Prints changes for people: a line naming each file and what happened
+	to it (and for changed files, which attributes differ), followed by
+	its manifest lines, the old prefixed by "-", the new by "+".
+*/
+func EmitDiff(changes []Change, stdout io.Writer) {
+	for _, c := range changes {
+		if c.Kind == Changed {
+			fmt.Fprintf(stdout, "%s %q (%s)\n", c.Kind, c.Name, strings.Join(c.Attrs, ", "))
+		} else {
+			fmt.Fprintf(stdout, "%s %q\n", c.Kind, c.Name)
+		}
+		if c.A != "" {
+			fmt.Fprintf(stdout, "\t- %s\n", c.A)
+		}
+		if c.B != "" {
+			fmt.Fprintf(stdout, "\t+ %s\n", c.B)
+		}
+	}
+}
+
+type linesByName []Line
+
+func (a linesByName) Len() int           { return len(a) }
+func (a linesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a linesByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+/*
+	Fetches a ware from any of the warehouses and scans it into a bucket.
+
+	Tar-packed kinds are streamed and hashed without unpacking, trying each
+	warehouse in turn; other kinds are materialized with the transmat.
+	With no warehouses, only the transmat's caches are looked in.
+
+	May panic with:
+
+	  - `*def.ErrWareDNE` -- if there are no warehouses, and it's not cached.
+	  - whatever the last warehouse tried (or the transmat) panicked with -- if none can provide the ware.
+*/
+func Fetch(ware def.Ware, warehouses def.WarehouseCoords, transmat rio.Transmat, log log15.Logger) *fshash.MemoryBucket {
+	kind := rio.TransmatKind(ware.Type)
+	uris := make([]rio.SiloURI, len(warehouses))
+	for i, coord := range warehouses {
+		uris[i] = rio.SiloURI(coord)
+	}
+	if len(uris) == 0 {
+		var arena rio.Arena
+		meep.Try(func() {
+			arena = transmat.Materialize(kind, rio.CommitID(ware.Hash), nil, log)
+		}, meep.TryPlan{
+			{ByType: &def.ErrWarehouseUnavailable{}, Handler: func(error) {
+				panic(&def.ErrWareDNE{Ware: ware})
+			}},
+		})
+		defer arena.Teardown()
+		return ScanPath(arena.Path())
+	}
+	if !mirror.TarPacked[kind] {
+		arena := transmat.Materialize(kind, rio.CommitID(ware.Hash), uris, log)
+		defer arena.Teardown()
+		return ScanPath(arena.Path())
+	}
+	var lastErr error
+	for _, uri := range uris {
+		var bucket *fshash.MemoryBucket
+		lastErr = meep.RecoverPanics(func() {
+			wh := mirror.OpenWarehouse(uri)
+			if err := wh.PingReadable(); err != nil {
+				panic(err)
+			}
+			stream := wh.OpenReader(rio.CommitID(ware.Hash))
+			defer stream.Close()
+			var actual rio.CommitID
+			bucket, actual = ScanPacked(stream, log)
+			if actual != rio.CommitID(ware.Hash) {
+				panic(&def.ErrHashMismatch{
+					Expected: ware,
+					Actual:   def.Ware{Type: ware.Type, Hash: string(actual)},
+					From:     def.WarehouseCoord(uri),
+				})
+			}
+		})
+		if lastErr == nil {
+			return bucket
+		}
+		log.Debug("warehouse can't provide ware", "warehouse", uri, "hash", ware.Hash, "reason", lastErr)
+	}
+	if lastErr == nil {
+		lastErr = &def.ErrWareDNE{Ware: ware}
+	}
+	panic(lastErr)
+}
@@ -0,0 +1,110 @@
+package examine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/cachedir"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+func names(changes []Change) []string {
+	var names []string
+	for _, c := range changes {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestDiff(t *testing.T) {
+	Convey("Given a scanned dir", t, testutil.WithTmpdir(func() {
+		os.Mkdir("dir", 0755)
+		ioutil.WriteFile("dir/a", []byte("apple"), 0644)
+		ioutil.WriteFile("dir/b", []byte("banana"), 0644)
+		before := ScanPath("dir")
+
+		Convey("Diffing against itself should find nothing", func() {
+			So(Diff(before, ScanPath("dir")), ShouldBeEmpty)
+		})
+
+		Convey("Changed files should be listed with both lines", func() {
+			ioutil.WriteFile("dir/a", []byte("avocado"), 0644)
+			changes := Diff(before, ScanPath("dir"))
+			So(names(changes), ShouldResemble, []string{"./a"})
+			So(changes[0].Kind, ShouldEqual, Changed)
+			So(changes[0].Attrs, ShouldContain, "content")
+			So(changes[0].A, ShouldNotEqual, "")
+			So(changes[0].B, ShouldNotEqual, "")
+			So(changes[0].A, ShouldNotEqual, changes[0].B)
+		})
+
+		Convey("Changes should name exactly the attributes that differ", func() {
+			os.Chmod("dir/b", 0600)
+			changes := Diff(before, ScanPath("dir"))
+			So(names(changes), ShouldResemble, []string{"./b"})
+			So(changes[0].Attrs, ShouldResemble, []string{"mode"})
+		})
+
+		Convey("Added and removed files should be listed with one line", func() {
+			os.Remove("dir/b")
+			ioutil.WriteFile("dir/c", []byte("cherry"), 0644)
+			changes := Diff(before, ScanPath("dir"))
+			// the dir's mtime changes too, of course.
+			So(names(changes), ShouldResemble, []string{"./", "./b", "./c"})
+			So(changes[0].Attrs, ShouldResemble, []string{"mtime"})
+			So(changes[1].Kind, ShouldEqual, Removed)
+			So(changes[1].B, ShouldEqual, "")
+			So(changes[2].Kind, ShouldEqual, Added)
+			So(changes[2].A, ShouldEqual, "")
+		})
+	}))
+}
+
+func TestFetch(t *testing.T) {
+	Convey("Given a tar ware in a warehouse", t, testutil.WithTmpdir(func(c C) {
+		log := testutil.TestLogger(c)
+		cwd, _ := os.Getwd()
+		caURI := rio.SiloURI("file+ca://" + filepath.Join(cwd, "ca"))
+		os.Mkdir("ca", 0755)
+		os.Mkdir("dir", 0755)
+		ioutil.WriteFile("dir/a", []byte("apple"), 0644)
+		transmat := tar.New("work")
+		hash := transmat.Scan(tar.Kind, "dir", []rio.SiloURI{caURI}, log)
+		ware := def.Ware{Type: string(tar.Kind), Hash: string(hash)}
+
+		Convey("It should be fetched and scanned, from whichever warehouse has it", func() {
+			bucket := Fetch(ware, def.WarehouseCoords{"file+ca:///nonexistent", def.WarehouseCoord(caURI)}, transmat, log)
+			var names []string
+			for _, l := range Lines(bucket) {
+				names = append(names, l.Name)
+			}
+			So(names, ShouldResemble, []string{"./", "./a"})
+		})
+
+		Convey("With no warehouses, cached wares should be scanned from the cache", func() {
+			cacher := cachedir.New("cache", map[rio.TransmatKind]rio.TransmatFactory{tar.Kind: tar.New})
+			cacher.Materialize(tar.Kind, hash, []rio.SiloURI{caURI}, log).Teardown()
+			bucket := Fetch(ware, nil, cacher, log)
+			So(Lines(bucket), ShouldHaveLength, 2)
+		})
+
+		Convey("Wares nowhere to be found should be reported", func() {
+			err := meep.RecoverPanics(func() {
+				Fetch(def.Ware{Type: string(tar.Kind), Hash: "nonexistent"}, def.WarehouseCoords{def.WarehouseCoord(caURI)}, transmat, log)
+			})
+			So(err, ShouldNotBeNil)
+			err = meep.RecoverPanics(func() {
+				Fetch(ware, nil, transmat, log)
+			})
+			So(err, ShouldHaveSameTypeAs, &def.ErrWareDNE{})
+		})
+	}))
+}
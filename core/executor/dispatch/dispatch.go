@@ -1,35 +1,91 @@
 package executordispatch
 
 import (
+	"fmt"
 	"path/filepath"
+	"strings"
 
 	"go.polydawn.net/repeatr/core/executor"
-	"go.polydawn.net/repeatr/core/executor/impl/chroot"
-	"go.polydawn.net/repeatr/core/executor/impl/null"
-	"go.polydawn.net/repeatr/core/executor/impl/runc"
+	_ "go.polydawn.net/repeatr/core/executor/impl/chroot"
+	_ "go.polydawn.net/repeatr/core/executor/impl/null"
+	_ "go.polydawn.net/repeatr/core/executor/impl/runc"
 	"go.polydawn.net/repeatr/core/jank"
 )
 
-// TODO: This should not require a global string -> class map :|
-// Should attempt to reflect-find, trying main package name first.
-// Will make simpler to use extended transports, etc.
+/*
+	The name which selects the best executor usable on this host.
+*/
+const Auto = "auto"
 
+/*
+	Get a configured executor by name (or `Auto`).
+
+	Naming an executor explicitly skips its probe: if you asked for it,
+	you get it, and any problems will be reported when it runs.
+
+	May panic with:
+
+	  - `executor.ConfigError` -- if there's no executor by that name,
+	    or if `Auto` was requested and no executor is usable.
+*/
 func Get(desire string) executor.Executor {
-	var execr executor.Executor
-
-	switch desire {
-	case "null":
-		execr = &null.Executor{}
-	case "chroot":
-		execr = &chroot.Executor{}
-	case "runc":
-		execr = &runc.Executor{}
-	default:
-		panic(executor.ConfigError.New("No such executor %s", desire))
+	var reg executor.Registration
+	if desire == Auto {
+		reg = Best()
+	} else {
+		var ok bool
+		reg, ok = executor.Lookup(desire)
+		if !ok {
+			panic(executor.ConfigError.New("No such executor %s", desire))
+		}
 	}
 
+	execr := reg.New()
+
 	// Set the base path to operate from
-	execr.Configure(filepath.Join(jank.Base(), "executor", desire))
+	execr.Configure(filepath.Join(jank.Base(), "executor", reg.Name))
 
 	return execr
 }
+
+/*
+	Returns the most preferred executor which reports itself usable
+	on this host.
+
+	May panic with:
+
+	  - `executor.ConfigError` -- if no executor is usable, listing why.
+*/
+func Best() executor.Registration {
+	var reasons []string
+	for _, avail := range Survey() {
+		if avail.Priority < 0 {
+			continue
+		}
+		if avail.Err == nil {
+			return avail.Registration
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %s", avail.Name, avail.Err))
+	}
+	panic(executor.ConfigError.New("No usable executor on this host (%s)", strings.Join(reasons, "; ")))
+}
+
+/*
+	An executor registration, and the result of probing it.
+*/
+type Availability struct {
+	executor.Registration
+	Err error // nil if usable.
+}
+
+/*
+	Probe all registered executors, in order of preference.
+*/
+func Survey() []Availability {
+	regs := executor.Registrations()
+	avails := make([]Availability, len(regs))
+	for i, reg := range regs {
+		avails[i] = Availability{reg, reg.Usable()}
+	}
+	return avails
+}
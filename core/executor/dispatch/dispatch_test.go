@@ -0,0 +1,41 @@
+package executordispatch
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"go.polydawn.net/repeatr/core/executor"
+	"go.polydawn.net/repeatr/core/executor/impl/null"
+)
+
+func TestRegistry(t *testing.T) {
+	Convey("The builtin executors should all be registered", t, func() {
+		for _, name := range []string{"runc", "chroot", "null"} {
+			_, ok := executor.Lookup(name)
+			So(ok, ShouldBeTrue)
+		}
+
+		Convey("In order of preference", func() {
+			var names []string
+			for _, avail := range Survey() {
+				names = append(names, avail.Name)
+			}
+			So(names, ShouldResemble, []string{"runc", "chroot", "null"})
+		})
+
+		Convey("Getting one by name should work", func() {
+			So(Get("null"), ShouldHaveSameTypeAs, &null.Executor{})
+		})
+
+		Convey("Auto should never pick the null executor", func() {
+			for _, avail := range Survey() {
+				if avail.Err != nil || avail.Priority < 0 {
+					continue
+				}
+				So(Best().Name, ShouldNotEqual, "null")
+				break
+			}
+		})
+	})
+}
@@ -23,6 +23,15 @@ import (
 
 var _ executor.Executor = &Executor{} // interface assertion
 
+func init() {
+	executor.Register(executor.Registration{
+		Name:     "chroot",
+		New:      func() executor.Executor { return &Executor{} },
+		Probe:    util.ProbeRoot, // chroot(2) requires CAP_SYS_CHROOT.
+		Priority: 10,
+	})
+}
+
 type Executor struct {
 	workspacePath string
 }
@@ -127,7 +136,7 @@ func (e *Executor) Execute(f def.Formula, j executor.Job, d string, result *exec
 
 	// set env.
 	// initialization already required by earlier 'validate' calls.
-	cmd.Env = envToSlice(f.Action.Env)
+	cmd.Env = f.Action.Env.Slice(f.Action.EnvRotation)
 
 	cmd.Stdin = stdin
 	cmd.Stdout = outS
@@ -169,13 +178,3 @@ func (e *Executor) Execute(f def.Formula, j executor.Job, d string, result *exec
 	// Save outputs
 	result.Outputs = util.PreserveOutputs(transmat, f.Outputs, rootfs, journal)
 }
-
-func envToSlice(env map[string]string) []string {
-	rv := make([]string, len(env))
-	i := 0
-	for k, v := range env {
-		rv[i] = k + "=" + v
-		i++
-	}
-	return rv
-}
@@ -18,6 +18,15 @@ import (
 
 var _ executor.Executor = &Executor{}
 
+func init() {
+	// Never picked automatically: it doesn't really run anything.
+	executor.Register(executor.Registration{
+		Name:     "null",
+		New:      func() executor.Executor { return &Executor{} },
+		Priority: -1,
+	})
+}
+
 type Mode int
 
 const (
@@ -26,13 +26,8 @@ func EmitRuncConfigStruct(frm def.Formula, job executor.Job, rootPath string, tt
 				"additionalGids": nil,
 			},
 			"args": frm.Action.Entrypoint,
-			"env": func() (env []string) {
-				for k, v := range frm.Action.Env {
-					env = append(env, k+"="+v)
-				}
-				return
-			}(),
-			"cwd": frm.Action.Cwd,
+			"env":  frm.Action.Env.Slice(frm.Action.EnvRotation),
+			"cwd":  frm.Action.Cwd,
 		},
 		"root": map[string]interface{}{
 			"path":     rootPath,
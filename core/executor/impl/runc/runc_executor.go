@@ -28,6 +28,31 @@ import (
 // interface assertion
 var _ executor.Executor = &Executor{}
 
+func init() {
+	executor.Register(executor.Registration{
+		Name:     "runc",
+		New:      func() executor.Executor { return &Executor{} },
+		Probe:    probe,
+		Priority: 20,
+	})
+}
+
+/*
+	Runc needs root, a kernel that will let it create namespaces,
+	and the runc binary itself.  That's an asset, fetched on first use;
+	probes don't touch the network, so until then (e.g. until someone runs
+	with `--executor=runc`) runc isn't picked automatically.
+*/
+func probe() error {
+	if err := util.ProbeRoot(); err != nil {
+		return err
+	}
+	if err := util.ProbeNamespaces("mnt", "pid", "ipc", "uts", "net"); err != nil {
+		return err
+	}
+	return assets.Cached("runc")
+}
+
 type Executor struct {
 	workspacePath string
 }
@@ -0,0 +1,97 @@
+package executor
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+	Registration describes an executor implementation to the registry.
+
+	Executor packages should call `Register` from an `init` function;
+	importing the package (even as `_`) is then enough to make it available
+	by name.  (The `executor/dispatch` package imports all the builtins.)
+*/
+type Registration struct {
+	// Name used to select this executor, e.g. on the command line.
+	Name string
+
+	// Produces a fresh, unconfigured executor.
+	New func() Executor
+
+	// Checks whether this executor can actually work on this host.
+	// Returns nil if it can; otherwise an error describing the problem
+	// in terms an operator can act on (e.g. "requires root").
+	// May be nil, meaning always usable.
+	Probe func() error
+
+	// When selecting an executor automatically, higher priorities are
+	// preferred.  Negative priorities are never selected automatically
+	// (this is for mocks and other executors that don't really run things).
+	Priority int
+}
+
+var registry = struct {
+	sync.Mutex
+	m map[string]Registration
+}{m: make(map[string]Registration)}
+
+/*
+	Make an executor implementation available by name.
+
+	Panics with `ConfigError` if the name is already taken.
+*/
+func Register(reg Registration) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, exists := registry.m[reg.Name]; exists {
+		panic(ConfigError.New("executor %q registered twice", reg.Name))
+	}
+	registry.m[reg.Name] = reg
+}
+
+/*
+	Look up an executor registration by name.
+*/
+func Lookup(name string) (Registration, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	reg, ok := registry.m[name]
+	return reg, ok
+}
+
+/*
+	Returns all registered executors, most preferred first
+	(by priority; ties are broken by name).
+*/
+func Registrations() []Registration {
+	registry.Lock()
+	defer registry.Unlock()
+	regs := make([]Registration, 0, len(registry.m))
+	for _, reg := range registry.m {
+		regs = append(regs, reg)
+	}
+	sort.Sort(registrationsByPreference(regs))
+	return regs
+}
+
+/*
+	Run the registration's probe; treats a nil probe as a pass.
+*/
+func (reg Registration) Usable() error {
+	if reg.Probe == nil {
+		return nil
+	}
+	return reg.Probe()
+}
+
+type registrationsByPreference []Registration
+
+func (a registrationsByPreference) Len() int      { return len(a) }
+func (a registrationsByPreference) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a registrationsByPreference) Less(i, j int) bool {
+	if a[i].Priority != a[j].Priority {
+		return a[i].Priority > a[j].Priority
+	}
+	return a[i].Name < a[j].Name
+}
@@ -22,6 +22,9 @@ import (
 	"go.polydawn.net/repeatr/rio/transmat/impl/file"
 	"go.polydawn.net/repeatr/rio/transmat/impl/git"
 	"go.polydawn.net/repeatr/rio/transmat/impl/gs"
+	"go.polydawn.net/repeatr/rio/transmat/impl/nar"
+	"go.polydawn.net/repeatr/rio/transmat/impl/oci"
+	"go.polydawn.net/repeatr/rio/transmat/impl/plugin"
 	"go.polydawn.net/repeatr/rio/transmat/impl/s3"
 	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
 	"go.polydawn.net/repeatr/rio/transmat/mux"
@@ -35,61 +38,128 @@ import (
 	you'll need to assemble your own Transmat instead of this one --
 	`rio.DispatchingTransmat` is good for composing them so you can still
 	use one interface to get any kind of data you want.
+	(Or, write a plugin executable: any `repeatr-transmat-<kind>` found on
+	the `$PATH` is included here automatically; see the `plugin` package.)
 */
 func DefaultTransmat() rio.Transmat {
-	workDir := filepath.Join(jank.Base(), "io")
-	dirCacher := cachedir.New(filepath.Join(workDir, "dircacher"), map[rio.TransmatKind]rio.TransmatFactory{
+	dirCacher := cachedir.New(cacheDir("dir"), map[rio.TransmatKind]rio.TransmatFactory{
 		rio.TransmatKind("dir"): dir.New,
 		rio.TransmatKind("tar"): tar.New,
 		rio.TransmatKind("s3"):  s3.New,
 		rio.TransmatKind("gs"):  gs.New,
 	})
-	fileCacher := cachedir.New(filepath.Join(workDir, "filecacher"), map[rio.TransmatKind]rio.TransmatFactory{
+	ociCacher := cachedir.New(cacheDir("oci"), map[rio.TransmatKind]rio.TransmatFactory{
+		rio.TransmatKind("oci"): oci.New,
+	})
+	narCacher := cachedir.New(cacheDir("nar"), map[rio.TransmatKind]rio.TransmatFactory{
+		rio.TransmatKind("nar"): nar.New,
+	})
+	fileCacher := cachedir.New(cacheDir("file"), map[rio.TransmatKind]rio.TransmatFactory{
 		rio.TransmatKind("file"): file.New,
 	})
-	universalTransmat := dispatch.New(map[rio.TransmatKind]rio.Transmat{
+	transmats := map[rio.TransmatKind]rio.Transmat{
 		rio.TransmatKind("dir"):  dirCacher,
 		rio.TransmatKind("tar"):  dirCacher,
 		rio.TransmatKind("s3"):   dirCacher,
 		rio.TransmatKind("gs"):   dirCacher,
 		rio.TransmatKind("file"): fileCacher,
-		rio.TransmatKind("git"):  git.New(filepath.Join(workDir, "git")),
-	})
-	return universalTransmat
+		rio.TransmatKind("oci"):  ociCacher,
+		rio.TransmatKind("nar"):  narCacher,
+		rio.TransmatKind("git"):  git.New(gitWorkDir()),
+	}
+	// Plugins get a cache each: we can't know which of them share a hash space.
+	//  Builtins always win; plugins can't shadow them.
+	for kind, binPath := range plugin.Discover() {
+		if _, exists := transmats[kind]; exists {
+			continue
+		}
+		transmats[kind] = cachedir.New(cacheDir(kind), map[rio.TransmatKind]rio.TransmatFactory{
+			kind: plugin.NewFactory(kind, binPath),
+		})
+	}
+	return dispatch.New(transmats)
+}
+
+// The work dir of `DefaultTransmat`'s git transmat.
+func gitWorkDir() string {
+	return filepath.Join(jank.Base(), "io", "git")
+}
+
+/*
+	The cache dir `DefaultTransmat` keeps wares of the kind in.
+	Kinds sharing a hash space share a cache.
+*/
+func cacheDir(kind rio.TransmatKind) string {
+	workDir := filepath.Join(jank.Base(), "io")
+	switch kind {
+	case "dir", "tar", "s3", "gs":
+		return filepath.Join(workDir, "dircacher")
+	case "file", "oci", "nar":
+		return filepath.Join(workDir, string(kind)+"cacher")
+	default:
+		return filepath.Join(workDir, "plugincacher", string(kind))
+	}
+}
+
+/*
+	Reports whether a ware is already in `DefaultTransmat`'s caches, so that
+	materializing it won't need to contact any warehouse.
+
+	Git wares are asked of the git transmat, which counts a commit already
+	in any remote's object store (see `git.Cached`).
+*/
+func IsCached(kind rio.TransmatKind, dataHash rio.CommitID) bool {
+	if dataHash == "" {
+		return false
+	}
+	if kind == git.Kind {
+		return git.Cached(gitWorkDir(), dataHash)
+	}
+	_, err := os.Stat(filepath.Join(cacheDir(kind), "committed", string(dataHash)))
+	return err == nil
 }
 
 func BestAssembler() rio.Assembler {
 	if bestAssembler == nil {
-		bestAssembler = determineBestAssembler()
+		bestAssembler, bestAssemblerName = determineBestAssembler()
 	}
 	return bestAssembler
 }
 
+/*
+	Names the placer `BestAssembler` uses: "overlay", "aufs", or "copy".
+*/
+func BestAssemblerName() string {
+	BestAssembler()
+	return bestAssemblerName
+}
+
 var bestAssembler rio.Assembler
+var bestAssemblerName string
 
-func determineBestAssembler() rio.Assembler {
+func determineBestAssembler() (rio.Assembler, string) {
 	if os.Getuid() != 0 {
 		// Can't mount without root.
 		fmt.Fprintf(os.Stderr, "WARN: using slow fs assembly system: need root privs to use faster systems.\n")
-		return placer.NewAssembler(copy.CopyingPlacer)
+		return placer.NewAssembler(copy.CopyingPlacer), "copy"
 	}
 	if os.Getenv("TRAVIS") != "" {
 		// Travis's own virtualization denies mounting.  whee.
 		fmt.Fprintf(os.Stderr, "WARN: using slow fs assembly system: travis' environment blocks faster systems.\n")
-		return placer.NewAssembler(copy.CopyingPlacer)
+		return placer.NewAssembler(copy.CopyingPlacer), "copy"
 	}
 	// If we *can* mount... (use overlay)
 	if isFSAvailable("overlay") {
-		return placer.NewAssembler(overlay.NewOverlayPlacer(filepath.Join(jank.Base(), "overlay")))
+		return placer.NewAssembler(overlay.NewOverlayPlacer(filepath.Join(jank.Base(), "overlay"))), "overlay"
 	}
 	// If we're old and lame but can still mount... (use aufs)
 	if isFSAvailable("aufs") {
 		// if AUFS is installed, AUFS+Bind is The Winner.
-		return placer.NewAssembler(aufs.NewAufsPlacer(filepath.Join(jank.Base(), "aufs")))
+		return placer.NewAssembler(aufs.NewAufsPlacer(filepath.Join(jank.Base(), "aufs"))), "aufs"
 	}
 	// last fallback... :( copy it is
 	fmt.Fprintf(os.Stderr, "WARN: using slow fs assembly system: install AUFS to use faster systems.\n")
-	return placer.NewAssembler(copy.CopyingPlacer)
+	return placer.NewAssembler(copy.CopyingPlacer), "copy"
 	// TODO we should be able to use copy for fallback RW isolator but still bind for RO.  write a new placer for that.  or really, maybe bind should chain.
 }
 
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	How hard to try each warehouse before moving on to the next.
+
+	Unavailability, and warehouse problems marked transient (e.g. an
+	http 503), are retried; after `Attempts` tries, we fail over to the
+	next warehouse.  Other problems, and wares that are missing, corrupt,
+	or don't match their hash, fail over immediately: asking again won't help.
+*/
+type RetryPolicy struct {
+	Attempts   int           // per warehouse, including the first.
+	Backoff    time.Duration // wait before the first retry; doubled for each retry after that.
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    1 * time.Second,
+	MaxBackoff: 30 * time.Second,
+}
+
+var sleep = time.Sleep // swappable for tests.
+
+/*
+	Materialize a ware, trying the warehouses one at a time in order
+	and retrying transient failures according to the policy.
+
+	If `cached` reports the ware is already in the transmat's caches
+	(`IsCached` does, for `DefaultTransmat`), the transmat is asked for it
+	without being offered any warehouses, and the hit is reported as being
+	served by no warehouse.  (Should the ware vanish from the cache in the
+	meanwhile, we carry on to the warehouses.)  A nil `cached` skips this.
+
+	Returns the arena and the warehouse that served it (empty for a cache hit).
+
+	May panic with whatever error the last warehouse tried raised;
+	or, if there were no warehouses, `*def.ErrWarehouseUnavailable`.
+	Errors that aren't about warehouses (e.g. `*rio.ErrInternal`) are raised
+	immediately without trying further.
+*/
+func MaterializeWithFailover(
+	transmat rio.Transmat,
+	kind rio.TransmatKind,
+	dataHash rio.CommitID,
+	warehouses []rio.SiloURI,
+	cached func(rio.TransmatKind, rio.CommitID) bool,
+	policy RetryPolicy,
+	journal log15.Logger,
+	options ...rio.MaterializerConfigurer,
+) (rio.Arena, rio.SiloURI) {
+	// Try the caches.
+	var arena rio.Arena
+	var lastErr error = &def.ErrWarehouseUnavailable{
+		Msg:    "No warehouse coords configured!",
+		During: "fetch",
+	}
+	if cached != nil && cached(kind, dataHash) {
+		meep.Try(func() {
+			arena = transmat.Materialize(kind, dataHash, nil, journal, options...)
+		}, meep.TryPlan{
+			{ByType: &def.ErrWarehouseUnavailable{}, Handler: func(e error) {
+				journal.Info("Cached ware went missing, trying warehouses", "error", e)
+			}},
+		})
+		if arena != nil {
+			return arena, ""
+		}
+	}
+
+	for _, wh := range warehouses {
+		backoff := policy.Backoff
+		for attempt := 1; ; attempt++ {
+			retry := false
+			meep.Try(func() {
+				arena = transmat.Materialize(kind, dataHash, []rio.SiloURI{wh}, journal, options...)
+			}, meep.TryPlan{
+				{ByType: &def.ErrWarehouseUnavailable{}, Handler: func(e error) {
+					lastErr = e
+					retry = true
+				}},
+				{ByType: &def.ErrWarehouseProblem{}, Handler: func(e error) {
+					lastErr = e
+					retry = e.(*def.ErrWarehouseProblem).Transient
+				}},
+				{ByType: &def.ErrWareDNE{}, Handler: func(e error) {
+					lastErr = e
+				}},
+				{ByType: &def.ErrHashMismatch{}, Handler: func(e error) {
+					lastErr = e
+				}},
+				{ByType: &def.ErrWareCorrupt{}, Handler: func(e error) {
+					lastErr = e
+				}},
+			})
+			if arena != nil {
+				return arena, wh
+			}
+			if !retry || attempt >= policy.Attempts {
+				journal.Warn("Warehouse failed, trying next",
+					"warehouse", wh,
+					"attempts", attempt,
+					"error", lastErr,
+				)
+				break
+			}
+			journal.Info("Warehouse failed, retrying",
+				"warehouse", wh,
+				"attempt", attempt,
+				"backoff", backoff.Seconds(),
+				"error", lastErr,
+			)
+			sleep(backoff)
+			backoff *= 2
+			if backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		}
+	}
+	panic(lastErr)
+}
@@ -0,0 +1,165 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	Fails according to a script: each warehouse pops an error off its list
+	per attempt, and serves the ware once its list is empty.
+	Asking with no warehouses is a cache miss unless `cached`; `isCached`
+	is what it claims to `MaterializeWithFailover`.
+*/
+type scriptedTransmat struct {
+	cached   bool
+	isCached bool
+	script   map[rio.SiloURI][]error
+	attempts []rio.SiloURI
+}
+
+func (t *scriptedTransmat) Materialize(kind rio.TransmatKind, dataHash rio.CommitID, siloURIs []rio.SiloURI, log log15.Logger, options ...rio.MaterializerConfigurer) rio.Arena {
+	if len(siloURIs) == 0 {
+		t.attempts = append(t.attempts, "(cache)")
+		if t.cached {
+			return scriptedArena{}
+		}
+		panic(&def.ErrWarehouseUnavailable{Msg: "No warehouse coords configured!", During: "fetch"})
+	}
+	wh := siloURIs[0]
+	t.attempts = append(t.attempts, wh)
+	if errs := t.script[wh]; len(errs) > 0 {
+		t.script[wh] = errs[1:]
+		panic(errs[0])
+	}
+	return scriptedArena{}
+}
+
+func (t *scriptedTransmat) claimsCached(rio.TransmatKind, rio.CommitID) bool {
+	return t.isCached
+}
+
+func (t *scriptedTransmat) Scan(kind rio.TransmatKind, subjectPath string, siloURIs []rio.SiloURI, log log15.Logger, options ...rio.MaterializerConfigurer) rio.CommitID {
+	panic("not used")
+}
+
+type scriptedArena struct{}
+
+func (scriptedArena) Path() string       { return "" }
+func (scriptedArena) Hash() rio.CommitID { return "" }
+func (scriptedArena) Teardown()          {}
+
+func TestMaterializeWithFailover(t *testing.T) {
+	Convey("Given a retry policy", t, func(c C) {
+		policy := RetryPolicy{Attempts: 3, Backoff: time.Second, MaxBackoff: 3 * time.Second}
+		var slept []time.Duration
+		sleep = func(d time.Duration) { slept = append(slept, d) }
+		defer func() { sleep = time.Sleep }()
+		unavailable := &def.ErrWarehouseUnavailable{Msg: "down", During: "fetch"}
+		problem := &def.ErrWarehouseProblem{Msg: "http status 503", During: "fetch", Transient: true}
+		lfsMissing := &def.ErrWarehouseProblem{Msg: "lfs object not found", During: "fetch"}
+		dne := &def.ErrWareDNE{}
+		mismatch := &def.ErrHashMismatch{}
+		corrupt := &def.ErrWareCorrupt{}
+		materialize := func(transmat *scriptedTransmat) rio.SiloURI {
+			_, servedBy := MaterializeWithFailover(transmat, "tar", "hash", []rio.SiloURI{"wh1", "wh2"}, transmat.claimsCached, policy, testutil.TestLogger(c))
+			return servedBy
+		}
+
+		Convey("Cache hits should be served by no warehouse", func() {
+			transmat := &scriptedTransmat{cached: true, isCached: true}
+			So(materialize(transmat), ShouldEqual, "")
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"(cache)"})
+		})
+
+		Convey("Cache misses should go straight to the warehouses", func() {
+			transmat := &scriptedTransmat{}
+			So(materialize(transmat), ShouldEqual, "wh1")
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"wh1"})
+		})
+
+		Convey("Wares gone from the cache should be fetched from the warehouses", func() {
+			transmat := &scriptedTransmat{isCached: true}
+			So(materialize(transmat), ShouldEqual, "wh1")
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"(cache)", "wh1"})
+		})
+
+		Convey("No warehouses and no cache should be unavailable", func() {
+			transmat := &scriptedTransmat{}
+			err := meep.RecoverPanics(func() {
+				MaterializeWithFailover(transmat, "tar", "hash", nil, transmat.claimsCached, policy, testutil.TestLogger(c))
+			})
+			So(err, ShouldHaveSameTypeAs, &def.ErrWarehouseUnavailable{})
+		})
+
+		Convey("Transient failures should be retried with backoff", func() {
+			transmat := &scriptedTransmat{script: map[rio.SiloURI][]error{
+				"wh1": {problem, unavailable},
+			}}
+			So(materialize(transmat), ShouldEqual, "wh1")
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"wh1", "wh1", "wh1"})
+			So(slept, ShouldResemble, []time.Duration{time.Second, 2 * time.Second})
+		})
+
+		Convey("Persistent failures should fail over to the next warehouse", func() {
+			transmat := &scriptedTransmat{script: map[rio.SiloURI][]error{
+				"wh1": {problem, problem, problem, problem},
+			}}
+			So(materialize(transmat), ShouldEqual, "wh2")
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"wh1", "wh1", "wh1", "wh2"})
+		})
+
+		Convey("Missing and mismatched wares should fail over immediately", func() {
+			transmat := &scriptedTransmat{script: map[rio.SiloURI][]error{
+				"wh1": {mismatch},
+			}}
+			So(materialize(transmat), ShouldEqual, "wh2")
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"wh1", "wh2"})
+			So(slept, ShouldBeEmpty)
+		})
+
+		Convey("Corrupt wares should fail over immediately", func() {
+			transmat := &scriptedTransmat{script: map[rio.SiloURI][]error{
+				"wh1": {corrupt},
+			}}
+			So(materialize(transmat), ShouldEqual, "wh2")
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"wh1", "wh2"})
+			So(slept, ShouldBeEmpty)
+		})
+
+		Convey("Problems not marked transient should fail over immediately", func() {
+			transmat := &scriptedTransmat{script: map[rio.SiloURI][]error{
+				"wh1": {lfsMissing},
+			}}
+			So(materialize(transmat), ShouldEqual, "wh2")
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"wh1", "wh2"})
+			So(slept, ShouldBeEmpty)
+		})
+
+		Convey("When every warehouse fails, the last error should be raised", func() {
+			transmat := &scriptedTransmat{script: map[rio.SiloURI][]error{
+				"wh1": {mismatch},
+				"wh2": {dne},
+			}}
+			err := meep.RecoverPanics(func() { materialize(transmat) })
+			So(err, ShouldEqual, dne)
+		})
+
+		Convey("Other errors should be raised without trying further", func() {
+			transmat := &scriptedTransmat{script: map[rio.SiloURI][]error{
+				"wh1": {&rio.ErrInternal{Msg: "bad"}},
+			}}
+			err := meep.RecoverPanics(func() { materialize(transmat) })
+			So(err, ShouldHaveSameTypeAs, &rio.ErrInternal{})
+			So(transmat.attempts, ShouldResemble, []rio.SiloURI{"wh1"})
+		})
+	})
+}
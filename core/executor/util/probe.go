@@ -0,0 +1,46 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Probe helpers for executor registrations.
+	Each returns nil if the host is suitable, or an error describing
+	what's missing in terms an operator can act on.
+*/
+
+/*
+	Checks the process is running as root.
+	Most containment mechanisms simply cannot be set up without it.
+*/
+func ProbeRoot() error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("requires root (running as uid %d)", os.Getuid())
+	}
+	return nil
+}
+
+/*
+	Checks we're allowed to create the named namespace kinds (e.g. "mnt",
+	"pid").  The kernel offering them (they're listed in `/proc/self/ns`)
+	isn't enough: seccomp policies and `user.max_*_namespaces` limits can
+	still refuse, so this actually launches a process in a fresh set of them.
+*/
+func ProbeNamespaces(kinds ...string) error {
+	var missing []string
+	for _, kind := range kinds {
+		if _, err := os.Stat(filepath.Join("/proc/self/ns", kind)); err != nil {
+			missing = append(missing, kind)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("kernel lacks namespace support for %v", missing)
+	}
+	if err := probeUnshare(kinds); err != nil {
+		return fmt.Errorf("not permitted to create namespaces %v: %s", kinds, err)
+	}
+	return nil
+}
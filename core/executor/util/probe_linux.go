@@ -0,0 +1,39 @@
+// +build linux
+
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+var cloneFlags = map[string]uintptr{
+	"mnt":  syscall.CLONE_NEWNS,
+	"pid":  syscall.CLONE_NEWPID,
+	"ipc":  syscall.CLONE_NEWIPC,
+	"uts":  syscall.CLONE_NEWUTS,
+	"net":  syscall.CLONE_NEWNET,
+	"user": syscall.CLONE_NEWUSER,
+}
+
+/*
+	Clones a child into new namespaces of each kind, running /bin/true
+	in them: if that exits cleanly, the namespaces are ours to make.
+*/
+func probeUnshare(kinds []string) error {
+	var flags uintptr
+	for _, kind := range kinds {
+		flag, ok := cloneFlags[kind]
+		if !ok {
+			return fmt.Errorf("unknown namespace kind %q", kind)
+		}
+		flags |= flag
+	}
+	cmd := exec.Command("/bin/true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: flags,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	return cmd.Run()
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package util
+
+import (
+	"fmt"
+)
+
+func probeUnshare(kinds []string) error {
+	return fmt.Errorf("namespaces unsupported on this platform")
+}
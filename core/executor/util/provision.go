@@ -3,6 +3,7 @@ package util
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/inconshreveable/log15"
@@ -37,14 +38,21 @@ func ProvisionInputs(transmat rio.Transmat, inputs def.InputGroup, journal log15
 					warehouses[i] = rio.SiloURI(wh)
 				}
 				// invoke transmat (blocking, potentially long time)
-				arena := transmat.Materialize(
+				arena, servedBy := MaterializeWithFailover(
+					transmat,
 					rio.TransmatKind(in.Type),
 					rio.CommitID(in.Hash),
 					warehouses,
+					IsCached,
+					DefaultRetryPolicy,
 					journal,
 				)
 				// submit report
+				if servedBy == "" {
+					servedBy = "(cache)"
+				}
 				journal.Info("Finished materialize",
+					"warehouse", servedBy,
 					"elapsed", time.Now().Sub(started).Seconds(),
 				)
 				fsGather <- map[string]materializerReport{
@@ -92,11 +100,30 @@ func AssembleFilesystem(
 ) rio.Assembly {
 	started := time.Now()
 	journal.Info("All inputs acquired... starting assembly")
-	// process inputs
-	assemblyParts := make([]rio.AssemblyPart, 0, len(inputArenas))
+	sourcePaths := make(map[string]string, len(inputArenas))
 	for name, arena := range inputArenas {
+		sourcePaths[name] = arena.Path()
+	}
+	assemblyParts := AssemblyParts(inputs, sourcePaths, hostMounts)
+	// assemmmmmmmmblllle
+	assembly := assemblerFn(rootPath, assemblyParts)
+	journal.Info("Assembly complete!",
+		"elapsed", time.Now().Sub(started).Seconds(),
+	)
+	return assembly
+}
+
+/*
+	Lists the parts a filesystem is assembled from -- each input (from the
+	given source paths, by input name) and each host mount -- in the order
+	the assembler places them: parents before the paths mounted inside them.
+*/
+func AssemblyParts(inputs def.InputGroup, sourcePaths map[string]string, hostMounts []def.Mount) []rio.AssemblyPart {
+	// process inputs
+	assemblyParts := make([]rio.AssemblyPart, 0, len(sourcePaths)+len(hostMounts))
+	for name, sourcePath := range sourcePaths {
 		assemblyParts = append(assemblyParts, rio.AssemblyPart{
-			SourcePath: arena.Path(),
+			SourcePath: sourcePath,
 			TargetPath: inputs[name].MountPath,
 			Writable:   true, // TODO input config should have a word about this
 		})
@@ -110,12 +137,8 @@ func AssembleFilesystem(
 			BareMount:  true,
 		})
 	}
-	// assemmmmmmmmblllle
-	assembly := assemblerFn(rootPath, assemblyParts)
-	journal.Info("Assembly complete!",
-		"elapsed", time.Now().Sub(started).Seconds(),
-	)
-	return assembly
+	sort.Sort(rio.AssemblyPartsByPath(assemblyParts))
+	return assemblyParts
 }
 
 type materializerReport struct {
@@ -154,6 +177,7 @@ func PreserveOutputs(transmat rio.Transmat, outputs def.OutputGroup, rootfs stri
 			)
 			out.Filters.InitDefaultsOutput()
 			filterOptions := rio.ConvertFilterConfig(*out.Filters)
+			filterOptions = append(filterOptions, rio.UseCompression(out.Compress))
 			scanPath := filepath.Join(rootfs, out.MountPath)
 			started := time.Now()
 			journal.Info("Starting scan")
@@ -0,0 +1,201 @@
+/*
+	Fetches the inputs of formulas (or of whole pipelines) into the local
+	caches ahead of time, so that later runs don't wait on warehouses.
+	Nothing is assembled, and nothing is run.
+*/
+package fetch
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/core/executor/util"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	A ware to fetch, the warehouses it may be fetched from,
+	and the inputs that need it.
+*/
+type Want struct {
+	Ware       def.Ware            `json:"ware"`
+	Warehouses def.WarehouseCoords `json:"silo,omitempty"`
+	Inputs     []string            `json:"inputs"` // input names; "<step>.<input>" for pipelines.
+}
+
+/*
+	Lists the wares the inputs of a formula need.
+*/
+func FormulaWants(frm *def.Formula) []Want {
+	g := gather{}
+	for _, name := range sortedInputNames(frm.Inputs) {
+		g.want(name, frm.Inputs[name])
+	}
+	return g.list()
+}
+
+/*
+	Lists the wares the unwired inputs of every step of a pipeline need.
+	(Wired inputs are whatever upstream steps produce, so there's nothing
+	to fetch for them until those steps have run.)
+*/
+func PipelineWants(p *def.Pipeline) []Want {
+	g := gather{}
+	stepNames := make([]string, 0, len(p.Steps))
+	for stepName := range p.Steps {
+		stepNames = append(stepNames, stepName)
+	}
+	sort.Strings(stepNames)
+	for _, stepName := range stepNames {
+		step := p.Steps[stepName]
+		for _, name := range sortedInputNames(step.Formula.Inputs) {
+			if _, wired := step.Wire[name]; wired {
+				continue
+			}
+			g.want(stepName+"."+name, step.Formula.Inputs[name])
+		}
+	}
+	return g.list()
+}
+
+func sortedInputNames(inputs def.InputGroup) []string {
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+	Collects wants, merging inputs that need the same ware,
+	so that each is fetched only once (from any of their warehouses).
+*/
+type gather map[def.Ware]*Want
+
+func (g gather) want(input string, in *def.Input) {
+	ware := def.Ware{Type: in.Type, Hash: in.Hash}
+	w := g[ware]
+	if w == nil {
+		w = &Want{Ware: ware}
+		g[ware] = w
+	}
+	w.Inputs = append(w.Inputs, input)
+	for _, coord := range in.Warehouses {
+		if !hasCoord(w.Warehouses, coord) {
+			w.Warehouses = append(w.Warehouses, coord)
+		}
+	}
+}
+
+func (g gather) list() []Want {
+	wants := make([]Want, 0, len(g))
+	for _, w := range g {
+		wants = append(wants, *w)
+	}
+	sort.Sort(wantsByInput(wants))
+	return wants
+}
+
+func hasCoord(coords def.WarehouseCoords, coord def.WarehouseCoord) bool {
+	for _, c := range coords {
+		if c == coord {
+			return true
+		}
+	}
+	return false
+}
+
+type wantsByInput []Want
+
+func (a wantsByInput) Len() int           { return len(a) }
+func (a wantsByInput) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a wantsByInput) Less(i, j int) bool { return a[i].Inputs[0] < a[j].Inputs[0] }
+
+/*
+	The outcome of fetching one want.
+*/
+type Result struct {
+	Want
+	ServedBy def.WarehouseCoord `json:"servedBy,omitempty"` // blank if it was already cached.
+	Elapsed  time.Duration      `json:"elapsed"`
+	Err      error              `json:"-"`
+}
+
+/*
+	Called as each fetch finishes, with the number finished so far
+	(this one included) and the total.  Calls are never concurrent.
+*/
+type Progress func(result Result, done int, total int)
+
+/*
+	Fetches every want, up to `parallel` at a time, with
+	`util.MaterializeWithFailover` -- trying each warehouse in turn,
+	with retries, unless `cached` says the transmat already has it.
+	With `util.DefaultTransmat` (and `util.IsCached`), the wares are left
+	in the local caches.
+
+	Returns a result for every want, in the same order.  Failures don't stop
+	the other fetches; they're reported in each result's `Err`.
+*/
+func Fetch(wants []Want, transmat rio.Transmat, cached func(rio.TransmatKind, rio.CommitID) bool, parallel int, progress Progress, log log15.Logger) []Result {
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]Result, len(wants))
+	finished := make(chan int)
+	slots := make(chan struct{}, parallel)
+	for i := range wants {
+		go func(i int) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i] = fetch(wants[i], transmat, cached, log)
+			finished <- i
+		}(i)
+	}
+	for done := 1; done <= len(wants); done++ {
+		i := <-finished
+		if progress != nil {
+			progress(results[i], done, len(wants))
+		}
+	}
+	return results
+}
+
+func fetch(want Want, transmat rio.Transmat, cached func(rio.TransmatKind, rio.CommitID) bool, log log15.Logger) Result {
+	journal := log.New(
+		"type", want.Ware.Type,
+		"hash", want.Ware.Hash,
+	)
+	result := Result{Want: want}
+	started := time.Now()
+	result.Err = meep.RecoverPanics(func() {
+		if want.Ware.Hash == "" {
+			panic(&def.ErrConfigValidation{
+				Msg: fmt.Sprintf("input %q has no hash to fetch", want.Inputs[0]),
+			})
+		}
+		warehouses := make([]rio.SiloURI, len(want.Warehouses))
+		for i, wh := range want.Warehouses {
+			warehouses[i] = rio.SiloURI(wh)
+		}
+		arena, servedBy := util.MaterializeWithFailover(
+			transmat,
+			rio.TransmatKind(want.Ware.Type),
+			rio.CommitID(want.Ware.Hash),
+			warehouses,
+			cached,
+			util.DefaultRetryPolicy,
+			journal,
+		)
+		arena.Teardown()
+		result.ServedBy = def.WarehouseCoord(servedBy)
+	})
+	result.Elapsed = time.Now().Sub(started)
+	return result
+}
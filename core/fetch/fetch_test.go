@@ -0,0 +1,161 @@
+package fetch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	Serves wares from warehouses by fixture, remembering what it served
+	as cached; and counts how many fetches are in flight at once.
+*/
+type fixtureTransmat struct {
+	mu       sync.Mutex
+	stock    map[rio.SiloURI][]rio.CommitID
+	cache    map[rio.CommitID]bool
+	inFlight int
+	maxIn    int
+}
+
+func (t *fixtureTransmat) Materialize(kind rio.TransmatKind, dataHash rio.CommitID, siloURIs []rio.SiloURI, log log15.Logger, options ...rio.MaterializerConfigurer) rio.Arena {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(siloURIs) == 0 {
+		if t.cache[dataHash] {
+			return fixtureArena{}
+		}
+		panic(&def.ErrWarehouseUnavailable{Msg: "No warehouse coords configured!", During: "fetch"})
+	}
+	t.inFlight++
+	if t.inFlight > t.maxIn {
+		t.maxIn = t.inFlight
+	}
+	// Let others start while this one's "fetching".
+	t.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	t.mu.Lock()
+	t.inFlight--
+	for _, hash := range t.stock[siloURIs[0]] {
+		if hash == dataHash {
+			t.cache[dataHash] = true
+			return fixtureArena{}
+		}
+	}
+	panic(&def.ErrWareDNE{Ware: def.Ware{Type: string(kind), Hash: string(dataHash)}, From: def.WarehouseCoord(siloURIs[0])})
+}
+
+func (t *fixtureTransmat) isCached(kind rio.TransmatKind, dataHash rio.CommitID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cache[dataHash]
+}
+
+func (t *fixtureTransmat) Scan(kind rio.TransmatKind, subjectPath string, siloURIs []rio.SiloURI, log log15.Logger, options ...rio.MaterializerConfigurer) rio.CommitID {
+	panic("not used")
+}
+
+type fixtureArena struct{}
+
+func (fixtureArena) Path() string       { return "" }
+func (fixtureArena) Hash() rio.CommitID { return "" }
+func (fixtureArena) Teardown()          {}
+
+func TestWants(t *testing.T) {
+	Convey("Given a pipeline", t, func() {
+		p := &def.Pipeline{Steps: map[string]*def.Step{
+			"build": {Formula: def.Formula{Inputs: def.InputGroup{
+				"rootfs": &def.Input{Type: "tar", Hash: "ware-root", MountPath: "/", Warehouses: def.WarehouseCoords{"file+ca://a"}},
+				"src":    &def.Input{Type: "git", Hash: "ware-src", MountPath: "/src", Warehouses: def.WarehouseCoords{"https://example.com/src.git"}},
+			}}},
+			"test": {
+				Formula: def.Formula{Inputs: def.InputGroup{
+					"rootfs": &def.Input{Type: "tar", Hash: "ware-root", MountPath: "/", Warehouses: def.WarehouseCoords{"file+ca://b", "file+ca://a"}},
+					"bin":    &def.Input{Type: "tar", MountPath: "/bin"},
+				}},
+				Wire: map[string]string{"bin": "build.bin"},
+			},
+		}}
+
+		Convey("Unwired inputs should be wanted, each ware once", func() {
+			So(PipelineWants(p), ShouldResemble, []Want{
+				{
+					Ware:       def.Ware{Type: "tar", Hash: "ware-root"},
+					Warehouses: def.WarehouseCoords{"file+ca://a", "file+ca://b"},
+					Inputs:     []string{"build.rootfs", "test.rootfs"},
+				},
+				{
+					Ware:       def.Ware{Type: "git", Hash: "ware-src"},
+					Warehouses: def.WarehouseCoords{"https://example.com/src.git"},
+					Inputs:     []string{"build.src"},
+				},
+			})
+		})
+
+		Convey("A formula's inputs should all be wanted", func() {
+			wants := FormulaWants(&p.Steps["test"].Formula)
+			So(wants, ShouldHaveLength, 2)
+			So(wants[0].Inputs, ShouldResemble, []string{"bin"})
+			So(wants[1].Inputs, ShouldResemble, []string{"rootfs"})
+		})
+	})
+}
+
+func TestFetch(t *testing.T) {
+	Convey("Given wares in warehouses", t, func(c C) {
+		log := testutil.TestLogger(c)
+		transmat := &fixtureTransmat{
+			stock: map[rio.SiloURI][]rio.CommitID{
+				"file+ca://a": {"ware-1", "ware-2", "ware-3"},
+				"file+ca://b": {"ware-4"},
+			},
+			cache: map[rio.CommitID]bool{"ware-0": true},
+		}
+		want := func(hash string, warehouses ...def.WarehouseCoord) Want {
+			return Want{Ware: def.Ware{Type: "tar", Hash: hash}, Warehouses: warehouses, Inputs: []string{"in-" + hash}}
+		}
+		wants := []Want{
+			want("ware-0"),
+			want("ware-1", "file+ca://a"),
+			want("ware-2", "file+ca://a"),
+			want("ware-3", "file+ca://a"),
+			want("ware-4", "file+ca://a", "file+ca://b"),
+			want("ware-5", "file+ca://a", "file+ca://b"),
+			want("ware-6"),
+		}
+
+		Convey("Everything obtainable should be fetched, and the rest reported", func() {
+			var dones []int
+			results := Fetch(wants, transmat, transmat.isCached, 2, func(result Result, done int, total int) {
+				So(total, ShouldEqual, len(wants))
+				dones = append(dones, done)
+			}, log)
+			So(dones, ShouldResemble, []int{1, 2, 3, 4, 5, 6, 7})
+			So(results, ShouldHaveLength, len(wants))
+			So(results[0].Err, ShouldBeNil)
+			So(results[0].ServedBy, ShouldEqual, "")
+			So(results[1].Err, ShouldBeNil)
+			So(results[1].ServedBy, ShouldEqual, "file+ca://a")
+			So(results[4].Err, ShouldBeNil)
+			So(results[4].ServedBy, ShouldEqual, "file+ca://b")
+			So(results[5].Err, ShouldHaveSameTypeAs, &def.ErrWareDNE{})
+			So(results[6].Err, ShouldHaveSameTypeAs, &def.ErrWarehouseUnavailable{})
+			So(transmat.maxIn, ShouldBeLessThanOrEqualTo, 2)
+
+			Convey("And be cached afterwards", func() {
+				for i, result := range Fetch(wants[:5], transmat, transmat.isCached, 2, nil, log) {
+					So(result.Err, ShouldBeNil)
+					So(result.ServedBy, ShouldEqual, "")
+					So(result.Ware, ShouldResemble, wants[i].Ware)
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,333 @@
+/*
+	A local store of past runs: every formula run, and the RunRecord it
+	produced, kept under the repeatr base dir so they can be looked up later.
+
+	Both are content-addressed, named by their hash IDs:
+
+		<dir>/formulas/<formulaHID>       -- each formula, as json
+		<dir>/records/<HID>               -- each runrecord, as json
+		<dir>/submitted/<HID>             -- the formula exactly as each run was given it
+		<dir>/runs/<formulaHID>/<HID>     -- empty; lists each formula's runs
+
+	A formula HID leaves out things that don't change what's computed --
+	warehouses, for one -- so formulas that differ only there share an HID,
+	and "formulas" keeps whichever was saved first.  "submitted" keeps
+	each run's own.
+
+	Since everything is named by its own hash, saving is idempotent.
+	The one index, "runs", is written last, so it never names a record
+	that isn't there; queries for a formula read only its runs' records,
+	and other queries read them all.
+*/
+package history
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go/codec"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/core/jank"
+)
+
+type Store struct {
+	dir string
+}
+
+/*
+	Opens (creating, if necessary) a history store in `dir`.
+
+	May panic with:
+
+	  - `*history.ErrIO` -- if the dirs can't be created.
+*/
+func Open(dir string) *Store {
+	s := &Store{dir}
+	for _, sub := range []string{"formulas", "records", "submitted", "runs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+		}
+	}
+	return s
+}
+
+/*
+	Opens the history store under the repeatr base dir.
+*/
+func Default() *Store {
+	return Open(filepath.Join(jank.Base(), "history"))
+}
+
+/*
+	Saves a run: its formula, and the record of what happened.
+	The record's `HID` and `FormulaHID` must already be filled in.
+
+	May panic with:
+
+	  - `*history.ErrIO` -- if anything can't be written.
+*/
+func (s *Store) Save(frm *def.Formula, rr *def.RunRecord) {
+	if rr.HID == "" || rr.FormulaHID == "" {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("runrecords must have their HIDs computed before saving")),
+		))
+	}
+	s.write(filepath.Join(s.dir, "formulas", rr.FormulaHID), frm)
+	s.write(filepath.Join(s.dir, "submitted", rr.HID), frm)
+	s.write(filepath.Join(s.dir, "records", rr.HID), rr)
+	s.index(rr)
+}
+
+// Lists the run under its formula in "runs".
+func (s *Store) index(rr *def.RunRecord) {
+	dir := filepath.Join(s.dir, "runs", rr.FormulaHID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+	}
+	f, err := os.OpenFile(filepath.Join(dir, rr.HID), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+	}
+	f.Close()
+}
+
+func (s *Store) write(pth string, val interface{}) {
+	// Content-addressed: if it's there, it's already right.
+	if _, err := os.Stat(pth); err == nil {
+		return
+	}
+	// Write aside and rename into place, so readers never see half a file.
+	f, err := ioutil.TempFile(filepath.Dir(pth), ".tmp.")
+	if err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+	}
+	defer os.Remove(f.Name())
+	err = codec.NewEncoder(f, &codec.JsonHandle{}).Encode(val)
+	f.Close()
+	if err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+	}
+	if err := os.Rename(f.Name(), pth); err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+	}
+}
+
+func (s *Store) read(pth string, val interface{}) {
+	f, err := os.Open(pth)
+	if err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+	}
+	defer f.Close()
+	if err := codec.NewDecoder(f, &codec.JsonHandle{}).Decode(val); err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(fmt.Errorf("corrupt history entry %q: %s", pth, err))))
+	}
+}
+
+/*
+	Loads the record of a run by its HID.
+	Any unambiguous prefix of the HID will do.
+
+	May panic with:
+
+	  - `*history.ErrNotFound` -- if no run matches, or more than one does.
+	  - `*history.ErrIO` -- if the record can't be read.
+*/
+func (s *Store) Load(hid string) *def.RunRecord {
+	name := s.resolve("records", hid)
+	rr := &def.RunRecord{}
+	s.read(filepath.Join(s.dir, "records", name), rr)
+	return rr
+}
+
+/*
+	Loads the formula a run was given, exactly as it was given
+	(warehouses and all), by the run's HID (or an unambiguous prefix).
+
+	May panic with:
+
+	  - `*history.ErrNotFound` -- if no run matches, or more than one does.
+	  - `*history.ErrIO` -- if the formula can't be read.
+*/
+func (s *Store) FormulaOf(hid string) *def.Formula {
+	name := s.resolve("submitted", hid)
+	frm := &def.Formula{}
+	s.read(filepath.Join(s.dir, "submitted", name), frm)
+	return frm
+}
+
+/*
+	Loads a formula that's been run, by its HID (or an unambiguous prefix).
+	Of formulas that share the HID, this is the first one saved;
+	use `FormulaOf` for the one a particular run was given.
+
+	May panic with:
+
+	  - `*history.ErrNotFound` -- if no formula matches, or more than one does.
+	  - `*history.ErrIO` -- if the formula can't be read.
+*/
+func (s *Store) LoadFormula(formulaHID string) *def.Formula {
+	name := s.resolve("formulas", formulaHID)
+	frm := &def.Formula{}
+	s.read(filepath.Join(s.dir, "formulas", name), frm)
+	return frm
+}
+
+/*
+	Returns the full HID of a formula that's been run, given any
+	unambiguous prefix of it.
+
+	May panic with:
+
+	  - `*history.ErrNotFound` -- if no formula matches, or more than one does.
+*/
+func (s *Store) ResolveFormula(prefix string) string {
+	return s.resolve("formulas", prefix)
+}
+
+func (s *Store) resolve(sub string, prefix string) string {
+	names := s.list(sub)
+	var matches []string
+	for _, name := range names {
+		if name == prefix {
+			return name
+		}
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) != 1 {
+		panic(meep.Meep(&ErrNotFound{HID: prefix, Candidates: len(matches)}))
+	}
+	return matches[0]
+}
+
+func (s *Store) list(sub string) []string {
+	f, err := os.Open(filepath.Join(s.dir, sub))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		panic(meep.Meep(&ErrIO{}, meep.Cause(err)))
+	}
+	// Skip anything still being written.
+	filtered := names[:0]
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			filtered = append(filtered, name)
+		}
+	}
+	sort.Strings(filtered)
+	return filtered
+}
+
+/*
+	Selects runs.  Zero values match everything.
+*/
+type Query struct {
+	FormulaHID string    // Only runs of this formula.
+	OutputHash string    // Only runs that produced a ware with this hash.
+	Since      time.Time // Only runs at or after this time.
+	Until      time.Time // Only runs before this time.
+}
+
+/*
+	Reports whether the run is one the query selects.
+*/
+func (q Query) Matches(rr *def.RunRecord) bool {
+	if q.FormulaHID != "" && rr.FormulaHID != q.FormulaHID {
+		return false
+	}
+	if !q.Since.IsZero() && rr.Date.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !rr.Date.Before(q.Until) {
+		return false
+	}
+	if q.OutputHash != "" {
+		for name, result := range rr.Results {
+			if name != "$exitcode" && result.Hash == q.OutputHash {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+/*
+	Finds all the runs matching the query, oldest first.
+	Queries for a formula only read that formula's records.
+
+	May panic with:
+
+	  - `*history.ErrIO` -- if the records can't be read.
+*/
+func (s *Store) Find(q Query) []*def.RunRecord {
+	names := s.list("records")
+	if q.FormulaHID != "" && !strings.ContainsAny(q.FormulaHID, "/.") { // HIDs never have these; don't let one wander off.
+		names = s.list(filepath.Join("runs", q.FormulaHID))
+	}
+	var found []*def.RunRecord
+	for _, name := range names {
+		rr := &def.RunRecord{}
+		s.read(filepath.Join(s.dir, "records", name), rr)
+		if q.Matches(rr) {
+			found = append(found, rr)
+		}
+	}
+	sort.Sort(ByDate(found))
+	return found
+}
+
+/*
+	Returns the records of all past runs of the formula with this HID.
+	(This makes the store a `memo.Source`.)
+*/
+func (s *Store) RunsOf(formulaHID string) []*def.RunRecord {
+	return s.Find(Query{FormulaHID: formulaHID})
+}
+
+/*
+	Sorts runs oldest first.  Runs at the same instant are ordered by HID,
+	so the order is the same however they were found.
+*/
+type ByDate []*def.RunRecord
+
+func (a ByDate) Len() int      { return len(a) }
+func (a ByDate) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByDate) Less(i, j int) bool {
+	if a[i].Date.Equal(a[j].Date) {
+		return a[i].HID < a[j].HID
+	}
+	return a[i].Date.Before(a[j].Date)
+}
+
+/*
+	Raised when a HID doesn't name exactly one thing in the store.
+*/
+type ErrNotFound struct {
+	meep.TraitAutodescribing
+	HID        string
+	Candidates int // how many entries the HID was a prefix of; more than one means it was ambiguous.
+}
+
+/*
+	Raised for any problems reading or writing the store.
+*/
+type ErrIO struct {
+	meep.TraitAutodescribing
+	meep.TraitCausable
+}
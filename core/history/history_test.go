@@ -0,0 +1,113 @@
+package history
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+)
+
+func fixtureRun(frm *def.Formula, uid string, when time.Time, output string) *def.RunRecord {
+	rr := &def.RunRecord{
+		UID:        def.RunID(uid),
+		Date:       when,
+		FormulaHID: frm.Hash(),
+		Results: def.ResultGroup{
+			"out":       &def.Result{"out", def.Ware{"tar", output}},
+			"$exitcode": &def.Result{"$exitcode", def.Ware{"exitcode", "0"}},
+		},
+	}
+	rr.HID = rr.Hash()
+	return rr
+}
+
+func TestHistory(t *testing.T) {
+	Convey("Given a history store with some runs", t, testutil.WithTmpdir(func() {
+		store := Open("history")
+		frmA := &def.Formula{Action: def.Action{Entrypoint: []string{"echo", "a"}}}
+		frmB := &def.Formula{Action: def.Action{Entrypoint: []string{"echo", "b"}}}
+		day := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+		run1 := fixtureRun(frmA, "run1", day.Add(1*time.Hour), "ware1")
+		run2 := fixtureRun(frmB, "run2", day.Add(2*time.Hour), "ware2")
+		run3 := fixtureRun(frmA, "run3", day.Add(26*time.Hour), "ware1")
+		// save out of order; queries sort by date.
+		store.Save(frmA, run3)
+		store.Save(frmA, run1)
+		store.Save(frmB, run2)
+
+		Convey("Runs should load by HID", func() {
+			rr := store.Load(run2.HID)
+			So(rr.HID, ShouldEqual, run2.HID)
+			So(rr.UID, ShouldEqual, run2.UID)
+			So(rr.Date.Equal(run2.Date), ShouldBeTrue)
+			So(rr.Results["out"].Hash, ShouldEqual, "ware2")
+			So(rr.Hash(), ShouldEqual, run2.HID)
+			So(store.LoadFormula(rr.FormulaHID).Action.Entrypoint, ShouldResemble, []string{"echo", "b"})
+
+			Convey("Or by prefix", func() {
+				So(store.Load(run2.HID[:12]).HID, ShouldEqual, run2.HID)
+				So(store.ResolveFormula(run2.FormulaHID[:12]), ShouldEqual, run2.FormulaHID)
+			})
+		})
+
+		Convey("Unknown HIDs should be reported", func() {
+			err := meep.RecoverPanics(func() { store.Load("nope") })
+			So(err, ShouldHaveSameTypeAs, &ErrNotFound{})
+			err = meep.RecoverPanics(func() { store.Load("") })
+			So(err, ShouldHaveSameTypeAs, &ErrNotFound{})
+		})
+
+		Convey("Each run's formula should be kept as it was given", func() {
+			frmA2 := &def.Formula{Action: def.Action{Entrypoint: []string{"echo", "a"}}}
+			frmA2.Inputs = def.InputGroup{"src": &def.Input{Type: "tar", Hash: "abcd", MountPath: "/src",
+				Warehouses: def.WarehouseCoords{"file+ca:///elsewhere"}}}
+			frmA.Inputs = def.InputGroup{"src": &def.Input{Type: "tar", Hash: "abcd", MountPath: "/src"}}
+			So(frmA2.Hash(), ShouldEqual, frmA.Hash())
+			run4 := fixtureRun(frmA, "run4", day.Add(30*time.Hour), "ware1")
+			run5 := fixtureRun(frmA2, "run5", day.Add(31*time.Hour), "ware1")
+			store.Save(frmA, run4)
+			store.Save(frmA2, run5)
+			So(store.FormulaOf(run4.HID).Inputs["src"].Warehouses, ShouldBeEmpty)
+			So(store.FormulaOf(run5.HID).Inputs["src"].Warehouses, ShouldResemble, def.WarehouseCoords{"file+ca:///elsewhere"})
+		})
+
+		Convey("Saving again should change nothing", func() {
+			store.Save(frmA, run1)
+			records, _ := ioutil.ReadDir("history/records")
+			So(records, ShouldHaveLength, 3)
+			formulas, _ := ioutil.ReadDir("history/formulas")
+			So(formulas, ShouldHaveLength, 2)
+			submitted, _ := ioutil.ReadDir("history/submitted")
+			So(submitted, ShouldHaveLength, 3)
+		})
+
+		Convey("Queries should find runs", func() {
+			hids := func(rrs []*def.RunRecord) []string {
+				var hids []string
+				for _, rr := range rrs {
+					hids = append(hids, rr.HID)
+				}
+				return hids
+			}
+			So(hids(store.Find(Query{})), ShouldResemble, []string{run1.HID, run2.HID, run3.HID})
+			So(hids(store.Find(Query{FormulaHID: frmA.Hash()})), ShouldResemble, []string{run1.HID, run3.HID})
+			So(hids(store.Find(Query{OutputHash: "ware2"})), ShouldResemble, []string{run2.HID})
+			So(hids(store.Find(Query{OutputHash: "0"})), ShouldBeEmpty)
+			So(hids(store.Find(Query{Since: day.Add(2 * time.Hour)})), ShouldResemble, []string{run2.HID, run3.HID})
+			So(hids(store.Find(Query{Until: day.Add(24 * time.Hour)})), ShouldResemble, []string{run1.HID, run2.HID})
+			So(hids(store.Find(Query{FormulaHID: frmA.Hash(), Since: day.Add(24 * time.Hour)})), ShouldResemble, []string{run3.HID})
+		})
+
+		Convey("Queries for a formula should read only its runs", func() {
+			// Another formula's record being unreadable is no concern of ours.
+			So(ioutil.WriteFile("history/records/"+run2.HID, []byte("garbage"), 0644), ShouldBeNil)
+			So(store.Find(Query{FormulaHID: frmA.Hash()}), ShouldHaveLength, 2)
+			So(store.Find(Query{FormulaHID: "nope"}), ShouldBeEmpty)
+		})
+	}))
+}
@@ -0,0 +1,163 @@
+/*
+	Finds the results of past runs that can stand in for running a formula again.
+
+	`Formula.Hash` covers everything that determines what a formula does
+	(and nothing incidental, like warehouses), so a past run of a formula with
+	the same hash did the same work.  If it succeeded, and the wares it
+	produced can still be fetched, there's no need to do that work again.
+*/
+package memo
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/core/history"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/mirror"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+/*
+	Somewhere to look up the records of past runs.
+	The local `history.Store` is one.
+*/
+type Source interface {
+	/*
+		Returns the records of past runs of the formula with this HID, in any order.
+		May panic; a source that does is logged and skipped.
+	*/
+	RunsOf(formulaHID string) []*def.RunRecord
+}
+
+/*
+	Reports whether a ware can currently be fetched from any of the warehouses.
+*/
+type Fetchable func(ware def.Ware, warehouses def.WarehouseCoords) bool
+
+/*
+	Looks through the sources for a past run of `frm` whose record can be
+	returned instead of running it again, and returns the newest such record,
+	or nil if there's none.
+
+	A run qualifies if it succeeded (no failure, and exit code zero), and has
+	a result for every output, of the output's type; and every output marked
+	as a conjecture is still fetchable from that output's warehouses (and is
+	the ware the formula expects, if it gives a hash).
+	(Outputs that aren't conjectures aren't expected to be reproducible, so
+	it doesn't much matter whether they're still around.)
+*/
+func Lookup(frm *def.Formula, sources []Source, fetchable Fetchable, log log15.Logger) *def.RunRecord {
+	formulaHID := frm.Hash()
+	var candidates []*def.RunRecord
+	for _, source := range sources {
+		meep.Try(func() {
+			candidates = append(candidates, source.RunsOf(formulaHID)...)
+		}, meep.TryPlan{
+			{CatchAny: true, Handler: func(e error) {
+				log.Warn("could not look up past runs; skipping", "source", fmt.Sprintf("%v", source), "error", e)
+			}},
+		})
+	}
+	// Newest first.
+	sort.Sort(sort.Reverse(history.ByDate(candidates)))
+	query := history.Query{FormulaHID: formulaHID}
+	for _, rr := range candidates {
+		if !query.Matches(rr) || rr.Failure != nil {
+			continue
+		}
+		if exit := rr.Results["$exitcode"]; exit == nil || exit.Hash != "0" {
+			continue
+		}
+		if reusable(frm, rr, fetchable, log) {
+			return rr
+		}
+	}
+	return nil
+}
+
+func reusable(frm *def.Formula, rr *def.RunRecord, fetchable Fetchable, log log15.Logger) bool {
+	for name, output := range frm.Outputs {
+		result := rr.Results[name]
+		if result == nil || result.Type != output.Type {
+			log.Info("past run lacks an output; not reusing it", "run", rr.HID, "output", name)
+			return false
+		}
+		if !output.Conjecture {
+			continue
+		}
+		if output.Hash != "" && result.Hash != output.Hash {
+			log.Info("past run's output isn't what the formula expects; not reusing it", "run", rr.HID, "output", name, "expected", output.Hash, "hash", result.Hash)
+			return false
+		}
+		if !fetchable(result.Ware, output.Warehouses) {
+			log.Info("past run's output is no longer fetchable; not reusing it", "run", rr.HID, "output", name, "hash", result.Hash)
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	A `Fetchable` that checks by asking the warehouses.
+
+	For the tar-packed kinds, content-addressable warehouses are simply asked
+	whether they have the ware; others are read and the contents hashed, since
+	whatever's at their path now may not be the ware that was put there.
+	Other kinds have no cheaper way to ask than fetching them with the
+	transmat (which will at least leave them cached for later).
+*/
+func CanFetch(transmat rio.Transmat, log log15.Logger) Fetchable {
+	return func(ware def.Ware, warehouses def.WarehouseCoords) bool {
+		kind := rio.TransmatKind(ware.Type)
+		uris := make([]rio.SiloURI, len(warehouses))
+		for i, coord := range warehouses {
+			uris[i] = rio.SiloURI(coord)
+		}
+		var ok bool
+		if mirror.TarPacked[kind] {
+			for _, uri := range uris {
+				meep.Try(func() {
+					ok = hasPacked(uri, rio.CommitID(ware.Hash), log)
+				}, meep.TryPlan{
+					{CatchAny: true, Handler: func(e error) {
+						log.Debug("warehouse can't provide ware", "warehouse", uri, "hash", ware.Hash, "reason", e)
+					}},
+				})
+				if ok {
+					return true
+				}
+			}
+			return false
+		}
+		if len(uris) == 0 {
+			return false
+		}
+		meep.Try(func() {
+			transmat.Materialize(kind, rio.CommitID(ware.Hash), uris, log).Teardown()
+			ok = true
+		}, meep.TryPlan{
+			{CatchAny: true, Handler: func(e error) {
+				log.Debug("warehouses can't provide ware", "hash", ware.Hash, "reason", e)
+			}},
+		})
+		return ok
+	}
+}
+
+func hasPacked(uri rio.SiloURI, dataHash rio.CommitID, log log15.Logger) bool {
+	wh := mirror.OpenWarehouse(uri)
+	if err := wh.PingReadable(); err != nil {
+		panic(err)
+	}
+	if wh.Has(dataHash) {
+		return true
+	}
+	stream := wh.OpenReader(dataHash)
+	defer stream.Close()
+	return tar.HashPacked(stream, log) == dataHash
+}
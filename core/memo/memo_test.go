@@ -0,0 +1,139 @@
+package memo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+type fixtureSource []*def.RunRecord
+
+func (s fixtureSource) RunsOf(formulaHID string) []*def.RunRecord {
+	var found []*def.RunRecord
+	for _, rr := range s {
+		if rr.FormulaHID == formulaHID {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
+
+type brokenSource struct{}
+
+func (brokenSource) RunsOf(string) []*def.RunRecord { panic(&def.ErrWarehouseUnavailable{Msg: "nope"}) }
+
+func TestLookup(t *testing.T) {
+	Convey("Given a formula and some past runs", t, func(c C) {
+		log := testutil.TestLogger(c)
+		frm := &def.Formula{
+			Action: def.Action{Entrypoint: []string{"echo"}},
+			Outputs: def.OutputGroup{
+				"product": &def.Output{Type: "tar", MountPath: "/out", Conjecture: true, Warehouses: def.WarehouseCoords{"file+ca://wh"}},
+				"logs":    &def.Output{Type: "tar", MountPath: "/logs"},
+			},
+		}
+		day := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+		run := func(uid string, hours int, exitcode string, product string) *def.RunRecord {
+			rr := &def.RunRecord{
+				UID:        def.RunID(uid),
+				Date:       day.Add(time.Duration(hours) * time.Hour),
+				FormulaHID: frm.Hash(),
+				Results: def.ResultGroup{
+					"product":   &def.Result{"product", def.Ware{"tar", product}},
+					"logs":      &def.Result{"logs", def.Ware{"tar", "logs-" + uid}},
+					"$exitcode": &def.Result{"$exitcode", def.Ware{"exitcode", exitcode}},
+				},
+			}
+			rr.HID = rr.Hash()
+			return rr
+		}
+		old := run("old", 1, "0", "ware-old")
+		newer := run("newer", 2, "0", "ware-newer")
+		failed := run("failed", 3, "1", "ware-failed")
+		source := fixtureSource{old, failed, newer}
+		var asked []string
+		fetchable := func(available ...string) Fetchable {
+			return func(ware def.Ware, warehouses def.WarehouseCoords) bool {
+				asked = append(asked, ware.Hash)
+				So(warehouses, ShouldResemble, def.WarehouseCoords{"file+ca://wh"})
+				for _, hash := range available {
+					if ware.Hash == hash {
+						return true
+					}
+				}
+				return false
+			}
+		}
+
+		Convey("The newest successful run should be reused", func() {
+			So(Lookup(frm, []Source{source}, fetchable("ware-old", "ware-newer", "ware-failed"), log), ShouldEqual, newer)
+			Convey("And only conjectured outputs need be fetchable", func() {
+				So(asked, ShouldResemble, []string{"ware-newer"})
+			})
+		})
+
+		Convey("Runs whose outputs are gone should be passed over", func() {
+			So(Lookup(frm, []Source{source}, fetchable("ware-old"), log), ShouldEqual, old)
+			So(Lookup(frm, []Source{source}, fetchable(), log), ShouldBeNil)
+		})
+
+		Convey("Runs of other formulas should be ignored", func() {
+			frm.Action.Entrypoint = []string{"echo", "different"}
+			So(Lookup(frm, []Source{source}, fetchable("ware-old", "ware-newer"), log), ShouldBeNil)
+		})
+
+		Convey("Runs missing outputs should be ignored", func() {
+			delete(newer.Results, "logs")
+			So(Lookup(frm, []Source{source}, fetchable("ware-old", "ware-newer"), log), ShouldEqual, old)
+		})
+
+		Convey("Runs that didn't produce the expected outputs should be passed over", func() {
+			frm.Outputs["product"].Hash = "ware-old"
+			So(Lookup(frm, []Source{source}, fetchable("ware-old", "ware-newer"), log), ShouldEqual, old)
+		})
+
+		Convey("Broken sources should be skipped", func() {
+			So(Lookup(frm, []Source{brokenSource{}, source}, fetchable("ware-newer"), log), ShouldEqual, newer)
+		})
+	})
+}
+
+func TestCanFetch(t *testing.T) {
+	Convey("Given tar wares in warehouses", t, testutil.WithTmpdir(func(c C) {
+		log := testutil.TestLogger(c)
+		cwd, _ := os.Getwd()
+		caURI := "file+ca://" + filepath.Join(cwd, "ca")
+		os.Mkdir("ca", 0755)
+		filefixture.Beta.Create("fixture")
+		transmat := tar.New("work")
+		hash := transmat.Scan(tar.Kind, "fixture", []rio.SiloURI{rio.SiloURI(caURI), "file://plain.tgz"}, log)
+		ware := def.Ware{Type: string(tar.Kind), Hash: string(hash)}
+		fetchable := CanFetch(transmat, log)
+
+		Convey("They should be fetchable where they are", func() {
+			So(fetchable(ware, def.WarehouseCoords{def.WarehouseCoord(caURI)}), ShouldBeTrue)
+			So(fetchable(ware, def.WarehouseCoords{"file://plain.tgz"}), ShouldBeTrue)
+			So(fetchable(ware, def.WarehouseCoords{"file://nonexistent.tgz", def.WarehouseCoord(caURI)}), ShouldBeTrue)
+		})
+
+		Convey("And not where they aren't", func() {
+			So(fetchable(ware, nil), ShouldBeFalse)
+			So(fetchable(def.Ware{Type: string(tar.Kind), Hash: "nonexistent"}, def.WarehouseCoords{def.WarehouseCoord(caURI)}), ShouldBeFalse)
+		})
+
+		Convey("Non-content-addressable warehouses should be checked for what's actually there now", func() {
+			filefixture.Alpha.Create("other")
+			transmat.Scan(tar.Kind, "other", []rio.SiloURI{"file://plain.tgz"}, log)
+			So(fetchable(ware, def.WarehouseCoords{"file://plain.tgz"}), ShouldBeFalse)
+		})
+	}))
+}
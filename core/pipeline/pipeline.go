@@ -0,0 +1,231 @@
+/*
+	Runs pipelines: DAGs of formulas, wired together by their outputs
+	(see `def.Pipeline`).
+
+	Steps run as soon as all the steps they're wired to have succeeded,
+	so steps that don't depend on each other run in parallel.  If a step
+	fails, the steps downstream of it are skipped; the rest carry on.
+*/
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/inconshreveable/log15"
+
+	"go.polydawn.net/repeatr/api/def"
+)
+
+type ref struct {
+	step   string
+	output string
+}
+
+func parseRef(s string) (ref, bool) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ref{}, false
+	}
+	return ref{parts[0], parts[1]}, true
+}
+
+func invalid(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	panic(&def.ErrConfigValidation{Msg: msg})
+}
+
+/*
+	Checks that the pipeline's wiring makes sense, and returns the names of
+	its steps in an order they could be run in one at a time (upstream
+	steps first; otherwise by name).
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if anything's wired wrong, or the steps form a cycle.
+*/
+func Validate(p *def.Pipeline) []string {
+	if len(p.Steps) == 0 {
+		invalid("pipeline has no steps")
+	}
+	deps := map[string][]string{}
+	for name, step := range p.Steps {
+		if name == "" || strings.Contains(name, ".") {
+			invalid("pipeline step name %q is invalid: must be nonempty, without dots", name)
+		}
+		if step == nil {
+			invalid("pipeline step %q is empty", name)
+		}
+		for inputName, refStr := range step.Wire {
+			input := step.Formula.Inputs[inputName]
+			if input == nil {
+				invalid("step %q wires input %q, but its formula has no such input", name, inputName)
+			}
+			r, ok := parseRef(refStr)
+			if !ok {
+				invalid("step %q wires input %q to %q, which isn't like \"<step>.<output>\"", name, inputName, refStr)
+			}
+			upstream := p.Steps[r.step]
+			if upstream == nil || r.step == name {
+				invalid("step %q wires input %q to %q, but there's no other step %q", name, inputName, refStr, r.step)
+			}
+			output := upstream.Formula.Outputs[r.output]
+			if output == nil {
+				invalid("step %q wires input %q to %q, but step %q has no output %q", name, inputName, refStr, r.step, r.output)
+			}
+			if output.Type != input.Type {
+				invalid("step %q wires input %q (of type %q) to %q, which is of type %q", name, inputName, input.Type, refStr, output.Type)
+			}
+			if len(output.Warehouses) == 0 {
+				invalid("step %q wires input %q to %q, which has no warehouses to fetch it from", name, inputName, refStr)
+			}
+			deps[name] = append(deps[name], r.step)
+		}
+	}
+	// Topological sort, taking steps by name when there's a choice, so the order is stable.
+	var order []string
+	done := map[string]bool{}
+	for len(order) < len(p.Steps) {
+		var ready []string
+		for name := range p.Steps {
+			if done[name] {
+				continue
+			}
+			ok := true
+			for _, dep := range deps[name] {
+				ok = ok && done[dep]
+			}
+			if ok {
+				ready = append(ready, name)
+			}
+		}
+		if len(ready) == 0 {
+			var stuck []string
+			for name := range p.Steps {
+				if !done[name] {
+					stuck = append(stuck, name)
+				}
+			}
+			sort.Strings(stuck)
+			invalid("pipeline steps are wired in a cycle: %s", strings.Join(stuck, ", "))
+		}
+		sort.Strings(ready)
+		done[ready[0]] = true
+		order = append(order, ready[0])
+	}
+	return order
+}
+
+/*
+	What became of a step.  Exactly one of the fields is set.
+*/
+type StepResult struct {
+	RunRecord *def.RunRecord `json:"runRecord,omitempty"`
+	Skipped   string         `json:"skipped,omitempty"` // why the step wasn't run.
+}
+
+func (r *StepResult) succeeded() bool {
+	if r.RunRecord == nil || r.RunRecord.Failure != nil {
+		return false
+	}
+	exit := r.RunRecord.Results["$exitcode"]
+	return exit != nil && exit.Hash == "0"
+}
+
+/*
+	What became of every step of a pipeline.
+*/
+type Report struct {
+	Steps map[string]*StepResult `json:"steps"`
+}
+
+/*
+	Lists the steps that didn't succeed (whether they failed or were skipped), by name.
+*/
+func (r *Report) Failed() []string {
+	var failed []string
+	for name, result := range r.Steps {
+		if !result.succeeded() {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+/*
+	Runs one step's formula, returning its runrecord.
+	Called concurrently for independent steps.
+*/
+type RunFunc func(step string, frm *def.Formula) *def.RunRecord
+
+/*
+	Runs a pipeline: every step, each once all the steps it's wired to
+	have succeeded, with their outputs filled into its inputs.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the pipeline doesn't `Validate`; nothing is run.
+*/
+func Run(p *def.Pipeline, run RunFunc, log log15.Logger) *Report {
+	order := Validate(p)
+	report := &Report{Steps: map[string]*StepResult{}}
+	var mu sync.Mutex
+	done := map[string]chan struct{}{}
+	for _, name := range order {
+		done[name] = make(chan struct{})
+	}
+	for _, name := range order {
+		go func(name string, step *def.Step) {
+			defer close(done[name])
+			result := &StepResult{}
+			defer func() {
+				mu.Lock()
+				report.Steps[name] = result
+				mu.Unlock()
+			}()
+			// Wait for everything upstream, and check it all went well.
+			upstream := map[string]*StepResult{}
+			for _, refStr := range step.Wire {
+				r, _ := parseRef(refStr)
+				<-done[r.step]
+				mu.Lock()
+				upstream[r.step] = report.Steps[r.step]
+				mu.Unlock()
+				if !upstream[r.step].succeeded() {
+					result.Skipped = fmt.Sprintf("upstream step %q did not succeed", r.step)
+				} else if upstream[r.step].RunRecord.Results[r.output] == nil {
+					result.Skipped = fmt.Sprintf("upstream step %q produced no output %q", r.step, r.output)
+				}
+			}
+			if result.Skipped != "" {
+				log.Info("Skipping pipeline step", "step", name, "reason", result.Skipped)
+				return
+			}
+			log.Info("Starting pipeline step", "step", name)
+			result.RunRecord = run(name, wire(p, step, upstream))
+			log.Info("Finished pipeline step", "step", name, "succeeded", result.succeeded())
+		}(name, p.Steps[name])
+	}
+	for _, name := range order {
+		<-done[name]
+	}
+	return report
+}
+
+/*
+	Returns a copy of the step's formula, with its wired inputs filled in
+	from the results of the upstream steps.
+*/
+func wire(p *def.Pipeline, step *def.Step, upstream map[string]*StepResult) *def.Formula {
+	frm := step.Formula.Clone()
+	for inputName, refStr := range step.Wire {
+		r, _ := parseRef(refStr)
+		input := frm.Inputs[inputName]
+		input.Hash = upstream[r.step].RunRecord.Results[r.output].Hash
+		input.Warehouses = append(input.Warehouses, p.Steps[r.step].Formula.Outputs[r.output].Warehouses...)
+	}
+	return frm
+}
@@ -0,0 +1,161 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+)
+
+func fixtureStep(inputs []string, outputs []string, wire map[string]string) *def.Step {
+	frm := def.Formula{
+		Inputs:  def.InputGroup{"/": &def.Input{Type: "tar", Hash: "base", MountPath: "/"}},
+		Action:  def.Action{Entrypoint: []string{"true"}},
+		Outputs: def.OutputGroup{},
+	}
+	for _, name := range inputs {
+		frm.Inputs[name] = &def.Input{Type: "tar", MountPath: "/" + name, Warehouses: def.WarehouseCoords{"file+ca://local"}}
+	}
+	for _, name := range outputs {
+		frm.Outputs[name] = &def.Output{Type: "tar", MountPath: "/" + name, Warehouses: def.WarehouseCoords{"file+ca://" + name}}
+	}
+	return &def.Step{Formula: frm, Wire: wire}
+}
+
+func fixtureRun(frm *def.Formula, exitcode string) *def.RunRecord {
+	rr := &def.RunRecord{
+		FormulaHID: frm.Hash(),
+		Results: def.ResultGroup{
+			"$exitcode": &def.Result{"$exitcode", def.Ware{"exitcode", exitcode}},
+		},
+	}
+	for name, output := range frm.Outputs {
+		// Name wares after the step's inputs, so wiring shows up in the hashes.
+		var ins string
+		for _, input := range frm.Inputs {
+			ins += input.Hash + ";"
+		}
+		rr.Results[name] = &def.Result{name, def.Ware{output.Type, name + "(" + ins + ")"}}
+	}
+	return rr
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Given pipelines", t, func() {
+		p := &def.Pipeline{Steps: map[string]*def.Step{
+			"c": fixtureStep([]string{"x", "y"}, []string{"z"}, map[string]string{"x": "a.x", "y": "b.y"}),
+			"b": fixtureStep([]string{"x"}, []string{"y"}, map[string]string{"x": "a.x"}),
+			"a": fixtureStep(nil, []string{"x"}, nil),
+			"d": fixtureStep(nil, []string{"w"}, nil),
+		}}
+
+		Convey("Steps should be ordered upstream first", func() {
+			So(Validate(p), ShouldResemble, []string{"a", "b", "c", "d"})
+		})
+
+		Convey("Cycles should be rejected", func() {
+			p.Steps["a"] = fixtureStep([]string{"z"}, []string{"x"}, map[string]string{"z": "c.z"})
+			err := meep.RecoverPanics(func() { Validate(p) })
+			So(err, ShouldHaveSameTypeAs, &def.ErrConfigValidation{})
+			So(err.Error(), ShouldContainSubstring, "a, b, c")
+		})
+
+		Convey("Bad wiring should be rejected", func() {
+			for _, wire := range []map[string]string{
+				{"nope": "a.x"}, // no such input
+				{"x": "a"},      // not a ref
+				{"x": "q.x"},    // no such step
+				{"x": "d.x"},    // no such output
+				{"x": "b.x"},    // itself
+			} {
+				p.Steps["b"].Wire = wire
+				So(func() { Validate(p) }, ShouldPanic)
+			}
+		})
+
+		Convey("Wiring mismatched types should be rejected", func() {
+			p.Steps["b"].Formula.Inputs["x"].Type = "git"
+			So(func() { Validate(p) }, ShouldPanic)
+		})
+
+		Convey("Wiring outputs with nowhere to fetch them from should be rejected", func() {
+			p.Steps["a"].Formula.Outputs["x"].Warehouses = nil
+			So(func() { Validate(p) }, ShouldPanic)
+		})
+	})
+}
+
+func TestRun(t *testing.T) {
+	Convey("Given a diamond-shaped pipeline", t, func(c C) {
+		log := testutil.TestLogger(c)
+		p := &def.Pipeline{Steps: map[string]*def.Step{
+			"a": fixtureStep(nil, []string{"x"}, nil),
+			"b": fixtureStep([]string{"x"}, []string{"y"}, map[string]string{"x": "a.x"}),
+			"c": fixtureStep([]string{"x"}, []string{"z"}, map[string]string{"x": "a.x"}),
+			"d": fixtureStep([]string{"y", "z"}, []string{"out"}, map[string]string{"y": "b.y", "z": "c.z"}),
+		}}
+		var mu sync.Mutex
+		ran := map[string]*def.Formula{}
+		exitcodes := map[string]string{}
+		run := func(step string, frm *def.Formula) *def.RunRecord {
+			mu.Lock()
+			ran[step] = frm
+			exitcode := exitcodes[step]
+			mu.Unlock()
+			if exitcode == "" {
+				exitcode = "0"
+			}
+			return fixtureRun(frm, exitcode)
+		}
+
+		Convey("Every step should run, with upstream outputs wired in", func() {
+			report := Run(p, run, log)
+			So(report.Failed(), ShouldBeEmpty)
+			So(report.Steps, ShouldHaveLength, 4)
+			So(ran["b"].Inputs["x"].Hash, ShouldEqual, "x(base;)")
+			So(ran["b"].Inputs["x"].Warehouses, ShouldResemble, def.WarehouseCoords{"file+ca://local", "file+ca://x"})
+			So(ran["d"].Inputs["y"].Hash, ShouldEqual, report.Steps["b"].RunRecord.Results["y"].Hash)
+			So(ran["d"].Inputs["z"].Hash, ShouldEqual, report.Steps["c"].RunRecord.Results["z"].Hash)
+			Convey("Without touching the pipeline", func() {
+				So(p.Steps["b"].Formula.Inputs["x"].Hash, ShouldEqual, "")
+			})
+		})
+
+		Convey("Failed steps should skip only what's downstream", func() {
+			exitcodes["b"] = "1"
+			report := Run(p, run, log)
+			So(report.Failed(), ShouldResemble, []string{"b", "d"})
+			So(report.Steps["c"].RunRecord, ShouldNotBeNil)
+			So(report.Steps["d"].RunRecord, ShouldBeNil)
+			So(report.Steps["d"].Skipped, ShouldContainSubstring, `"b"`)
+			So(ran["d"], ShouldBeNil)
+		})
+
+		Convey("Independent steps should run in parallel", func() {
+			// b and c each wait for the other to start; run serially, they'd time out.
+			started := map[string]chan struct{}{"b": make(chan struct{}), "c": make(chan struct{})}
+			other := map[string]string{"b": "c", "c": "b"}
+			parallel := map[string]bool{}
+			report := Run(p, func(step string, frm *def.Formula) *def.RunRecord {
+				if ch, ok := started[step]; ok {
+					close(ch)
+					select {
+					case <-started[other[step]]:
+						mu.Lock()
+						parallel[step] = true
+						mu.Unlock()
+					case <-time.After(5 * time.Second):
+					}
+				}
+				return run(step, frm)
+			}, log)
+			So(report.Failed(), ShouldBeEmpty)
+			So(parallel, ShouldResemble, map[string]bool{"b": true, "c": true})
+		})
+	})
+}
@@ -0,0 +1,333 @@
+/*
+	Works out what running a formula would involve, without running it:
+	which inputs are already cached and which must be fetched (and whether
+	their warehouses have them), whether the outputs' warehouses will take
+	the results, and the order the filesystem will be assembled in.
+
+	A plan lists every problem it finds, so they can all be fixed at once
+	instead of one run at a time.  `repeatr run --plan` prints one.
+*/
+package plan
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/core/executor/util"
+	"go.polydawn.net/repeatr/core/memo"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/mirror"
+	"go.polydawn.net/repeatr/rio/transmat/impl/git"
+)
+
+type Plan struct {
+	FormulaHID string   `json:"formulaHID"`
+	Executor   string   `json:"executor"`
+	Placer     string   `json:"placer"`
+	Inputs     []Input  `json:"inputs"`   // sorted by name.
+	Outputs    []Output `json:"outputs"`  // sorted by name.
+	Assembly   []Part   `json:"assembly"` // in the order they're placed.
+	Problems   []string `json:"problems,omitempty"`
+}
+
+type Input struct {
+	Name       string   `json:"name"`
+	Ware       def.Ware `json:"ware"`
+	MountPath  string   `json:"mount"`
+	Cached     bool     `json:"cached"`
+	Warehouses []Check  `json:"silo,omitempty"`
+}
+
+type Output struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	MountPath  string  `json:"mount"`
+	Conjecture bool    `json:"cnj,omitempty"`
+	Warehouses []Check `json:"silo,omitempty"`
+}
+
+/*
+	One piece of the filesystem: an input, or a host mount.
+*/
+type Part struct {
+	MountPath string `json:"mount"`
+	Input     string `json:"input,omitempty"` // blank for host mounts.
+	HostPath  string `json:"host,omitempty"`  // blank for inputs.
+	Writable  bool   `json:"writable"`
+}
+
+/*
+	The result of checking a warehouse.
+*/
+type Check struct {
+	URI    def.WarehouseCoord `json:"uri"`
+	Status Status             `json:"status"`
+	Reason string             `json:"reason,omitempty"`
+}
+
+type Status string
+
+const (
+	StatusOK          = Status("ok")
+	StatusMissing     = Status("missing")     // reachable, but doesn't have the ware.
+	StatusUnavailable = Status("unavailable") // can't be read (or written) at all.
+	StatusUnchecked   = Status("unchecked")   // there's no way to check without doing the work.
+)
+
+/*
+	Returned by checks that can't tell without doing the work.
+*/
+type ErrUnchecked struct {
+	meep.TraitAutodescribing
+	Reason string
+}
+
+/*
+	How a plan checks on things outside the formula.
+	`Probe` gives the real ones; tests may substitute others.
+*/
+type Checker struct {
+	// Reports whether the ware is already cached locally.
+	Cached func(ware def.Ware) bool
+
+	// Returns nil if the warehouse has the ware; `*def.ErrWareDNE` if it
+	// doesn't; `*plan.ErrUnchecked` if it can't tell; or why it can't be read.
+	Readable func(ware def.Ware, cached bool, uri def.WarehouseCoord) error
+
+	// Returns nil if the warehouse can be saved to; `*plan.ErrUnchecked`
+	// if it can't tell; or why it can't.
+	Writable func(kind string, uri def.WarehouseCoord) error
+}
+
+/*
+	Plans a run of `frm` by the named executor and placer.
+	The formula is not modified.
+*/
+func Make(frm *def.Formula, executor string, placer string, checker Checker) *Plan {
+	p := &Plan{
+		FormulaHID: frm.Hash(),
+		Executor:   executor,
+		Placer:     placer,
+		Inputs:     []Input{},
+		Outputs:    []Output{},
+		Assembly:   []Part{},
+	}
+	p.validate(frm)
+
+	for _, name := range inputNames(frm.Inputs) {
+		in := frm.Inputs[name]
+		ware := def.Ware{Type: in.Type, Hash: in.Hash}
+		planned := Input{
+			Name:      name,
+			Ware:      ware,
+			MountPath: in.MountPath,
+			Cached:    checker.Cached(ware),
+		}
+		available := planned.Cached
+		for _, uri := range in.Warehouses {
+			check := classify(uri, checker.Readable(ware, planned.Cached, uri))
+			available = available || check.Status == StatusOK || check.Status == StatusUnchecked
+			planned.Warehouses = append(planned.Warehouses, check)
+		}
+		if !available {
+			p.problem("input %q: ware %s:%s is not cached, and no warehouse has it", name, ware.Type, ware.Hash)
+		}
+		p.Inputs = append(p.Inputs, planned)
+	}
+
+	for _, name := range outputNames(frm.Outputs) {
+		out := frm.Outputs[name]
+		planned := Output{
+			Name:       name,
+			Type:       out.Type,
+			MountPath:  out.MountPath,
+			Conjecture: out.Conjecture,
+		}
+		for _, uri := range out.Warehouses {
+			check := classify(uri, checker.Writable(out.Type, uri))
+			if check.Status != StatusOK && check.Status != StatusUnchecked {
+				p.problem("output %q: can't save to warehouse %q: %s", name, uri, check.Reason)
+			}
+			planned.Warehouses = append(planned.Warehouses, check)
+		}
+		p.Outputs = append(p.Outputs, planned)
+	}
+
+	// Input names stand in for the source paths they'll be materialized at.
+	inputsByPath := make(map[string]string, len(frm.Inputs))
+	for name := range frm.Inputs {
+		inputsByPath[name] = name
+	}
+	for _, part := range util.AssemblyParts(frm.Inputs, inputsByPath, frm.Action.Escapes.Mounts) {
+		planned := Part{MountPath: part.TargetPath, Writable: part.Writable}
+		if part.BareMount {
+			planned.HostPath = part.SourcePath
+		} else {
+			planned.Input = part.SourcePath
+		}
+		p.Assembly = append(p.Assembly, planned)
+	}
+	return p
+}
+
+/*
+	Checks the formula for anything that would stop a run before it got
+	as far as fetching inputs.
+*/
+func (p *Plan) validate(frm *def.Formula) {
+	if len(frm.Action.Entrypoint) == 0 {
+		p.problem("action: no command given")
+	}
+	mounted := map[string]string{}
+	mount := func(what string, mountPath string) {
+		if mountPath == "" {
+			p.problem("%s: no mount path given", what)
+			return
+		}
+		if !path.IsAbs(mountPath) {
+			p.problem("%s: mount path %q is not absolute", what, mountPath)
+		}
+		mountPath = path.Clean(mountPath)
+		if other, ok := mounted[mountPath]; ok {
+			p.problem("%s: mount path %q is already used by %s", what, mountPath, other)
+			return
+		}
+		mounted[mountPath] = what
+	}
+	for _, name := range inputNames(frm.Inputs) {
+		in := frm.Inputs[name]
+		what := fmt.Sprintf("input %q", name)
+		if in.Type == "" {
+			p.problem("%s: no type given", what)
+		}
+		if in.Hash == "" {
+			p.problem("%s: no hash given", what)
+		}
+		mount(what, in.MountPath)
+	}
+	for _, m := range frm.Action.Escapes.Mounts {
+		mount(fmt.Sprintf("host mount %q", m.SourcePath), m.TargetPath)
+	}
+	for _, name := range outputNames(frm.Outputs) {
+		out := frm.Outputs[name]
+		if out.Type == "" {
+			p.problem("output %q: no type given", name)
+		}
+		if out.MountPath == "" {
+			p.problem("output %q: no mount path given", name)
+		}
+	}
+}
+
+func (p *Plan) problem(format string, args ...interface{}) {
+	p.Problems = append(p.Problems, fmt.Sprintf(format, args...))
+}
+
+func classify(uri def.WarehouseCoord, err error) Check {
+	check := Check{URI: uri, Status: StatusOK}
+	switch err.(type) {
+	case nil:
+		return check
+	case *def.ErrWareDNE:
+		check.Status = StatusMissing
+	case *ErrUnchecked:
+		check.Status = StatusUnchecked
+		check.Reason = err.(*ErrUnchecked).Reason
+		return check
+	default:
+		check.Status = StatusUnavailable
+	}
+	check.Reason = err.Error()
+	return check
+}
+
+/*
+	A `Checker` that asks the caches and warehouses `DefaultTransmat` uses,
+	without fetching anything.
+
+	Warehouses of the tar-packed kinds are pinged, then asked whether they
+	have the ware (see `memo.CanFetch`).  Git remotes are pinged, and have
+	the ware if they advertise it as the tip of a ref (as they do whatever
+	repeatr saved there); commits further back can't be checked without
+	fetching, so those are reported unchecked.  Other kinds have no way
+	to ask short of fetching, so they're unchecked too.
+	Tar-packed and git warehouses can be checked for writability.
+*/
+func Probe(transmat rio.Transmat, log log15.Logger) Checker {
+	fetchable := memo.CanFetch(transmat, log)
+	return Checker{
+		Cached: func(ware def.Ware) bool {
+			return util.IsCached(rio.TransmatKind(ware.Type), rio.CommitID(ware.Hash))
+		},
+		Readable: func(ware def.Ware, cached bool, uri def.WarehouseCoord) error {
+			kind := rio.TransmatKind(ware.Type)
+			if !mirror.TarPacked[kind] && cached {
+				return &ErrUnchecked{Reason: "already cached; fetching would not contact the warehouse"}
+			}
+			switch {
+			case mirror.TarPacked[kind]:
+				return meep.RecoverPanics(func() {
+					if err := mirror.OpenWarehouse(rio.SiloURI(uri)).PingReadable(); err != nil {
+						panic(err)
+					}
+					if !fetchable(ware, def.WarehouseCoords{uri}) {
+						panic(&def.ErrWareDNE{Ware: ware, From: uri})
+					}
+				})
+			case kind == git.Kind:
+				return meep.RecoverPanics(func() {
+					wh := git.NewWarehouse(rio.SiloURI(uri))
+					if err := wh.Ping(); err != nil {
+						panic(err)
+					}
+					if !wh.Advertises(rio.CommitID(ware.Hash)) {
+						panic(&ErrUnchecked{Reason: "not the tip of any ref; commits further back can't be checked without fetching"})
+					}
+				})
+			default:
+				return &ErrUnchecked{Reason: fmt.Sprintf("%s warehouses can't be checked without fetching", kind)}
+			}
+		},
+		Writable: func(kind string, uri def.WarehouseCoord) error {
+			switch {
+			case mirror.TarPacked[rio.TransmatKind(kind)]:
+				return meep.RecoverPanics(func() {
+					if err := mirror.OpenWarehouse(rio.SiloURI(uri)).PingWritable(); err != nil {
+						panic(err)
+					}
+				})
+			case rio.TransmatKind(kind) == git.Kind:
+				return meep.RecoverPanics(func() {
+					if err := git.NewWarehouse(rio.SiloURI(uri)).PingWritable(); err != nil {
+						panic(err)
+					}
+				})
+			default:
+				return &ErrUnchecked{Reason: fmt.Sprintf("%s warehouses can't be checked for writability", kind)}
+			}
+		},
+	}
+}
+
+func inputNames(inputs def.InputGroup) []string {
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func outputNames(outputs def.OutputGroup) []string {
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
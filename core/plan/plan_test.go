@@ -0,0 +1,176 @@
+package plan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/polydawn/gosh"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/git"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+func TestMake(t *testing.T) {
+	Convey("Given a formula", t, func() {
+		frm := &def.Formula{
+			Inputs: def.InputGroup{
+				"rootfs": &def.Input{Type: "tar", Hash: "ware-root", MountPath: "/", Warehouses: def.WarehouseCoords{"file+ca://up", "file+ca://down"}},
+				"src":    &def.Input{Type: "git", Hash: "ware-src", MountPath: "/src/app", Warehouses: def.WarehouseCoords{"https://example.com/src.git"}},
+				"tools":  &def.Input{Type: "tar", Hash: "ware-tools", MountPath: "/src", Warehouses: def.WarehouseCoords{"file+ca://down"}},
+			},
+			Action: def.Action{
+				Entrypoint: []string{"make"},
+				Escapes: def.Escapes{Mounts: def.MountGroup{
+					{SourcePath: "/etc/resolv.conf", TargetPath: "/etc/resolv.conf"},
+				}},
+			},
+			Outputs: def.OutputGroup{
+				"bin": &def.Output{Type: "tar", MountPath: "/src/app/bin", Conjecture: true, Warehouses: def.WarehouseCoords{"file+ca://up", "file+ca://down"}},
+			},
+		}
+		checker := Checker{
+			Cached: func(ware def.Ware) bool {
+				return ware.Hash == "ware-src"
+			},
+			Readable: func(ware def.Ware, cached bool, uri def.WarehouseCoord) error {
+				switch {
+				case uri == "file+ca://down":
+					return &def.ErrWarehouseUnavailable{From: uri, During: "fetch"}
+				case cached:
+					return &ErrUnchecked{Reason: "cached"}
+				}
+				return nil
+			},
+			Writable: func(kind string, uri def.WarehouseCoord) error {
+				if uri == "file+ca://down" {
+					return &def.ErrWarehouseUnavailable{From: uri, During: "save"}
+				}
+				return nil
+			},
+		}
+
+		Convey("Planning should check every input and output warehouse", func() {
+			p := Make(frm, "runc", "overlay", checker)
+			So(p.FormulaHID, ShouldEqual, frm.Hash())
+			So(p.Executor, ShouldEqual, "runc")
+			So(p.Placer, ShouldEqual, "overlay")
+			So(p.Inputs, ShouldHaveLength, 3)
+			So(p.Inputs[0].Name, ShouldEqual, "rootfs")
+			So(p.Inputs[0].Cached, ShouldBeFalse)
+			So(p.Inputs[0].Warehouses[0], ShouldResemble, Check{URI: "file+ca://up", Status: StatusOK})
+			So(p.Inputs[0].Warehouses[1].Status, ShouldEqual, StatusUnavailable)
+			So(p.Inputs[1].Name, ShouldEqual, "src")
+			So(p.Inputs[1].Cached, ShouldBeTrue)
+			So(p.Inputs[1].Warehouses[0], ShouldResemble, Check{URI: "https://example.com/src.git", Status: StatusUnchecked, Reason: "cached"})
+			So(p.Outputs, ShouldHaveLength, 1)
+			So(p.Outputs[0].Warehouses[0].Status, ShouldEqual, StatusOK)
+			So(p.Outputs[0].Warehouses[1].Status, ShouldEqual, StatusUnavailable)
+
+			Convey("And list what would stop the run", func() {
+				So(p.Problems, ShouldHaveLength, 2)
+				So(p.Problems[0], ShouldStartWith, `input "tools": ware tar:ware-tools is not cached, and no warehouse has it`)
+				So(p.Problems[1], ShouldStartWith, `output "bin": can't save to warehouse "file+ca://down"`)
+			})
+
+			Convey("And give the assembly order", func() {
+				So(p.Assembly, ShouldResemble, []Part{
+					{MountPath: "/", Input: "rootfs", Writable: true},
+					{MountPath: "/etc/resolv.conf", HostPath: "/etc/resolv.conf"},
+					{MountPath: "/src", Input: "tools", Writable: true},
+					{MountPath: "/src/app", Input: "src", Writable: true},
+				})
+			})
+		})
+
+		Convey("Broken formulas should have every problem listed", func() {
+			frm.Action.Entrypoint = nil
+			frm.Inputs["tools"].MountPath = "/src/app/"
+			frm.Inputs["src"].Hash = ""
+			frm.Outputs["bin"].MountPath = ""
+			p := Make(frm, "runc", "overlay", checker)
+			So(p.Problems, ShouldContain, "action: no command given")
+			So(p.Problems, ShouldContain, `input "src": no hash given`)
+			So(p.Problems, ShouldContain, `input "tools": mount path "/src/app" is already used by input "src"`)
+			So(p.Problems, ShouldContain, `output "bin": no mount path given`)
+		})
+	})
+}
+
+func TestProbe(t *testing.T) {
+	Convey("Given a tar ware in a warehouse", t, testutil.WithTmpdir(func(c C) {
+		log := testutil.TestLogger(c)
+		cwd, _ := os.Getwd()
+		caURI := def.WarehouseCoord("file+ca://" + filepath.Join(cwd, "ca"))
+		os.Mkdir("ca", 0755)
+		filefixture.Beta.Create("fixture")
+		transmat := tar.New("work")
+		hash := transmat.Scan(tar.Kind, "fixture", []rio.SiloURI{rio.SiloURI(caURI)}, log)
+		ware := def.Ware{Type: string(tar.Kind), Hash: string(hash)}
+		checker := Probe(transmat, log)
+
+		Convey("The warehouse should be found to have it", func() {
+			So(checker.Readable(ware, false, caURI), ShouldBeNil)
+		})
+
+		Convey("Other wares should be reported missing", func() {
+			err := checker.Readable(def.Ware{Type: string(tar.Kind), Hash: "nonexistent"}, false, caURI)
+			So(classify(caURI, err).Status, ShouldEqual, StatusMissing)
+		})
+
+		Convey("Warehouses that aren't there should be reported unavailable", func() {
+			nowhere := def.WarehouseCoord("file+ca://" + filepath.Join(cwd, "nowhere"))
+			So(classify(nowhere, checker.Readable(ware, false, nowhere)).Status, ShouldEqual, StatusUnavailable)
+			So(classify(nowhere, checker.Writable("tar", nowhere)).Status, ShouldEqual, StatusUnavailable)
+		})
+
+		Convey("Writability should be checked where it can be", func() {
+			So(checker.Writable("tar", caURI), ShouldBeNil)
+			So(classify("https://example.com/x", checker.Writable("oci", "https://example.com/x")).Status, ShouldEqual, StatusUnchecked)
+		})
+
+		Convey("Kinds that can only be checked by fetching should be left unchecked", func() {
+			ociWare := def.Ware{Type: "oci", Hash: "sha256:abcd"}
+			So(classify(caURI, checker.Readable(ociWare, false, caURI)).Status, ShouldEqual, StatusUnchecked)
+		})
+	}))
+
+	Convey("Given a git repo with a saved tree", t, testutil.Requires(
+		testutil.WithTmpdir(func(c C) {
+			log := testutil.TestLogger(c)
+			gosh.Gosh("git", "init", "--bare", "--", "repo", gosh.NullIO).RunAndReport()
+			filefixture.Beta.Create("fixture")
+			hash := git.New("gitwork").Scan(git.Kind, "fixture", []rio.SiloURI{"./repo"}, log)
+			ware := def.Ware{Type: string(git.Kind), Hash: string(hash)}
+			checker := Probe(git.New("gitwork"), log)
+
+			Convey("The remote should be found to have it, without fetching", func() {
+				So(checker.Readable(ware, false, "./repo"), ShouldBeNil)
+				fetched, _ := ioutil.ReadDir(filepath.Join("gitwork", "gits"))
+				So(fetched, ShouldBeEmpty)
+				checkouts, _ := ioutil.ReadDir(filepath.Join("gitwork", "full"))
+				So(checkouts, ShouldBeEmpty)
+			})
+
+			Convey("Other commits can't be checked", func() {
+				other := def.Ware{Type: string(git.Kind), Hash: "0000000000000000000000000000000000000000"}
+				So(classify("./repo", checker.Readable(other, false, "./repo")).Status, ShouldEqual, StatusUnchecked)
+			})
+
+			Convey("Remotes that aren't there should be reported unavailable", func() {
+				So(classify("./nowhere", checker.Readable(ware, false, "./nowhere")).Status, ShouldEqual, StatusUnavailable)
+				So(classify("./nowhere", checker.Writable("git", "./nowhere")).Status, ShouldEqual, StatusUnavailable)
+			})
+
+			Convey("Remotes should be checked for writability", func() {
+				So(checker.Writable("git", "./repo"), ShouldBeNil)
+			})
+		}),
+	))
+}
@@ -0,0 +1,106 @@
+package resultcache
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+	"go.polydawn.net/meep"
+	"golang.org/x/crypto/ed25519"
+
+	"go.polydawn.net/repeatr/api/def"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+/*
+	Talks to a result cache server.
+
+	As a `memo.Source`, it offers the runs the server has entries for,
+	but only those correctly signed by one of the `Trusted` keys.
+*/
+type Client struct {
+	URL     string              // base URL of the server.
+	Trusted []ed25519.PublicKey // only entries signed by these keys are believed.
+	Key     ed25519.PrivateKey  // signs published entries.  Not needed to only read.
+	Log     log15.Logger
+}
+
+func (c *Client) String() string {
+	return c.URL
+}
+
+/*
+	Returns the runs of the formula that the server has entries for,
+	and that check out.  Entries that don't are logged, and ignored.
+
+	May panic with:
+
+	  - `*resultcache.ErrUnavailable` -- if the server can't be reached or gives nonsense.
+*/
+func (c *Client) RunsOf(formulaHID string) []*def.RunRecord {
+	url := strings.TrimSuffix(c.URL, "/") + "/v1/runs/" + formulaHID
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		panic(meep.Meep(&ErrUnavailable{URL: c.URL}, meep.Cause(err)))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		panic(meep.Meep(&ErrUnavailable{URL: c.URL}, meep.Cause(fmt.Errorf("http status %s", resp.Status))))
+	}
+	var entries []*Entry
+	if err := codec.NewDecoder(resp.Body, &codec.JsonHandle{}).Decode(&entries); err != nil {
+		panic(meep.Meep(&ErrUnavailable{URL: c.URL}, meep.Cause(fmt.Errorf("unparsable response: %s", err))))
+	}
+	var runs []*def.RunRecord
+	for _, entry := range entries {
+		if err := entry.Verify(formulaHID); err != nil {
+			c.Log.Warn("Ignoring invalid result cache entry", "cache", c.URL, "reason", err)
+			continue
+		}
+		if !trusts(c.Trusted, entry.Key) {
+			c.Log.Debug("Ignoring result cache entry from untrusted signer", "cache", c.URL, "run", entry.RunRecord.HID)
+			continue
+		}
+		runs = append(runs, entry.RunRecord)
+	}
+	return runs
+}
+
+/*
+	Signs the record of a successful run, and sends it to the server.
+
+	May panic with:
+
+	  - `*resultcache.ErrUnavailable` -- if the server can't be reached, or refuses the entry.
+*/
+func (c *Client) Publish(rr *def.RunRecord) {
+	if c.Key == nil {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("cannot publish to a result cache without a key to sign with")),
+		))
+	}
+	var body bytes.Buffer
+	if err := codec.NewEncoder(&body, &codec.JsonHandle{}).Encode(Sign(rr, c.Key)); err != nil {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+		))
+	}
+	url := strings.TrimSuffix(c.URL, "/") + "/v1/runs/" + rr.FormulaHID + "/" + rr.HID
+	req, _ := http.NewRequest("PUT", url, &body)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		panic(meep.Meep(&ErrUnavailable{URL: c.URL}, meep.Cause(err)))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		panic(meep.Meep(&ErrUnavailable{URL: c.URL}, meep.Cause(fmt.Errorf("entry refused: http status %s", resp.Status))))
+	}
+}
@@ -0,0 +1,180 @@
+/*
+	A result cache shares the records of successful runs between hosts,
+	so a formula run on one is a cache hit (see the `memo` package) on all
+	the others.
+
+	The protocol is plain HTTP, with runrecords keyed by formula HID:
+
+		GET /v1/runs/<formulaHID>         -- a json list of entries; empty if none.
+		PUT /v1/runs/<formulaHID>/<HID>   -- store an entry.
+
+	Each entry is a runrecord, signed with ed25519 by whoever ran it.
+	Clients only believe entries signed by keys they trust; servers may
+	also be told which keys to accept entries from.  The signature covers
+	the record's HID, which is a hash of the whole record, so nothing in
+	an entry can be changed without invalidating it.
+
+	Entries don't contain any wares: only the hashes of them.
+	The wares themselves must be in warehouses that other hosts can reach
+	for the entries to be of any use.
+*/
+package resultcache
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"go.polydawn.net/meep"
+	"golang.org/x/crypto/ed25519"
+
+	"go.polydawn.net/repeatr/api/def"
+)
+
+type Entry struct {
+	RunRecord *def.RunRecord `json:"runRecord"`
+	Key       []byte         `json:"key"` // ed25519 public key of the signer.
+	Signature []byte         `json:"sig"`
+}
+
+func signedMessage(formulaHID, hid string) []byte {
+	return []byte("repeatr result cache entry\x00" + formulaHID + "\x00" + hid)
+}
+
+/*
+	Signs a runrecord, whose HIDs must already be computed.
+*/
+func Sign(rr *def.RunRecord, key ed25519.PrivateKey) *Entry {
+	return &Entry{
+		RunRecord: rr,
+		Key:       []byte(key.Public().(ed25519.PublicKey)),
+		Signature: ed25519.Sign(key, signedMessage(rr.FormulaHID, rr.HID)),
+	}
+}
+
+/*
+	Checks that the entry is a consistent, correctly signed record of a
+	successful run of the formula with the given HID.
+	Returns an error describing what's wrong, if anything.
+	Whether the signer is trustworthy is up to the caller.
+*/
+func (e *Entry) Verify(formulaHID string) error {
+	rr := e.RunRecord
+	switch {
+	case rr == nil:
+		return fmt.Errorf("entry has no runrecord")
+	case rr.FormulaHID != formulaHID:
+		return fmt.Errorf("entry is for formula %q, not %q", rr.FormulaHID, formulaHID)
+	case rr.Hash() != rr.HID:
+		return fmt.Errorf("entry's runrecord does not match its HID %q", rr.HID)
+	case rr.Failure != nil || rr.Results["$exitcode"] == nil || rr.Results["$exitcode"].Hash != "0":
+		return fmt.Errorf("entry %q is not of a successful run", rr.HID)
+	case len(e.Key) != ed25519.PublicKeySize:
+		return fmt.Errorf("entry %q has a malformed key", rr.HID)
+	case !ed25519.Verify(ed25519.PublicKey(e.Key), signedMessage(rr.FormulaHID, rr.HID), e.Signature):
+		return fmt.Errorf("entry %q has a bad signature", rr.HID)
+	}
+	return nil
+}
+
+func trusts(trusted []ed25519.PublicKey, key []byte) bool {
+	for _, k := range trusted {
+		if string(k) == string(key) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Generates a new signing key, writing the private key to `path` and
+	the public key to `path + ".pub"`, each as one line of base64.
+
+	May panic with:
+
+	  - `*resultcache.ErrKey` -- if the files can't be written (or already exist).
+*/
+func GenerateKey(path string) ed25519.PublicKey {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(meep.Meep(&ErrKey{Path: path}, meep.Cause(err)))
+	}
+	writeKey(path, priv, 0600)
+	writeKey(path+".pub", pub, 0644)
+	return pub
+}
+
+func writeKey(path string, key []byte, perm os.FileMode) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		panic(meep.Meep(&ErrKey{Path: path}, meep.Cause(err)))
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(FormatKey(key) + "\n")); err != nil {
+		panic(meep.Meep(&ErrKey{Path: path}, meep.Cause(err)))
+	}
+}
+
+/*
+	Formats a key the way key files hold them.
+*/
+func FormatKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+/*
+	Loads a private key written by `GenerateKey`.
+
+	May panic with:
+
+	  - `*resultcache.ErrKey` -- if the file can't be read, or isn't a key.
+*/
+func LoadPrivateKey(path string) ed25519.PrivateKey {
+	return ed25519.PrivateKey(readKey(path, ed25519.PrivateKeySize))
+}
+
+/*
+	Loads a public key written by `GenerateKey`.
+
+	May panic with:
+
+	  - `*resultcache.ErrKey` -- if the file can't be read, or isn't a key.
+*/
+func LoadPublicKey(path string) ed25519.PublicKey {
+	return ed25519.PublicKey(readKey(path, ed25519.PublicKeySize))
+}
+
+func readKey(path string, size int) []byte {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(meep.Meep(&ErrKey{Path: path}, meep.Cause(err)))
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		panic(meep.Meep(&ErrKey{Path: path}, meep.Cause(err)))
+	}
+	if len(key) != size {
+		panic(meep.Meep(&ErrKey{Path: path}, meep.Cause(fmt.Errorf("expected a %d byte key, got %d bytes", size, len(key)))))
+	}
+	return key
+}
+
+/*
+	Raised when a key file can't be read or written.
+*/
+type ErrKey struct {
+	meep.TraitAutodescribing
+	meep.TraitCausable
+	Path string
+}
+
+/*
+	Raised when a result cache server can't be reached, or refuses a request.
+*/
+type ErrUnavailable struct {
+	meep.TraitAutodescribing
+	meep.TraitCausable
+	URL string
+}
@@ -0,0 +1,143 @@
+package resultcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/ugorji/go/codec"
+	"go.polydawn.net/meep"
+	"golang.org/x/crypto/ed25519"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/core/memo"
+	"go.polydawn.net/repeatr/lib/testutil"
+)
+
+func fixtureRun(frm *def.Formula, uid string, exitcode string) *def.RunRecord {
+	rr := &def.RunRecord{
+		UID:        def.RunID(uid),
+		Date:       time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC),
+		FormulaHID: frm.Hash(),
+		Results: def.ResultGroup{
+			"out":       &def.Result{"out", def.Ware{"tar", "ware-" + uid}},
+			"$exitcode": &def.Result{"$exitcode", def.Ware{"exitcode", exitcode}},
+		},
+	}
+	rr.HID = rr.Hash()
+	return rr
+}
+
+func TestResultCache(t *testing.T) {
+	Convey("Given a result cache server, and hosts with keys", t, testutil.WithTmpdir(func(c C) {
+		log := testutil.TestLogger(c)
+		pubA, privA, _ := ed25519.GenerateKey(nil)
+		_, privB, _ := ed25519.GenerateKey(nil)
+		server := &Server{Dir: "cache", Log: log}
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+		hostA := &Client{URL: srv.URL, Key: privA, Trusted: []ed25519.PublicKey{pubA}, Log: log}
+		hostB := &Client{URL: srv.URL, Trusted: []ed25519.PublicKey{pubA}, Log: log}
+		frm := &def.Formula{
+			Action:  def.Action{Entrypoint: []string{"echo"}},
+			Outputs: def.OutputGroup{"out": &def.Output{Type: "tar", MountPath: "/out"}},
+		}
+		rr := fixtureRun(frm, "run1", "0")
+
+		Convey("Formulas nobody has run should have no entries", func() {
+			So(hostB.RunsOf(frm.Hash()), ShouldBeEmpty)
+		})
+
+		Convey("A run published by one host should be a cache hit on another", func() {
+			hostA.Publish(rr)
+			runs := hostB.RunsOf(frm.Hash())
+			So(runs, ShouldHaveLength, 1)
+			So(runs[0].HID, ShouldEqual, rr.HID)
+			So(runs[0].Results["out"].Hash, ShouldEqual, "ware-run1")
+			found := memo.Lookup(frm, []memo.Source{hostB}, func(def.Ware, def.WarehouseCoords) bool { return true }, log)
+			So(found, ShouldNotBeNil)
+			So(found.HID, ShouldEqual, rr.HID)
+
+			Convey("Publishing again should change nothing", func() {
+				hostA.Publish(rr)
+				So(hostB.RunsOf(frm.Hash()), ShouldHaveLength, 1)
+			})
+
+			Convey("Hosts not trusting the signer should ignore it", func() {
+				hostC := &Client{URL: srv.URL, Trusted: []ed25519.PublicKey{privB.Public().(ed25519.PublicKey)}, Log: log}
+				So(hostC.RunsOf(frm.Hash()), ShouldBeEmpty)
+			})
+
+			Convey("Tampered entries should be ignored", func() {
+				pth := filepath.Join("cache", frm.Hash(), rr.HID)
+				body, _ := ioutil.ReadFile(pth)
+				ioutil.WriteFile(pth, []byte(strings.Replace(string(body), "ware-run1", "ware-evil", 1)), 0644)
+				So(hostB.RunsOf(frm.Hash()), ShouldBeEmpty)
+			})
+		})
+
+		Convey("Servers should refuse failed runs", func() {
+			err := meep.RecoverPanics(func() { hostA.Publish(fixtureRun(frm, "run2", "1")) })
+			So(err, ShouldHaveSameTypeAs, &ErrUnavailable{})
+			So(hostB.RunsOf(frm.Hash()), ShouldBeEmpty)
+		})
+
+		Convey("Servers with trusted keys should refuse entries signed by others", func() {
+			server.Trusted = []ed25519.PublicKey{pubA}
+			hostB.Key = privB
+			err := meep.RecoverPanics(func() { hostB.Publish(rr) })
+			So(err, ShouldHaveSameTypeAs, &ErrUnavailable{})
+			hostA.Publish(rr)
+			So(hostB.RunsOf(frm.Hash()), ShouldHaveLength, 1)
+		})
+
+		Convey("Servers should refuse entries filed under the wrong names", func() {
+			var body bytes.Buffer
+			codec.NewEncoder(&body, &codec.JsonHandle{}).Encode(Sign(rr, privA))
+			req, _ := http.NewRequest("PUT", srv.URL+"/v1/runs/"+frm.Hash()+"/elsewhere", &body)
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, 400)
+			So(hostB.RunsOf(frm.Hash()), ShouldBeEmpty)
+		})
+
+		Convey("Paths that aren't HIDs should not be found", func() {
+			resp, err := http.Get(srv.URL + "/v1/runs/..%2f..%2fetc")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, 404)
+		})
+
+		Convey("Unreachable servers should be reported", func() {
+			srv.Close()
+			err := meep.RecoverPanics(func() { hostB.RunsOf(frm.Hash()) })
+			So(err, ShouldHaveSameTypeAs, &ErrUnavailable{})
+		})
+	}))
+}
+
+func TestKeys(t *testing.T) {
+	Convey("Generated keys should load back", t, testutil.WithTmpdir(func() {
+		pub := GenerateKey("key")
+		priv := LoadPrivateKey("key")
+		So([]byte(priv.Public().(ed25519.PublicKey)), ShouldResemble, []byte(pub))
+		So([]byte(LoadPublicKey("key.pub")), ShouldResemble, []byte(pub))
+
+		Convey("But not overwrite existing ones", func() {
+			err := meep.RecoverPanics(func() { GenerateKey("key") })
+			So(err, ShouldHaveSameTypeAs, &ErrKey{})
+		})
+
+		Convey("And the wrong kind of key should be rejected", func() {
+			err := meep.RecoverPanics(func() { LoadPrivateKey("key.pub") })
+			So(err, ShouldHaveSameTypeAs, &ErrKey{})
+		})
+	}))
+}
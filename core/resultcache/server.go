@@ -0,0 +1,159 @@
+package resultcache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/ed25519"
+)
+
+/*
+	Serves a result cache from a directory, laid out as:
+
+		<dir>/<formulaHID>/<HID>  -- each entry, as json
+
+	Entries are checked before they're stored, so a server never hands
+	out an entry that doesn't verify.  If `Trusted` is set, entries must
+	also be signed by one of those keys, or they're refused.
+*/
+type Server struct {
+	Dir     string
+	Trusted []ed25519.PublicKey // if empty, entries signed by anyone are accepted.
+	Log     log15.Logger
+}
+
+const maxEntrySize = 4 << 20
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v1/runs/"), "/")
+	if !strings.HasPrefix(req.URL.Path, "/v1/runs/") || len(parts) > 2 {
+		http.NotFound(w, req)
+		return
+	}
+	for _, part := range parts {
+		if !validHID(part) {
+			http.NotFound(w, req)
+			return
+		}
+	}
+	switch {
+	case req.Method == "GET" && len(parts) == 1:
+		s.list(w, parts[0])
+	case req.Method == "PUT" && len(parts) == 2:
+		s.put(w, req, parts[0], parts[1])
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HIDs are base58, so anything else can't be one (and can't escape the dir).
+func validHID(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) list(w http.ResponseWriter, formulaHID string) {
+	dir := filepath.Join(s.Dir, formulaHID)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		s.Log.Error("cannot list entries", "formula", formulaHID, "error", err)
+		http.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	// The entries are already json; just splice them into a list.
+	var body bytes.Buffer
+	body.WriteString("[")
+	n := 0
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		entry, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			s.Log.Error("cannot read entry", "formula", formulaHID, "run", fi.Name(), "error", err)
+			continue
+		}
+		if n > 0 {
+			body.WriteString(",")
+		}
+		body.Write(bytes.TrimSpace(entry))
+		n++
+	}
+	body.WriteString("]\n")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body.Bytes())
+}
+
+func (s *Server) put(w http.ResponseWriter, req *http.Request, formulaHID, hid string) {
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, maxEntrySize+1))
+	if err != nil {
+		http.Error(w, "cannot read entry", http.StatusBadRequest)
+		return
+	}
+	if len(raw) > maxEntrySize {
+		http.Error(w, "entry too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var entry Entry
+	if err := codec.NewDecoderBytes(raw, &codec.JsonHandle{}).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("unparsable entry: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := entry.Verify(formulaHID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if entry.RunRecord.HID != hid {
+		http.Error(w, fmt.Sprintf("entry is for run %q, not %q", entry.RunRecord.HID, hid), http.StatusBadRequest)
+		return
+	}
+	if len(s.Trusted) > 0 && !trusts(s.Trusted, entry.Key) {
+		http.Error(w, "entry not signed by a trusted key", http.StatusForbidden)
+		return
+	}
+	if err := s.store(formulaHID, hid, raw); err != nil {
+		s.Log.Error("cannot store entry", "formula", formulaHID, "run", hid, "error", err)
+		http.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	s.Log.Info("stored entry", "formula", formulaHID, "run", hid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Entries are named by their HID, so storing one twice changes nothing.
+func (s *Server) store(formulaHID, hid string, raw []byte) error {
+	dir := filepath.Join(s.Dir, formulaHID)
+	pth := filepath.Join(dir, hid)
+	if _, err := os.Stat(pth); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(raw)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), pth)
+}
@@ -0,0 +1,189 @@
+/*
+	Checks that formulas really are reproducible: that every output marked
+	as a `Conjecture` comes out the same, run after run.
+
+	Each run's files live under a different path on the host (named by the
+	run ID), so that's checked for free; but nothing the process can see
+	varies unless we vary it.  Perturbations do that on purpose.
+*/
+package verify
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/mirror"
+)
+
+/*
+	Something that shouldn't affect a formula's outputs, but could be
+	made to differ between runs anyway, to make sure.
+*/
+type Perturbation string
+
+const (
+	/*
+		Give each run its own hostname, even if the formula sets one.
+		(Executors that can set a hostname default to the run ID, which
+		differs anyway; this catches formulas that fixed it and came to
+		depend on it.)
+	*/
+	PerturbHostname = Perturbation("hostname")
+
+	/*
+		Pass the environment in a different order each run.
+		(Executors otherwise pass it sorted by key, every time.)
+	*/
+	PerturbEnvOrder = Perturbation("env-order")
+
+	/*
+		Run each time from a different parent path: the mount holding the
+		working dir (the deepest one other than "/"), and every input and
+		output mounted within it, are moved under "/verify-<n>".
+		Catches builds that record their own absolute paths.
+	*/
+	PerturbCwdParent = Perturbation("cwd-parent")
+)
+
+var Perturbations = []Perturbation{
+	PerturbHostname,
+	PerturbEnvOrder,
+	PerturbCwdParent,
+}
+
+/*
+	Returns a copy of the formula that saves its outputs nowhere but the
+	scratch warehouse -- and there, only conjectured outputs of the
+	tar-packed kinds -- so that each run's outputs can be fetched for
+	comparison, and verifying doesn't publish anything.
+*/
+func Prepare(frm *def.Formula, scratch rio.SiloURI) *def.Formula {
+	frm = frm.Clone()
+	for _, output := range frm.Outputs {
+		output.Warehouses = nil
+		if output.Conjecture && mirror.TarPacked[rio.TransmatKind(output.Type)] {
+			output.Warehouses = def.WarehouseCoords{def.WarehouseCoord(scratch)}
+		}
+	}
+	return frm
+}
+
+/*
+	Returns a copy of the formula, perturbed for the `run`th run (from zero).
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the formula can't be perturbed so:
+	    e.g. moving the cwd's parent, when the cwd isn't within any mount but "/".
+*/
+func Perturb(frm *def.Formula, run int, perturbations []Perturbation) *def.Formula {
+	frm = frm.Clone()
+	for _, p := range perturbations {
+		switch p {
+		case PerturbHostname:
+			frm.Action.Hostname = fmt.Sprintf("verify-%d", run+1)
+		case PerturbEnvOrder:
+			frm.Action.EnvRotation = run + 1
+		case PerturbCwdParent:
+			moveCwdParent(frm, fmt.Sprintf("/verify-%d", run+1))
+		default:
+			panic(meep.Meep(
+				&meep.ErrProgrammer{},
+				meep.Cause(fmt.Errorf("unknown perturbation %q", p)),
+			))
+		}
+	}
+	return frm
+}
+
+/*
+	Moves the mount holding the cwd, and all mounted within it, under `parent`.
+	Mutates; only call on a clone.
+*/
+func moveCwdParent(frm *def.Formula, parent string) {
+	cwd := path.Clean("/" + frm.Action.Cwd)
+	anchor := ""
+	for _, mountPath := range mountPaths(frm) {
+		if mountPath != "/" && within(cwd, mountPath) && len(mountPath) > len(anchor) {
+			anchor = mountPath
+		}
+	}
+	if anchor == "" {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("cannot move the parent of cwd %q: it isn't within any input or output but the root", cwd),
+		})
+	}
+	for _, input := range frm.Inputs {
+		if within(path.Clean(input.MountPath), anchor) {
+			input.MountPath = parent + path.Clean(input.MountPath)
+		}
+	}
+	for _, output := range frm.Outputs {
+		if within(path.Clean(output.MountPath), anchor) {
+			output.MountPath = parent + path.Clean(output.MountPath)
+		}
+	}
+	frm.Action.Cwd = parent + cwd
+}
+
+func mountPaths(frm *def.Formula) []string {
+	var paths []string
+	for _, input := range frm.Inputs {
+		paths = append(paths, path.Clean(input.MountPath))
+	}
+	for _, output := range frm.Outputs {
+		paths = append(paths, path.Clean(output.MountPath))
+	}
+	return paths
+}
+
+// Reports whether `pth` is `dir` or beneath it.  Both must be clean.
+func within(pth string, dir string) bool {
+	return pth == dir || strings.HasPrefix(pth, dir+"/")
+}
+
+/*
+	A conjectured output that didn't come out the same in every run.
+*/
+type Divergence struct {
+	Output string
+	Wares  []def.Ware // the output's ware in each run, in order.
+}
+
+/*
+	Compares the conjectured outputs of runs of the formula, returning the
+	ones that diverged, sorted by name.  An output missing from a run
+	counts as diverging, with a blank ware.
+*/
+func Compare(frm *def.Formula, runs []*def.RunRecord) []Divergence {
+	var names []string
+	for name, output := range frm.Outputs {
+		if output.Conjecture {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var divergences []Divergence
+	for _, name := range names {
+		wares := make([]def.Ware, len(runs))
+		same := true
+		for i, rr := range runs {
+			if result := rr.Results[name]; result != nil {
+				wares[i] = result.Ware
+			}
+			if wares[i] != wares[0] || wares[i].Hash == "" {
+				same = false
+			}
+		}
+		if !same {
+			divergences = append(divergences, Divergence{name, wares})
+		}
+	}
+	return divergences
+}
@@ -0,0 +1,98 @@
+package verify
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+)
+
+func TestVerify(t *testing.T) {
+	Convey("Given a formula with conjectured outputs", t, func() {
+		frm := &def.Formula{
+			Action: def.Action{Entrypoint: []string{"echo"}, Hostname: "fixed"},
+			Outputs: def.OutputGroup{
+				"product": &def.Output{Type: "tar", MountPath: "/out", Conjecture: true, Warehouses: def.WarehouseCoords{"file+ca://wh"}},
+				"tree":    &def.Output{Type: "git", MountPath: "/tree", Conjecture: true},
+				"logs":    &def.Output{Type: "tar", MountPath: "/logs"},
+			},
+		}
+
+		Convey("Preparing should save tar-packed conjectures to the scratch warehouse, and nothing anywhere else", func() {
+			prepared := Prepare(frm, "file+ca:///scratch")
+			So(prepared.Outputs["product"].Warehouses, ShouldResemble, def.WarehouseCoords{"file+ca:///scratch"})
+			So(prepared.Outputs["tree"].Warehouses, ShouldBeEmpty)
+			So(prepared.Outputs["logs"].Warehouses, ShouldBeEmpty)
+			So(prepared.Hash(), ShouldEqual, frm.Hash())
+			Convey("Without touching the original", func() {
+				So(frm.Outputs["product"].Warehouses, ShouldResemble, def.WarehouseCoords{"file+ca://wh"})
+			})
+		})
+
+		Convey("Perturbing should vary the hostname by run", func() {
+			So(Perturb(frm, 0, nil).Action.Hostname, ShouldEqual, "fixed")
+			So(Perturb(frm, 0, []Perturbation{PerturbHostname}).Action.Hostname, ShouldEqual, "verify-1")
+			So(Perturb(frm, 1, []Perturbation{PerturbHostname}).Action.Hostname, ShouldEqual, "verify-2")
+			So(frm.Action.Hostname, ShouldEqual, "fixed")
+		})
+
+		Convey("Perturbing should vary the env order by run", func() {
+			frm.Action.Env = def.Env{"A": "1", "B": "2", "C": "3"}
+			So(Perturb(frm, 0, nil).Action.Env.Slice(Perturb(frm, 0, nil).Action.EnvRotation), ShouldResemble, []string{"A=1", "B=2", "C=3"})
+			first := Perturb(frm, 0, []Perturbation{PerturbEnvOrder})
+			second := Perturb(frm, 1, []Perturbation{PerturbEnvOrder})
+			So(first.Action.Env.Slice(first.Action.EnvRotation), ShouldResemble, []string{"B=2", "C=3", "A=1"})
+			So(second.Action.Env.Slice(second.Action.EnvRotation), ShouldResemble, []string{"C=3", "A=1", "B=2"})
+			So(second.Hash(), ShouldEqual, frm.Hash())
+		})
+
+		Convey("Perturbing should move the cwd and what's mounted around it", func() {
+			frm.Inputs = def.InputGroup{
+				"rootfs": &def.Input{Type: "tar", Hash: "r", MountPath: "/"},
+				"src":    &def.Input{Type: "tar", Hash: "s", MountPath: "/task"},
+				"deps":   &def.Input{Type: "tar", Hash: "d", MountPath: "/task/deps"},
+				"tools":  &def.Input{Type: "tar", Hash: "t", MountPath: "/opt/tools"},
+			}
+			frm.Action.Cwd = "/task/build"
+			moved := Perturb(frm, 1, []Perturbation{PerturbCwdParent})
+			So(moved.Action.Cwd, ShouldEqual, "/verify-2/task/build")
+			So(moved.Inputs["rootfs"].MountPath, ShouldEqual, "/")
+			So(moved.Inputs["src"].MountPath, ShouldEqual, "/verify-2/task")
+			So(moved.Inputs["deps"].MountPath, ShouldEqual, "/verify-2/task/deps")
+			So(moved.Inputs["tools"].MountPath, ShouldEqual, "/opt/tools")
+			So(moved.Outputs["product"].MountPath, ShouldEqual, "/out")
+			So(frm.Inputs["src"].MountPath, ShouldEqual, "/task")
+
+			Convey("But only if something besides the root holds the cwd", func() {
+				frm.Action.Cwd = "/usr/src"
+				err := meep.RecoverPanics(func() {
+					Perturb(frm, 0, []Perturbation{PerturbCwdParent})
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrConfigValidation{})
+			})
+		})
+
+		Convey("Comparing runs should find the outputs that diverged", func() {
+			run := func(product, tree, logs string) *def.RunRecord {
+				rr := &def.RunRecord{Results: def.ResultGroup{
+					"tree":      &def.Result{"tree", def.Ware{"git", tree}},
+					"logs":      &def.Result{"logs", def.Ware{"tar", logs}},
+					"$exitcode": &def.Result{"$exitcode", def.Ware{"exitcode", "0"}},
+				}}
+				if product != "" {
+					rr.Results["product"] = &def.Result{"product", def.Ware{"tar", product}}
+				}
+				return rr
+			}
+			So(Compare(frm, []*def.RunRecord{run("p1", "t1", "l1"), run("p1", "t1", "l2")}), ShouldBeEmpty)
+			So(Compare(frm, []*def.RunRecord{run("p1", "t1", "l1"), run("p1", "t2", "l1"), run("p1", "t1", "l1")}), ShouldResemble, []Divergence{
+				{"tree", []def.Ware{{"git", "t1"}, {"git", "t2"}, {"git", "t1"}}},
+			})
+			So(Compare(frm, []*def.RunRecord{run("p1", "t1", "l1"), run("", "t1", "l1")}), ShouldResemble, []Divergence{
+				{"product", []def.Ware{{"tar", "p1"}, {}}},
+			})
+		})
+	})
+}
@@ -96,6 +96,10 @@ type MaterializerOptions struct {
 	AcceptHashMismatch bool
 
 	FilterSet filter.FilterSet
+
+	// Compression for transmats that produce compressed blobs, e.g. "zstd:19".
+	// Empty means whatever the transmat defaults to; transmats with no use for it ignore it.
+	Compression string
 }
 
 type MaterializerConfigurer func(*MaterializerOptions)
@@ -118,6 +122,12 @@ func UseFilter(filt filter.Filter) MaterializerConfigurer {
 	}
 }
 
+func UseCompression(spec string) MaterializerConfigurer {
+	return func(opts *MaterializerOptions) {
+		opts.Compression = spec
+	}
+}
+
 func ConvertFilterConfig(conf def.Filters) []MaterializerConfigurer {
 	filterOptions := make([]MaterializerConfigurer, 0, 3)
 	switch conf.UidMode {
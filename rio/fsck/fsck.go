@@ -0,0 +1,126 @@
+/*
+	Checks the integrity of content-addressable warehouses.
+
+	Every object in the warehouse is re-hashed -- using exactly the same
+	`fshash` logic the transmats use to verify wares when materializing --
+	and compared against the hash it's stored under.  Objects that don't
+	match, or that can't be unpacked at all, are reported; so are any staging
+	files left behind by uploads that were interrupted before committing.
+*/
+package fsck
+
+import (
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+type Status string
+
+const (
+	StatusOK         = Status("ok")
+	StatusMismatch   = Status("mismatch")   // the content hashes to something else.
+	StatusCorrupt    = Status("corrupt")    // the content isn't a readable packed ware at all.
+	StatusUnreadable = Status("unreadable") // the warehouse wouldn't give us the content.
+	StatusOrphan     = Status("orphan")     // debris from an interrupted upload.
+)
+
+/*
+	The outcome of checking one object.
+*/
+type Finding struct {
+	Name        string // the name the object is stored under; the expected hash, for wares.
+	Status      Status
+	Detail      string // the actual hash for mismatches; an error message for other problems.
+	Quarantined bool
+}
+
+func (f Finding) Bad() bool {
+	return f.Status == StatusMismatch || f.Status == StatusCorrupt
+}
+
+type Summary struct {
+	Checked    int // count of wares hashed (not counting orphans).
+	Bad        int // count of mismatched and corrupt wares.
+	Unreadable int
+	Orphans    int
+}
+
+func (s Summary) Clean() bool {
+	return s.Bad == 0 && s.Unreadable == 0 && s.Orphans == 0
+}
+
+/*
+	Check every object in the warehouse, calling `report` with each finding
+	as it's made (warehouses may be large; this is a long-running operation).
+
+	If `quarantine` is set, bad objects are moved into the warehouse's
+	quarantine area.  Orphans are only reported; an upload may still be
+	in progress, and only the operator can know.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the warehouse can't be listed
+	    (or can't quarantine, when requested).
+	  - `*def.ErrWarehouseProblem` -- if listing or quarantining fails.
+*/
+func Verify(wh rio.BlobInventory, quarantine bool, log log15.Logger, report func(Finding)) Summary {
+	var summary Summary
+	for _, info := range wh.List() {
+		name := info.Name
+		if strings.HasPrefix(name, rio.UploadStagePrefix) {
+			summary.Orphans++
+			report(Finding{Name: name, Status: StatusOrphan})
+			continue
+		}
+		finding := check(wh, name, log)
+		summary.Checked++
+		switch {
+		case finding.Bad():
+			summary.Bad++
+			if quarantine {
+				wh.Quarantine(name)
+				finding.Quarantined = true
+			}
+		case finding.Status == StatusUnreadable:
+			summary.Unreadable++
+		}
+		report(finding)
+	}
+	return summary
+}
+
+func check(wh rio.BlobInventory, name string, log log15.Logger) (finding Finding) {
+	finding.Name = name
+	meep.Try(func() {
+		stream := wh.OpenReader(rio.CommitID(name))
+		defer stream.Close()
+		actual := tar.HashPacked(stream, log)
+		if actual == rio.CommitID(name) {
+			finding.Status = StatusOK
+		} else {
+			finding.Status = StatusMismatch
+			finding.Detail = string(actual)
+		}
+	}, meep.TryPlan{
+		{ByType: &def.ErrWareCorrupt{}, Handler: func(e error) {
+			finding.Status = StatusCorrupt
+			finding.Detail = e.Error()
+		}},
+		{ByType: &def.ErrWareDNE{}, Handler: func(e error) {
+			// vanished between listing and reading; someone else is moving things around.
+			finding.Status = StatusUnreadable
+			finding.Detail = e.Error()
+		}},
+		{ByType: &def.ErrWarehouseProblem{}, Handler: func(e error) {
+			finding.Status = StatusUnreadable
+			finding.Detail = e.Error()
+		}},
+	})
+	return
+}
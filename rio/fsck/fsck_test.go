@@ -0,0 +1,77 @@
+package fsck
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+func TestVerify(t *testing.T) {
+	Convey("Given a content-addressable warehouse", t, testutil.WithTmpdir(func(c C) {
+		cwd, _ := os.Getwd()
+		os.Mkdir("wh", 0755)
+		wh := tar.NewWarehouse(rio.SiloURI("file+ca://" + filepath.Join(cwd, "wh")))
+		filefixture.Alpha.Create("alpha")
+		filefixture.Beta.Create("beta")
+		transmat := tar.New("work")
+		alphaHash := transmat.Scan(tar.Kind, "alpha", []rio.SiloURI{rio.SiloURI("file+ca://" + filepath.Join(cwd, "wh"))}, testutil.TestLogger(c))
+		betaHash := transmat.Scan(tar.Kind, "beta", []rio.SiloURI{rio.SiloURI("file+ca://" + filepath.Join(cwd, "wh"))}, testutil.TestLogger(c))
+
+		collect := func(quarantine bool) (Summary, map[string]Finding) {
+			findings := map[string]Finding{}
+			summary := Verify(wh, quarantine, testutil.TestLogger(c), func(f Finding) {
+				findings[f.Name] = f
+			})
+			return summary, findings
+		}
+
+		Convey("A healthy warehouse should verify clean", func() {
+			summary, findings := collect(false)
+			So(summary.Clean(), ShouldBeTrue)
+			So(summary.Checked, ShouldEqual, 2)
+			So(findings[string(alphaHash)].Status, ShouldEqual, StatusOK)
+		})
+
+		Convey("Given some rot", func() {
+			// swap a ware's content for another's, plant garbage, and leave an upload half-done.
+			os.Rename(filepath.Join("wh", string(betaHash)), filepath.Join("wh", "impostor"))
+			ioutil.WriteFile(filepath.Join("wh", "garbage"), bytes.Repeat([]byte("not a tarball"), 100), 0644)
+			ioutil.WriteFile(filepath.Join("wh", rio.UploadStagePrefix+"abandoned"), []byte{}, 0644)
+
+			Convey("Verify should report each problem", func() {
+				summary, findings := collect(false)
+				So(summary.Clean(), ShouldBeFalse)
+				So(summary.Checked, ShouldEqual, 3)
+				So(summary.Bad, ShouldEqual, 2)
+				So(summary.Orphans, ShouldEqual, 1)
+				So(findings[string(alphaHash)].Status, ShouldEqual, StatusOK)
+				So(findings["impostor"].Status, ShouldEqual, StatusMismatch)
+				So(findings["impostor"].Detail, ShouldEqual, string(betaHash))
+				So(findings["garbage"].Status, ShouldEqual, StatusCorrupt)
+				So(findings[rio.UploadStagePrefix+"abandoned"].Status, ShouldEqual, StatusOrphan)
+			})
+
+			Convey("Verify with quarantine should move bad wares aside", func() {
+				_, findings := collect(true)
+				So(findings["impostor"].Quarantined, ShouldBeTrue)
+				So(filepath.Join("wh", rio.QuarantineDir, "impostor"), testutil.ShouldBeFile)
+				So(filepath.Join("wh", rio.QuarantineDir, "garbage"), testutil.ShouldBeFile)
+
+				Convey("And then only the orphan should remain a problem", func() {
+					summary, _ := collect(false)
+					So(summary.Bad, ShouldEqual, 0)
+					So(summary.Orphans, ShouldEqual, 1)
+				})
+			})
+		})
+	}))
+}
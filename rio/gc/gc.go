@@ -0,0 +1,97 @@
+/*
+	Collects garbage in content-addressable warehouses.
+
+	The caller decides what's live -- typically by gathering every ware hash
+	mentioned in a set of formulas, run records, and catalogs -- and everything
+	else in the warehouse is removed, as long as it's older than a grace period.
+	The grace period protects wares which were uploaded recently but aren't
+	referenced by any root *yet* (e.g. the outputs of a run in progress).
+
+	Debris from interrupted uploads is collected the same way, once it's
+	older than the grace period.  Quarantined objects are never touched.
+*/
+package gc
+
+import (
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	A set of ware hashes which must be kept.
+*/
+type LiveSet map[rio.CommitID]struct{}
+
+func (ls LiveSet) Add(hash rio.CommitID) {
+	if hash == "" {
+		return
+	}
+	ls[hash] = struct{}{}
+}
+
+func (ls LiveSet) Contains(hash rio.CommitID) bool {
+	_, ok := ls[hash]
+	return ok
+}
+
+/*
+	Describes an object which was (or, on a dry run, would have been) removed.
+*/
+type Sweep struct {
+	Name    string
+	ModTime time.Time
+	Orphan  bool // true if this was debris from an interrupted upload rather than a ware.
+}
+
+type Summary struct {
+	Live  int // count of objects kept because they're live.
+	Young int // count of unreferenced objects kept because they're within the grace period (or of unknown age).
+	Swept int // count of objects removed (or that would have been, on a dry run).
+}
+
+/*
+	Remove every object in the warehouse not in the live set and older than
+	`grace` (as of `now`), calling `report` for each.
+	If `dryRun` is set, report only; remove nothing.
+
+	Objects whose age the warehouse can't report are always kept.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the warehouse can't be listed or isn't writable.
+	  - `*def.ErrWarehouseProblem` -- if listing or removing fails.
+*/
+func Collect(
+	wh rio.BlobInventory,
+	live LiveSet,
+	grace time.Duration,
+	now time.Time,
+	dryRun bool,
+	log log15.Logger,
+	report func(Sweep),
+) Summary {
+	var summary Summary
+	cutoff := now.Add(-grace)
+	for _, info := range wh.List() {
+		orphan := strings.HasPrefix(info.Name, rio.UploadStagePrefix)
+		if !orphan && live.Contains(rio.CommitID(info.Name)) {
+			summary.Live++
+			continue
+		}
+		if info.ModTime.IsZero() || info.ModTime.After(cutoff) {
+			log.Debug("Keeping unreferenced object within grace period", "name", info.Name, "mtime", info.ModTime)
+			summary.Young++
+			continue
+		}
+		if !dryRun {
+			wh.Delete(info.Name)
+		}
+		summary.Swept++
+		report(Sweep{Name: info.Name, ModTime: info.ModTime, Orphan: orphan})
+	}
+	return summary
+}
@@ -0,0 +1,62 @@
+package gc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+func TestCollect(t *testing.T) {
+	Convey("Given a content-addressable warehouse", t, testutil.WithTmpdir(func(c C) {
+		cwd, _ := os.Getwd()
+		os.Mkdir("wh", 0755)
+		wh := tar.NewWarehouse(rio.SiloURI("file+ca://" + filepath.Join(cwd, "wh")))
+		now := time.Now()
+		old := now.Add(-48 * time.Hour)
+		place := func(name string, mtime time.Time) {
+			pth := filepath.Join("wh", name)
+			ioutil.WriteFile(pth, []byte(name), 0644)
+			os.Chtimes(pth, mtime, mtime)
+		}
+		place("live", old)
+		place("dead", old)
+		place("fresh", now)
+		place(rio.UploadStagePrefix+"abandoned", old)
+		os.MkdirAll(filepath.Join("wh", rio.QuarantineDir), 0755)
+		ioutil.WriteFile(filepath.Join("wh", rio.QuarantineDir, "quarantined"), []byte{}, 0644)
+		live := LiveSet{}
+		live.Add("live")
+
+		collect := func(dryRun bool) (Summary, []string) {
+			var swept []string
+			summary := Collect(wh, live, 24*time.Hour, now, dryRun, testutil.TestLogger(c), func(s Sweep) {
+				swept = append(swept, s.Name)
+			})
+			return summary, swept
+		}
+
+		Convey("A dry run should report but remove nothing", func() {
+			summary, swept := collect(true)
+			So(swept, ShouldResemble, []string{rio.UploadStagePrefix + "abandoned", "dead"})
+			So(summary, ShouldResemble, Summary{Live: 1, Young: 1, Swept: 2})
+			So(filepath.Join("wh", "dead"), testutil.ShouldBeFile)
+		})
+
+		Convey("Collection should remove only old unreferenced objects", func() {
+			collect(false)
+			So(filepath.Join("wh", "dead"), testutil.ShouldBeNotFile)
+			So(filepath.Join("wh", rio.UploadStagePrefix+"abandoned"), testutil.ShouldBeNotFile)
+			So(filepath.Join("wh", "live"), testutil.ShouldBeFile)
+			So(filepath.Join("wh", "fresh"), testutil.ShouldBeFile)
+			So(filepath.Join("wh", rio.QuarantineDir, "quarantined"), testutil.ShouldBeFile)
+		})
+	}))
+}
@@ -0,0 +1,77 @@
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/inconshreveable/log15"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+/*
+	Store a packed tarball from some arbitrary stream -- one built by
+	another tool, say -- in the warehouse `to`, in one pass: the bytes are
+	written verbatim while being hashed on the way past, and committed
+	under the resulting hash once the whole stream checks out as a tar.
+	The hash is the same one scanning the unpacked files would give, so the
+	ware can be used as an input straight away.
+
+	If `to` is content-addressable and already has the ware, its existing
+	copy is kept, and the result is marked `Skipped`.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the kind isn't `TarPacked`, or the URI is unusable.
+	  - `*def.ErrWarehouseUnavailable` -- if the destination can't be reached.
+	  - `*def.ErrWareCorrupt` -- if the stream isn't a (possibly compressed) tar.
+	    Nothing is committed to the destination.
+	  - `*def.ErrWarehouseProblem` -- for IO errors writing to the destination.
+*/
+func Adopt(
+	kind rio.TransmatKind,
+	stream io.Reader,
+	to rio.SiloURI,
+	log log15.Logger,
+) Result {
+	if !TarPacked[kind] {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("only tar-packed kinds can be adopted from a stream, not %q", kind),
+		})
+	}
+	result := Result{Ware: def.Ware{Type: string(kind)}, To: def.WarehouseCoord(to), Streamed: true}
+
+	dest := OpenWarehouse(to)
+	if err := dest.PingWritable(); err != nil {
+		panic(err)
+	}
+
+	// Shovel the raw bytes into the destination while hashing them, same as mirroring;
+	//  the ware's hash isn't known until the end, so write errors can't name it.
+	wc := dest.OpenWriter()
+	committed := false
+	defer func() {
+		if !committed {
+			wc.Abort()
+		}
+	}()
+	tee := io.TeeReader(stream, panickyWriter{wc, result.Ware, result.To})
+	result.Ware.Hash = string(tar.HashPacked(tee, log))
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		panic(&def.ErrWareCorrupt{
+			Msg:  fmt.Sprintf("could not read the rest of the stream: %s", err),
+			Ware: result.Ware,
+		})
+	}
+	if dest.Has(rio.CommitID(result.Ware.Hash)) {
+		log.Info("Destination already has ware, keeping its copy", "warehouse", to, "hash", result.Ware.Hash)
+		result.Skipped = true
+		return result
+	}
+	wc.Commit(rio.CommitID(result.Ware.Hash))
+	committed = true
+	return result
+}
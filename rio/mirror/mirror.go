@@ -0,0 +1,249 @@
+/*
+	Copies wares from one warehouse to another.
+
+	When the ware's kind is one of the tar-packed kinds (tar, s3, gs -- they
+	all share one packing, and thus one hash space), the packed object is
+	streamed from warehouse to warehouse without ever being unpacked; it's
+	hashed in flight, and only committed to the destination if the hash checks out.
+	Any of the warehouse URI schemes those transmats understand may be used
+	on either side, so e.g. an http+ca warehouse may be mirrored into an s3+ca one.
+
+	Other kinds take the long way round: the ware is materialized
+	from the source and scanned into the destination.
+*/
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/gs"
+	"go.polydawn.net/repeatr/rio/transmat/impl/s3"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+/*
+	Kinds whose wares are stored as packed tarballs, and which can be
+	copied between any `rio.BlobWarehouse` without unpacking.
+*/
+var TarPacked = map[rio.TransmatKind]bool{
+	tar.Kind: true,
+	s3.Kind:  true,
+	gs.Kind:  true,
+}
+
+/*
+	Describes the outcome of mirroring one ware.
+*/
+type Result struct {
+	Ware     def.Ware           `json:"ware"`
+	From     def.WarehouseCoord `json:"from,omitempty"` // blank if nothing needed copying.
+	To       def.WarehouseCoord `json:"to"`
+	Skipped  bool               `json:"skipped"`  // true if the destination already had the ware.
+	Streamed bool               `json:"streamed"` // true if copied packed; false if it took the materialize-and-scan route.
+}
+
+/*
+	Open a blob warehouse by URI, picking the implementation by scheme.
+	Credentials for s3 and gs are loaded from the host environment.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the URI is unparsable or of an unknown scheme.
+*/
+func OpenWarehouse(uri rio.SiloURI) rio.BlobWarehouse {
+	u, err := url.Parse(string(uri))
+	if err != nil {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("failed to parse URI: %s", err),
+		})
+	}
+	switch u.Scheme {
+	case "file", "file+ca", "http", "http+ca", "https", "https+ca":
+		return tar.NewWarehouse(uri)
+	case "s3", "s3+ca":
+		return s3.NewWarehouseFromEnv(uri)
+	case "gs", "gs+ca":
+		return gs.NewWarehouseFromEnv(uri)
+	default:
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("unsupported scheme in warehouse URI for mirroring: %q", u.Scheme),
+		})
+	}
+}
+
+/*
+	Copy the ware `kind:dataHash` from the first of `from` that has it into `to`.
+
+	If the destination already has the ware, nothing is copied.
+	(This check is only possible for content-addressable destinations;
+	others are always written.)
+
+	The `transmat` is only used for kinds that aren't `TarPacked`.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if any URI is unusable.
+	  - `*def.ErrWarehouseUnavailable` -- if the destination, or all sources, can't be reached.
+	  - `*def.ErrWareDNE` -- if no source has the ware.
+	  - `*def.ErrHashMismatch` -- if the source's data doesn't match the hash.
+	    Nothing is committed to the destination.
+	  - `*def.ErrWareCorrupt` -- if the source's data can't be unpacked.
+	  - `*def.ErrWarehouseProblem` -- for IO errors along the way.
+*/
+func Mirror(
+	kind rio.TransmatKind,
+	dataHash rio.CommitID,
+	from []rio.SiloURI,
+	to rio.SiloURI,
+	transmat rio.Transmat,
+	log log15.Logger,
+) Result {
+	if TarPacked[kind] {
+		return stream(kind, dataHash, from, to, log)
+	}
+	return rescan(kind, dataHash, from, to, transmat, log)
+}
+
+func stream(
+	kind rio.TransmatKind,
+	dataHash rio.CommitID,
+	from []rio.SiloURI,
+	to rio.SiloURI,
+	log log15.Logger,
+) Result {
+	ware := def.Ware{Type: string(kind), Hash: string(dataHash)}
+	result := Result{Ware: ware, To: def.WarehouseCoord(to), Streamed: true}
+
+	// Check the destination first: if it's down, no point dialing anyone else;
+	//  and if it's already got the goods, we're done.
+	dest := OpenWarehouse(to)
+	if err := dest.PingWritable(); err != nil {
+		panic(err)
+	}
+	if dest.Has(dataHash) {
+		log.Info("Destination already has ware, skipping", "warehouse", to, "hash", dataHash)
+		result.Skipped = true
+		return result
+	}
+
+	// Our policy is to take the first source that has it, same as materializing.
+	var src io.ReadCloser
+	var available bool
+	for _, uri := range from {
+		meep.Try(func() {
+			wh := OpenWarehouse(uri)
+			if err := wh.PingReadable(); err != nil {
+				panic(err)
+			}
+			src = wh.OpenReader(dataHash)
+			result.From = def.WarehouseCoord(uri)
+		}, meep.TryPlan{
+			{ByType: &def.ErrWarehouseUnavailable{}, Handler: func(_ error) {
+				log.Info("Warehouse not available, skipping", "warehouse", uri)
+			}},
+			{ByType: &def.ErrWareDNE{}, Handler: func(_ error) {
+				available = true // but at least someone was *alive*
+				log.Info("Warehouse does not have the data, skipping", "warehouse", uri, "hash", dataHash)
+			}},
+		})
+		if src != nil {
+			break
+		}
+	}
+	if src == nil {
+		if available {
+			panic(&def.ErrWareDNE{Ware: ware})
+		}
+		panic(&def.ErrWarehouseUnavailable{
+			Msg:    "No warehouses responded!",
+			During: "fetch",
+		})
+	}
+	defer src.Close()
+
+	// Shovel the raw bytes into the destination while hashing them on the way past.
+	//  Hashing may finish before the source is exhausted (compression trailers, tar padding),
+	//  so drain whatever's left afterwards; the copy must be byte-for-byte.
+	wc := dest.OpenWriter()
+	committed := false
+	defer func() {
+		if !committed {
+			wc.Abort()
+		}
+	}()
+	tee := io.TeeReader(src, panickyWriter{wc, ware, result.To})
+	actualHash := tar.HashPacked(tee, log)
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    err.Error(),
+			During: "fetch",
+			Ware:   ware,
+			From:   result.From,
+		})
+	}
+	if actualHash != dataHash {
+		panic(&def.ErrHashMismatch{
+			Expected: ware,
+			Actual:   def.Ware{Type: string(kind), Hash: string(actualHash)},
+			From:     result.From,
+		})
+	}
+	wc.Commit(dataHash)
+	committed = true
+	return result
+}
+
+/*
+	Raises write errors as warehouse problems, so they're not mistaken
+	for problems with the source stream they're teed off of.
+*/
+type panickyWriter struct {
+	w    io.Writer
+	ware def.Ware
+	to   def.WarehouseCoord
+}
+
+func (pw panickyWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	if err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    err.Error(),
+			During: "save",
+			Ware:   pw.ware,
+			From:   pw.to,
+		})
+	}
+	return n, nil
+}
+
+func rescan(
+	kind rio.TransmatKind,
+	dataHash rio.CommitID,
+	from []rio.SiloURI,
+	to rio.SiloURI,
+	transmat rio.Transmat,
+	log log15.Logger,
+) Result {
+	ware := def.Ware{Type: string(kind), Hash: string(dataHash)}
+	arena := transmat.Materialize(kind, dataHash, from, log)
+	defer arena.Teardown()
+	actualHash := transmat.Scan(kind, arena.Path(), []rio.SiloURI{to}, log)
+	if actualHash != dataHash {
+		// Materialize already verified the content, so this means the scan
+		//  couldn't faithfully reproduce it.  Not much we can do about that.
+		panic(&def.ErrHashMismatch{
+			Expected: ware,
+			Actual:   def.Ware{Type: string(kind), Hash: string(actualHash)},
+			From:     def.WarehouseCoord(to),
+		})
+	}
+	return Result{Ware: ware, To: def.WarehouseCoord(to)}
+}
@@ -0,0 +1,111 @@
+package mirror
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+func TestMirror(t *testing.T) {
+	Convey("Given a ware in a content-addressable warehouse", t, testutil.WithTmpdir(func(c C) {
+		cwd, _ := os.Getwd()
+		srcURI := rio.SiloURI("file+ca://" + filepath.Join(cwd, "src"))
+		destURI := rio.SiloURI("file+ca://" + filepath.Join(cwd, "dest"))
+		os.Mkdir("src", 0755)
+		os.Mkdir("dest", 0755)
+		filefixture.Beta.Create("fixture")
+		transmat := tar.New("work")
+		hash := transmat.Scan(tar.Kind, "fixture", []rio.SiloURI{srcURI}, testutil.TestLogger(c))
+
+		Convey("Mirroring should copy the packed object exactly", func() {
+			result := Mirror(tar.Kind, hash, []rio.SiloURI{srcURI}, destURI, transmat, testutil.TestLogger(c))
+			So(result.Skipped, ShouldBeFalse)
+			So(result.Streamed, ShouldBeTrue)
+			So(result.From, ShouldEqual, def.WarehouseCoord(srcURI))
+			original, _ := ioutil.ReadFile(filepath.Join("src", string(hash)))
+			copied, err := ioutil.ReadFile(filepath.Join("dest", string(hash)))
+			So(err, ShouldBeNil)
+			So(copied, ShouldResemble, original)
+
+			Convey("And the copy should materialize", func() {
+				arena := transmat.Materialize(tar.Kind, hash, []rio.SiloURI{destURI}, testutil.TestLogger(c))
+				So(arena.Hash(), ShouldEqual, hash)
+			})
+
+			Convey("Mirroring again should be a no-op", func() {
+				result := Mirror(tar.Kind, hash, []rio.SiloURI{srcURI}, destURI, transmat, testutil.TestLogger(c))
+				So(result.Skipped, ShouldBeTrue)
+			})
+		})
+
+		Convey("Mirroring a ware the source doesn't have should raise DNE", func() {
+			err := meep.RecoverPanics(func() {
+				Mirror(tar.Kind, "nonexistent", []rio.SiloURI{srcURI}, destURI, transmat, testutil.TestLogger(c))
+			})
+			So(err, ShouldHaveSameTypeAs, &def.ErrWareDNE{})
+		})
+
+		Convey("Mirroring a ware under the wrong hash should commit nothing", func() {
+			os.Rename(filepath.Join("src", string(hash)), filepath.Join("src", "wronghash"))
+			err := meep.RecoverPanics(func() {
+				Mirror(tar.Kind, "wronghash", []rio.SiloURI{srcURI}, destURI, transmat, testutil.TestLogger(c))
+			})
+			So(err, ShouldHaveSameTypeAs, &def.ErrHashMismatch{})
+			leftovers, _ := ioutil.ReadDir("dest")
+			So(leftovers, ShouldBeEmpty)
+		})
+	}))
+}
+
+func TestAdopt(t *testing.T) {
+	Convey("Given a tarball built elsewhere", t, testutil.WithTmpdir(func(c C) {
+		cwd, _ := os.Getwd()
+		destURI := rio.SiloURI("file+ca://" + filepath.Join(cwd, "dest"))
+		os.Mkdir("dest", 0755)
+		filefixture.Beta.Create("fixture")
+		transmat := tar.New("work")
+		hash := transmat.Scan(tar.Kind, "fixture", []rio.SiloURI{"file://external.tgz"}, testutil.TestLogger(c))
+		original, _ := ioutil.ReadFile("external.tgz")
+
+		Convey("Adopting it should store it verbatim under its ware hash", func() {
+			result := Adopt(tar.Kind, bytes.NewReader(original), destURI, testutil.TestLogger(c))
+			So(result.Ware, ShouldResemble, def.Ware{Type: string(tar.Kind), Hash: string(hash)})
+			So(result.Skipped, ShouldBeFalse)
+			adopted, err := ioutil.ReadFile(filepath.Join("dest", string(hash)))
+			So(err, ShouldBeNil)
+			So(adopted, ShouldResemble, original)
+
+			Convey("And it should materialize", func() {
+				arena := transmat.Materialize(tar.Kind, hash, []rio.SiloURI{destURI}, testutil.TestLogger(c))
+				So(arena.Hash(), ShouldEqual, hash)
+			})
+
+			Convey("Adopting it again should keep the existing copy", func() {
+				result := Adopt(tar.Kind, bytes.NewReader(original), destURI, testutil.TestLogger(c))
+				So(result.Skipped, ShouldBeTrue)
+				leftovers, _ := ioutil.ReadDir("dest")
+				So(leftovers, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("Adopting something that isn't a tarball should commit nothing", func() {
+			err := meep.RecoverPanics(func() {
+				Adopt(tar.Kind, bytes.NewReader(original[:len(original)/2]), destURI, testutil.TestLogger(c))
+			})
+			So(err, ShouldHaveSameTypeAs, &def.ErrWareCorrupt{})
+			leftovers, _ := ioutil.ReadDir("dest")
+			So(leftovers, ShouldBeEmpty)
+		})
+	}))
+}
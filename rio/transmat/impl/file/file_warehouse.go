@@ -180,10 +180,11 @@ func (wh *Warehouse) makeReader(dataHash rio.CommitID) io.ReadCloser {
 		resp, err := http.Get(u.String())
 		if err != nil {
 			panic(&def.ErrWarehouseProblem{
-				Msg:    err.Error(),
-				During: "fetch",
-				Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
-				From:   wh.coord,
+				Msg:       err.Error(),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: true,
 			})
 		}
 		switch resp.StatusCode {
@@ -196,10 +197,11 @@ func (wh *Warehouse) makeReader(dataHash rio.CommitID) io.ReadCloser {
 			})
 		default:
 			panic(&def.ErrWarehouseProblem{
-				Msg:    fmt.Sprintf("http status %s", resp.Status),
-				During: "fetch",
-				Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
-				From:   wh.coord,
+				Msg:       fmt.Sprintf("http status %s", resp.Status),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: resp.StatusCode >= 500,
 			})
 		}
 	case "https+ca":
@@ -210,10 +212,11 @@ func (wh *Warehouse) makeReader(dataHash rio.CommitID) io.ReadCloser {
 		resp, err := http.Get(u.String())
 		if err != nil {
 			panic(&def.ErrWarehouseProblem{
-				Msg:    err.Error(),
-				During: "fetch",
-				Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
-				From:   wh.coord,
+				Msg:       err.Error(),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: true,
 			})
 		}
 		switch resp.StatusCode {
@@ -226,10 +229,11 @@ func (wh *Warehouse) makeReader(dataHash rio.CommitID) io.ReadCloser {
 			})
 		default:
 			panic(&def.ErrWarehouseProblem{
-				Msg:    fmt.Sprintf("http status %s", resp.Status),
-				During: "fetch",
-				Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
-				From:   wh.coord,
+				Msg:       fmt.Sprintf("http status %s", resp.Status),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: resp.StatusCode >= 500,
 			})
 		}
 	default:
@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -24,8 +26,10 @@ import (
 
 	Maps the remotes as their escaped url, so you can pile multiple remotes
 	into one repo and never fuss with collision issues.
+
+	Returns an error carrying git's output if the fetch fails.
 */
-func yank(log log15.Logger, gitDir string, remoteURL string) {
+func yank(log log15.Logger, gitDir string, remoteURL string) error {
 	// Mkdir.  (Fine if exists.)
 	if err := os.Mkdir(gitDir, 0755); err != nil && !os.IsExist(err) {
 		panic(err)
@@ -39,15 +43,58 @@ func yank(log log15.Logger, gitDir string, remoteURL string) {
 	log.Info("git: object fetch starting",
 		"remote", remoteURL,
 	)
-	git.Bake(
+	buf := &bytes.Buffer{}
+	p := git.Bake(
 		"fetch", "--",
 		remoteURL,
 		"+refs/heads/*:refs/remotes/"+slugifyRemote(remoteURL)+"/*",
-	).RunAndReport()
+		"+refs/tags/*:refs/tags/"+slugifyRemote(remoteURL)+"/*", // where `Scan` leaves things by default.
+		gosh.Opts{
+			OkExit: gosh.AnyExit,
+			Err:    buf,
+			Out:    buf,
+		},
+	).Run()
+	if p.GetExitCode() != 0 {
+		return fmt.Errorf("git fetch failed: %s", strings.TrimSpace(buf.String()))
+	}
 	log.Info("git: object fetch complete",
 		"remote", remoteURL,
 		"elapsed", time.Now().Sub(started).Seconds(),
 	)
+	return nil
+}
+
+/*
+	Makes sure the git dir has the commit (or tree): fetching just that if we can, or everything if we must.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- if the remote won't give us anything.
+	    Git's exit code doesn't say why, and it's most often the network,
+	    so these are marked transient.
+*/
+func fetch(log log15.Logger, gitDir string, remoteURL string, commitHash string) {
+	// Skip if the gitDir should have the objects already.
+	if hasObject(commitHash, gitDir) {
+		return
+	}
+	// Okay, we need more stuff.  Fetch away.
+	started := time.Now()
+	if !fetchCommit(log, gitDir, remoteURL, commitHash) {
+		if err := yank(log, gitDir, remoteURL); err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:       err.Error(),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: commitHash},
+				From:      def.WarehouseCoord(remoteURL),
+				Transient: true,
+			})
+		}
+	}
+	log.Info("git: fetch complete",
+		"elapsed", time.Now().Sub(started).Seconds(),
+	)
 }
 
 func hasCommit(commitHash string, gitDir string) bool {
@@ -72,27 +119,116 @@ func hasCommit(commitHash string, gitDir string) bool {
 	return true
 }
 
-func checkout(log log15.Logger, destPath string, commitHash string, gitDir string) {
+/*
+	Reports whether the git dir has the commit or tree named by `hash`.
+	(Scans without an mtime filter give tree hashes, and `hasCommit`
+	won't admit those.)  As with commits, having the object means we
+	fetched it, and everything it refers to, at once.
+*/
+func hasObject(hash string, gitDir string) bool {
+	if hasCommit(hash, gitDir) {
+		return true
+	}
+	git := bakeGitDir(git, gitDir)
+	buf := &bytes.Buffer{}
+	p := git.Bake("cat-file", "-t", hash,
+		gosh.Opts{
+			OkExit: gosh.AnyExit,
+			Out:    buf,
+		},
+	).Run()
+	return p.GetExitCode() == 0 && buf.String() == "tree\n"
+}
+
+/*
+	Fetches one commit, and none of its history, into the specified git dir.
+
+	Returns false if the remote wouldn't give it to us.  Remotes only
+	serve commits by hash if they're configured to (e.g. with
+	`uploadpack.allowReachableSHA1InWant`); most do, especially those
+	speaking git's v2 protocol.  If not, fall back to `yank`.
+*/
+func fetchCommit(log log15.Logger, gitDir string, remoteURL string, commitHash string) bool {
+	// Mkdir.  (Fine if exists.)
+	if err := os.Mkdir(gitDir, 0755); err != nil && !os.IsExist(err) {
+		panic(err)
+	}
 	// Template out command with the right paths set.
 	git := bakeGitDir(git, gitDir)
-	git = bakeCheckoutDir(git, destPath)
+	// Init (is idempotent).
+	git.Bake("init", "--bare").RunAndReport()
+	// Fetch.
+	started := time.Now()
+	log.Info("git: shallow fetch starting",
+		"remote", remoteURL,
+	)
+	buf := &bytes.Buffer{}
+	p := git.Bake(
+		"fetch", "--depth=1", "--",
+		remoteURL,
+		commitHash,
+		gosh.Opts{
+			OkExit: gosh.AnyExit,
+			Err:    buf,
+			Out:    buf,
+		},
+	).Run()
+	if p.GetExitCode() != 0 || !hasObject(commitHash, gitDir) {
+		log.Info("git: shallow fetch refused",
+			"remote", remoteURL,
+			"reason", strings.TrimSpace(buf.String()),
+		)
+		return false
+	}
+	log.Info("git: shallow fetch complete",
+		"remote", remoteURL,
+		"elapsed", time.Now().Sub(started).Seconds(),
+	)
+	return true
+}
+
+/*
+	Writes out the files of `treeish` (a commit hash, or "<commit>:<path>")
+	into `destPath`, which must exist.
+
+	Uses an index of its own, so the git dir isn't touched, and many
+	checkouts may share it at once.
+*/
+func checkout(log log15.Logger, destPath string, treeish string, gitDir string) {
+	// Template out command with the right paths set.
+	indexPath := destPath + ".index"
+	defer os.Remove(indexPath)
+	git := bakeGitDir(git, gitDir).Bake(gosh.Opts{
+		Env: map[string]string{"GIT_INDEX_FILE": indexPath},
+	})
 	// Checkout.
 	started := time.Now()
 	log.Info("git: tree checkout starting")
 	buf := &bytes.Buffer{}
 	p := git.Bake(
-		"checkout", "-f", commitHash,
+		"read-tree", treeish,
 		gosh.Opts{
 			OkExit: gosh.AnyExit,
 			Err:    buf,
 			Out:    buf,
 		},
 	).Run()
-	if bytes.HasPrefix(buf.Bytes(), []byte("fatal: reference is not a tree: ")) {
+	if bytes.HasPrefix(buf.Bytes(), []byte("fatal: Not a valid object name ")) ||
+		bytes.HasPrefix(buf.Bytes(), []byte("fatal: failed to unpack tree object ")) {
 		panic(&def.ErrWareDNE{
-			Ware: def.Ware{Type: string(Kind), Hash: string(commitHash)},
+			Ware: def.Ware{Type: string(Kind), Hash: treeish},
 		})
 	}
+	if p.GetExitCode() == 0 {
+		p = bakeCheckoutDir(git, destPath).Bake(
+			"checkout-index", "--all", "--force",
+			gosh.Opts{
+				OkExit: gosh.AnyExit,
+				Err:    buf,
+				Out:    buf,
+			},
+		).Run()
+	}
 	if p.GetExitCode() != 0 {
 		// catchall.
 		panic(meep.Meep(
@@ -223,6 +359,24 @@ func applyGitmodulesUrls(commitHash string, gitDir string, submodules []submodul
 	return submodules
 }
 
+/*
+	Filter submodules to those within `subdir` (of the repo root),
+	and make their paths relative to it.
+*/
+func submodulesWithin(subdir string, submodules []submodule) []submodule {
+	if subdir == "" {
+		return submodules
+	}
+	within := make([]submodule, 0, len(submodules))
+	for _, subm := range submodules {
+		if strings.HasPrefix(subm.path, subdir+"/") {
+			subm.path = strings.TrimPrefix(subm.path, subdir+"/")
+			within = append(within, subm)
+		}
+	}
+	return within
+}
+
 func grabFile(commitHash string, filePath string, gitDir string) (buf io.Reader) {
 	buf = &bytes.Buffer{}
 	// we punt pretty hard on errors:
@@ -241,3 +395,146 @@ func grabFile(commitHash string, filePath string, gitDir string) (buf io.Reader)
 	).Run()
 	return
 }
+
+/*
+	Writes the files under `subjectPath` into the git dir as a tree object,
+	and returns the tree's hash.
+
+	The git dir is initialized if necessary, and its index is clobbered.
+	Everything is added verbatim: gitignore files don't apply, nor do
+	gitattributes (no eol conversion, no filters).  The usual git caveats
+	still do: empty dirs vanish, and only the executable bit of permissions
+	survives.  Dirs that are git repos of their own (they contain a ".git")
+	are left out entirely; git would otherwise record them as links to
+	submodule commits that nothing can fetch.
+*/
+func writeTree(log log15.Logger, gitDir string, subjectPath string) string {
+	// Template out command with the right paths set.
+	git := bakeGitDir(git, gitDir)
+	// Init (is idempotent).
+	git.Bake("init", "--bare").RunAndReport()
+	// Attributes in the git dir override any in the tree.
+	if err := os.MkdirAll(filepath.Join(gitDir, "info"), 0755); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(gitDir, "info/attributes"),
+		[]byte("* -text -filter -ident -working-tree-encoding\n"),
+		0644,
+	); err != nil {
+		panic(err)
+	}
+	// Stage everything (but embedded repos), and write it out.
+	started := time.Now()
+	log.Info("git: tree write starting")
+	pathspecs := []string{"."}
+	for _, repo := range embeddedRepos(subjectPath) {
+		log.Info("git: leaving out embedded repo", "path", repo)
+		pathspecs = append(pathspecs, ":(exclude,literal)"+repo)
+	}
+	bakeCheckoutDir(git, subjectPath).Bake(
+		"add", "--all", "--force", "--", pathspecs,
+	).RunAndReport()
+	treeHash := strings.TrimSpace(git.Bake("write-tree").Output())
+	log.Info("git: tree write complete",
+		"tree", treeHash,
+		"elapsed", time.Now().Sub(started).Seconds(),
+	)
+	return treeHash
+}
+
+/*
+	Lists the dirs under `subjectPath` (relative to it, slash-separated)
+	that contain a ".git" -- whether a dir, or a file pointing elsewhere.
+	Doesn't descend into them.
+*/
+func embeddedRepos(subjectPath string) []string {
+	var repos []string
+	err := filepath.Walk(subjectPath, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || pth == subjectPath {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(pth, ".git")); err == nil {
+			rel, _ := filepath.Rel(subjectPath, pth)
+			repos = append(repos, filepath.ToSlash(rel))
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return repos
+}
+
+/*
+	Wraps a tree in a commit with no parents and fixed metadata:
+	the author and committer are both "repeatr", at time `when`.
+	The same tree and time always make the same commit hash:
+	config that would add to the commit (signing, or an encoding header)
+	is overridden.
+*/
+func commitTree(gitDir string, treeHash string, when time.Time) string {
+	date := fmt.Sprintf("%d +0000", when.Unix())
+	return strings.TrimSpace(bakeGitDir(git, gitDir).Bake(
+		"-c", "commit.gpgSign=false",
+		"-c", "i18n.commitEncoding=UTF-8",
+		"commit-tree", "--no-gpg-sign", "-m", "repeatr output", treeHash,
+		gosh.Opts{Env: map[string]string{
+			"GIT_AUTHOR_NAME":     "repeatr",
+			"GIT_AUTHOR_EMAIL":    "repeatr",
+			"GIT_AUTHOR_DATE":     date,
+			"GIT_COMMITTER_NAME":  "repeatr",
+			"GIT_COMMITTER_EMAIL": "repeatr",
+			"GIT_COMMITTER_DATE":  date,
+		}},
+	).Output())
+}
+
+/*
+	Pushes the object `hash` from the git dir to `ref` on the remote.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- if the push is rejected or fails.
+*/
+func push(log log15.Logger, gitDir string, wh *Warehouse, hash string, ref string) {
+	git := bakeGitDir(git, gitDir)
+	started := time.Now()
+	log.Info("git: push starting",
+		"remote", wh.url,
+		"ref", ref,
+	)
+	// A "+" on the ref carries through to the refspec, where it means the same thing to git: force.
+	refspec := hash + ":" + strings.TrimPrefix(ref, "+")
+	if strings.HasPrefix(ref, "+") {
+		refspec = "+" + refspec
+	}
+	buf := &bytes.Buffer{}
+	p := git.Bake(
+		"push", "--quiet", "--",
+		wh.url,
+		refspec,
+		gosh.Opts{
+			OkExit: gosh.AnyExit,
+			Err:    buf,
+			Out:    buf,
+		},
+	).Run()
+	if p.GetExitCode() != 0 {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    fmt.Sprintf("git push to %q failed: %s", ref, strings.TrimSpace(buf.String())),
+			During: "save",
+			Ware:   def.Ware{Type: string(Kind), Hash: hash},
+			From:   wh.coord,
+		})
+	}
+	log.Info("git: push complete",
+		"remote", wh.url,
+		"ref", ref,
+		"elapsed", time.Now().Sub(started).Seconds(),
+	)
+}
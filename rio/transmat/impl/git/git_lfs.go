@@ -0,0 +1,442 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/polydawn/gosh"
+	"github.com/vaughan0/go-ini"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	Git LFS stores big files outside of git: the tree holds small "pointer"
+	files in their place, naming the content by sha256 and size, and the
+	content lives on an LFS server.
+
+	See https://github.com/git-lfs/git-lfs/blob/master/docs/spec.md
+	and https://github.com/git-lfs/git-lfs/blob/master/docs/api/batch.md
+*/
+const (
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+	lfsPointerMaxSize = 1024 // pointers are always smaller than this; anything bigger is real content.
+	lfsMediaType      = "application/vnd.git-lfs+json"
+)
+
+/*
+	Clients for talking to LFS servers, so a server that stops answering
+	fails the fetch rather than hanging it forever.  Batch requests are
+	small, so they get a deadline outright; downloads may be big, so only
+	connecting and waiting for the response to start are limited.
+*/
+var (
+	lfsTransport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+	lfsBatchClient    = &http.Client{Transport: lfsTransport, Timeout: 60 * time.Second}
+	lfsDownloadClient = &http.Client{Transport: lfsTransport}
+)
+
+type lfsPointer struct {
+	oid  string // hex sha256
+	size int64
+}
+
+/*
+	Parses an LFS pointer file; returns false if it isn't one.
+*/
+func parseLFSPointer(body []byte) (lfsPointer, bool) {
+	var ptr lfsPointer
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if len(lines) < 3 || lines[0] != lfsPointerVersion {
+		return ptr, false
+	}
+	var haveSize bool
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, " ", 2)
+		if len(kv) != 2 {
+			return ptr, false
+		}
+		switch kv[0] {
+		case "oid":
+			digits := strings.TrimPrefix(kv[1], "sha256:")
+			if digits == kv[1] || len(digits) != hex.EncodedLen(sha256.Size) {
+				return ptr, false
+			}
+			if _, err := hex.DecodeString(digits); err != nil {
+				return ptr, false
+			}
+			ptr.oid = digits
+		case "size":
+			n, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || n < 0 {
+				return ptr, false
+			}
+			ptr.size, haveSize = n, true
+		}
+	}
+	return ptr, ptr.oid != "" && haveSize
+}
+
+/*
+	Figures out where the LFS server for a remote is: `lfs.url` from the
+	commit's ".lfsconfig" if it has one; otherwise, for http remotes,
+	"<remote>.git/info/lfs", as git-lfs does.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- if there's no way to know.
+*/
+func lfsEndpoint(wh *Warehouse, commitHash string, gitDir string) string {
+	if conf, err := ini.Load(grabFile(commitHash, ".lfsconfig", gitDir)); err == nil {
+		if endpoint, ok := conf.Get("lfs", "url"); ok && endpoint != "" {
+			return strings.TrimSuffix(endpoint, "/")
+		}
+	}
+	if strings.HasPrefix(wh.url, "http://") || strings.HasPrefix(wh.url, "https://") {
+		endpoint := strings.TrimSuffix(wh.url, "/")
+		if !strings.HasSuffix(endpoint, ".git") {
+			endpoint += ".git"
+		}
+		return endpoint + "/info/lfs"
+	}
+	panic(&def.ErrWarehouseProblem{
+		Msg:    "no git lfs server known for this remote: it's not http, and the commit has no \"lfs.url\" in an .lfsconfig file",
+		During: "fetch",
+		Ware:   def.Ware{Type: string(Kind), Hash: commitHash},
+		From:   wh.coord,
+	})
+}
+
+/*
+	Finds every LFS pointer file under `workDirPath` (a checkout of `subdir`
+	of the commit), and replaces each with its content, fetched from the
+	LFS server at `endpoint` and verified.  Only files the commit's
+	attributes mark "filter=lfs" count; others are left as they are,
+	even if they look like pointers.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- if the server is missing objects, or otherwise fails.
+	  - `*def.ErrHashMismatch` -- if an object's content doesn't match its pointer.
+*/
+func smudgeLFS(log log15.Logger, workDirPath string, commitHash string, subdir string, gitDir string, endpoint string, wh *Warehouse) {
+	// Find pointers.  (Several paths may share content.)  Paths are kept relative, for messages' sake.
+	candidates := map[string]lfsPointer{}
+	err := filepath.Walk(workDirPath, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() >= lfsPointerMaxSize {
+			return nil
+		}
+		body, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return err
+		}
+		if ptr, ok := parseLFSPointer(body); ok {
+			rel, _ := filepath.Rel(workDirPath, pth)
+			candidates[filepath.ToSlash(rel)] = ptr
+		}
+		return nil
+	})
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to scan checkout for git lfs pointers"},
+			meep.Cause(err),
+		))
+	}
+	pointers := map[lfsPointer][]string{}
+	for rel := range lfsTracked(commitHash, subdir, gitDir, candidates) {
+		ptr := candidates[rel]
+		pointers[ptr] = append(pointers[ptr], rel)
+	}
+	for _, paths := range pointers {
+		sort.Strings(paths)
+	}
+	log.Info("git: lfs pointers found",
+		"count", len(pointers),
+	)
+	if len(pointers) == 0 {
+		return
+	}
+
+	// Ask where to download them from.
+	started := time.Now()
+	actions := lfsBatch(endpoint, pointers, wh)
+
+	// Fetch each, verify, and put in place of all its pointers.
+	for ptr, paths := range pointers {
+		action := actions[ptr.oid]
+		for i, rel := range paths {
+			if i == 0 {
+				lfsDownload(action, ptr, filepath.Join(workDirPath, rel), wh)
+				continue
+			}
+			if err := copyOver(filepath.Join(workDirPath, paths[0]), filepath.Join(workDirPath, rel)); err != nil {
+				panic(meep.Meep(
+					&rio.ErrInternal{Msg: "Unable to place git lfs content"},
+					meep.Cause(err),
+				))
+			}
+		}
+	}
+	log.Info("git: lfs content fetched",
+		"count", len(pointers),
+		"elapsed", time.Now().Sub(started).Seconds(),
+	)
+}
+
+/*
+	Returns the subset of `candidates` (paths relative to `subdir`) that
+	the commit's gitattributes mark "filter=lfs".
+
+	The attributes are read from the commit itself, by way of a throwaway
+	index, since the git dir is bare (and the checkout may be only a subdir).
+*/
+func lfsTracked(commitHash string, subdir string, gitDir string, candidates map[string]lfsPointer) map[string]struct{} {
+	tracked := map[string]struct{}{}
+	if len(candidates) == 0 {
+		return tracked
+	}
+	tmp, err := ioutil.TempDir("", "repeatr-git-attr-")
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to make a temp dir"},
+			meep.Cause(err),
+		))
+	}
+	defer os.RemoveAll(tmp)
+	git := bakeGitDir(git, gitDir).Bake(gosh.Opts{Env: map[string]string{
+		"GIT_INDEX_FILE": filepath.Join(tmp, "index"),
+	}})
+	git.Bake("read-tree", commitHash).RunAndReport()
+
+	// Ask about every candidate at once; paths go in and come out NUL-separated,
+	//  as "<path>\0filter\0<value>\0".
+	prefix := ""
+	if subdir != "" {
+		prefix = subdir + "/"
+	}
+	in := &bytes.Buffer{}
+	for rel := range candidates {
+		in.WriteString(prefix + rel + "\x00")
+	}
+	out := &bytes.Buffer{}
+	git.Bake("check-attr", "--cached", "--stdin", "-z", "filter",
+		gosh.Opts{In: in, Out: out},
+	).RunAndReport()
+	fields := strings.Split(out.String(), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == "lfs" {
+			tracked[strings.TrimPrefix(fields[i], prefix)] = struct{}{}
+		}
+	}
+	return tracked
+}
+
+type lfsBatchRequest struct {
+	Operation string         `json:"operation"`
+	Transfers []string       `json:"transfers"`
+	Objects   []lfsBatchItem `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsBatchItem `json:"objects"`
+}
+
+type lfsBatchItem struct {
+	Oid     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Actions *struct {
+		Download *lfsAction `json:"download"`
+	} `json:"actions,omitempty"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+/*
+	Asks the LFS batch API for download actions for all the pointers.
+	Every object must be available, or this panics, listing those that aren't.
+*/
+func lfsBatch(endpoint string, pointers map[lfsPointer][]string, wh *Warehouse) map[string]*lfsAction {
+	problem := func(msg string) {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    fmt.Sprintf("git lfs server %s: %s", endpoint, msg),
+			During: "fetch",
+			From:   wh.coord,
+		})
+	}
+	req := lfsBatchRequest{Operation: "download", Transfers: []string{"basic"}}
+	for ptr := range pointers {
+		req.Objects = append(req.Objects, lfsBatchItem{Oid: ptr.oid, Size: ptr.size})
+	}
+	sort.Sort(lfsBatchItems(req.Objects)) // just for the sake of tidy requests.
+	body, _ := json.Marshal(req)
+	httpReq, _ := http.NewRequest("POST", endpoint+"/objects/batch", bytes.NewReader(body))
+	httpReq.Header.Set("Accept", lfsMediaType)
+	httpReq.Header.Set("Content-Type", lfsMediaType)
+	resp, err := lfsBatchClient.Do(httpReq)
+	if err != nil {
+		problem(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		problem(fmt.Sprintf("batch request failed: http status %s", resp.Status))
+	}
+	var batch lfsBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		problem(fmt.Sprintf("unparsable batch response: %s", err))
+	}
+
+	actions := make(map[string]*lfsAction, len(batch.Objects))
+	reasons := make(map[string]string)
+	for _, obj := range batch.Objects {
+		switch {
+		case obj.Error != nil:
+			reasons[obj.Oid] = fmt.Sprintf("%d %s", obj.Error.Code, obj.Error.Message)
+		case obj.Actions == nil || obj.Actions.Download == nil:
+			reasons[obj.Oid] = "no download offered"
+		default:
+			actions[obj.Oid] = obj.Actions.Download
+		}
+	}
+	var failures []string
+	for ptr, paths := range pointers {
+		if _, ok := actions[ptr.oid]; ok {
+			continue
+		}
+		reason, ok := reasons[ptr.oid]
+		if !ok {
+			reason = "not in response"
+		}
+		failures = append(failures, fmt.Sprintf("%s for %q (%s)", ptr.oid, paths[0], reason))
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		problem(fmt.Sprintf("objects unavailable: %s", strings.Join(failures, "; ")))
+	}
+	return actions
+}
+
+type lfsBatchItems []lfsBatchItem
+
+func (s lfsBatchItems) Len() int           { return len(s) }
+func (s lfsBatchItems) Less(i, j int) bool { return s[i].Oid < s[j].Oid }
+func (s lfsBatchItems) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+/*
+	Downloads one object over the pointer file at `pth`, verifying it on the way.
+	The file keeps the pointer's permissions.
+*/
+func lfsDownload(action *lfsAction, ptr lfsPointer, pth string, wh *Warehouse) {
+	problem := func(msg string) {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    fmt.Sprintf("git lfs object %s: %s", ptr.oid, msg),
+			During: "fetch",
+			From:   wh.coord,
+		})
+	}
+	httpReq, err := http.NewRequest("GET", action.Href, nil)
+	if err != nil {
+		problem(err.Error())
+	}
+	for k, v := range action.Header {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := lfsDownloadClient.Do(httpReq)
+	if err != nil {
+		problem(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		problem(fmt.Sprintf("download failed: http status %s", resp.Status))
+	}
+
+	// Write next to the pointer, and swap it in once it checks out.
+	info, err := os.Stat(pth)
+	if err != nil {
+		panic(err)
+	}
+	file, err := ioutil.TempFile(filepath.Dir(pth), ".lfs-")
+	if err != nil {
+		panic(err)
+	}
+	stagePath := file.Name()
+	defer os.Remove(stagePath)
+	if err := file.Chmod(info.Mode()); err != nil {
+		panic(err)
+	}
+	hasher := sha256.New()
+	// Read one byte past the size, so we notice if there's too much.
+	n, err := io.Copy(io.MultiWriter(file, hasher), io.LimitReader(resp.Body, ptr.size+1))
+	file.Close()
+	if err != nil {
+		problem(err.Error())
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if n != ptr.size || actual != ptr.oid {
+		panic(&def.ErrHashMismatch{
+			Expected: def.Ware{Type: "git-lfs", Hash: "sha256:" + ptr.oid},
+			Actual:   def.Ware{Type: "git-lfs", Hash: "sha256:" + actual},
+			From:     wh.coord,
+		})
+	}
+	if err := os.Rename(stagePath, pth); err != nil {
+		panic(err)
+	}
+}
+
+/*
+	Copies the file at `src` over `dest`, keeping `dest`'s permissions.
+*/
+func copyOver(src string, dest string) error {
+	info, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
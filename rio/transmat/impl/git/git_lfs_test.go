@@ -0,0 +1,180 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/polydawn/gosh"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/rio"
+)
+
+func lfsPointerFor(content []byte) (string, []byte) {
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	return oid, []byte(fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, len(content)))
+}
+
+func TestLFSPointerParsing(t *testing.T) {
+	Convey("LFS pointers should parse", t, func() {
+		oid, pointer := lfsPointerFor([]byte("content"))
+		ptr, ok := parseLFSPointer(pointer)
+		So(ok, ShouldBeTrue)
+		So(ptr, ShouldResemble, lfsPointer{oid, 7})
+
+		Convey("Other things shouldn't", func() {
+			for _, body := range []string{
+				"",
+				"version https://git-lfs.github.com/spec/v1\n",
+				"version https://git-lfs.github.com/spec/v1\noid sha256:abcd\nsize 7\n",
+				"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\n",
+				"version https://git-lfs.github.com/spec/v1\noid md5:" + oid + "\nsize 7\n",
+				"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize -1\n",
+				"just some file\noid sha256:" + oid + "\nsize 7\n",
+			} {
+				_, ok := parseLFSPointer([]byte(body))
+				So(ok, ShouldBeFalse)
+			}
+		})
+	})
+}
+
+func TestGitLFSMaterialize(t *testing.T) {
+	Convey("Given a bare repo with LFS pointers, and an LFS server", t, testutil.Requires(
+		testutil.WithTmpdir(func(c C) {
+			content := []byte("big binary stuff\x00\x01\x02")
+			oid, pointer := lfsPointerFor(content)
+			objects := map[string][]byte{oid: content}
+			var batchRequests int
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == "POST" && r.URL.Path == "/objects/batch":
+					batchRequests++
+					var req struct {
+						Operation string
+						Objects   []struct {
+							Oid  string
+							Size int64
+						}
+					}
+					if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Operation != "download" {
+						w.WriteHeader(422)
+						return
+					}
+					var objs []map[string]interface{}
+					for _, obj := range req.Objects {
+						item := map[string]interface{}{"oid": obj.Oid, "size": obj.Size}
+						if _, ok := objects[obj.Oid]; ok {
+							item["actions"] = map[string]interface{}{
+								"download": map[string]interface{}{"href": server.URL + "/objects/" + obj.Oid},
+							}
+						} else {
+							item["error"] = map[string]interface{}{"code": 404, "message": "Object does not exist"}
+						}
+						objs = append(objs, item)
+					}
+					w.Header().Set("Content-Type", lfsMediaType)
+					json.NewEncoder(w).Encode(map[string]interface{}{"objects": objs})
+				case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/objects/"):
+					body, ok := objects[strings.TrimPrefix(r.URL.Path, "/objects/")]
+					if !ok {
+						w.WriteHeader(404)
+						return
+					}
+					w.Write(body)
+				default:
+					w.WriteHeader(404)
+				}
+			}))
+			defer server.Close()
+
+			git := git.Bake(gosh.Opts{Env: map[string]string{
+				"GIT_AUTHOR_NAME":     "repeatr",
+				"GIT_AUTHOR_EMAIL":    "repeatr",
+				"GIT_COMMITTER_NAME":  "repeatr",
+				"GIT_COMMITTER_EMAIL": "repeatr",
+			}})
+			var dataHash rio.CommitID
+			git.Bake("init", "--", "repo-w").RunAndReport()
+			testutil.UsingDir("repo-w", func() {
+				os.Mkdir("data", 0755)
+				ioutil.WriteFile(".gitattributes", []byte("*.bin filter=lfs diff=lfs merge=lfs -text\n"), 0644)
+				ioutil.WriteFile(".lfsconfig", []byte("[lfs]\n\turl = "+server.URL+"\n"), 0644)
+				ioutil.WriteFile("data/big.bin", pointer, 0644)
+				ioutil.WriteFile("copy.bin", pointer, 0755)
+				ioutil.WriteFile("readme", []byte("not lfs"), 0644)
+				// Looks like a pointer, but isn't tracked: it's somebody's docs, say.
+				ioutil.WriteFile("data/example.txt", pointer, 0644)
+				git.Bake("add", ".").RunAndReport()
+				git.Bake("commit", "-m", "lfs content").RunAndReport()
+				dataHash = rio.CommitID(strings.Trim(git.Bake("rev-parse", "HEAD").Output(), "\n"))
+			})
+			git.Bake("clone", "--bare", "--", "repo-w", "repo.git").RunAndReport()
+			remote, _ := filepath.Abs("repo.git")
+			lfsHash := dataHash + "+lfs"
+
+			transmat := New("./workdir")
+			log := testutil.TestLogger(c)
+
+			Convey("Materializing with '+lfs' fetches the content", func() {
+				arena := transmat.Materialize(Kind, lfsHash, []rio.SiloURI{rio.SiloURI(remote)}, log)
+				So(arena.Hash(), ShouldEqual, lfsHash)
+				body, _ := ioutil.ReadFile(filepath.Join(arena.Path(), "data/big.bin"))
+				So(body, ShouldResemble, content)
+				body, _ = ioutil.ReadFile(filepath.Join(arena.Path(), "copy.bin"))
+				So(body, ShouldResemble, content)
+				So(filepath.Join(arena.Path(), "copy.bin"), testutil.ShouldBeFile, os.FileMode(0755))
+				body, _ = ioutil.ReadFile(filepath.Join(arena.Path(), "readme"))
+				So(string(body), ShouldEqual, "not lfs")
+				body, _ = ioutil.ReadFile(filepath.Join(arena.Path(), "data/example.txt"))
+				So(body, ShouldResemble, pointer)
+				So(batchRequests, ShouldEqual, 1)
+
+				Convey("Without '+lfs', the pointers are left alone", func() {
+					arena := transmat.Materialize(Kind, dataHash, []rio.SiloURI{rio.SiloURI(remote)}, log)
+					body, _ := ioutil.ReadFile(filepath.Join(arena.Path(), "data/big.bin"))
+					So(body, ShouldResemble, pointer)
+				})
+			})
+
+			Convey("Attributes above a subdir still apply within it", func() {
+				arena := transmat.Materialize(Kind, lfsHash+":data", []rio.SiloURI{rio.SiloURI(remote)}, log)
+				body, _ := ioutil.ReadFile(filepath.Join(arena.Path(), "big.bin"))
+				So(body, ShouldResemble, content)
+				body, _ = ioutil.ReadFile(filepath.Join(arena.Path(), "example.txt"))
+				So(body, ShouldResemble, pointer)
+			})
+
+			Convey("Objects missing from the server are an error", func() {
+				delete(objects, oid)
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, lfsHash, []rio.SiloURI{rio.SiloURI(remote)}, log)
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrWarehouseProblem{})
+				So(err.Error(), ShouldContainSubstring, oid)
+			})
+
+			Convey("Objects that don't match their pointer are rejected", func() {
+				objects[oid] = []byte("something else entirely")
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, lfsHash, []rio.SiloURI{rio.SiloURI(remote)}, log)
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrHashMismatch{})
+			})
+		})),
+	)
+}
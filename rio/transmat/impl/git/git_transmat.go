@@ -38,13 +38,42 @@ func New(workPath string) rio.Transmat {
 		fullCheckouts:  filepath.Join(workPath, "full"),
 		nosubCheckouts: filepath.Join(workPath, "nosub"),
 		gitDirs:        filepath.Join(workPath, "gits"),
+		scans:          filepath.Join(workPath, "scans"),
 	}
 	mustDir(wa.fullCheckouts)
 	mustDir(wa.nosubCheckouts)
 	mustDir(wa.gitDirs)
+	mustDir(wa.scans)
 	return &GitTransmat{wa}
 }
 
+/*
+	Reports whether a git transmat working in `workPath` can materialize
+	the ware without any warehouses: either its checkout is cached, or the
+	object store for some remote already has the commit.  (Wares with
+	LFS content only count if their checkout is cached, since the content
+	comes from the remote's LFS server.)
+
+	Submodules not yet seen may still be fetched from their own remotes.
+*/
+func Cached(workPath string, dataHash rio.CommitID) bool {
+	wa := workArea{
+		fullCheckouts: filepath.Join(workPath, "full"),
+		gitDirs:       filepath.Join(workPath, "gits"),
+	}
+	if _, err := os.Stat(wa.getFullchFinalPath(string(dataHash))); err == nil {
+		return true
+	}
+	var commitHash string
+	var lfs bool
+	if err := meep.RecoverPanics(func() {
+		commitHash, _, lfs = splitWareHash(dataHash)
+	}); err != nil || lfs {
+		return false
+	}
+	return wa.findGitDir(commitHash) != ""
+}
+
 /*
 	Git transmats plonk down the contents of one commit (or tree) as a filesystem.
 
@@ -65,10 +94,28 @@ func New(workPath string) rio.Transmat {
 	will act *consistently*, but it does not overcome these issues in git
 	(doing so would require additional metadata or protocol extensions).
 
-	This transmat is *not* currently well optimized, and should generally be assumed
-	to be re-cloning on all materializations -- specifically, it is not smart
-	enough to recognize requests for different commits and trees from the
-	same repos in order to save reclones.
+	The hash may name just a subdirectory of a commit, in git's own syntax:
+	"<commit>:<path>".  Only that dir is checked out, and it becomes the root
+	of the filesystem (submodules within it are included).  This makes
+	it practical to use one project out of a big monorepo.
+
+	Git LFS content is fetched if the hash has "+lfs" after the commit
+	(e.g. "<commit>+lfs", or "<commit>+lfs:<path>"): since that makes a
+	different filesystem, it's a different ware.  Every LFS pointer file in
+	the checkout that ".gitattributes" marks "filter=lfs" (as `git lfs track`
+	does) is replaced by its content, from
+	the LFS server named by `lfs.url` in the commit's ".lfsconfig", or else
+	the one that goes with the remote (for http remotes).  Content is
+	verified against the sha256 in its pointer, and if any is missing from
+	the server, materialization fails.  (Submodules are left as they are.)
+
+	Objects are kept in a bare repo per remote, within the transmat's work dir,
+	and reused by later materializations -- a commit that's already there is
+	used without even contacting the remote.  Otherwise, we ask the remote for
+	just the one commit, without history; if it won't serve commits by hash,
+	we fall back to fetching all its branches and tags.  Finished checkouts
+	are cached, too, by hash.  Given no warehouses at all, any remote's
+	objects will do (see `Cached`).
 */
 func (t *GitTransmat) Materialize(
 	kind rio.TransmatKind,
@@ -82,6 +129,7 @@ func (t *GitTransmat) Materialize(
 		// Basic validation and config
 		mixins.MustBeType(Kind, kind)
 		//config := rio.EvaluateConfig(options...)
+		commitHash, subdir, lfs := splitWareHash(dataHash)
 
 		// Short circut out if we have the whole hash cached.
 		finalPath := t.workArea.getFullchFinalPath(string(dataHash))
@@ -96,8 +144,18 @@ func (t *GitTransmat) Materialize(
 		gitv := git.Bake("version").CombinedOutput()
 		log.Info("using `git version`:", "v", strings.TrimSpace(gitv))
 
+		// With no warehouses, any object store that has the commit will do.
+		//  (LFS content comes from the remote, though, so those need one.)
+		var gitDirPath string
+		if len(siloURIs) < 1 && !lfs {
+			gitDirPath = t.workArea.findGitDir(commitHash)
+			if gitDirPath != "" {
+				log.Info("git: already have commit", "gitDir", gitDirPath)
+			}
+		}
+
 		// Ping silos
-		if len(siloURIs) < 1 {
+		if len(siloURIs) < 1 && gitDirPath == "" {
 			// Note that it's possible a caching layer will satisfy things even without data sources...
 			//  but if that was going to happen, it already would have by now.
 			panic(&def.ErrWarehouseUnavailable{
@@ -105,13 +163,25 @@ func (t *GitTransmat) Materialize(
 				During: "fetch",
 			})
 		}
+		// If we've fetched the commit (or tree) from any of these before, there's no need to call anyone.
+		var warehouse *Warehouse
+		for _, uri := range siloURIs {
+			wh := NewWarehouse(uri)
+			if hasObject(commitHash, t.workArea.gitDirPath(wh.url)) {
+				log.Info("git: already have commit from remote warehouse", "remote", uri)
+				warehouse = wh
+				break
+			}
+		}
 		// Our policy is to take the first path that exists.
 		//  This lets you specify a series of potential locations,
 		//  and if one is unavailable we'll just take the next.
 		// Future work: cycle through later potential locations if one returns DNE!
 		//  (Unfortunately this is tricky to implement efficiently with git commands.)
-		var warehouse *Warehouse
 		for _, uri := range siloURIs {
+			if warehouse != nil {
+				break
+			}
 			wh := NewWarehouse(uri)
 			pong := wh.Ping()
 			if pong == nil {
@@ -125,31 +195,18 @@ func (t *GitTransmat) Materialize(
 				)
 			}
 		}
-		if warehouse == nil {
+		if warehouse == nil && gitDirPath == "" {
 			panic(&def.ErrWarehouseUnavailable{
 				Msg:    "No warehouses responded!",
 				During: "fetch",
 			})
 		}
-		gitDirPath := t.workArea.gitDirPath(warehouse.url)
+		if warehouse != nil {
+			gitDirPath = t.workArea.gitDirPath(warehouse.url)
 
-		// Fetch objects.
-		func() {
-			// Skip yank if the gitDir should have the objects already.
-			if hasCommit(string(dataHash), gitDirPath) {
-				return
-			}
-			// Okay, we need more stuff.  Fetch away.
-			started := time.Now()
-			yank(
-				log,
-				gitDirPath,
-				warehouse.url,
-			)
-			log.Info("git: fetch complete",
-				"elapsed", time.Now().Sub(started).Seconds(),
-			)
-		}()
+			// Fetch objects.
+			fetch(log, gitDirPath, warehouse.url, commitHash)
+		}
 
 		// Checkout.
 		// Pick tempdir under full checkouts area.
@@ -160,10 +217,14 @@ func (t *GitTransmat) Materialize(
 		defer os.RemoveAll(arena.workDirPath)
 		func() {
 			started := time.Now()
+			treeish := commitHash
+			if subdir != "" {
+				treeish += ":" + subdir
+			}
 			checkout(
 				log,
 				arena.workDirPath,
-				string(dataHash),
+				treeish,
 				gitDirPath,
 			)
 			log.Info("git: checkout main repo complete",
@@ -171,29 +232,30 @@ func (t *GitTransmat) Materialize(
 			)
 		}()
 
+		// Swap LFS pointers for their content.
+		if lfs {
+			smudgeLFS(log, arena.workDirPath, commitHash, subdir, gitDirPath, lfsEndpoint(warehouse, commitHash, gitDirPath), warehouse)
+		}
+
 		// Enumerate and fetch submodule objects.
-		submodules := listSubmodules(string(dataHash), gitDirPath)
+		submodules := listSubmodules(commitHash, gitDirPath)
+		submodules = applyGitmodulesUrls(commitHash, gitDirPath, submodules)
+		submodules = submodulesWithin(subdir, submodules)
 		log.Info("git: submodules found",
 			"count", len(submodules),
 		)
-		submodules = applyGitmodulesUrls(string(dataHash), gitDirPath, submodules)
 		func() {
 			started := time.Now()
 			for _, subm := range submodules {
-				// Skip yank if we have the full checkout cached already.
+				// Skip fetch if we have the full checkout cached already.
 				if _, err := os.Stat(t.workArea.getNosubchFinalPath(subm.hash)); err == nil {
 					continue
 				}
-				// Skip yank if the gitDir should have the objects already.
-				gitDir := t.workArea.gitDirPath(subm.url)
-				if hasCommit(subm.hash, gitDir) {
-					continue
-				}
-				// Okay, we need more stuff.  Fetch away.
-				yank(
+				fetch(
 					log.New("submhash", subm.hash),
-					gitDir,
+					t.workArea.gitDirPath(subm.url),
 					subm.url,
+					subm.hash,
 				)
 			}
 			log.Info("git: fetch submodules complete",
@@ -269,6 +331,34 @@ func (t *GitTransmat) Materialize(
 	return arena
 }
 
+/*
+	Git transmats save a filesystem as a git tree, and (usually) a commit
+	of that tree, pushing it to each warehouse.
+
+	If an mtime filter is in use (as it is by default on outputs), the tree
+	is wrapped in a commit with no parents, author and committer "repeatr",
+	dated at the filter's time, and the commit hash is returned.
+	Otherwise there's no sensible date to give a commit, so the tree hash is
+	returned.  (Trees can be materialized again too, though less efficiently:
+	remotes won't hand them out alone, so everything gets fetched.)
+	Either way, the same files always yield the same hash; other filters
+	have no effect, since git doesn't record owners in the first place.
+
+	Trees record what `git add` would, in the end, except that gitignore and
+	gitattributes files are not heeded: all files go in, byte for byte.
+	As usual for git, empty dirs are dropped, only the executable bit of
+	permissions survives, and special files and nested ".git" dirs are left out.
+
+	Each warehouse's URI may name the ref to push to with a fragment, e.g.
+	"https://example.com/releases.git#refs/heads/nightly".  Short names
+	get "refs/heads/" prepended for commits ("refs/tags/" for trees,
+	since git won't put a tree on a branch).  Pushes must fast-forward
+	unless the ref is prefixed with "+", as in a git refspec; since our commits
+	have no parents, that means a ref without a "+" can only be created, or
+	re-pushed with the same commit.  Without a fragment, the push goes to a
+	tag named "repeatr/<hash>", which is enough to keep the objects around.
+	Remote repos must already exist.
+*/
 func (t GitTransmat) Scan(
 	kind rio.TransmatKind,
 	subjectPath string,
@@ -276,13 +366,89 @@ func (t GitTransmat) Scan(
 	log log15.Logger,
 	options ...rio.MaterializerConfigurer,
 ) rio.CommitID {
-	// Git commits would be an oddity to generate.
-	//  Git trees?  Sure: a consistent result can be generated given a file tree.
-	//  Git *commits*?  Not so: the "parents" info is required, and that doesn't
-	//  match how we think of the world very much at all.
-	panic(&def.ErrConfigValidation{
-		Msg: "saving with the git transmat is not supported",
-	})
+	var commitID rio.CommitID
+	meep.Try(func() {
+		// Basic validation and config
+		mixins.MustBeType(Kind, kind)
+		config := rio.EvaluateConfig(options...)
+
+		// If scan area doesn't exist, bail immediately.
+		// No need to even start dialing warehouses if we've got nothing for em.
+		_, err := os.Stat(subjectPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return // empty commitID
+			} else {
+				panic(err)
+			}
+		}
+		subjectPath, err = filepath.Abs(subjectPath)
+		if err != nil {
+			panic(err)
+		}
+
+		// Dial warehouses.
+		warehouses := make([]*Warehouse, 0, len(siloURIs))
+		for _, uri := range siloURIs {
+			wh := NewWarehouse(uri)
+			pong := wh.PingWritable()
+			if pong == nil {
+				warehouses = append(warehouses, wh)
+			} else {
+				log.Info("Unable to contact a warehouse, skipping it",
+					"warehouse", uri,
+					"reason", pong,
+				)
+			}
+		}
+		// By default we're tolerant of some warehouses being unresponsive,
+		//  but if ALL of them are down?  That's bad enough news to stop for.
+		//  (No save locations at all is fine: still need to hash.)
+		if len(siloURIs) > 0 && len(warehouses) == 0 {
+			panic(&def.ErrWarehouseUnavailable{
+				Msg:    "No warehouses responded!",
+				During: "save",
+			})
+		}
+
+		// Build the objects in a scratch git dir.
+		gitDirPath := t.workArea.makeScanTempPath()
+		defer os.RemoveAll(gitDirPath)
+		hash := writeTree(log, gitDirPath, subjectPath)
+		isCommit := config.FilterSet.Mtime != nil
+		if isCommit {
+			hash = commitTree(gitDirPath, hash, config.FilterSet.Mtime.Value)
+		}
+		commitID = rio.CommitID(hash)
+
+		// Push.
+		for _, wh := range warehouses {
+			push(log, gitDirPath, wh, hash, saveRef(wh.ref, hash, isCommit))
+		}
+	}, rio.TryPlanWhitelist)
+	return commitID
+}
+
+/*
+	Expands the ref from a warehouse URI fragment into the full ref name to push to.
+	See `GitTransmat.Scan`.
+*/
+func saveRef(ref string, hash string, isCommit bool) string {
+	if ref == "" {
+		return "refs/tags/repeatr/" + hash
+	}
+	var force string
+	if strings.HasPrefix(ref, "+") {
+		force, ref = "+", ref[1:]
+	}
+	if !strings.HasPrefix(ref, "refs/") {
+		if isCommit {
+			ref = "refs/heads/" + ref
+		} else {
+			ref = "refs/tags/" + ref
+		}
+	}
+	return force + ref
 }
 
 type gitArena struct {
@@ -6,21 +6,32 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/polydawn/gosh"
 	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
 
+	"go.polydawn.net/repeatr/api/def"
 	"go.polydawn.net/repeatr/lib/testutil"
 	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/filter"
+	"go.polydawn.net/repeatr/rio/tests"
 )
 
-//func TestCoreCompliance(t *testing.T) {
-//	Convey("Spec Compliance: Git Transmat", t, testutil.WithTmpdir(func() {
-//		// Nope.
-//		// Most of the core compliance tests require round-trip;
-//		// we can't satisfy any of those because we don't (yet) support scan with git.
-//	}))
-//}
+func TestCoreCompliance(t *testing.T) {
+	Convey("Spec Compliance: Git Transmat", t, testutil.WithTmpdir(func() {
+		// scanning
+		tests.CheckScanWithoutMutation(Kind, New)
+		tests.CheckScanProducesConsistentHash(Kind, New)
+		tests.CheckScanProducesDistinctHashes(Kind, New)
+		tests.CheckScanEmptyIsCalm(Kind, New)
+		tests.CheckScanWithFilters(Kind, New)
+		// (round-trip checks would fail on purpose: git doesn't keep empty dirs, owners, times, or most perms.)
+		git.Bake("init", "--bare", "--", "bounce").RunAndReport()
+		tests.CheckMultipleCommit(Kind, New, "./bounce", "local bare repo")
+	}))
+}
 
 func TestGitLocalFileInputCompat(t *testing.T) {
 	// note that this test eschews use of regular file fixtures for a few reasons:
@@ -103,3 +114,207 @@ func TestGitLocalFileInputCompat(t *testing.T) {
 	// so do both i guess.
 	//filefixture.Beta.Create("repo-a")
 }
+
+func TestGitScan(t *testing.T) {
+	Convey("Given a filesystem and a bare repo to push to", t, testutil.Requires(
+		testutil.WithTmpdir(func(c C) {
+			os.Mkdir("subject", 0755)
+			ioutil.WriteFile("subject/file-a", []byte("abcd"), 0644)
+			ioutil.WriteFile("subject/script", []byte("#!/bin/sh\r\n"), 0755)
+			ioutil.WriteFile("subject/.gitignore", []byte("file-a\n"), 0644)
+			ioutil.WriteFile("subject/.gitattributes", []byte("* text=auto\n"), 0644)
+			os.Symlink("file-a", "subject/link")
+			git.Bake("init", "--bare", "--", "repo-b").RunAndReport()
+			gitB := bakeGitDir(git, "repo-b")
+			revParse := func(rev string) string {
+				return strings.TrimSpace(gitB.Bake("rev-parse", rev, gosh.Opts{OkExit: gosh.AnyExit}).Output())
+			}
+
+			transmat := New("./workdir")
+			log := testutil.TestLogger(c)
+			mtime := rio.UseFilter(filter.MtimeFilter{def.FilterDefaultMtime})
+
+			Convey("Scanning with an mtime filter makes and pushes a commit", func() {
+				commitID := transmat.Scan(Kind, "./subject", []rio.SiloURI{"./repo-b"}, log, mtime)
+				So(commitID, ShouldHaveLength, 40)
+				So(revParse("refs/tags/repeatr/"+string(commitID)), ShouldEqual, string(commitID))
+				So(gitB.Bake("cat-file", "-p", string(commitID)).Output(), ShouldContainSubstring,
+					"\nauthor repeatr <repeatr> 1262304000 +0000\ncommitter repeatr <repeatr> 1262304000 +0000\n",
+				)
+				So(NewWarehouse("./repo-b").Advertises(commitID), ShouldBeTrue)
+				So(NewWarehouse("./repo-b").Advertises(commitID+":sub"), ShouldBeTrue)
+				So(NewWarehouse("./repo-b").Advertises("0000000000000000000000000000000000000000"), ShouldBeFalse)
+
+				Convey("The hash depends only on the files", func() {
+					So(transmat.Scan(Kind, "./subject", nil, log, mtime), ShouldEqual, commitID)
+					So(os.Chtimes("subject/file-a", time.Now(), time.Now()), ShouldBeNil)
+					So(transmat.Scan(Kind, "./subject", nil, log, mtime), ShouldEqual, commitID)
+				})
+
+				Convey("Commit config from the environment doesn't change the hash", func() {
+					// Config passed this way reaches git despite the clean HOME.
+					for k, v := range map[string]string{
+						"GIT_CONFIG_COUNT":   "2",
+						"GIT_CONFIG_KEY_0":   "i18n.commitEncoding",
+						"GIT_CONFIG_VALUE_0": "ISO-8859-1",
+						"GIT_CONFIG_KEY_1":   "commit.gpgSign",
+						"GIT_CONFIG_VALUE_1": "true",
+					} {
+						os.Setenv(k, v)
+						defer os.Unsetenv(k)
+					}
+					So(transmat.Scan(Kind, "./subject", nil, log, mtime), ShouldEqual, commitID)
+				})
+
+				Convey("Scanning without an mtime filter gives the bare tree", func() {
+					treeID := transmat.Scan(Kind, "./subject", []rio.SiloURI{"./repo-b"}, log)
+					So(treeID, ShouldEqual, revParse(string(commitID)+"^{tree}"))
+					So(revParse("refs/tags/repeatr/"+string(treeID)), ShouldEqual, string(treeID))
+
+					Convey("Which materializes, and later comes from the object store alone", func() {
+						arena := transmat.Materialize(Kind, treeID, []rio.SiloURI{"./repo-b"}, log)
+						So(arena.Hash(), ShouldEqual, treeID)
+						So(filepath.Join(arena.Path(), "script"), testutil.ShouldBeFile, os.FileMode(0755))
+						So(hasObject(string(treeID), filepath.Join("./workdir/gits", slugifyRemote(NewWarehouse("./repo-b").url))), ShouldBeTrue)
+
+						// Drop the checkout and the remote: only the store can serve it now.
+						So(os.RemoveAll("./workdir/full"), ShouldBeNil)
+						So(os.Mkdir("./workdir/full", 0755), ShouldBeNil)
+						So(os.Rename("repo-b", "repo-gone"), ShouldBeNil)
+						arena = transmat.Materialize(Kind, treeID, []rio.SiloURI{"./repo-b"}, log)
+						So(filepath.Join(arena.Path(), "file-a"), testutil.ShouldBeFile, os.FileMode(0644))
+					})
+				})
+
+				Convey("The commit materializes with every file, verbatim", func() {
+					arena := transmat.Materialize(Kind, commitID, []rio.SiloURI{"./repo-b"}, log)
+					So(arena.Hash(), ShouldEqual, commitID)
+					So(filepath.Join(arena.Path(), "file-a"), testutil.ShouldBeFile, os.FileMode(0644))
+					So(filepath.Join(arena.Path(), "script"), testutil.ShouldBeFile, os.FileMode(0755))
+					body, _ := ioutil.ReadFile(filepath.Join(arena.Path(), "script"))
+					So(string(body), ShouldEqual, "#!/bin/sh\r\n")
+					target, _ := os.Readlink(filepath.Join(arena.Path(), "link"))
+					So(target, ShouldEqual, "file-a")
+				})
+			})
+
+			Convey("Embedded repos are left out, not recorded as gitlinks", func() {
+				os.MkdirAll("subject/vendored/inner", 0755)
+				ioutil.WriteFile("subject/vendored/inner/file-v", []byte("v"), 0644)
+				git.Bake("init", "--", "subject/vendored").RunAndReport()
+				os.Mkdir("subject/worktree", 0755)
+				ioutil.WriteFile("subject/worktree/.git", []byte("gitdir: /nonexistent\n"), 0644)
+				commitID := transmat.Scan(Kind, "./subject", []rio.SiloURI{"./repo-b"}, log, mtime)
+				listing := gitB.Bake("ls-tree", "-r", string(commitID)).Output()
+				So(listing, ShouldNotContainSubstring, "160000")
+				So(listing, ShouldNotContainSubstring, "vendored")
+				So(listing, ShouldNotContainSubstring, "worktree")
+				So(listing, ShouldContainSubstring, "file-a")
+			})
+
+			Convey("Scanning to a named ref pushes there", func() {
+				commitID := transmat.Scan(Kind, "./subject", []rio.SiloURI{"./repo-b#release"}, log, mtime)
+				So(revParse("refs/heads/release"), ShouldEqual, string(commitID))
+
+				Convey("Different content can't replace it without a '+'", func() {
+					ioutil.WriteFile("subject/file-b", []byte("efgh"), 0644)
+					err := meep.RecoverPanics(func() {
+						transmat.Scan(Kind, "./subject", []rio.SiloURI{"./repo-b#release"}, log, mtime)
+					})
+					So(err, ShouldHaveSameTypeAs, &def.ErrWarehouseProblem{})
+					So(revParse("refs/heads/release"), ShouldEqual, string(commitID))
+
+					commitID2 := transmat.Scan(Kind, "./subject", []rio.SiloURI{"./repo-b#+release"}, log, mtime)
+					So(commitID2, ShouldNotEqual, commitID)
+					So(revParse("refs/heads/release"), ShouldEqual, string(commitID2))
+				})
+			})
+
+			Convey("Scanning to a repo that doesn't exist is an error", func() {
+				err := meep.RecoverPanics(func() {
+					transmat.Scan(Kind, "./subject", []rio.SiloURI{"./nonexistent"}, log, mtime)
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrWarehouseUnavailable{})
+			})
+		})),
+	)
+}
+
+func TestGitMaterializeFromStore(t *testing.T) {
+	Convey("Given a local git repo with some history and subdirs", t, testutil.Requires(
+		testutil.WithTmpdir(func(c C) {
+			git := git.Bake(gosh.Opts{Env: map[string]string{
+				"GIT_AUTHOR_NAME":     "repeatr",
+				"GIT_AUTHOR_EMAIL":    "repeatr",
+				"GIT_COMMITTER_NAME":  "repeatr",
+				"GIT_COMMITTER_EMAIL": "repeatr",
+			}})
+			var dataHash_1 rio.CommitID
+			var dataHash_2 rio.CommitID
+			git.Bake("init", "--", "repo-a").RunAndReport()
+			testutil.UsingDir("repo-a", func() {
+				os.MkdirAll("proj/lib", 0755)
+				ioutil.WriteFile("proj/lib/file-p", []byte("proj"), 0644)
+				ioutil.WriteFile("file-r", []byte("root"), 0644)
+				git.Bake("add", ".").RunAndReport()
+				git.Bake("commit", "-m", "testrepo-a commit 1").RunAndReport()
+				dataHash_1 = rio.CommitID(strings.Trim(git.Bake("rev-parse", "HEAD").Output(), "\n"))
+				ioutil.WriteFile("proj/file-q", []byte("more"), 0644)
+				git.Bake("add", ".").RunAndReport()
+				git.Bake("commit", "-m", "testrepo-a commit 2").RunAndReport()
+				dataHash_2 = rio.CommitID(strings.Trim(git.Bake("rev-parse", "HEAD").Output(), "\n"))
+			})
+			remote, _ := filepath.Abs("repo-a")
+			uris := []rio.SiloURI{rio.SiloURI("./repo-a")}
+
+			transmat := New("./workdir")
+			log := testutil.TestLogger(c)
+			store := bakeGitDir(git, filepath.Join("./workdir/gits", slugifyRemote(remote)))
+
+			Convey("Materializing a commit fetches only that commit", func() {
+				arena := transmat.Materialize(Kind, dataHash_2, uris, log)
+				So(filepath.Join(arena.Path(), "proj/file-q"), testutil.ShouldBeFile)
+				So(strings.TrimSpace(store.Bake("rev-parse", "--is-shallow-repository").Output()), ShouldEqual, "true")
+				So(hasCommit(string(dataHash_1), filepath.Join("./workdir/gits", slugifyRemote(remote))), ShouldBeFalse)
+
+				Convey("Later materializations reuse the store, even without the remote", func() {
+					So(os.RemoveAll("repo-a"), ShouldBeNil)
+					arena := transmat.Materialize(Kind, dataHash_2+":proj", uris, log)
+					So(arena.Hash(), ShouldEqual, dataHash_2+":proj")
+					So(filepath.Join(arena.Path(), "file-q"), testutil.ShouldBeFile)
+				})
+
+				Convey("The commit counts as cached, and materializes with no warehouses at all", func() {
+					So(Cached("./workdir", dataHash_2+":proj"), ShouldBeTrue)
+					So(Cached("./workdir", dataHash_1), ShouldBeFalse)
+					So(Cached("./workdir", dataHash_2+"+lfs"), ShouldBeFalse)
+					arena := transmat.Materialize(Kind, dataHash_2+":proj", nil, log)
+					So(filepath.Join(arena.Path(), "file-q"), testutil.ShouldBeFile)
+				})
+			})
+
+			Convey("Materializing a subdirectory gives just that dir", func() {
+				arena := transmat.Materialize(Kind, dataHash_1+":proj/lib", uris, log)
+				So(arena.Hash(), ShouldEqual, dataHash_1+":proj/lib")
+				So(filepath.Join(arena.Path(), "file-p"), testutil.ShouldBeFile)
+				So(filepath.Join(arena.Path(), "file-r"), testutil.ShouldBeNotFile)
+				So(filepath.Join(arena.Path(), "proj"), testutil.ShouldBeNotFile)
+				So(filepath.Join(arena.Path(), ".git"), testutil.ShouldBeNotFile)
+			})
+
+			Convey("Materializing a subdirectory that doesn't exist reports DNE", func() {
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, dataHash_1+":proj/nope", uris, log)
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrWareDNE{})
+			})
+
+			Convey("Paths outside the tree are rejected", func() {
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, dataHash_1+":../up", uris, log)
+				})
+				So(err, ShouldNotBeNil)
+			})
+		})),
+	)
+}
@@ -2,8 +2,12 @@ package git
 
 import (
 	"encoding/hex"
+	"fmt"
 	"net/url"
+	"path"
+	"strings"
 
+	"go.polydawn.net/repeatr/api/def"
 	"go.polydawn.net/repeatr/rio"
 )
 
@@ -16,6 +20,44 @@ func mustBeFullHash(hash rio.CommitID) {
 	}
 }
 
+/*
+	Split a ware hash into the commit, the subdirectory of it to use
+	(or "" for the whole tree), and whether Git LFS content is wanted.
+	Hashes are a commit hash, optionally followed by "+lfs", then optionally
+	by a path in git's own syntax: "<commit>[+lfs][:<path>]".
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the commit isn't a full hex hash, or the path leaves the tree.
+*/
+func splitWareHash(dataHash rio.CommitID) (commitHash string, subdir string, lfs bool) {
+	commitHash = string(dataHash)
+	if i := strings.IndexByte(commitHash, ':'); i >= 0 {
+		commitHash, subdir = commitHash[:i], commitHash[i+1:]
+	}
+	if strings.HasSuffix(commitHash, "+lfs") {
+		commitHash, lfs = strings.TrimSuffix(commitHash, "+lfs"), true
+	}
+	if _, err := hex.DecodeString(commitHash); err != nil || len(commitHash) != 40 {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("git hashes must begin with a full 40-character commit hash; %q does not", dataHash),
+		})
+	}
+	if subdir == "" {
+		return
+	}
+	subdir = path.Clean(subdir)
+	if path.IsAbs(subdir) || subdir == ".." || strings.HasPrefix(subdir, "../") {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("git hash %q names a path outside the tree", dataHash),
+		})
+	}
+	if subdir == "." {
+		subdir = ""
+	}
+	return
+}
+
 /*
 	Return a string that's safe to use as a dir name.
 
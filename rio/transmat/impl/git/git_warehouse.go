@@ -22,6 +22,7 @@ import (
 type Warehouse struct {
 	coord def.WarehouseCoord // user's string retained for messages
 	url   string
+	ref   string // from the URI fragment, if any; where saves are pushed.
 }
 
 /*
@@ -34,13 +35,21 @@ type Warehouse struct {
 	of pinning specific git versions and sandboxing their environment,
 	but at the moment, caveat emptor, and this is "PRs welcome" turf.)
 
+	A fragment on the URI (e.g. "./repo#release") names the ref that saves
+	should be pushed to; it's ignored when fetching.  See `GitTransmat.Scan`.
+
 	May panic with:
 	  - Config Error: if the URI is unparsable or has an unsupported scheme.
 */
 func NewWarehouse(coords rio.SiloURI) *Warehouse {
+	remote, ref := string(coords), ""
+	if i := strings.LastIndex(remote, "#"); i >= 0 {
+		remote, ref = remote[:i], remote[i+1:]
+	}
 	wh := &Warehouse{
 		coord: def.WarehouseCoord(coords),
-		url:   hammerRelativePaths(string(coords)),
+		url:   hammerRelativePaths(remote),
+		ref:   ref,
 	}
 	return wh
 }
@@ -119,6 +128,47 @@ func hammerRelativePaths(coords string) string {
 	an end-user-meaningful description of why the warehouse is out of reach.
 */
 func (wh *Warehouse) Ping() error {
+	return wh.ping("fetch")
+}
+
+/*
+	Like `Ping`, but for warehouses we're about to push to.
+
+	Git remotes must already exist to be pushed to; we don't create them.
+*/
+func (wh *Warehouse) PingWritable() error {
+	return wh.ping("save")
+}
+
+/*
+	Reports whether the remote advertises the commit (or tree) of a ware
+	hash as the tip of one of its refs -- as it does whatever `Scan` pushed.
+	That's the only way to know a remote has something without fetching;
+	commits further back in history aren't advertised, so false doesn't
+	mean the remote lacks it.
+*/
+func (wh *Warehouse) Advertises(dataHash rio.CommitID) bool {
+	commitHash, _, _ := splitWareHash(dataHash)
+	buf := &bytes.Buffer{}
+	p := git.Bake(
+		"ls-remote", wh.url,
+		gosh.Opts{
+			Out:    buf,
+			OkExit: gosh.AnyExit,
+		},
+	).Run()
+	if p.GetExitCode() != 0 {
+		return false
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, commitHash+"\t") {
+			return true
+		}
+	}
+	return false
+}
+
+func (wh *Warehouse) ping(during string) error {
 	// Shell out to git and ask it if it thinks there's a repo here.
 	//  `git ls-remote` is our best option here for checking out that location and making sure it's advertising refs,
 	//    while refraining from any alarmingly heavyweight operations or data transfers.
@@ -144,7 +194,7 @@ func (wh *Warehouse) Ping() error {
 		//  - "attempt to fetch/clone from a shallow repository"
 		return &def.ErrWarehouseUnavailable{
 			Msg:    fmt.Sprintf("git remote unavailable: %s", msg),
-			During: "fetch",
+			During: during,
 			From:   wh.coord,
 		}
 	default:
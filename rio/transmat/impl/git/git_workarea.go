@@ -3,6 +3,7 @@ package git
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"syscall"
@@ -25,14 +26,50 @@ type workArea struct {
 	fullCheckouts  string
 	nosubCheckouts string
 	gitDirs        string
+	scans          string
 }
 
 func (wa workArea) gitDirPath(repoURL string) string {
 	return filepath.Join(wa.gitDirs, slugifyRemote(repoURL))
 }
 
-func (wa workArea) makeFullchTempPath(commitHash string) string {
-	pth, err := ioutil.TempDir(wa.fullCheckouts, commitHash+"-")
+/*
+	Finds the git dir of any remote that has the commit (or tree) named by
+	`hash`; or returns "" if none do.  Hashes are hashes: whichever remote
+	we got the objects from, they're the same objects.
+*/
+func (wa workArea) findGitDir(hash string) string {
+	dirs, err := ioutil.ReadDir(wa.gitDirs)
+	if err != nil {
+		return ""
+	}
+	for _, dir := range dirs {
+		pth := filepath.Join(wa.gitDirs, dir.Name())
+		if dir.IsDir() && hasObject(hash, pth) {
+			return pth
+		}
+	}
+	return ""
+}
+
+/*
+	A scratch git dir to build the objects for one scan in.
+	The caller should remove it when done.
+*/
+func (wa workArea) makeScanTempPath() string {
+	pth, err := ioutil.TempDir(wa.scans, "")
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to set up tempdir"},
+			meep.Cause(err),
+		))
+	}
+	return pth
+}
+
+// Full checkouts are named by ware hash, which may include a path; hence the escaping.
+func (wa workArea) makeFullchTempPath(dataHash string) string {
+	pth, err := ioutil.TempDir(wa.fullCheckouts, url.QueryEscape(dataHash)+"-")
 	if err != nil {
 		panic(meep.Meep(
 			&rio.ErrInternal{Msg: "Unable to set up tempdir"},
@@ -42,8 +79,8 @@ func (wa workArea) makeFullchTempPath(commitHash string) string {
 	return pth
 }
 
-func (wa workArea) getFullchFinalPath(commitHash string) string {
-	return filepath.Join(wa.fullCheckouts, commitHash)
+func (wa workArea) getFullchFinalPath(dataHash string) string {
+	return filepath.Join(wa.fullCheckouts, url.QueryEscape(dataHash))
 }
 
 func (wa workArea) makeNosubchTempPath(commitHash string) string {
@@ -3,17 +3,21 @@ package gs
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
 	"path/filepath"
 
 	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
 
 	"go.polydawn.net/repeatr/api/def"
 	"go.polydawn.net/repeatr/lib/guid"
 	"go.polydawn.net/repeatr/rio"
 )
 
+var _ rio.BlobWarehouse = &Warehouse{}
+
 type Warehouse struct {
 	coord      def.WarehouseCoord // user's string retained for messages
 	bucketName string             // s3 bucket name
@@ -54,6 +58,18 @@ func NewWarehouse(coords rio.SiloURI, token *oauth2.Token) *Warehouse {
 	return wh
 }
 
+/*
+	Like `NewWarehouse`, but loads a token from the host environment,
+	the same way the transmat does.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the URI is bad or credentials are missing.
+*/
+func NewWarehouseFromEnv(coords rio.SiloURI) *Warehouse {
+	return NewWarehouse(coords, mustLoadToken())
+}
+
 /*
 	Returns nil if the warehouse is expected to be readable;
 	returns `*def.ErrWarehouseUnavailable` if not.
@@ -96,9 +112,9 @@ func (wh *Warehouse) getShelf(dataHash rio.CommitID) string {
 */
 func (wh *Warehouse) getStageShelf() string {
 	if wh.ctntAddr {
-		return filepath.Join(wh.pathPrefix, ".tmp.upload."+guid.New())
+		return filepath.Join(wh.pathPrefix, rio.UploadStagePrefix+guid.New())
 	}
-	return filepath.Join(path.Dir(wh.pathPrefix), ".tmp.upload."+path.Base(wh.pathPrefix)+"."+guid.New())
+	return filepath.Join(path.Dir(wh.pathPrefix), rio.UploadStagePrefix+path.Base(wh.pathPrefix)+"."+guid.New())
 }
 
 /*
@@ -133,6 +149,44 @@ func (wh *Warehouse) openReader(dataHash rio.CommitID) io.ReadCloser {
 	})
 }
 
+/*
+	Return a reader for the raw binary content of the ware.
+	See `openReader`.
+*/
+func (wh *Warehouse) OpenReader(dataHash rio.CommitID) io.ReadCloser {
+	return wh.openReader(dataHash)
+}
+
+/*
+	Returns true if the warehouse already has an object stored under the hash.
+	Always false for warehouses that aren't content-addressable.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- if the warehouse can't give a clear answer.
+*/
+func (wh *Warehouse) Has(dataHash rio.CommitID) bool {
+	if !wh.ctntAddr {
+		return false
+	}
+	service, err := makeGsObjectService(wh.token)
+	if err == nil {
+		_, err = service.Get(wh.bucketName, wh.getShelf(dataHash)).Do()
+	}
+	if err == nil {
+		return true
+	}
+	if err2, ok := err.(*googleapi.Error); ok && err2.Code == http.StatusNotFound {
+		return false
+	}
+	panic(&def.ErrWarehouseProblem{
+		Msg:    err.Error(),
+		During: "fetch",
+		Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
+		From:   wh.coord,
+	})
+}
+
 type writeController struct {
 	warehouse *Warehouse
 	writer    io.WriteCloser
@@ -140,6 +194,10 @@ type writeController struct {
 	stagePath string // may be empty if !ctntAddr -- we upload in place because obj writes are already atomic in s3.
 }
 
+func (wh *Warehouse) OpenWriter() rio.BlobWriteController {
+	return wh.openWriter()
+}
+
 func (wh *Warehouse) openWriter() *writeController {
 	wc := &writeController{
 		warehouse: wh,
@@ -205,3 +263,28 @@ func (wc *writeController) Commit(saveAs rio.CommitID) {
 		reloc(wc.warehouse.bucketName, wc.stagePath, finalPath, wc.warehouse.token)
 	}
 }
+
+func (wc *writeController) Write(p []byte) (int, error) {
+	return wc.writer.Write(p)
+}
+
+/*
+	Discard the current data.
+	Closes the writer and invalidates any future use.
+*/
+func (wc *writeController) Abort() {
+	// failing the pipe makes the upload routine give up rather than finish.
+	if pw, ok := wc.writer.(*io.PipeWriter); ok {
+		pw.CloseWithError(fmt.Errorf("upload aborted"))
+	} else {
+		wc.writer.Close()
+	}
+	for _ = range wc.writerErr {
+		// drain; we already know it failed.
+	}
+	if wc.stagePath != "" {
+		if service, err := makeGsObjectService(wc.warehouse.token); err == nil {
+			service.Delete(wc.warehouse.bucketName, wc.stagePath).Do()
+		}
+	}
+}
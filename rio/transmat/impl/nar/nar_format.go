@@ -0,0 +1,278 @@
+/*
+	The NAR transmat reads and writes Nix ARchives, so that filesystems can
+	be shared with Nix store paths without re-packing.
+
+	Wares of kind "nar" are identified by their NAR hash in the form Nix
+	prints it (as in a `.narinfo`'s `NarHash`, or `nix-store --query --hash`):
+	"sha256:" followed by Nix's base32.  (Hex digests are accepted for
+	materializing, too.)
+
+	NARs only know of regular files (executable or not), symlinks, and dirs;
+	there are no owners, timestamps, or other permissions.  Materialized files
+	get modes 0644 or 0755 (dirs 0755), and the usual filters for owners and
+	times.  Scanning anything else (device nodes, fifos) is an error.
+
+	Warehouses may be:
+
+	  - `file:///path/thing.nar` -- a single NAR file.
+	  - `file+ca:///path/cache` -- a dir laid out like a Nix binary cache,
+	    with NARs stored as `nar/<hash>.nar`.  (This matches what
+	    `nix copy --to 'file:///path/cache?compression=none'` produces,
+	    since an uncompressed NAR's file hash is its NAR hash.)
+	  - `http://`, `https://`, `http+ca://`, `https+ca://` -- the same, over http (read-only).
+*/
+package nar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/fs"
+)
+
+const narMagic = "nix-archive-1"
+
+// Guards against absurd lengths in corrupt archives; names and symlink targets are never this long.
+const maxTokenLen = 4096
+
+/*
+	Walks `pth`, writing it as a NAR to `w`.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the filesystem has things NARs can't represent.
+	  - other errors, on IO problems.
+*/
+func Pack(w io.Writer, pth string) {
+	writeString(w, narMagic)
+	packNode(w, pth)
+}
+
+func packNode(w io.Writer, pth string) {
+	fi, err := os.Lstat(pth)
+	if err != nil {
+		panic(err)
+	}
+	writeString(w, "(")
+	writeString(w, "type")
+	switch {
+	case fi.Mode().IsRegular():
+		writeString(w, "regular")
+		if fi.Mode()&0100 != 0 {
+			writeString(w, "executable")
+			writeString(w, "")
+		}
+		writeString(w, "contents")
+		file, err := os.Open(pth)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		writeStream(w, file, fi.Size())
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(pth)
+		if err != nil {
+			panic(err)
+		}
+		writeString(w, "symlink")
+		writeString(w, "target")
+		writeString(w, target)
+	case fi.IsDir():
+		writeString(w, "directory")
+		// ReadDir sorts by name, bytewise; exactly the order NARs require.
+		entries, err := ioutil.ReadDir(pth)
+		if err != nil {
+			panic(err)
+		}
+		for _, entry := range entries {
+			writeString(w, "entry")
+			writeString(w, "(")
+			writeString(w, "name")
+			writeString(w, entry.Name())
+			writeString(w, "node")
+			packNode(w, filepath.Join(pth, entry.Name()))
+			writeString(w, ")")
+		}
+	default:
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("cannot pack %q into a NAR: NARs can only hold files, dirs, and symlinks, not %s", pth, fi.Mode()),
+		})
+	}
+	writeString(w, ")")
+}
+
+func writeString(w io.Writer, s string) {
+	writeLength(w, uint64(len(s)))
+	mustWrite(w, []byte(s))
+	writePadding(w, uint64(len(s)))
+}
+
+func writeStream(w io.Writer, r io.Reader, size int64) {
+	writeLength(w, uint64(size))
+	if _, err := io.CopyN(w, r, size); err != nil {
+		panic(err) // includes the file shrinking while we read it
+	}
+	writePadding(w, uint64(size))
+}
+
+func writeLength(w io.Writer, n uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	mustWrite(w, buf[:])
+}
+
+func writePadding(w io.Writer, n uint64) {
+	if n%8 != 0 {
+		mustWrite(w, make([]byte, 8-n%8))
+	}
+}
+
+func mustWrite(w io.Writer, b []byte) {
+	if _, err := w.Write(b); err != nil {
+		panic(err)
+	}
+}
+
+/*
+	Reads a NAR from `r`, placing its root node at `destPath` (which must not exist).
+	Each node's metadata is `meta` with the type, mode, and name filled in.
+
+	May panic with:
+
+	  - `*def.ErrWareCorrupt` -- if the NAR is malformed.
+	  - other errors, on IO problems.
+*/
+func Unpack(r io.Reader, destPath string, meta fs.Metadata) {
+	u := &unpacker{r: r, base: filepath.Dir(destPath), meta: meta}
+	u.expect(narMagic)
+	u.node("./" + filepath.Base(destPath))
+}
+
+type unpacker struct {
+	r    io.Reader
+	base string      // all placement is relative to this, for `fs.PlaceFile`'s sake.
+	meta fs.Metadata // prototype for every node.
+}
+
+func (u *unpacker) node(name string) {
+	u.expect("(")
+	u.expect("type")
+	hdr := u.meta
+	hdr.Name = name
+	switch typ := u.readString(); typ {
+	case "regular":
+		hdr.Typeflag = '0' // tar.TypeReg
+		hdr.Mode = 0644
+		tok := u.readString()
+		if tok == "executable" {
+			u.expect("")
+			hdr.Mode = 0755
+			tok = u.readString()
+		}
+		if tok != "contents" {
+			u.corrupt(fmt.Sprintf("expected \"contents\", got %q", tok))
+		}
+		size := u.readLength()
+		body := &io.LimitedReader{R: u.r, N: int64(size)}
+		fs.PlaceFile(u.base, hdr, body)
+		if body.N != 0 {
+			u.corrupt(fmt.Sprintf("file contents truncated (%d of %d bytes missing)", body.N, size))
+		}
+		u.readPadding(size)
+		u.expect(")")
+	case "symlink":
+		hdr.Typeflag = '2' // tar.TypeSymlink
+		hdr.Mode = 0777
+		u.expect("target")
+		hdr.Linkname = u.readString()
+		fs.PlaceFile(u.base, hdr, nil)
+		u.expect(")")
+	case "directory":
+		hdr.Typeflag = '5' // tar.TypeDir
+		hdr.Mode = 0755
+		hdr.Name += "/"
+		fs.PlaceFile(u.base, hdr, nil)
+		var prev string
+		for {
+			tok := u.readString()
+			if tok == ")" {
+				break
+			}
+			if tok != "entry" {
+				u.corrupt(fmt.Sprintf("expected \"entry\" or \")\", got %q", tok))
+			}
+			u.expect("(")
+			u.expect("name")
+			entryName := u.readString()
+			if entryName == "" || entryName == "." || entryName == ".." || strings.ContainsAny(entryName, "/\x00") {
+				u.corrupt(fmt.Sprintf("invalid entry name %q", entryName))
+			}
+			if prev != "" && entryName <= prev {
+				u.corrupt(fmt.Sprintf("entries out of order (%q after %q)", entryName, prev))
+			}
+			prev = entryName
+			u.expect("node")
+			u.node(name + "/" + entryName)
+			u.expect(")")
+		}
+		// All children are placed; now the dir's times can stick.
+		fs.PlaceDirTime(u.base, hdr)
+	default:
+		u.corrupt(fmt.Sprintf("unknown node type %q", typ))
+	}
+}
+
+func (u *unpacker) expect(s string) {
+	if tok := u.readString(); tok != s {
+		u.corrupt(fmt.Sprintf("expected %q, got %q", s, tok))
+	}
+}
+
+func (u *unpacker) readString() string {
+	n := u.readLength()
+	if n > maxTokenLen {
+		u.corrupt(fmt.Sprintf("token length %d is unreasonable", n))
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(u.r, buf); err != nil {
+		u.corrupt(err.Error())
+	}
+	u.readPadding(n)
+	return string(buf)
+}
+
+func (u *unpacker) readLength() uint64 {
+	var buf [8]byte
+	if _, err := io.ReadFull(u.r, buf[:]); err != nil {
+		u.corrupt(err.Error())
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func (u *unpacker) readPadding(n uint64) {
+	if n%8 == 0 {
+		return
+	}
+	pad := make([]byte, 8-n%8)
+	if _, err := io.ReadFull(u.r, pad); err != nil {
+		u.corrupt(err.Error())
+	}
+	for _, b := range pad {
+		if b != 0 {
+			u.corrupt("nonzero padding")
+		}
+	}
+}
+
+func (u *unpacker) corrupt(msg string) {
+	panic(&def.ErrWareCorrupt{
+		Msg: "corrupt nar: " + msg,
+	})
+}
+
@@ -0,0 +1,176 @@
+package nar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/tests"
+)
+
+func TestNixBase32(t *testing.T) {
+	Convey("Nix base32 should match what Nix prints", t, func() {
+		sum := sha256.Sum256(nil)
+		So(EncodeBase32(sum[:]), ShouldEqual, "0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73")
+
+		Convey("And should decode back again", func() {
+			decoded, err := DecodeBase32("0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73", sha256.Size)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, sum[:])
+		})
+
+		Convey("Malformed input should be rejected", func() {
+			_, err := DecodeBase32("0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c7e", sha256.Size)
+			So(err, ShouldNotBeNil)
+			_, err = DecodeBase32("0mdqa9w1p6", sha256.Size)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+/*
+	Filesystems and the NAR hashes Nix gives them (`nix-hash --type sha256 --base32`).
+*/
+var narVectors = []struct {
+	name  string
+	setup func(pth string)
+	hash  rio.CommitID
+}{
+	{"empty file", func(pth string) {
+		ioutil.WriteFile(pth, []byte{}, 0644)
+	}, "sha256:0ip26j2h11n1kgkz36rl4akv694yz65hr72q4kv4b3lxcbi65b3p"},
+	{"file", func(pth string) {
+		ioutil.WriteFile(pth, []byte("hello\n"), 0644)
+	}, "sha256:04zwf782yjwnh3q6hz5izfd6jyip8kgw6g6yj43fiqhbyhdd0dqw"},
+	{"executable", func(pth string) {
+		ioutil.WriteFile(pth, []byte("#!/bin/sh\necho hi\n"), 0755)
+	}, "sha256:183p8jhjfcpk6kac6hxwp4gzp9brkvkibylz27jfbvgd5kqcq2jy"},
+	{"symlink", func(pth string) {
+		os.Symlink("../target", pth)
+	}, "sha256:0d68k8xwc4dqhxaq2gkswn550yr5qw07576lkhlqbpxdpnlp4ng5"},
+	{"empty dir", func(pth string) {
+		os.Mkdir(pth, 0755)
+	}, "sha256:0sjjj9z1dhilhpc8pq4154czrb79z9cm044jvn75kxcjv6v5l2m5"},
+	{"tree", func(pth string) {
+		os.Mkdir(pth, 0755)
+		os.Mkdir(filepath.Join(pth, "a"), 0755)
+		ioutil.WriteFile(filepath.Join(pth, "a/x"), []byte{}, 0755)
+		ioutil.WriteFile(filepath.Join(pth, "b"), []byte("bee\n"), 0644)
+		ioutil.WriteFile(filepath.Join(pth, "A"), []byte("upper\n"), 0600) // only the executable bit matters
+		os.Symlink("b", filepath.Join(pth, "link"))
+	}, "sha256:07j2bsq5nrav82rjchzx20g6kmfkh25dgzxbsw8r48q7hsbych01"},
+}
+
+func TestNarFormat(t *testing.T) {
+	Convey("Packing filesystems should produce the same NARs as Nix", t, testutil.WithTmpdir(func() {
+		for _, vector := range narVectors {
+			Convey(vector.name, func() {
+				vector.setup("./subject")
+				var buf bytes.Buffer
+				Pack(&buf, "./subject")
+				sum := sha256.Sum256(buf.Bytes())
+				So(formatHash(sum[:]), ShouldEqual, vector.hash)
+			})
+		}
+
+		Convey("Byte for byte, in the simplest case", func() {
+			ioutil.WriteFile("./subject", []byte("hello\n"), 0644)
+			var buf bytes.Buffer
+			Pack(&buf, "./subject")
+			So(hex.EncodeToString(buf.Bytes()), ShouldEqual, ""+
+				"0d00000000000000"+"6e69782d617263686976652d31000000"+ // "nix-archive-1"
+				"0100000000000000"+"2800000000000000"+ // "("
+				"0400000000000000"+"7479706500000000"+ // "type"
+				"0700000000000000"+"726567756c617200"+ // "regular"
+				"0800000000000000"+"636f6e74656e7473"+ // "contents"
+				"0600000000000000"+"68656c6c6f0a0000"+ // "hello\n"
+				"0100000000000000"+"2900000000000000", // ")"
+			)
+		})
+	}))
+}
+
+func TestCoreCompliance(t *testing.T) {
+	Convey("Spec Compliance: NAR Transmat", t, testutil.WithTmpdir(func() {
+		// scanning
+		tests.CheckScanWithoutMutation(Kind, New)
+		tests.CheckScanProducesConsistentHash(Kind, New)
+		tests.CheckScanProducesDistinctHashes(Kind, New)
+		tests.CheckScanEmptyIsCalm(Kind, New)
+		// (round-trip checks would fail on purpose: NARs don't keep owners, times, or most perms.)
+		os.Mkdir("bounce", 0755)
+		tests.CheckMultipleCommit(Kind, New, "file+ca://bounce", "binary cache dir")
+	}))
+}
+
+func TestNarTransmat(t *testing.T) {
+	Convey("Given the NAR transmat", t,
+		testutil.Requires(testutil.RequiresRoot, testutil.WithTmpdir(func(c C) {
+			transmat := New("./workdir")
+			log := testutil.TestLogger(c)
+
+			for _, vector := range narVectors {
+				Convey("Round-tripping a "+vector.name+" through a binary cache dir preserves its hash", func() {
+					os.Mkdir("cache", 0755)
+					vector.setup("./subject")
+					uris := []rio.SiloURI{"file+ca://cache"}
+					hash := transmat.Scan(Kind, "./subject", uris, log)
+					So(hash, ShouldEqual, vector.hash)
+					So(filepath.Join("cache/nar", hashDigits(hash)+".nar"), testutil.ShouldBeFile)
+					arena := transmat.Materialize(Kind, hash, uris, log)
+					defer arena.Teardown()
+					So(arena.Hash(), ShouldEqual, hash)
+					// Re-packing the result must give the same hash again.
+					So(transmat.Scan(Kind, arena.Path(), nil, log), ShouldEqual, hash)
+				})
+			}
+
+			Convey("Round-tripping a fixture preserves its content", func() {
+				filefixture.Gamma.Create("./subject")
+				hash := transmat.Scan(Kind, "./subject", []rio.SiloURI{"file://single.nar"}, log)
+				arena := transmat.Materialize(Kind, hash, []rio.SiloURI{"file://single.nar"}, log)
+				defer arena.Teardown()
+				comparisonLevel := filefixture.CompareBody // NARs keep content and types, not metadata.
+				So(filefixture.Scan(arena.Path()).Describe(comparisonLevel), ShouldEqual, filefixture.Gamma.Describe(comparisonLevel))
+			})
+
+			Convey("Materializing by hex hash works too", func() {
+				vector := narVectors[5]
+				vector.setup("./subject")
+				hash := transmat.Scan(Kind, "./subject", []rio.SiloURI{"file://single.nar"}, log)
+				hexHash := rio.CommitID("sha256:" + hex.EncodeToString(parseHash(hash)))
+				arena := transmat.Materialize(Kind, hexHash, []rio.SiloURI{"file://single.nar"}, log)
+				defer arena.Teardown()
+				So(filepath.Join(arena.Path(), "b"), testutil.ShouldBeFile)
+			})
+
+			Convey("Materializing content that doesn't match the hash is rejected", func() {
+				narVectors[1].setup("./subject")
+				transmat.Scan(Kind, "./subject", []rio.SiloURI{"file://single.nar"}, log)
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, narVectors[0].hash, []rio.SiloURI{"file://single.nar"}, log)
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrHashMismatch{})
+			})
+
+			Convey("Materializing a hash the cache doesn't have reports DNE", func() {
+				os.Mkdir("cache", 0755)
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, narVectors[0].hash, []rio.SiloURI{"file+ca://cache"}, log)
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrWareDNE{})
+			})
+		})),
+	)
+}
@@ -0,0 +1,323 @@
+package nar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/fs"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/filter"
+	"go.polydawn.net/repeatr/rio/transmat/mixins"
+)
+
+const Kind = rio.TransmatKind("nar")
+
+var _ rio.Transmat = &Transmat{}
+
+type Transmat struct {
+	workPath string
+}
+
+var _ rio.TransmatFactory = New
+
+func New(workPath string) rio.Transmat {
+	err := os.MkdirAll(workPath, 0755)
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to set up workspace"},
+			meep.Cause(err),
+		))
+	}
+	return &Transmat{workPath}
+}
+
+/*
+	Render a sha256 the way Nix does.
+*/
+func formatHash(sum []byte) rio.CommitID {
+	return rio.CommitID("sha256:" + EncodeBase32(sum))
+}
+
+/*
+	Parse a NAR hash in either of the forms Nix uses ("sha256:" then base32 or hex).
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if it's not one.
+*/
+func parseHash(dataHash rio.CommitID) []byte {
+	digits := strings.TrimPrefix(string(dataHash), "sha256:")
+	if digits == string(dataHash) {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("nar hashes must begin with \"sha256:\"; %q does not", dataHash),
+		})
+	}
+	var sum []byte
+	var err error
+	if len(digits) == hex.EncodedLen(sha256.Size) {
+		sum, err = hex.DecodeString(digits)
+	} else {
+		sum, err = DecodeBase32(digits, sha256.Size)
+	}
+	if err != nil {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("malformed nar hash %q: %s", dataHash, err),
+		})
+	}
+	return sum
+}
+
+// The base32 digits of a hash, as used in binary cache filenames.
+func hashDigits(dataHash rio.CommitID) string {
+	if dataHash == "" {
+		return ""
+	}
+	return strings.TrimPrefix(string(formatHash(parseHash(dataHash))), "sha256:")
+}
+
+/*
+	Arenas produced by NAR Transmats may be relocated by simple `mv`.
+*/
+func (t *Transmat) Materialize(
+	kind rio.TransmatKind,
+	dataHash rio.CommitID,
+	siloURIs []rio.SiloURI,
+	log log15.Logger,
+	options ...rio.MaterializerConfigurer,
+) rio.Arena {
+	var arena narArena
+	meep.Try(func() {
+		// Basic validation and config
+		mixins.MustBeType(Kind, kind)
+		expected := parseHash(dataHash)
+		// Before we eval all config, prepend some default filter setup.
+		//  We need these defaults here because "keep" isn't a
+		//   semantically valid concept (there's no metadata to keep!).
+		options = append([]rio.MaterializerConfigurer{
+			rio.UseFilter(filter.MtimeFilter{def.FilterDefaultMtime}),
+			rio.UseFilter(filter.UidFilter{def.FilterDefaultUid}),
+			rio.UseFilter(filter.GidFilter{def.FilterDefaultGid}),
+		}, options...)
+		config := rio.EvaluateConfig(options...)
+
+		// Ping silos
+		if len(siloURIs) < 1 {
+			// Note that it's possible a caching layer will satisfy things even without data sources...
+			//  but if that was going to happen, it already would have by now.
+			panic(&def.ErrWarehouseUnavailable{
+				Msg:    "No warehouse coords configured!",
+				During: "fetch",
+			})
+		}
+		// Our policy is to take the first path that exists.
+		//  This lets you specify a series of potential locations, and if one is unavailable we'll just take the next.
+		var wh *Warehouse
+		var stream io.ReadCloser
+		var available bool
+		for _, uri := range siloURIs {
+			meep.Try(func() {
+				wh = NewWarehouse(uri)
+				if err := wh.PingReadable(); err != nil {
+					panic(err)
+				}
+				stream = wh.makeReader(dataHash)
+			}, meep.TryPlan{
+				{ByType: &def.ErrWarehouseUnavailable{}, Handler: func(_ error) {
+					// fine, we'll just try the next one
+					log.Info("Warehouse not available, skipping", "warehouse", uri)
+				}},
+				{ByType: &def.ErrWareDNE{}, Handler: func(_ error) {
+					// fine, we'll just try the next one
+					available = true // but at least someone was *alive*
+					log.Info("Warehouse does not have the data, skipping", "warehouse", uri, "hash", dataHash)
+				}},
+			})
+			if stream != nil {
+				break
+			}
+		}
+		if stream == nil {
+			if available {
+				panic(&def.ErrWareDNE{
+					Ware: def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				})
+			}
+			panic(&def.ErrWarehouseUnavailable{
+				Msg:    "No warehouses responded!",
+				During: "fetch",
+			})
+		}
+		defer stream.Close()
+
+		// Create staging arena to produce data into.
+		//  The root of a NAR may be a file, so we reserve a name rather than make a dir.
+		f, err := ioutil.TempFile(t.workPath, "")
+		if err != nil {
+			panic(meep.Meep(
+				&rio.ErrInternal{Msg: "Unable to create arena"},
+				meep.Cause(err),
+			))
+		}
+		f.Close()
+		arena.path = f.Name() + ".nar"
+		defer os.Remove(f.Name())
+
+		// Unpack, hashing everything as it goes by.
+		hasher := sha256.New()
+		reader := io.TeeReader(stream, hasher)
+		Unpack(reader, arena.path, config.FilterSet.Apply(fs.Metadata{
+			ModTime:    fs.Epochwhen,
+			AccessTime: fs.Epochwhen,
+		}))
+		// Anything after the end of the archive would make the hash mismatch anyway; may as well show it.
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    err.Error(),
+				During: "fetch",
+				Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:   wh.coord,
+			})
+		}
+		actual := hasher.Sum(nil)
+
+		// verify total integrity
+		if string(actual) == string(expected) {
+			arena.hash = dataHash
+			return
+		}
+		// If not... this may or may not be grounds for panic, depending on configuration.
+		if config.AcceptHashMismatch {
+			// if we're tolerating mismatches, report the actual hash through different mechanisms.
+			// you probably only ever want to use this in tests or debugging; in prod it's just asking for insanity.
+			arena.hash = formatHash(actual)
+		}
+		// If tolerance mode not configured, this is a panic.
+		panic(&def.ErrHashMismatch{
+			Expected: def.Ware{Type: string(Kind), Hash: string(dataHash)},
+			Actual:   def.Ware{Type: string(Kind), Hash: string(formatHash(actual))},
+			From:     wh.coord,
+		})
+	}, rio.TryPlanWhitelist)
+	return arena
+}
+
+/*
+	Packs the filesystem as a NAR, and returns its hash.
+	Filters have no effect; NARs don't record any of the things they filter.
+*/
+func (t Transmat) Scan(
+	kind rio.TransmatKind,
+	subjectPath string,
+	siloURIs []rio.SiloURI,
+	log log15.Logger,
+	options ...rio.MaterializerConfigurer,
+) rio.CommitID {
+	var commitID rio.CommitID
+	meep.Try(func() {
+		// Basic validation and config
+		mixins.MustBeType(Kind, kind)
+
+		// If scan area doesn't exist, bail immediately.
+		// No need to even start dialing warehouses if we've got nothing for em.
+		//  (Lstat: a NAR's root may itself be a symlink.)
+		_, err := os.Lstat(subjectPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return // empty commitID
+			} else {
+				panic(err)
+			}
+		}
+
+		// Dial warehouses.
+		warehouses := make([]*Warehouse, 0, len(siloURIs))
+		for _, uri := range siloURIs {
+			wh := NewWarehouse(uri)
+			err := wh.PingWritable()
+			if err == nil {
+				warehouses = append(warehouses, wh)
+			} else {
+				log.Info("Unable to contact a warehouse, skipping it",
+					"warehouse", uri,
+					"reason", err,
+				)
+			}
+		}
+		// By default we're tolerant of some warehouses being unresponsive,
+		//  but if ALL of them are down?  That's bad enough news to stop for.
+		//  (No save locations at all is fine: still need to hash.)
+		if len(siloURIs) > 0 && len(warehouses) == 0 {
+			panic(&def.ErrWarehouseUnavailable{
+				Msg:    "No warehouses responded!",
+				During: "save",
+			})
+		}
+
+		// Open output streams for writing.
+		controllers := make([]*writeController, 0, len(warehouses))
+		writers := make([]io.Writer, 0, len(warehouses)+1)
+		for _, wh := range warehouses {
+			controller := wh.openWriter()
+			controllers = append(controllers, controller)
+			writers = append(writers, controller.writer)
+		}
+		hasher := sha256.New()
+		writers = append(writers, hasher)
+
+		// walk, fwrite, hash
+		meep.Try(func() {
+			Pack(io.MultiWriter(writers...), subjectPath)
+		}, meep.TryPlan{
+			{CatchAny: true, Handler: func(e error) {
+				for _, controller := range controllers {
+					controller.Abort()
+				}
+				panic(e)
+			}},
+		})
+		commitID = formatHash(hasher.Sum(nil))
+
+		// commit
+		for _, controller := range controllers {
+			controller.Commit(commitID)
+		}
+	}, rio.TryPlanWhitelist)
+	return commitID
+}
+
+type narArena struct {
+	path string
+	hash rio.CommitID
+}
+
+func (a narArena) Path() string {
+	return a.path
+}
+
+func (a narArena) Hash() rio.CommitID {
+	return a.hash
+}
+
+// rm's.
+// does not consider it an error if path already does not exist.
+func (a narArena) Teardown() {
+	if err := os.RemoveAll(a.path); err != nil {
+		if e2, ok := err.(*os.PathError); ok && e2.Err == syscall.ENOENT && e2.Path == a.path {
+			return
+		}
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Failed to tear down arena"},
+			meep.Cause(err),
+		))
+	}
+}
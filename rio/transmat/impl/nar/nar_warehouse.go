@@ -0,0 +1,286 @@
+package nar
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/guid"
+	"go.polydawn.net/repeatr/rio"
+)
+
+type Warehouse struct {
+	coord    def.WarehouseCoord // user's string retained for messages
+	url      *url.URL
+	ctntAddr bool
+}
+
+func NewWarehouse(coords rio.SiloURI) *Warehouse {
+	// verify schema is sensible up front.
+	u, err := url.Parse(string(coords))
+	if err != nil {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("failed to parse URI: %s", err),
+		})
+	}
+	// stamp out a warehouse handle.
+	wh := &Warehouse{
+		coord: def.WarehouseCoord(coords),
+		url:   u,
+	}
+	// whitelist scheme types.
+	switch u.Scheme {
+	case "file":
+	case "file+ca":
+		wh.ctntAddr = true
+		u.Scheme = "file"
+	case "http":
+	case "http+ca":
+		wh.ctntAddr = true
+		u.Scheme = "http"
+	case "https":
+	case "https+ca":
+		wh.ctntAddr = true
+		u.Scheme = "https"
+	case "":
+		panic(&def.ErrConfigValidation{
+			Msg: "missing scheme in warehouse URI; need a prefix, e.g. \"file://\" or \"http://\"",
+		})
+	default:
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("unsupported scheme in warehouse URI: %q", u.Scheme),
+		})
+	}
+	return wh
+}
+
+/*
+	The path (local, or in the URL) of a NAR, relative to the warehouse root.
+	Binary caches keep them in a "nar" subdir, named by their hash.
+*/
+func shelfName(dataHash rio.CommitID) string {
+	return path.Join("nar", hashDigits(dataHash)+".nar")
+}
+
+/*
+	Return a reader for the raw NAR.
+
+	May panic with:
+
+	  - `*def.ErrWareDNE` -- if the ware does not exist.
+	  - `*def.ErrWarehouseProblem` -- for most other problems in fetch.
+*/
+func (wh *Warehouse) makeReader(dataHash rio.CommitID) io.ReadCloser {
+	u := wh.url
+	switch u.Scheme {
+	case "file":
+		file, err := os.Open(wh.getShelf(dataHash))
+		if err != nil {
+			// Raise DNE for file-not-found; raise WarehouseProblem for anything less routine.
+			if os.IsNotExist(err) {
+				panic(&def.ErrWareDNE{
+					Ware: def.Ware{Type: string(Kind), Hash: string(dataHash)},
+					From: wh.coord,
+				})
+			}
+			panic(&def.ErrWarehouseProblem{
+				Msg:    err.Error(),
+				During: "fetch",
+				Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:   wh.coord,
+			})
+		}
+		return file
+	case "http", "https":
+		if wh.ctntAddr {
+			u, _ = url.Parse(u.String()) // copy
+			u.Path = path.Join(u.Path, shelfName(dataHash))
+		}
+		resp, err := http.Get(u.String())
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:       err.Error(),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: true,
+			})
+		}
+		switch resp.StatusCode {
+		case 200:
+			return resp.Body
+		case 404:
+			resp.Body.Close()
+			panic(&def.ErrWareDNE{
+				Ware: def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From: wh.coord,
+			})
+		default:
+			resp.Body.Close()
+			panic(&def.ErrWarehouseProblem{
+				Msg:       fmt.Sprintf("http status %s", resp.Status),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: resp.StatusCode >= 500,
+			})
+		}
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Returns nil if the warehouse is expected to be readable;
+	returns `*def.ErrWarehouseUnavailable` if not.
+
+	For http warehouses, this is stubbed to always return success;
+	we find out when we try to fetch.
+*/
+func (wh *Warehouse) PingReadable() error {
+	switch wh.url.Scheme {
+	case "file":
+		pth := filepath.Join(wh.url.Host, wh.url.Path) // file uris don't have hosts
+		if !wh.ctntAddr {
+			pth = filepath.Dir(pth)
+		}
+		if _, err := os.Stat(pth); err != nil {
+			return &def.ErrWarehouseUnavailable{
+				Msg:    fmt.Sprintf("error pinging: %s", err),
+				During: "fetch",
+				From:   wh.coord,
+			}
+		}
+		return nil
+	case "http", "https":
+		return nil
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Returns nil if the warehouse is expected to be writable;
+	returns `*def.ErrWarehouseUnavailable` if not.
+*/
+func (wh *Warehouse) PingWritable() error {
+	switch wh.url.Scheme {
+	case "file":
+		pth := filepath.Join(wh.url.Host, wh.url.Path) // file uris don't have hosts
+		if !wh.ctntAddr {
+			// The *parent* of the path must be a dir.
+			pth = filepath.Dir(pth)
+		}
+		stat, err := os.Stat(pth)
+		if err != nil {
+			return &def.ErrWarehouseUnavailable{
+				Msg:    fmt.Sprintf("error pinging: %s", err),
+				During: "save",
+				From:   wh.coord,
+			}
+		}
+		if !stat.IsDir() {
+			return &def.ErrWarehouseUnavailable{
+				Msg:    fmt.Sprintf("nar warehouse must be (or be within) a dir: %s is not a dir", pth),
+				During: "save",
+				From:   wh.coord,
+			}
+		}
+		return nil
+	case "http", "https":
+		return &def.ErrWarehouseUnavailable{
+			Msg:    "warehouses accessed by http are not writable with this transmat",
+			During: "save",
+			From:   wh.coord,
+		}
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	For "file" coords, return the (local) path expected for a given piece of data.
+*/
+func (wh *Warehouse) getShelf(dataHash rio.CommitID) string {
+	pth := filepath.Join(wh.url.Host, wh.url.Path) // file uris don't have hosts
+	if wh.ctntAddr {
+		return filepath.Join(pth, filepath.FromSlash(shelfName(dataHash)))
+	}
+	return pth
+}
+
+type writeController struct {
+	warehouse     *Warehouse
+	writer        io.WriteCloser
+	stageFilePath string
+}
+
+func (wh *Warehouse) openWriter() *writeController {
+	wc := &writeController{warehouse: wh}
+	// Pick a random upload path, next to where it'll end up.
+	finalPath := wh.getShelf("")
+	if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    fmt.Sprintf("failed to reserve temp space in warehouse: %s", err),
+			During: "save",
+			From:   wh.coord,
+		})
+	}
+	wc.stageFilePath = filepath.Join(filepath.Dir(finalPath), rio.UploadStagePrefix+guid.New())
+	file, err := os.OpenFile(wc.stageFilePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    fmt.Sprintf("failed to reserve temp space in warehouse: %s", err),
+			During: "save",
+			From:   wh.coord,
+		})
+	}
+	wc.writer = file
+	return wc
+}
+
+/*
+	Commit the current data as the given hash.
+	Caller must be an adult and specify the hash truthfully.
+	Closes the writer and invalidates any future use.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- in the event of IO errors committing.
+*/
+func (wc *writeController) Commit(saveAs rio.CommitID) {
+	wc.writer.Close()
+	if err := os.Rename(wc.stageFilePath, wc.warehouse.getShelf(saveAs)); err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    fmt.Sprintf("failed to commit: %s", err),
+			During: "save",
+			Ware:   def.Ware{Type: string(Kind), Hash: string(saveAs)},
+			From:   wc.warehouse.coord,
+		})
+	}
+}
+
+/*
+	Discard the current data, removing the stage file.
+	Closes the writer and invalidates any future use.
+*/
+func (wc *writeController) Abort() {
+	wc.writer.Close()
+	os.Remove(wc.stageFilePath)
+}
@@ -0,0 +1,53 @@
+package nar
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	Nix's peculiar base32: its own alphabet (no 'e', 'o', 'u', 't'),
+	and the digits emitted starting from the *end* of the hash.
+	Hashes must be in this form to match what Nix prints.
+*/
+const nixBase32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+func EncodeBase32(hash []byte) string {
+	n := (len(hash)*8-1)/5 + 1
+	out := make([]byte, 0, n)
+	for k := n - 1; k >= 0; k-- {
+		b := uint(k * 5)
+		i := b / 8
+		j := b % 8
+		c := hash[i] >> j
+		if int(i)+1 < len(hash) {
+			c |= hash[i+1] << (8 - j)
+		}
+		out = append(out, nixBase32Alphabet[c&0x1f])
+	}
+	return string(out)
+}
+
+func DecodeBase32(s string, size int) ([]byte, error) {
+	if len(s) != (size*8-1)/5+1 {
+		return nil, fmt.Errorf("nix base32 hash of %d bytes must be %d chars, not %d", size, (size*8-1)/5+1, len(s))
+	}
+	hash := make([]byte, size)
+	for n := 0; n < len(s); n++ {
+		digit := strings.IndexByte(nixBase32Alphabet, s[len(s)-n-1])
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid character %q in nix base32 hash", s[len(s)-n-1])
+		}
+		b := uint(n * 5)
+		i := b / 8
+		j := b % 8
+		hash[i] |= byte(digit) << j
+		if carry := byte(digit >> (8 - j)); carry != 0 {
+			if int(i)+1 >= size {
+				return nil, fmt.Errorf("nix base32 hash overflows %d bytes", size)
+			}
+			hash[i+1] |= carry
+		}
+	}
+	return hash, nil
+}
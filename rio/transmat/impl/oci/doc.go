@@ -0,0 +1,33 @@
+/*
+	The OCI transmat materializes container images.
+
+	Wares of kind "oci" are identified by the digest of their image manifest
+	(e.g. "sha256:4b6f..."), exactly as `docker pull image@sha256:...` would name them.
+	Materializing fetches the manifest, then applies each of its layers in order
+	into a single filesystem, honoring whiteouts (files named `.wh.<name>` delete
+	`<name>` from lower layers; a `.wh..wh..opq` file empties its directory of
+	lower layers' contents).  The manifest and every layer are verified against
+	their digests.  Digests of image indexes (multi-platform images) are
+	refused: which image they'd give depends on the platform, so the hash
+	wouldn't name one filesystem.  Use the digest of one platform's manifest.
+
+	Warehouses may be:
+
+	  - `file:///path/to/layout` -- an OCI image-layout directory
+	    (the kind with an `oci-layout` file, `index.json`, and `blobs/`).
+	  - `https://registry.example.com/some/repo` -- a repository in a registry
+	    speaking the distribution v2 API.  Anonymous bearer-token auth
+	    (as used by e.g. Docker Hub for public images) is handled automatically.
+	    (`http://` is accepted as well, for local registries.)
+
+	Image config (entrypoint, env, etc) is not part of the filesystem, and is ignored.
+
+	Scanning packs a filesystem as a single-layer image, and saves it to the
+	same kinds of warehouses (layout dirs are created if necessary, and the
+	image is listed in their `index.json`; registries are pushed to by digest,
+	without a tag).  The image is reproducible: the layer is a gzip'd tar in
+	the same normalized form the tar transmat produces, with filters applied,
+	and the config's timestamp is always the epoch.  Scanning the same
+	filesystem always yields the same manifest digest.
+*/
+package oci
@@ -0,0 +1,192 @@
+package oci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/lib/fs"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/filter"
+	tartrans "go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+/*
+	The architecture we declare in image configs.  We don't know what (if any)
+	architecture the filesystem's binaries are for, and asking the host would
+	make the digest depend on where the scan ran; so it's always this.
+*/
+const imageArchitecture = "amd64"
+
+/*
+	The image config blob.  We only fill in what's needed to describe the
+	filesystem; entrypoints and such are the deploying party's business.
+*/
+type imageConfig struct {
+	Created      string      `json:"created"`
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	Config       struct{}    `json:"config"`
+	RootFS       imageRootFS `json:"rootfs"`
+}
+
+type imageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+/*
+	A single-layer image, built and ready to push.
+	The layer lives in a file (it may be big); the rest is in memory.
+*/
+type image struct {
+	layerPath    string
+	layer        descriptor
+	config       []byte
+	configDesc   descriptor
+	manifest     []byte
+	manifestDesc descriptor
+}
+
+/*
+	Pack `subjectPath` into a single-layer image.
+
+	Everything that goes into the image is deterministic: the layer is a tar
+	in the same normalized form as the tar transmat's (with the filters applied),
+	the config's timestamps are fixed at the epoch, and its architecture is
+	fixed too (see `imageArchitecture`).  So the same filesystem always yields
+	the same manifest digest, on any host.
+
+	The layer file is created in `workPath`; call `image.Teardown` to remove it.
+*/
+func buildImage(subjectPath string, filterset filter.FilterSet, workPath string) *image {
+	img := &image{}
+
+	// Pack the layer.  It's gzip'd; the digest is of that, but the config wants the uncompressed digest too.
+	layerFile, err := ioutil.TempFile(workPath, "layer-")
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to create layer file"},
+			meep.Cause(err),
+		))
+	}
+	defer layerFile.Close()
+	img.layerPath = layerFile.Name()
+	layerHasher := sha256.New()
+	// Always gzip: that's what the layer media type we declare says.
+	tartrans.Save(io.MultiWriter(layerFile, layerHasher), tartrans.DefaultCompression, subjectPath, filterset, sha512.New384)
+	size, err := layerFile.Seek(0, 2)
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to read back layer file"},
+			meep.Cause(err),
+		))
+	}
+	img.layer = descriptor{
+		MediaType: MediaTypeLayerGzip,
+		Digest:    "sha256:" + hex.EncodeToString(layerHasher.Sum(nil)),
+		Size:      size,
+	}
+	img.describe(img.diffID(layerFile))
+	return img
+}
+
+/*
+	Produce the config and manifest for the layer.
+	Depends on nothing but the layer's descriptor and `diffID`.
+*/
+func (img *image) describe(diffID string) {
+	config := imageConfig{
+		Created:      fs.Epochwhen.Format(time.RFC3339),
+		Architecture: imageArchitecture,
+		OS:           "linux",
+		RootFS: imageRootFS{
+			Type:    "layers",
+			DiffIDs: []string{diffID},
+		},
+	}
+	img.config, img.configDesc = marshalBlob(MediaTypeConfig, config)
+	img.manifest, img.manifestDesc = marshalBlob(MediaTypeManifest, manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        &img.configDesc,
+		Layers:        []descriptor{img.layer},
+	})
+}
+
+// Hashes the uncompressed layer.
+func (img *image) diffID(layerFile *os.File) string {
+	if _, err := layerFile.Seek(0, 0); err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to read back layer file"},
+			meep.Cause(err),
+		))
+	}
+	gzReader, err := gzip.NewReader(layerFile)
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to read back layer file"},
+			meep.Cause(err),
+		))
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, gzReader); err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to read back layer file"},
+			meep.Cause(err),
+		))
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+func marshalBlob(mediaType string, v interface{}) ([]byte, descriptor) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+		))
+	}
+	sum := sha256.Sum256(body)
+	return body, descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(body)),
+	}
+}
+
+/*
+	Store the whole image in a warehouse: blobs first, so that the manifest
+	never refers to anything that isn't there yet.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- for any problems storing.
+*/
+func (img *image) push(wh *Warehouse) {
+	layerFile, err := os.Open(img.layerPath)
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to read back layer file"},
+			meep.Cause(err),
+		))
+	}
+	defer layerFile.Close()
+	wh.pushBlob(img.layer, layerFile)
+	wh.pushBlob(img.configDesc, bytes.NewReader(img.config))
+	wh.pushManifest(img.manifestDesc, img.manifest)
+}
+
+func (img *image) Teardown() {
+	os.Remove(img.layerPath)
+}
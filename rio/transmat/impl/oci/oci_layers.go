@@ -0,0 +1,211 @@
+package oci
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/fs"
+	"go.polydawn.net/repeatr/lib/fshash"
+	"go.polydawn.net/repeatr/rio"
+	tartrans "go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+/*
+	Applies one layer's tar stream on top of whatever is already in `destBasePath`.
+
+	Whiteouts remove things placed by lower layers; entries replace
+	whatever was at their path before, except that a dir landing on a dir
+	just updates its attributes (keeping the lower layers' contents).
+
+	Dir headers are accumulated into `dirs` (keyed by name) so the caller can
+	fix up their times after the last layer; any later change to a dir's
+	contents would disturb its mtime.
+
+	No entry may reach through a symlink placed by a lower layer -- not to
+	place a file, and not to white one out.  (An image with `etc -> /etc` in
+	one layer and `etc/.wh.passwd` in the next would otherwise delete the
+	host's files.)
+
+	May panic with:
+
+	  - `*def.ErrWareCorrupt` -- if the tar stream is malformed,
+	    or an entry's path traverses a symlink.
+*/
+func applyLayer(tr *tar.Reader, destBasePath string, dirs map[string]fs.Metadata, log log15.Logger) {
+	// Paths placed by this layer.  An opaque whiteout only hides lower layers,
+	//  and may legitimately come after siblings from its own layer in the stream.
+	placed := map[string]struct{}{}
+	for {
+		thdr, err := tr.Next()
+		if err == io.EOF {
+			break // end of archive
+		}
+		if err != nil {
+			panic(&def.ErrWareCorrupt{
+				Msg: fmt.Sprintf("corrupt layer tar: %s", err),
+			})
+		}
+		hdr := tartrans.NormalizeHeader(thdr)
+		if hdr.Name == "." {
+			hdr.Name = "./"
+		}
+		dir, base := path.Split(strings.TrimSuffix(hdr.Name, "/"))
+		refuseSymlinkedParents(destBasePath, hdr.Name)
+
+		// Whiteouts aren't files; they remove things.
+		switch {
+		case base == whiteoutOpaque:
+			clearDir(destBasePath, dir, placed, dirs)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			// A whiteout names a sibling; anything else (like ".wh..") would reach out of its dir.
+			name := strings.TrimPrefix(base, whiteoutPrefix)
+			if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+				panic(&def.ErrWareCorrupt{
+					Msg: fmt.Sprintf("corrupt layer tar: whiteout %q names no sibling", hdr.Name),
+				})
+			}
+			removeAll(destBasePath, dir+name, dirs)
+			continue
+		}
+
+		// Conjure parents, if necessary.  Same as any other tar.
+		parts := strings.Split(hdr.Name, "/")
+		for i := range parts[:len(parts)-1] {
+			i++
+			_, err := os.Lstat(filepath.Join(append([]string{destBasePath}, parts[:i]...)...))
+			if err == nil || !os.IsNotExist(err) {
+				continue
+			}
+			conjuredHdr := fshash.DefaultDirRecord().Metadata
+			conjuredHdr.Name = strings.Join(parts[:i], "/") + "/"
+			fs.PlaceFile(destBasePath, conjuredHdr, nil)
+			placed[strings.Join(parts[:i], "/")] = struct{}{}
+			dirs[conjuredHdr.Name] = conjuredHdr
+		}
+
+		// Place the file, replacing whatever a lower layer had there.
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if hdr.Name != "./" {
+				hdr.Name += "/"
+			}
+			placed[strings.TrimSuffix(hdr.Name, "/")] = struct{}{}
+			destPath := filepath.Join(destBasePath, hdr.Name)
+			if fi, err := os.Lstat(destPath); err == nil && fi.IsDir() {
+				// Merge: keep the contents, take the new attributes.
+				if err := os.Lchown(destPath, hdr.Uid, hdr.Gid); err != nil {
+					ioError(err)
+				}
+				if err := os.Chmod(destPath, hdr.FileMode()); err != nil {
+					ioError(err)
+				}
+			} else {
+				removeAll(destBasePath, hdr.Name, dirs)
+				fs.PlaceFile(destBasePath, hdr, nil)
+			}
+			dirs[hdr.Name] = hdr
+		case tar.TypeReg, tar.TypeRegA:
+			hdr.Typeflag = tar.TypeReg
+			placed[hdr.Name] = struct{}{}
+			removeAll(destBasePath, hdr.Name, dirs)
+			fs.PlaceFile(destBasePath, hdr, tr)
+		case tar.TypeSymlink, tar.TypeLink, tar.TypeBlock, tar.TypeChar, tar.TypeFifo:
+			placed[hdr.Name] = struct{}{}
+			removeAll(destBasePath, hdr.Name, dirs)
+			fs.PlaceFile(destBasePath, hdr, nil)
+		default:
+			log.Warn(fmt.Sprintf("oci layer extract: ignoring entry type %q", hdr.Typeflag))
+		}
+	}
+}
+
+/*
+	Panics with `*def.ErrWareCorrupt` if any parent of `name` inside
+	`destBasePath` is a symlink.  (`name` itself may be one: removing or
+	replacing a symlink doesn't follow it.)
+
+	Must be checked before anything touches the path, since whiteouts and
+	replacements remove things before `fs.PlaceFile` gets its chance to
+	refuse the same.
+*/
+func refuseSymlinkedParents(destBasePath string, name string) {
+	parts := strings.Split(strings.TrimSuffix(name, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+		fi, err := os.Lstat(filepath.Join(destBasePath, parent))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return // nothing further down exists either.
+			}
+			ioError(err)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			panic(&def.ErrWareCorrupt{
+				Msg: fmt.Sprintf("corrupt layer tar: entry %q would traverse the symlink at %q", name, parent),
+			})
+		}
+	}
+}
+
+/*
+	Remove everything in a dir that wasn't placed by the current layer.
+*/
+func clearDir(destBasePath string, dir string, placed map[string]struct{}, dirs map[string]fs.Metadata) {
+	dir = strings.TrimSuffix(dir, "/")
+	entries, err := ioutil.ReadDir(filepath.Join(destBasePath, dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		ioError(err)
+	}
+	for _, entry := range entries {
+		name := dir + "/" + entry.Name()
+		if _, ok := placed[name]; ok {
+			continue
+		}
+		removeAll(destBasePath, name, dirs)
+	}
+}
+
+/*
+	Remove a path (and everything under it) if it exists,
+	forgetting any dir records for it.
+*/
+func removeAll(destBasePath string, name string, dirs map[string]fs.Metadata) {
+	name = strings.TrimSuffix(name, "/")
+	if clean := path.Clean(name); clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return // never remove the root, or anything outside it.
+	}
+	if err := os.RemoveAll(filepath.Join(destBasePath, name)); err != nil {
+		ioError(err)
+	}
+	for dirName := range dirs {
+		if dirName == name+"/" || strings.HasPrefix(dirName, name+"/") {
+			delete(dirs, dirName)
+		}
+	}
+}
+
+func ioError(err error) {
+	panic(meep.Meep(
+		&rio.ErrInternal{Msg: "Unable to apply layer"},
+		meep.Cause(err),
+	))
+}
@@ -0,0 +1,148 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"go.polydawn.net/repeatr/api/def"
+)
+
+const (
+	MediaTypeManifest           = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeIndex              = "application/vnd.oci.image.index.v1+json"
+	MediaTypeConfig             = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer              = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip          = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+/*
+	The union of the fields of an image manifest and an image index,
+	so we can parse before knowing which we've got.
+*/
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        *descriptor  `json:"config,omitempty"`
+	Layers        []descriptor `json:"layers,omitempty"`
+	Manifests     []descriptor `json:"manifests,omitempty"`
+}
+
+func (m manifest) isIndex() bool {
+	return m.MediaType == MediaTypeIndex || m.MediaType == MediaTypeDockerManifestList ||
+		(m.MediaType == "" && m.Manifests != nil && m.Layers == nil)
+}
+
+/*
+	Describe the platform manifests listed in an index, for error messages
+	pointing the user at the digest they should use instead.
+*/
+func (m manifest) describePlatforms() string {
+	var lines []string
+	for _, desc := range m.Manifests {
+		if desc.Platform == nil {
+			lines = append(lines, desc.Digest)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s/%s)", desc.Digest, desc.Platform.OS, desc.Platform.Architecture))
+	}
+	return strings.Join(lines, ", ")
+}
+
+/*
+	Fetch a manifest (or index) by digest, and verify it.
+
+	May panic with:
+
+	  - `*def.ErrHashMismatch` -- if the content doesn't match the digest.
+	  - `*def.ErrWareCorrupt` -- if the content doesn't parse.
+	  - the same errors as `Warehouse.openBlob`.
+*/
+func fetchManifest(wh *Warehouse, digest string) manifest {
+	stream := wh.openBlob(digest, true)
+	defer stream.Close()
+	verifier := newVerifier(stream, digest)
+	body, err := ioutil.ReadAll(verifier)
+	if err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    err.Error(),
+			During: "fetch",
+			Ware:   def.Ware{Type: string(Kind), Hash: digest},
+			From:   wh.coord,
+		})
+	}
+	verifier.mustMatch(wh)
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		panic(&def.ErrWareCorrupt{
+			Msg:  fmt.Sprintf("could not parse manifest: %s", err),
+			Ware: def.Ware{Type: string(Kind), Hash: digest},
+			From: wh.coord,
+		})
+	}
+	return m
+}
+
+/*
+	Hashes everything read through it, for comparison against a digest.
+*/
+type verifier struct {
+	io.Reader
+	hasher hash.Hash
+	digest string
+}
+
+func newVerifier(r io.Reader, digest string) *verifier {
+	algo, _ := splitDigest(digest)
+	var hasher hash.Hash
+	switch algo {
+	case "sha256":
+		hasher = sha256.New()
+	case "sha512":
+		hasher = sha512.New()
+	default:
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("unsupported digest algorithm %q", algo),
+		})
+	}
+	return &verifier{io.TeeReader(r, hasher), hasher, digest}
+}
+
+func (v *verifier) actual() string {
+	algo, _ := splitDigest(v.digest)
+	return algo + ":" + hex.EncodeToString(v.hasher.Sum(nil))
+}
+
+/*
+	Raises `*def.ErrHashMismatch` if what's been read doesn't match the digest.
+*/
+func (v *verifier) mustMatch(wh *Warehouse) {
+	if actual := v.actual(); actual != v.digest {
+		panic(&def.ErrHashMismatch{
+			Expected: def.Ware{Type: string(Kind), Hash: v.digest},
+			Actual:   def.Ware{Type: string(Kind), Hash: actual},
+			From:     wh.coord,
+		})
+	}
+}
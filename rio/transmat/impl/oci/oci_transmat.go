@@ -0,0 +1,279 @@
+package oci
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/fs"
+	"go.polydawn.net/repeatr/lib/fshash"
+	"go.polydawn.net/repeatr/rio"
+	tartrans "go.polydawn.net/repeatr/rio/transmat/impl/tar"
+	"go.polydawn.net/repeatr/rio/transmat/mixins"
+)
+
+const Kind = rio.TransmatKind("oci")
+
+var _ rio.Transmat = &OCITransmat{}
+
+type OCITransmat struct {
+	workPath string
+}
+
+var _ rio.TransmatFactory = New
+
+func New(workPath string) rio.Transmat {
+	err := os.MkdirAll(workPath, 0755)
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to set up workspace"},
+			meep.Cause(err),
+		))
+	}
+	return &OCITransmat{workPath}
+}
+
+/*
+	Arenas produced by OCI Transmats may be relocated by simple `mv`.
+*/
+func (t *OCITransmat) Materialize(
+	kind rio.TransmatKind,
+	dataHash rio.CommitID,
+	siloURIs []rio.SiloURI,
+	log log15.Logger,
+	options ...rio.MaterializerConfigurer,
+) rio.Arena {
+	var arena ociArena
+	meep.Try(func() {
+		// Basic validation and config
+		mixins.MustBeType(Kind, kind)
+		if algo, _ := splitDigest(string(dataHash)); algo == "" {
+			panic(&def.ErrConfigValidation{
+				Msg: fmt.Sprintf("oci wares are identified by manifest digest, e.g. \"sha256:...\"; %q is not one", dataHash),
+			})
+		}
+
+		// Ping silos
+		if len(siloURIs) < 1 {
+			// Note that it's possible a caching layer will satisfy things even without data sources...
+			//  but if that was going to happen, it already would have by now.
+			panic(&def.ErrWarehouseUnavailable{
+				Msg:    "No warehouse coords configured!",
+				During: "fetch",
+			})
+		}
+		// Our policy is to take the first warehouse that has the manifest.
+		//  Layers are then fetched from that same warehouse; registries only serve blobs for their own repositories.
+		var wh *Warehouse
+		var m manifest
+		var available bool
+		for _, uri := range siloURIs {
+			var found bool
+			meep.Try(func() {
+				wh = NewWarehouse(uri)
+				if err := wh.PingReadable(); err != nil {
+					panic(err)
+				}
+				m = fetchManifest(wh, string(dataHash))
+				found = true
+			}, meep.TryPlan{
+				{ByType: &def.ErrWarehouseUnavailable{}, Handler: func(_ error) {
+					// fine, we'll just try the next one
+					log.Info("Warehouse not available, skipping", "warehouse", uri)
+				}},
+				{ByType: &def.ErrWareDNE{}, Handler: func(_ error) {
+					// fine, we'll just try the next one
+					available = true // but at least someone was *alive*
+					log.Info("Warehouse does not have the data, skipping", "warehouse", uri, "hash", dataHash)
+				}},
+			})
+			if found {
+				break
+			}
+			wh = nil
+		}
+		if wh == nil {
+			if available {
+				panic(&def.ErrWareDNE{
+					Ware: def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				})
+			}
+			panic(&def.ErrWarehouseUnavailable{
+				Msg:    "No warehouses responded!",
+				During: "fetch",
+			})
+		}
+
+		// An index is a different image per platform; picking one by the host
+		//  we're on would make the same hash mean different filesystems.
+		if m.isIndex() {
+			panic(&def.ErrConfigValidation{
+				Msg: fmt.Sprintf("%s is a multi-platform image index, not an image; use the digest of one platform's manifest: %s", dataHash, m.describePlatforms()),
+			})
+		}
+
+		// Create staging arena to produce data into.
+		var err error
+		arena.path, err = ioutil.TempDir(t.workPath, "")
+		if err != nil {
+			panic(meep.Meep(
+				&rio.ErrInternal{Msg: "Unable to create arena"},
+				meep.Cause(err),
+			))
+		}
+		// Start with a root like any other tar's; the first layer will usually overrule it.
+		rootHdr := fshash.DefaultDirRecord().Metadata
+		rootHdr.Name = "./"
+		fs.PlaceFile(arena.path, rootHdr, nil)
+		dirs := map[string]fs.Metadata{rootHdr.Name: rootHdr}
+
+		// Apply each layer in turn.
+		for i, layer := range m.Layers {
+			log.Info("Applying layer", "n", i+1, "of", len(m.Layers), "digest", layer.Digest)
+			applyBlob(wh, layer, arena.path, dirs, log)
+		}
+
+		// Fix dir times now that their contents are final: deepest first, so parents don't get bumped again.
+		names := make([]string, 0, len(dirs))
+		for name := range dirs {
+			names = append(names, name)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		for _, name := range names {
+			fs.PlaceDirTime(arena.path, dirs[name])
+		}
+
+		arena.hash = dataHash
+	}, rio.TryPlanWhitelist)
+	return arena
+}
+
+/*
+	Fetch one layer blob, verify it, and apply it.
+*/
+func applyBlob(wh *Warehouse, layer descriptor, destBasePath string, dirs map[string]fs.Metadata, log log15.Logger) {
+	stream := wh.openBlob(layer.Digest, false)
+	defer stream.Close()
+	verifier := newVerifier(stream, layer.Digest)
+	// Layers may be plain or gzip'd (or other things, in other media types; the sniffing decompressor handles the ones we know).
+	reader, err := tartrans.Decompress(verifier)
+	if err != nil {
+		panic(&def.ErrWareCorrupt{
+			Msg:  fmt.Sprintf("could not start decompressing layer %s: %s", layer.Digest, err),
+			Ware: def.Ware{Type: string(Kind), Hash: layer.Digest},
+			From: wh.coord,
+		})
+	}
+	applyLayer(tar.NewReader(reader), destBasePath, dirs, log)
+	// Tar streams often have trailing padding past the end marker; the digest covers it all.
+	if _, err := io.Copy(ioutil.Discard, verifier); err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    err.Error(),
+			During: "fetch",
+			Ware:   def.Ware{Type: string(Kind), Hash: layer.Digest},
+			From:   wh.coord,
+		})
+	}
+	verifier.mustMatch(wh)
+}
+
+/*
+	Packs the filesystem as a single-layer image (see `buildImage`), and
+	returns the manifest digest.
+*/
+func (t OCITransmat) Scan(
+	kind rio.TransmatKind,
+	subjectPath string,
+	siloURIs []rio.SiloURI,
+	log log15.Logger,
+	options ...rio.MaterializerConfigurer,
+) rio.CommitID {
+	var commitID rio.CommitID
+	meep.Try(func() {
+		// Basic validation and config
+		mixins.MustBeType(Kind, kind)
+		config := rio.EvaluateConfig(options...)
+
+		// If scan area doesn't exist, bail immediately.
+		// No need to even start dialing warehouses if we've got nothing for em.
+		_, err := os.Stat(subjectPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return // empty commitID
+			} else {
+				panic(err)
+			}
+		}
+
+		// Dial warehouses.
+		//  (Before packing, which may take a while; no sense doing it if there's nowhere to put it.)
+		warehouses := make([]*Warehouse, 0, len(siloURIs))
+		for _, uri := range siloURIs {
+			wh := NewWarehouse(uri)
+			err := wh.PingWritable()
+			if err == nil {
+				warehouses = append(warehouses, wh)
+			} else {
+				log.Info("Unable to contact a warehouse, skipping it",
+					"warehouse", uri,
+					"reason", err,
+				)
+			}
+		}
+		// By default we're tolerant of some warehouses being unresponsive,
+		//  but if ALL of them are down?  That's bad enough news to stop for.
+		//  (No save locations at all is fine: still need to hash.)
+		if len(siloURIs) > 0 && len(warehouses) == 0 {
+			panic(&def.ErrWarehouseUnavailable{
+				Msg:    "No warehouses responded!",
+				During: "save",
+			})
+		}
+
+		// Pack.
+		img := buildImage(subjectPath, config.FilterSet, t.workPath)
+		defer img.Teardown()
+		commitID = rio.CommitID(img.manifestDesc.Digest)
+
+		// Push.
+		for _, wh := range warehouses {
+			img.push(wh)
+		}
+	}, rio.TryPlanWhitelist)
+	return commitID
+}
+
+type ociArena struct {
+	path string
+	hash rio.CommitID
+}
+
+func (a ociArena) Path() string {
+	return a.path
+}
+
+func (a ociArena) Hash() rio.CommitID {
+	return a.hash
+}
+
+// rm's.
+// does not consider it an error if path already does not exist.
+func (a ociArena) Teardown() {
+	if err := os.RemoveAll(a.path); err != nil {
+		if e2, ok := err.(*os.PathError); ok && e2.Err == syscall.ENOENT && e2.Path == a.path {
+			return
+		}
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Failed to tear down arena"},
+			meep.Cause(err),
+		))
+	}
+}
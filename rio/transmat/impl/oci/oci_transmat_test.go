@@ -0,0 +1,401 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/tests"
+)
+
+type layerEntry struct {
+	name     string
+	typeflag byte
+	body     string // or for symlinks, the target.
+}
+
+func makeLayer(entries []layerEntry, gz bool) []byte {
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var gzw *gzip.Writer
+	if gz {
+		gzw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gzw)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for _, ent := range entries {
+		hdr := &tar.Header{Name: ent.name, Typeflag: ent.typeflag, Mode: 0644}
+		if ent.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if ent.typeflag == tar.TypeSymlink {
+			hdr.Linkname = ent.body
+			tw.WriteHeader(hdr)
+			continue
+		}
+		hdr.Size = int64(len(ent.body))
+		tw.WriteHeader(hdr)
+		tw.Write([]byte(ent.body))
+	}
+	tw.Close()
+	if gz {
+		gzw.Close()
+	}
+	return buf.Bytes()
+}
+
+// Writes a blob into an OCI layout dir, returning its descriptor.
+func putBlob(layout string, mediaType string, body []byte) descriptor {
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0755)
+	ioutil.WriteFile(filepath.Join(layout, "blobs", "sha256", hex.EncodeToString(sum[:])), body, 0644)
+	return descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(body))}
+}
+
+func putJSON(layout string, mediaType string, v interface{}) descriptor {
+	body, _ := json.Marshal(v)
+	return putBlob(layout, mediaType, body)
+}
+
+/*
+	Creates an OCI layout dir holding a two-layer image, where the upper
+	layer whites out some of the lower; returns the manifest digest.
+*/
+func makeLayout(layout string) string {
+	os.MkdirAll(layout, 0755)
+	ioutil.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+	config := putJSON(layout, MediaTypeConfig, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+	})
+	lower := putBlob(layout, MediaTypeLayerGzip, makeLayer([]layerEntry{
+		{"etc/", tar.TypeDir, ""},
+		{"etc/a", tar.TypeReg, "lower a"},
+		{"etc/b", tar.TypeReg, "lower b"},
+		{"opaque/", tar.TypeDir, ""},
+		{"opaque/x", tar.TypeReg, "lower x"},
+		{"gone", tar.TypeReg, "lower gone"},
+		{"replaced", tar.TypeReg, "lower replaced"},
+	}, true))
+	upper := putBlob(layout, MediaTypeLayer, makeLayer([]layerEntry{
+		{".wh.gone", tar.TypeReg, ""},
+		{"etc/.wh.a", tar.TypeReg, ""},
+		{"etc/c", tar.TypeReg, "upper c"},
+		{"opaque/y", tar.TypeReg, "upper y"},
+		{"opaque/.wh..wh..opq", tar.TypeReg, ""},
+		{"replaced", tar.TypeReg, "upper replaced"},
+	}, false))
+	m := putJSON(layout, MediaTypeManifest, manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        &config,
+		Layers:        []descriptor{lower, upper},
+	})
+	return m.Digest
+}
+
+/*
+	Creates an OCI layout dir holding a two-layer image whose lower layer
+	makes `etc` a symlink to `target`, and whose upper layer has `upper`
+	(e.g. whiteouts) under `etc/`; returns the manifest digest.
+*/
+func makeSymlinkLayout(layout string, target string, upper ...layerEntry) string {
+	os.MkdirAll(layout, 0755)
+	ioutil.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+	config := putJSON(layout, MediaTypeConfig, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+	})
+	lowerLayer := putBlob(layout, MediaTypeLayer, makeLayer([]layerEntry{
+		{"etc", tar.TypeSymlink, target},
+	}, false))
+	upperLayer := putBlob(layout, MediaTypeLayer, makeLayer(upper, false))
+	m := putJSON(layout, MediaTypeManifest, manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        &config,
+		Layers:        []descriptor{lowerLayer, upperLayer},
+	})
+	return m.Digest
+}
+
+/*
+	Serves the distribution v2 endpoints from an OCI layout dir:
+	reads, and monolithic uploads (which are stored into the layout dir).
+	If `auth` is set, demands a bearer token, which it hands out from `/token`.
+*/
+func registryServer(layout string, auth bool) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			w.Write([]byte(`{"token":"letmein"}`))
+			return
+		}
+		if auth && req.Header.Get("Authorization") != "Bearer letmein" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:library/thing:pull,push"`)
+			w.WriteHeader(401)
+			return
+		}
+		if req.URL.Path == "/v2/" {
+			w.WriteHeader(200)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v2/"), "/")
+		if len(parts) < 3 {
+			w.WriteHeader(404)
+			return
+		}
+		last, section := parts[len(parts)-1], parts[len(parts)-2]
+		switch {
+		case req.Method == "POST" && last == "uploads":
+			w.Header().Set("Location", req.URL.Path+"session")
+			w.WriteHeader(202)
+			return
+		case req.Method == "PUT":
+			digest := req.URL.Query().Get("digest")
+			if section == "manifests" {
+				digest = last
+			}
+			algo, encoded := splitDigest(digest)
+			body, _ := ioutil.ReadAll(req.Body)
+			if algo == "" {
+				w.WriteHeader(400)
+				return
+			}
+			os.MkdirAll(filepath.Join(layout, "blobs", algo), 0755)
+			ioutil.WriteFile(filepath.Join(layout, "blobs", algo, encoded), body, 0644)
+			w.WriteHeader(201)
+			return
+		}
+		algo, encoded := splitDigest(last)
+		body, err := ioutil.ReadFile(filepath.Join(layout, "blobs", algo, encoded))
+		if err != nil || algo == "" {
+			w.WriteHeader(404)
+			return
+		}
+		if section == "manifests" {
+			w.Header().Set("Content-Type", MediaTypeManifest)
+		}
+		w.Write(body)
+	}))
+	return server
+}
+
+func TestCoreCompliance(t *testing.T) {
+	Convey("Spec Compliance: OCI Transmat", t, testutil.WithTmpdir(func() {
+		// scanning
+		tests.CheckScanWithoutMutation(Kind, New)
+		tests.CheckScanProducesConsistentHash(Kind, New)
+		tests.CheckScanProducesDistinctHashes(Kind, New)
+		tests.CheckScanEmptyIsCalm(Kind, New)
+		tests.CheckScanWithFilters(Kind, New)
+		// round-trip (with relative paths)
+		tests.CheckRoundTrip(Kind, New, "file://bounce", "layout dir", "relative")
+		// round-trip (with absolute paths)
+		cwd, _ := os.Getwd()
+		tests.CheckRoundTrip(Kind, New, "file://"+filepath.Join(cwd, "bounce"), "layout dir", "absolute")
+		tests.CheckMultipleCommit(Kind, New, "file://bounce", "layout dir")
+	}))
+}
+
+func TestOCIMaterialize(t *testing.T) {
+	Convey("Given an OCI image layout with a layered image", t,
+		testutil.Requires(testutil.RequiresRoot, testutil.WithTmpdir(func(c C) {
+			cwd, _ := os.Getwd()
+			layout := filepath.Join(cwd, "layout")
+			digest := makeLayout(layout)
+			transmat := New("./workdir/oci")
+
+			shouldHaveTheImage := func(arena rio.Arena) {
+				So(arena.Hash(), ShouldEqual, rio.CommitID(digest))
+				read := func(name string) string {
+					body, _ := ioutil.ReadFile(filepath.Join(arena.Path(), name))
+					return string(body)
+				}
+				So(read("etc/b"), ShouldEqual, "lower b")
+				So(read("etc/c"), ShouldEqual, "upper c")
+				So(read("opaque/y"), ShouldEqual, "upper y")
+				So(read("replaced"), ShouldEqual, "upper replaced")
+				So(filepath.Join(arena.Path(), "etc/a"), testutil.ShouldBeNotFile)
+				So(filepath.Join(arena.Path(), "opaque/x"), testutil.ShouldBeNotFile)
+				So(filepath.Join(arena.Path(), "gone"), testutil.ShouldBeNotFile)
+				So(filepath.Join(arena.Path(), ".wh.gone"), testutil.ShouldBeNotFile)
+				So(filepath.Join(arena.Path(), "opaque/.wh..wh..opq"), testutil.ShouldBeNotFile)
+			}
+
+			Convey("Materializing from the layout dir applies layers and whiteouts", func() {
+				arena := transmat.Materialize(Kind, rio.CommitID(digest), []rio.SiloURI{rio.SiloURI("file://" + layout)}, testutil.TestLogger(c))
+				defer arena.Teardown()
+				shouldHaveTheImage(arena)
+			})
+
+			Convey("Materializing from a registry gets the same image", func() {
+				server := registryServer(layout, false)
+				defer server.Close()
+				arena := transmat.Materialize(Kind, rio.CommitID(digest), []rio.SiloURI{rio.SiloURI(server.URL + "/library/thing")}, testutil.TestLogger(c))
+				defer arena.Teardown()
+				shouldHaveTheImage(arena)
+			})
+
+			Convey("Materializing from a registry that demands a token gets the same image", func() {
+				server := registryServer(layout, true)
+				defer server.Close()
+				arena := transmat.Materialize(Kind, rio.CommitID(digest), []rio.SiloURI{rio.SiloURI(server.URL + "/library/thing")}, testutil.TestLogger(c))
+				defer arena.Teardown()
+				shouldHaveTheImage(arena)
+			})
+
+			Convey("Materializing an image index is refused, naming its platform manifests", func() {
+				index := putJSON(layout, MediaTypeIndex, manifest{
+					SchemaVersion: 2,
+					MediaType:     MediaTypeIndex,
+					Manifests: []descriptor{
+						{MediaType: MediaTypeManifest, Digest: digest, Platform: &platform{Architecture: "amd64", OS: "linux"}},
+					},
+				})
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, rio.CommitID(index.Digest), []rio.SiloURI{rio.SiloURI("file://" + layout)}, testutil.TestLogger(c))
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrConfigValidation{})
+				So(err.Error(), ShouldContainSubstring, digest+" (linux/amd64)")
+			})
+
+			Convey("Materializing an unknown digest reports DNE", func() {
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, rio.CommitID("sha256:"+strings.Repeat("0", 64)), []rio.SiloURI{rio.SiloURI("file://" + layout)}, testutil.TestLogger(c))
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrWareDNE{})
+			})
+
+			// The real attack would link `etc -> /etc`; we aim at a stand-in
+			//  for the host's /etc, so a regression can't wreck the test machine.
+			for _, upper := range [][]layerEntry{
+				{{"etc/.wh.passwd", tar.TypeReg, ""}},
+				{{"etc/.wh..wh..opq", tar.TypeReg, ""}},
+				{{"etc/passwd", tar.TypeReg, "pwned"}},
+				{{".wh...", tar.TypeReg, ""}},
+				{{"x/.wh..", tar.TypeReg, ""}},
+			} {
+				Convey(fmt.Sprintf("Entries reaching through a lower layer's symlink are refused (%s)", upper[0].name), func() {
+					hostEtc := filepath.Join(cwd, "host", "etc")
+					os.MkdirAll(hostEtc, 0755)
+					ioutil.WriteFile(filepath.Join(hostEtc, "passwd"), []byte("root:x:0:0"), 0644)
+					digest := makeSymlinkLayout(filepath.Join(cwd, "evil"), hostEtc, upper...)
+					err := meep.RecoverPanics(func() {
+						transmat.Materialize(Kind, rio.CommitID(digest), []rio.SiloURI{rio.SiloURI("file://" + filepath.Join(cwd, "evil"))}, testutil.TestLogger(c))
+					})
+					So(err, ShouldHaveSameTypeAs, &def.ErrWareCorrupt{})
+					body, _ := ioutil.ReadFile(filepath.Join(hostEtc, "passwd"))
+					So(string(body), ShouldEqual, "root:x:0:0")
+				})
+			}
+
+			Convey("A corrupted layer is caught", func() {
+				// Flip the content of every layer blob; the manifest still names the old digests.
+				m := fetchManifest(NewWarehouse(rio.SiloURI("file://"+layout)), digest)
+				for _, layer := range m.Layers {
+					_, encoded := splitDigest(layer.Digest)
+					ioutil.WriteFile(filepath.Join(layout, "blobs", "sha256", encoded), makeLayer([]layerEntry{
+						{"evil", tar.TypeReg, "not what you asked for"},
+					}, false), 0644)
+				}
+				err := meep.RecoverPanics(func() {
+					transmat.Materialize(Kind, rio.CommitID(digest), []rio.SiloURI{rio.SiloURI("file://" + layout)}, testutil.TestLogger(c))
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrHashMismatch{})
+			})
+		})),
+	)
+}
+
+func TestOCIScan(t *testing.T) {
+	Convey("Given a filesystem", t,
+		testutil.Requires(testutil.RequiresRoot, testutil.WithTmpdir(func(c C) {
+			filefixture.Beta.Create("./fixture")
+			transmat := New("./workdir/oci")
+
+			Convey("Scanning into a layout dir produces a listed, digest-addressed image", func() {
+				cwd, _ := os.Getwd()
+				layout := filepath.Join(cwd, "layout")
+				digest := transmat.Scan(Kind, "./fixture", []rio.SiloURI{rio.SiloURI("file://" + layout)}, testutil.TestLogger(c))
+				So(string(digest), ShouldStartWith, "sha256:")
+				So(filepath.Join(layout, "oci-layout"), testutil.ShouldBeFile)
+				index, _ := ioutil.ReadFile(filepath.Join(layout, "index.json"))
+				So(string(index), ShouldContainSubstring, string(digest))
+
+				Convey("Scanning again produces the same digest, and doesn't list it twice", func() {
+					digest2 := transmat.Scan(Kind, "./fixture", []rio.SiloURI{rio.SiloURI("file://" + layout)}, testutil.TestLogger(c))
+					So(digest2, ShouldEqual, digest)
+					index, _ := ioutil.ReadFile(filepath.Join(layout, "index.json"))
+					So(strings.Count(string(index), string(digest)), ShouldEqual, 1)
+				})
+
+				Convey("Scanning again keeps other entries' annotations and unknown fields", func() {
+					indexPath := filepath.Join(layout, "index.json")
+					ioutil.WriteFile(indexPath, []byte(`{"schemaVersion":2,"x-extra":true,"manifests":[{"mediaType":"`+MediaTypeManifest+`","digest":"sha256:other","size":1,"annotations":{"org.opencontainers.image.ref.name":"v1"}}]}`), 0644)
+					transmat.Scan(Kind, "./fixture", []rio.SiloURI{rio.SiloURI("file://" + layout)}, testutil.TestLogger(c))
+					index, _ := ioutil.ReadFile(indexPath)
+					So(string(index), ShouldContainSubstring, `"x-extra":true`)
+					So(string(index), ShouldContainSubstring, `"org.opencontainers.image.ref.name":"v1"`)
+					So(string(index), ShouldContainSubstring, string(digest))
+				})
+
+				Convey("The image's config has a fixed timestamp", func() {
+					m := fetchManifest(NewWarehouse(rio.SiloURI("file://"+layout)), string(digest))
+					So(m.Layers, ShouldHaveLength, 1)
+					_, encoded := splitDigest(m.Config.Digest)
+					config, _ := ioutil.ReadFile(filepath.Join(layout, "blobs", "sha256", encoded))
+					So(string(config), ShouldContainSubstring, `"created":"1970-01-01T00:00:00Z"`)
+				})
+			})
+
+			for _, auth := range []bool{false, true} {
+				Convey(fmt.Sprintf("Pushing to a registry (auth: %v) round-trips", auth), func() {
+					os.Mkdir("registry", 0755)
+					server := registryServer("registry", auth)
+					defer server.Close()
+					uris := []rio.SiloURI{rio.SiloURI(server.URL + "/library/thing")}
+					digest := transmat.Scan(Kind, "./fixture", uris, testutil.TestLogger(c))
+					arena := transmat.Materialize(Kind, digest, uris, testutil.TestLogger(c))
+					defer arena.Teardown()
+					So(arena.Hash(), ShouldEqual, digest)
+					comparisonLevel := filefixture.CompareDefaults &^ filefixture.CompareSubsecond
+					So(filefixture.Scan(arena.Path()).Describe(comparisonLevel), ShouldEqual, filefixture.Beta.Describe(comparisonLevel))
+				})
+			}
+		})),
+	)
+}
+
+func TestOCIImageDigest(t *testing.T) {
+	Convey("Describing a layer yields the same digests on any host", t, func() {
+		img := &image{layer: descriptor{
+			MediaType: MediaTypeLayerGzip,
+			Digest:    "sha256:" + strings.Repeat("0", 63) + "1",
+			Size:      1234,
+		}}
+		img.describe("sha256:" + strings.Repeat("0", 63) + "2")
+		So(img.configDesc.Digest, ShouldEqual, "sha256:59d0154817366e206520a5940ede7d39f65cc5b32268a5b02d87475e86ab6091")
+		So(img.manifestDesc.Digest, ShouldEqual, "sha256:9f787b1f63ca8b4dce874d1df6ff6cae1d078df0f7eede827d77ca724aa0000a")
+	})
+}
@@ -0,0 +1,583 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+)
+
+// Manifest media types we can make sense of, for registries' content negotiation.
+var acceptManifests = strings.Join([]string{
+	MediaTypeManifest,
+	MediaTypeIndex,
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+}, ", ")
+
+type Warehouse struct {
+	coord def.WarehouseCoord // user's string retained for messages
+	url   *url.URL
+	repo  string // registry repository name; blank for layout dirs.
+	token string // bearer token, once we've been challenged for one.
+}
+
+func NewWarehouse(coords rio.SiloURI) *Warehouse {
+	// verify schema is sensible up front.
+	u, err := url.Parse(string(coords))
+	if err != nil {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("failed to parse URI: %s", err),
+		})
+	}
+	// stamp out a warehouse handle.
+	wh := &Warehouse{
+		coord: def.WarehouseCoord(coords),
+		url:   u,
+	}
+	// whitelist scheme types.
+	switch u.Scheme {
+	case "file":
+	case "http", "https":
+		wh.repo = strings.Trim(u.Path, "/")
+		if wh.repo == "" {
+			panic(&def.ErrConfigValidation{
+				Msg: "registry warehouse URI must include a repository name, e.g. \"https://registry.example.com/library/busybox\"",
+			})
+		}
+	case "":
+		panic(&def.ErrConfigValidation{
+			Msg: "missing scheme in warehouse URI; need a prefix, e.g. \"file://\" or \"https://\"",
+		})
+	default:
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("unsupported scheme in warehouse URI: %q", u.Scheme),
+		})
+	}
+	return wh
+}
+
+/*
+	Returns nil if the warehouse is expected to be readable;
+	returns `*def.ErrWarehouseUnavailable` if not.
+*/
+func (wh *Warehouse) PingReadable() error {
+	switch wh.url.Scheme {
+	case "file":
+		pth := filepath.Join(wh.url.Host, wh.url.Path) // file uris don't have hosts
+		if _, err := os.Stat(filepath.Join(pth, "oci-layout")); err != nil {
+			return &def.ErrWarehouseUnavailable{
+				Msg:    fmt.Sprintf("not an OCI image layout: %s", err),
+				During: "fetch",
+				From:   wh.coord,
+			}
+		}
+		return nil
+	case "http", "https":
+		resp, err := wh.get("/v2/", "")
+		if err != nil {
+			return &def.ErrWarehouseUnavailable{
+				Msg:    fmt.Sprintf("error pinging: %s", err),
+				During: "fetch",
+				From:   wh.coord,
+			}
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return &def.ErrWarehouseUnavailable{
+				Msg:    fmt.Sprintf("registry api check: http status %s", resp.Status),
+				During: "fetch",
+				From:   wh.coord,
+			}
+		}
+		return nil
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Return a reader for the raw content of a blob, identified by digest.
+	Manifests are blobs too (though registries serve them separately;
+	set `manifest` to fetch one of those).
+
+	The content is *not* verified; that's the caller's job.
+
+	May panic with:
+
+	  - `*def.ErrWareDNE` -- if the blob does not exist.
+	  - `*def.ErrWarehouseProblem` -- for most other problems in fetch.
+*/
+func (wh *Warehouse) openBlob(digest string, manifest bool) io.ReadCloser {
+	ware := def.Ware{Type: string(Kind), Hash: digest}
+	algo, hex := splitDigest(digest)
+	if algo == "" {
+		panic(&def.ErrConfigValidation{
+			Msg: fmt.Sprintf("malformed digest %q: must be of the form \"algorithm:hex\"", digest),
+		})
+	}
+	switch wh.url.Scheme {
+	case "file":
+		pth := filepath.Join(wh.url.Host, wh.url.Path) // file uris don't have hosts
+		file, err := os.Open(filepath.Join(pth, "blobs", algo, hex))
+		if err != nil {
+			if os.IsNotExist(err) {
+				panic(&def.ErrWareDNE{Ware: ware, From: wh.coord})
+			}
+			panic(&def.ErrWarehouseProblem{
+				Msg:    err.Error(),
+				During: "fetch",
+				Ware:   ware,
+				From:   wh.coord,
+			})
+		}
+		return file
+	case "http", "https":
+		var resp *http.Response
+		var err error
+		if manifest {
+			resp, err = wh.get("/v2/"+wh.repo+"/manifests/"+digest, acceptManifests)
+		} else {
+			resp, err = wh.get("/v2/"+wh.repo+"/blobs/"+digest, "")
+		}
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:       err.Error(),
+				During:    "fetch",
+				Ware:      ware,
+				From:      wh.coord,
+				Transient: true,
+			})
+		}
+		switch resp.StatusCode {
+		case 200:
+			return resp.Body
+		case 404:
+			resp.Body.Close()
+			panic(&def.ErrWareDNE{Ware: ware, From: wh.coord})
+		default:
+			resp.Body.Close()
+			panic(&def.ErrWarehouseProblem{
+				Msg:       fmt.Sprintf("http status %s", resp.Status),
+				During:    "fetch",
+				Ware:      ware,
+				From:      wh.coord,
+				Transient: resp.StatusCode >= 500,
+			})
+		}
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Issue a GET against the registry, handling a bearer token challenge
+	if we get one (see `do`).
+*/
+func (wh *Warehouse) get(pth string, accept string) (*http.Response, error) {
+	u := *wh.url // copy
+	u.Path = pth
+	header := http.Header{}
+	if accept != "" {
+		header.Set("Accept", accept)
+	}
+	return wh.do("GET", &u, header, nil)
+}
+
+/*
+	Issue a request against the registry.  If we're challenged for a bearer
+	token, fetch one and try again (once; a second 401 is returned to the caller).
+	Challenges can come at any point, since a token is only good for the
+	scope it was issued for (e.g. pulling is not pushing).
+
+	The body, if any, is rewound for the retry.
+*/
+func (wh *Warehouse) do(method string, u *url.URL, header http.Header, body io.ReadSeeker) (*http.Response, error) {
+	attempt := func() (*http.Response, error) {
+		var size int64
+		if body != nil {
+			var err error
+			if size, err = body.Seek(0, 2); err != nil {
+				return nil, err
+			}
+			if _, err := body.Seek(0, 0); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequest(method, u.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if wh.token != "" {
+			req.Header.Set("Authorization", "Bearer "+wh.token)
+		}
+		return http.DefaultClient.Do(req)
+	}
+	resp, err := attempt()
+	if err != nil || resp.StatusCode != 401 {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return nil, fmt.Errorf("registry requires unsupported auth: %q", challenge)
+	}
+	wh.token, err = fetchToken(parseChallenge(strings.TrimPrefix(challenge, "Bearer ")))
+	if err != nil {
+		return nil, fmt.Errorf("fetching registry auth token: %s", err)
+	}
+	return attempt()
+}
+
+func fetchToken(params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("bad realm in auth challenge: %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	resp, err := http.Get(realm.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("http status %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// Parses `key="value",key2="value2"`; good enough for the challenges registries send.
+// Commas inside quotes (e.g. `scope="repository:foo:pull,push"`) are part of the value.
+func parseChallenge(s string) map[string]string {
+	params := map[string]string{}
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, s[start:])
+	for _, part := range parts {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+func splitDigest(digest string) (algo, hex string) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(digest, "/\\") {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+/*
+	Returns nil if the warehouse is expected to be writable;
+	returns `*def.ErrWarehouseUnavailable` if not.
+
+	A layout dir that doesn't exist yet is fine, as long as its parent does;
+	it will be created on first write.
+*/
+func (wh *Warehouse) PingWritable() error {
+	switch wh.url.Scheme {
+	case "file":
+		pth := filepath.Join(wh.url.Host, wh.url.Path) // file uris don't have hosts
+		if stat, err := os.Stat(pth); err == nil {
+			if !stat.IsDir() {
+				return &def.ErrWarehouseUnavailable{
+					Msg:    fmt.Sprintf("oci layout warehouse must be a dir: %s is not a dir", pth),
+					During: "save",
+					From:   wh.coord,
+				}
+			}
+			return nil
+		}
+		if stat, err := os.Stat(filepath.Dir(pth)); err != nil || !stat.IsDir() {
+			return &def.ErrWarehouseUnavailable{
+				Msg:    fmt.Sprintf("oci layout warehouse must be within a dir: %s is not a dir", filepath.Dir(pth)),
+				During: "save",
+				From:   wh.coord,
+			}
+		}
+		return nil
+	case "http", "https":
+		if err := wh.PingReadable(); err != nil {
+			err.(*def.ErrWarehouseUnavailable).During = "save"
+			return err
+		}
+		return nil
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Store a blob, unless the warehouse already has it.
+	The content is *not* verified against the descriptor; that's the caller's job.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- for any problems storing.
+*/
+func (wh *Warehouse) pushBlob(desc descriptor, body io.ReadSeeker) {
+	algo, hex := splitDigest(desc.Digest)
+	switch wh.url.Scheme {
+	case "file":
+		wh.initLayout()
+		dest := filepath.Join(wh.url.Host, wh.url.Path, "blobs", algo, hex)
+		if _, err := os.Stat(dest); err == nil {
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		// Write to a staging file and rename into place, so a blob is never seen half-written.
+		stage, err := ioutil.TempFile(filepath.Dir(dest), rio.UploadStagePrefix)
+		if err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		defer os.Remove(stage.Name())
+		defer stage.Close()
+		if _, err := body.Seek(0, 0); err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		if _, err := io.Copy(stage, body); err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		if err := stage.Chmod(0644); err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		if err := os.Rename(stage.Name(), dest); err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+	case "http", "https":
+		// Skip the upload if the registry already has it.
+		u := *wh.url // copy
+		u.Path = "/v2/" + wh.repo + "/blobs/" + desc.Digest
+		resp, err := wh.do("HEAD", &u, nil, nil)
+		if err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode == 200 {
+			return
+		}
+		// Start an upload session, then send the whole blob in one go.
+		u.Path = "/v2/" + wh.repo + "/blobs/uploads/"
+		resp, err = wh.do("POST", &u, nil, nil)
+		if err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 202 {
+			wh.saveProblem(desc, fmt.Sprintf("starting upload: http status %s", resp.Status))
+		}
+		location, err := wh.url.Parse(resp.Header.Get("Location"))
+		if err != nil || resp.Header.Get("Location") == "" {
+			wh.saveProblem(desc, "starting upload: registry gave no usable upload location")
+		}
+		query := location.Query()
+		query.Set("digest", desc.Digest)
+		location.RawQuery = query.Encode()
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+		resp, err = wh.do("PUT", location, header, body)
+		if err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 201 {
+			wh.saveProblem(desc, fmt.Sprintf("finishing upload: http status %s", resp.Status))
+		}
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Store a manifest (whose blobs must already be stored).
+	In a layout dir, it's also listed in the index, so other tools can find it.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- for any problems storing.
+*/
+func (wh *Warehouse) pushManifest(desc descriptor, body []byte) {
+	switch wh.url.Scheme {
+	case "file":
+		wh.pushBlob(desc, bytes.NewReader(body))
+		wh.addToIndex(desc)
+	case "http", "https":
+		u := *wh.url // copy
+		u.Path = "/v2/" + wh.repo + "/manifests/" + desc.Digest
+		header := http.Header{}
+		header.Set("Content-Type", desc.MediaType)
+		resp, err := wh.do("PUT", &u, header, bytes.NewReader(body))
+		if err != nil {
+			wh.saveProblem(desc, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 201 {
+			wh.saveProblem(desc, fmt.Sprintf("putting manifest: http status %s", resp.Status))
+		}
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+// Create the layout dir's skeleton, if it's not there already.
+func (wh *Warehouse) initLayout() {
+	pth := filepath.Join(wh.url.Host, wh.url.Path) // file uris don't have hosts
+	if err := os.MkdirAll(filepath.Join(pth, "blobs"), 0755); err != nil {
+		wh.saveProblem(descriptor{}, err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(pth, "oci-layout")); err == nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(pth, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		wh.saveProblem(descriptor{}, err.Error())
+	}
+}
+
+/*
+	Add a manifest to the layout dir's `index.json`, unless it's listed already.
+
+	Everything else in the index -- other entries' annotations, fields
+	we don't know -- is kept as it was.  The read-modify-write holds a
+	lock on `index.json.lock`, so concurrent scans into the same layout
+	don't lose each other's entries.
+*/
+func (wh *Warehouse) addToIndex(desc descriptor) {
+	indexPath := filepath.Join(wh.url.Host, wh.url.Path, "index.json")
+	lock, err := os.OpenFile(indexPath+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		wh.saveProblem(desc, err.Error())
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		wh.saveProblem(desc, fmt.Sprintf("locking index.json: %s", err))
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	index := map[string]json.RawMessage{}
+	if body, err := ioutil.ReadFile(indexPath); err == nil {
+		if err := json.Unmarshal(body, &index); err != nil {
+			wh.saveProblem(desc, fmt.Sprintf("existing index.json is unparsable: %s", err))
+		}
+	} else if !os.IsNotExist(err) {
+		wh.saveProblem(desc, err.Error())
+	}
+	if _, ok := index["schemaVersion"]; !ok {
+		index["schemaVersion"] = json.RawMessage("2")
+	}
+	var manifests []json.RawMessage
+	if raw, ok := index["manifests"]; ok {
+		if err := json.Unmarshal(raw, &manifests); err != nil {
+			wh.saveProblem(desc, fmt.Sprintf("existing index.json is unparsable: %s", err))
+		}
+	}
+	for _, raw := range manifests {
+		var existing descriptor
+		if err := json.Unmarshal(raw, &existing); err != nil {
+			wh.saveProblem(desc, fmt.Sprintf("existing index.json is unparsable: %s", err))
+		}
+		if existing.Digest == desc.Digest {
+			return
+		}
+	}
+	entry, err := json.Marshal(desc)
+	if err != nil {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+		))
+	}
+	manifests = append(manifests, entry)
+	index["manifests"], err = json.Marshal(manifests)
+	if err != nil {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+		))
+	}
+	body, err := json.Marshal(index)
+	if err != nil {
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("Transcription error: %s", err)),
+		))
+	}
+	stage := indexPath + rio.UploadStagePrefix
+	if err := ioutil.WriteFile(stage, body, 0644); err != nil {
+		wh.saveProblem(desc, err.Error())
+	}
+	if err := os.Rename(stage, indexPath); err != nil {
+		wh.saveProblem(desc, err.Error())
+	}
+}
+
+func (wh *Warehouse) saveProblem(desc descriptor, msg string) {
+	panic(&def.ErrWarehouseProblem{
+		Msg:    msg,
+		During: "save",
+		Ware:   def.Ware{Type: string(Kind), Hash: desc.Digest},
+		From:   wh.coord,
+	})
+}
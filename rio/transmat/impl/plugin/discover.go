@@ -0,0 +1,73 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	Executables named with this prefix are transmat plugins;
+	the remainder of the name is the transmat kind they handle.
+*/
+const BinaryPrefix = "repeatr-transmat-"
+
+/*
+	Searches every directory on `$PATH` for transmat plugins, and
+	returns a map of kind to executable path.
+
+	If more than one executable is found for the same kind, the first one
+	on the `$PATH` wins, just like a shell would pick.
+	Kinds that aren't valid `TransmatKind` labels are skipped.
+*/
+func Discover() map[rio.TransmatKind]string {
+	found := make(map[rio.TransmatKind]string)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue // a bogus $PATH entry isn't our problem.
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, BinaryPrefix) {
+				continue
+			}
+			kind := rio.TransmatKind(strings.TrimPrefix(name, BinaryPrefix))
+			if !validKind(kind) {
+				continue
+			}
+			if _, exists := found[kind]; exists {
+				continue
+			}
+			pth := filepath.Join(dir, name)
+			info, err := os.Stat(pth) // follow symlinks
+			if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+				continue
+			}
+			found[kind] = pth
+		}
+	}
+	return found
+}
+
+func validKind(kind rio.TransmatKind) bool {
+	if kind == "" {
+		return false
+	}
+	for _, r := range kind {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+/*
+	Transmats provided by external executables.
+
+	Any executable on the `$PATH` named `repeatr-transmat-<kind>` is treated
+	as a transmat plugin for that kind (very much in the same spirit as
+	`git-remote-<transport>` helpers).  This lets you wire repeatr up to
+	storage systems it has never heard of, without forking repeatr.
+	Kinds that are built in to repeatr always take precedence over plugins
+	of the same name.
+
+	Repeatr drives a plugin by invoking it once per operation, with the
+	operation name as its only argument:
+
+		repeatr-transmat-<kind> capabilities
+		repeatr-transmat-<kind> materialize
+		repeatr-transmat-<kind> scan
+
+	The request is written to the plugin's stdin as a series of lines,
+	each a keyword followed by a single space and a value, and terminated
+	by a blank line (or EOF):
+
+		hash <hash>          -- the ware hash to materialize.  (materialize only.)
+		path <abspath>       -- materialize: an existing, empty dir to fill.
+		                        scan: the file or dir to scan.
+		workdir <abspath>    -- scratch space the plugin may use freely.
+		                        It's on the same filesystem as `path` for materialize,
+		                        so renames out of it are cheap.
+		silo <uri>           -- a warehouse coordinate.  May be repeated;
+		                        order is significant (preference order).
+		filter uid <n>       -- flatten uids to n.
+		filter gid <n>       -- flatten gids to n.
+		filter mtime <time>  -- flatten mtimes to the given RFC3339 time.
+		accept-hash-mismatch -- (no value) a materialize should complete
+		                        even if the content does not match the hash.
+
+	Unknown keywords must be ignored by the plugin, so that repeatr may
+	extend the protocol without breaking existing plugins.
+
+	The plugin answers on stdout.  It may emit any number of progress lines
+	first, then must emit exactly one final status line:
+
+		progress <fraction>           -- a float between 0 and 1.
+		ok <hash>                     -- success; for materialize this is
+		                                 the actual hash of the content placed.
+		error <code> <message>        -- failure.
+
+	Error codes map onto the usual repeatr error types:
+
+		config         -- `*def.ErrConfigValidation`
+		unavailable    -- `*def.ErrWarehouseUnavailable`
+		dne            -- `*def.ErrWareDNE`
+		hash-mismatch  -- `*def.ErrHashMismatch` (the message is the actual hash)
+		corrupt        -- `*def.ErrWareCorrupt`
+		problem        -- `*def.ErrWarehouseProblem`
+		internal       -- `*rio.ErrInternal` (also used for any unrecognized code)
+
+	Anything the plugin writes to stderr is forwarded to repeatr's logs.
+
+	The `capabilities` operation takes no request; the plugin responds
+	with one supported operation name per line ("materialize", "scan").
+
+	Plugins written in Go can use `Serve` to expose any `rio.Transmat`
+	over this protocol with no further glue; see the "repeatr-transmat-reftar"
+	reference plugin in this package's tree for an example.
+*/
+package plugin
@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/filter"
+)
+
+/*
+	One request to a plugin, as serialized on the plugin's stdin.
+	See the package docs for the wire format.
+*/
+type request struct {
+	Hash               rio.CommitID
+	Path               string
+	Workdir            string
+	Silos              []rio.SiloURI
+	Filters            filter.FilterSet
+	AcceptHashMismatch bool
+}
+
+func (r request) WriteTo(w io.Writer) (int64, error) {
+	var lines []string
+	if r.Hash != "" {
+		lines = append(lines, "hash "+string(r.Hash))
+	}
+	if r.Path != "" {
+		lines = append(lines, "path "+r.Path)
+	}
+	if r.Workdir != "" {
+		lines = append(lines, "workdir "+r.Workdir)
+	}
+	for _, silo := range r.Silos {
+		lines = append(lines, "silo "+string(silo))
+	}
+	if r.Filters.Uid != nil {
+		lines = append(lines, fmt.Sprintf("filter uid %d", r.Filters.Uid.Value))
+	}
+	if r.Filters.Gid != nil {
+		lines = append(lines, fmt.Sprintf("filter gid %d", r.Filters.Gid.Value))
+	}
+	if r.Filters.Mtime != nil {
+		lines = append(lines, "filter mtime "+r.Filters.Mtime.Value.UTC().Format(time.RFC3339))
+	}
+	if r.AcceptHashMismatch {
+		lines = append(lines, "accept-hash-mismatch")
+	}
+	n, err := io.WriteString(w, strings.Join(append(lines, "", ""), "\n"))
+	return int64(n), err
+}
+
+/*
+	Parse a request.  Reads up until a blank line or EOF.
+
+	Returns `*def.ErrConfigValidation` for malformed lines, and for
+	filters of kinds it doesn't know.
+*/
+func readRequest(r io.Reader) (req request, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		hunks := strings.SplitN(line, " ", 2)
+		switch hunks[0] {
+		case "hash":
+			req.Hash = rio.CommitID(mustValue(hunks))
+		case "path":
+			req.Path = mustValue(hunks)
+		case "workdir":
+			req.Workdir = mustValue(hunks)
+		case "silo":
+			req.Silos = append(req.Silos, rio.SiloURI(mustValue(hunks)))
+		case "filter":
+			parts := strings.SplitN(mustValue(hunks), " ", 2)
+			if len(parts) != 2 {
+				return req, &def.ErrConfigValidation{Msg: fmt.Sprintf("plugin protocol: malformed filter line %q", line)}
+			}
+			switch parts[0] {
+			case "uid":
+				n, err := strconv.Atoi(parts[1])
+				if err != nil {
+					return req, &def.ErrConfigValidation{Msg: fmt.Sprintf("plugin protocol: malformed filter line %q", line)}
+				}
+				req.Filters = req.Filters.Put(filter.UidFilter{n})
+			case "gid":
+				n, err := strconv.Atoi(parts[1])
+				if err != nil {
+					return req, &def.ErrConfigValidation{Msg: fmt.Sprintf("plugin protocol: malformed filter line %q", line)}
+				}
+				req.Filters = req.Filters.Put(filter.GidFilter{n})
+			case "mtime":
+				t, err := time.Parse(time.RFC3339, parts[1])
+				if err != nil {
+					return req, &def.ErrConfigValidation{Msg: fmt.Sprintf("plugin protocol: malformed filter line %q", line)}
+				}
+				req.Filters = req.Filters.Put(filter.MtimeFilter{t})
+			default:
+				// Unlike unknown keywords, an unknown filter can't be ignored:
+				//  the hash would come out computed under different filters.
+				return req, &def.ErrConfigValidation{Msg: fmt.Sprintf("plugin protocol: unknown filter %q", parts[0])}
+			}
+		case "accept-hash-mismatch":
+			req.AcceptHashMismatch = true
+		default:
+			// Unknown keywords are ignored, per protocol.
+		}
+	}
+	return req, scanner.Err()
+}
+
+func mustValue(hunks []string) string {
+	if len(hunks) < 2 {
+		return ""
+	}
+	return hunks[1]
+}
+
+/*
+	Error codes used in "error" status lines.
+*/
+const (
+	codeConfig       = "config"
+	codeUnavailable  = "unavailable"
+	codeDNE          = "dne"
+	codeHashMismatch = "hash-mismatch"
+	codeCorrupt      = "corrupt"
+	codeProblem      = "problem"
+	codeInternal     = "internal"
+)
+
+/*
+	Turn an "error" status line from a plugin back into one of the
+	well-known error types.
+
+	`during` is "fetch" or "save"; `ware` is filled in as best we know it.
+*/
+func decodeError(kind rio.TransmatKind, code, msg string, during string, hash rio.CommitID) error {
+	ware := def.Ware{Type: string(kind), Hash: string(hash)}
+	switch code {
+	case codeConfig:
+		return &def.ErrConfigValidation{Msg: msg}
+	case codeUnavailable:
+		return &def.ErrWarehouseUnavailable{Msg: msg, During: during}
+	case codeDNE:
+		return &def.ErrWareDNE{Ware: ware}
+	case codeHashMismatch:
+		return &def.ErrHashMismatch{
+			Expected: ware,
+			Actual:   def.Ware{Type: string(kind), Hash: msg},
+		}
+	case codeCorrupt:
+		return &def.ErrWareCorrupt{Msg: msg, Ware: ware}
+	case codeProblem:
+		return &def.ErrWarehouseProblem{Msg: msg, During: during, Ware: ware}
+	default:
+		return &rio.ErrInternal{Msg: fmt.Sprintf("transmat plugin for %q reported: %s %s", kind, code, msg)}
+	}
+}
+
+/*
+	Pick an error code and message for a status line.
+	The inverse of `decodeError`.
+*/
+func encodeError(err error) (code, msg string) {
+	switch e := err.(type) {
+	case *def.ErrConfigValidation:
+		return codeConfig, e.Msg
+	case *def.ErrWarehouseUnavailable:
+		return codeUnavailable, e.Error()
+	case *def.ErrWareDNE:
+		return codeDNE, e.Error()
+	case *def.ErrHashMismatch:
+		return codeHashMismatch, e.Actual.Hash
+	case *def.ErrWareCorrupt:
+		return codeCorrupt, e.Msg
+	case *def.ErrWarehouseProblem:
+		return codeProblem, e.Error()
+	default:
+		return codeInternal, err.Error()
+	}
+}
+
+/*
+	Status lines must be single lines.  Squash anything that isn't.
+*/
+func oneLine(s string) string {
+	return strings.Replace(strings.TrimSpace(s), "\n", " ", -1)
+}
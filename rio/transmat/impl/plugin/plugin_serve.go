@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/filter"
+)
+
+/*
+	Serve one plugin protocol operation by driving a regular `rio.Transmat`.
+
+	This is the plugin-side half of the protocol: a plugin executable
+	written in Go can be as small as
+
+		func main() {
+			os.Exit(plugin.Serve("mykind", mytransmat.New, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+		}
+
+	`kind` is the kind that will be passed to the wrapped transmat (it need
+	not match the plugin's own name).  The transmat factory is handed the
+	request's workdir.
+
+	Returns an exit code.
+*/
+func Serve(
+	kind rio.TransmatKind,
+	factory rio.TransmatFactory,
+	args []string,
+	stdin io.Reader,
+	stdout, stderr io.Writer,
+) int {
+	if len(args) != 1 {
+		fmt.Fprintf(stderr, "usage: %s capabilities|materialize|scan\n", BinaryPrefix+"<kind>")
+		return 1
+	}
+	op := args[0]
+	if op == "capabilities" {
+		fmt.Fprintln(stdout, "materialize")
+		fmt.Fprintln(stdout, "scan")
+		return 0
+	}
+	req, err := readRequest(stdin)
+	if err != nil {
+		code, msg := encodeError(err)
+		fmt.Fprintf(stdout, "error %s %s\n", code, oneLine(msg))
+		return 1
+	}
+
+	log := log15.New()
+	log.SetHandler(log15.StreamHandler(stderr, log15.LogfmtFormat()))
+
+	var result rio.CommitID
+	err = meep.RecoverPanics(func() {
+		if req.Workdir == "" {
+			panic(&rio.ErrInternal{Msg: "plugin protocol: request must include workdir"})
+		}
+		transmat := factory(req.Workdir)
+		options := filterOptions(req.Filters)
+		switch op {
+		case "materialize":
+			if req.AcceptHashMismatch {
+				options = append(options, rio.AcceptHashMismatch)
+			}
+			arena := transmat.Materialize(kind, req.Hash, req.Silos, log, options...)
+			placeArena(arena, req.Path)
+			result = arena.Hash()
+		case "scan":
+			result = transmat.Scan(kind, req.Path, req.Silos, log, options...)
+		default:
+			panic(&rio.ErrInternal{Msg: fmt.Sprintf("plugin protocol: unknown operation %q", op)})
+		}
+	})
+	if err != nil {
+		code, msg := encodeError(err)
+		fmt.Fprintf(stdout, "error %s %s\n", code, oneLine(msg))
+		return 1
+	}
+	fmt.Fprintf(stdout, "ok %s\n", result)
+	return 0
+}
+
+func filterOptions(fs filter.FilterSet) []rio.MaterializerConfigurer {
+	var options []rio.MaterializerConfigurer
+	if fs.Uid != nil {
+		options = append(options, rio.UseFilter(*fs.Uid))
+	}
+	if fs.Gid != nil {
+		options = append(options, rio.UseFilter(*fs.Gid))
+	}
+	if fs.Mtime != nil {
+		options = append(options, rio.UseFilter(*fs.Mtime))
+	}
+	return options
+}
+
+/*
+	Move the arena's content into the (empty) destination dir the protocol
+	requested.  Since the workdir is on the same filesystem, this is a rename.
+*/
+func placeArena(arena rio.Arena, destPath string) {
+	if err := os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "plugin protocol: materialize path must be an empty dir"},
+			meep.Cause(err),
+		))
+	}
+	if err := os.Rename(arena.Path(), destPath); err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Error moving arena into place"},
+			meep.Cause(err),
+		))
+	}
+}
@@ -0,0 +1,303 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/inconshreveable/log15"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/transmat/mixins"
+)
+
+var _ rio.Transmat = &PluginTransmat{}
+
+/*
+	PluginTransmat proxies materialize and scan operations to an external
+	executable speaking the plugin protocol (see package docs).
+*/
+type PluginTransmat struct {
+	kind     rio.TransmatKind
+	binPath  string
+	workPath string
+}
+
+/*
+	Returns a `rio.TransmatFactory` that will produce transmats for
+	the given kind, driving the plugin executable at `binPath`.
+
+	Arenas produced by plugin transmats may be relocated by simple `mv`,
+	so the factory is suitable for use with `cachedir`.
+*/
+func NewFactory(kind rio.TransmatKind, binPath string) rio.TransmatFactory {
+	return func(workPath string) rio.Transmat {
+		err := os.MkdirAll(workPath, 0755)
+		if err != nil {
+			panic(meep.Meep(
+				&rio.ErrInternal{Msg: "Unable to set up workspace"},
+				meep.Cause(err),
+			))
+		}
+		workPath, err = filepath.Abs(workPath)
+		if err != nil {
+			panic(meep.Meep(
+				&rio.ErrInternal{Msg: "Unable to set up workspace"},
+				meep.Cause(err),
+			))
+		}
+		return &PluginTransmat{kind, binPath, workPath}
+	}
+}
+
+func (t *PluginTransmat) Materialize(
+	kind rio.TransmatKind,
+	dataHash rio.CommitID,
+	siloURIs []rio.SiloURI,
+	log log15.Logger,
+	options ...rio.MaterializerConfigurer,
+) rio.Arena {
+	var arena pluginArena
+	meep.Try(func() {
+		// Basic validation and config
+		mixins.MustBeType(t.kind, kind)
+		config := rio.EvaluateConfig(options...)
+
+		// Create staging arena for the plugin to produce data into,
+		//  and a scratch area beside it.
+		var err error
+		arena.path, err = ioutil.TempDir(t.workPath, "")
+		if err != nil {
+			panic(meep.Meep(
+				&rio.ErrInternal{Msg: "Unable to create arena"},
+				meep.Cause(err),
+			))
+		}
+		// If the plugin fails, the arena goes with it.
+		//  (Scan and cachedir only ever see arenas we return.)
+		defer func() {
+			if rcvr := recover(); rcvr != nil {
+				os.RemoveAll(arena.path)
+				panic(rcvr)
+			}
+		}()
+		scratch := t.makeScratch()
+		defer os.RemoveAll(scratch)
+
+		// Invoke the plugin.
+		actualHash := t.invoke("materialize", request{
+			Hash:               dataHash,
+			Path:               arena.path,
+			Workdir:            scratch,
+			Silos:              siloURIs,
+			Filters:            config.FilterSet,
+			AcceptHashMismatch: config.AcceptHashMismatch,
+		}, "fetch", dataHash, config.ProgressReporter, log)
+
+		// Trust, but verify: if the plugin claims a different hash and
+		//  we weren't told to tolerate that, it's a mismatch regardless
+		//   of whether the plugin thought so.
+		arena.hash = actualHash
+		if actualHash != dataHash && !config.AcceptHashMismatch {
+			panic(decodeError(t.kind, codeHashMismatch, string(actualHash), "fetch", dataHash))
+		}
+	}, rio.TryPlanWhitelist)
+	return arena
+}
+
+func (t *PluginTransmat) Scan(
+	kind rio.TransmatKind,
+	subjectPath string,
+	siloURIs []rio.SiloURI,
+	log log15.Logger,
+	options ...rio.MaterializerConfigurer,
+) rio.CommitID {
+	var commitID rio.CommitID
+	meep.Try(func() {
+		// Basic validation and config
+		mixins.MustBeType(t.kind, kind)
+		config := rio.EvaluateConfig(options...)
+
+		// If scan area doesn't exist, bail immediately.
+		//  Same as every other transmat; no need to bother the plugin.
+		_, err := os.Stat(subjectPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return // empty commitID
+			} else {
+				panic(err)
+			}
+		}
+		subjectPath, err = filepath.Abs(subjectPath)
+		if err != nil {
+			panic(err)
+		}
+		scratch := t.makeScratch()
+		defer os.RemoveAll(scratch)
+
+		// Invoke the plugin.
+		commitID = t.invoke("scan", request{
+			Path:    subjectPath,
+			Workdir: scratch,
+			Silos:   siloURIs,
+			Filters: config.FilterSet,
+		}, "save", "", config.ProgressReporter, log)
+	}, rio.TryPlanWhitelist)
+	return commitID
+}
+
+func (t *PluginTransmat) makeScratch() string {
+	pth, err := ioutil.TempDir(t.workPath, ".scratch.")
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to set up tempdir"},
+			meep.Cause(err),
+		))
+	}
+	return pth
+}
+
+/*
+	Exec the plugin for one operation, feed it the request, and
+	interpret the status line it returns.
+
+	May panic with any of the errors the plugin reported (see `decodeError`),
+	or `*rio.ErrInternal` if the plugin misbehaves.
+*/
+func (t *PluginTransmat) invoke(
+	op string,
+	req request,
+	during string,
+	dataHash rio.CommitID,
+	progress chan<- float32,
+	log log15.Logger,
+) rio.CommitID {
+	log = log.New("plugin", t.binPath, "op", op)
+	var reqBuf bytes.Buffer
+	req.WriteTo(&reqBuf)
+	cmd := exec.Command(t.binPath, op)
+	cmd.Stdin = &reqBuf
+	cmd.Stderr = &logWriter{log: log}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to launch transmat plugin"},
+			meep.Cause(err),
+		))
+	}
+	if err := cmd.Start(); err != nil {
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Unable to launch transmat plugin"},
+			meep.Cause(err),
+		))
+	}
+
+	// Read status lines until the final one.
+	var status []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		hunks := strings.SplitN(scanner.Text(), " ", 3)
+		switch hunks[0] {
+		case "progress":
+			if progress == nil || len(hunks) < 2 {
+				continue
+			}
+			if f, err := strconv.ParseFloat(hunks[1], 32); err == nil {
+				progress <- float32(f)
+			}
+			continue
+		case "ok", "error":
+			status = hunks
+		default:
+			log.Warn("transmat plugin emitted unrecognized line", "line", scanner.Text())
+			continue
+		}
+		break
+	}
+	io.Copy(ioutil.Discard, stdout)
+	waitErr := cmd.Wait()
+
+	// Interpret.
+	switch {
+	case status == nil:
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: fmt.Sprintf("transmat plugin for %q exited without reporting status", t.kind)},
+			meep.Cause(waitErr),
+		))
+	case status[0] == "ok" && len(status) >= 2:
+		if waitErr != nil {
+			panic(meep.Meep(
+				&rio.ErrInternal{Msg: fmt.Sprintf("transmat plugin for %q reported success but exited uncleanly", t.kind)},
+				meep.Cause(waitErr),
+			))
+		}
+		return rio.CommitID(strings.Join(status[1:], " "))
+	case status[0] == "error" && len(status) >= 2:
+		msg := ""
+		if len(status) > 2 {
+			msg = status[2]
+		}
+		panic(decodeError(t.kind, status[1], msg, during, dataHash))
+	default:
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: fmt.Sprintf("transmat plugin for %q reported malformed status %q", t.kind, strings.Join(status, " "))},
+		))
+	}
+}
+
+/*
+	Forwards each line written to it into a log.
+*/
+type logWriter struct {
+	log log15.Logger
+	buf []byte
+}
+
+func (lw *logWriter) Write(b []byte) (int, error) {
+	lw.buf = append(lw.buf, b...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.log.Info(string(lw.buf[:i]))
+		lw.buf = lw.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+type pluginArena struct {
+	path string
+	hash rio.CommitID
+}
+
+func (a pluginArena) Path() string {
+	return a.path
+}
+
+func (a pluginArena) Hash() rio.CommitID {
+	return a.hash
+}
+
+// rm's.
+// does not consider it an error if path already does not exist.
+func (a pluginArena) Teardown() {
+	if err := os.RemoveAll(a.path); err != nil {
+		if e2, ok := err.(*os.PathError); ok && e2.Err == syscall.ENOENT && e2.Path == a.path {
+			return
+		}
+		panic(meep.Meep(
+			&rio.ErrInternal{Msg: "Failed to tear down arena"},
+			meep.Cause(err),
+		))
+	}
+}
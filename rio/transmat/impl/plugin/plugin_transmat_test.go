@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/tests"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+const refKind = rio.TransmatKind("reftar")
+
+/*
+	The test binary doubles as the reference plugin: when invoked under the
+	plugin's name (via the symlink `linkPlugin` makes), it serves the tar
+	transmat, exactly as the "repeatr-transmat-reftar" command does.
+*/
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == BinaryPrefix+string(refKind) {
+		os.Exit(Serve(tar.Kind, tar.New, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	os.Exit(m.Run())
+}
+
+func linkPlugin(dir string) string {
+	self, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+	pth, err := filepath.Abs(filepath.Join(dir, BinaryPrefix+string(refKind)))
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Symlink(self, pth); err != nil {
+		panic(err)
+	}
+	return pth
+}
+
+func TestCoreCompliance(t *testing.T) {
+	Convey("Spec Compliance: Plugin Transmat (reference plugin)", t, testutil.WithTmpdir(func() {
+		factory := NewFactory(refKind, linkPlugin("bin"))
+		// scanning
+		tests.CheckScanWithoutMutation(refKind, factory)
+		tests.CheckScanProducesConsistentHash(refKind, factory)
+		tests.CheckScanProducesDistinctHashes(refKind, factory)
+		tests.CheckScanEmptyIsCalm(refKind, factory)
+		tests.CheckScanWithFilters(refKind, factory)
+		// round-trip using content-addressible "warehouse"
+		cwd, _ := os.Getwd()
+		os.Mkdir("bounce", 0755) // make the warehouse location
+		tests.CheckRoundTrip(refKind, factory, "file+ca://"+filepath.Join(cwd, "bounce"), "content-addressible")
+	}))
+}
+
+func TestPluginErrors(t *testing.T) {
+	Convey("Given the reference plugin", t, testutil.WithTmpdir(func(c C) {
+		transmat := NewFactory(refKind, linkPlugin("bin"))("./workdir")
+		cwd, _ := os.Getwd()
+		os.Mkdir("bounce", 0755)
+
+		Convey("Materializing a missing ware should raise DNE", func() {
+			err := meep.RecoverPanics(func() {
+				transmat.Materialize(refKind, "nonexistent", []rio.SiloURI{rio.SiloURI("file+ca://" + filepath.Join(cwd, "bounce"))}, testutil.TestLogger(c))
+			})
+			So(err, ShouldHaveSameTypeAs, &def.ErrWareDNE{})
+
+			Convey("And leave no arena behind", func() {
+				entries, _ := ioutil.ReadDir("./workdir")
+				So(entries, ShouldBeEmpty)
+			})
+		})
+
+		Convey("Materializing with no warehouses should raise unavailable", func() {
+			err := meep.RecoverPanics(func() {
+				transmat.Materialize(refKind, "nonexistent", nil, testutil.TestLogger(c))
+			})
+			So(err, ShouldHaveSameTypeAs, &def.ErrWarehouseUnavailable{})
+		})
+
+		Convey("Dispatching the wrong kind should be refused", func() {
+			err := meep.RecoverPanics(func() {
+				transmat.Materialize(tar.Kind, "nonexistent", nil, testutil.TestLogger(c))
+			})
+			So(err, ShouldHaveSameTypeAs, &rio.ErrInternal{})
+		})
+	}))
+}
+
+func TestReadRequest(t *testing.T) {
+	Convey("Known filters should parse", t, func() {
+		req, err := readRequest(strings.NewReader("hash abc\nfilter uid 1000\nfuture-keyword x\n\n"))
+		So(err, ShouldBeNil)
+		So(req.Hash, ShouldEqual, rio.CommitID("abc"))
+		So(req.Filters.Uid.Value, ShouldEqual, 1000)
+	})
+	Convey("Unknown filters should be refused", t, func() {
+		_, err := readRequest(strings.NewReader("hash abc\nfilter xattrs keep\n\n"))
+		So(err, ShouldHaveSameTypeAs, &def.ErrConfigValidation{})
+	})
+}
+
+func TestDiscover(t *testing.T) {
+	Convey("Given a $PATH containing plugins", t, testutil.WithTmpdir(func() {
+		first := linkPlugin("bin1")
+		linkPlugin("bin2")
+		os.Mkdir("bin3", 0755)
+		os.Symlink("/nonexistent", filepath.Join("bin3", BinaryPrefix+"dangling"))
+		cwd, _ := os.Getwd()
+		path := os.Getenv("PATH")
+		defer os.Setenv("PATH", path)
+		os.Setenv("PATH", filepath.Join(cwd, "bin1")+":"+filepath.Join(cwd, "bin2")+":"+filepath.Join(cwd, "bin3"))
+
+		found := Discover()
+
+		Convey("The first plugin on the path should win", func() {
+			So(found[refKind], ShouldEqual, first)
+		})
+		Convey("Broken links should be skipped", func() {
+			So(found, ShouldNotContainKey, rio.TransmatKind("dangling"))
+		})
+	}))
+}
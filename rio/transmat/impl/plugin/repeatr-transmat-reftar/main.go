@@ -0,0 +1,24 @@
+/*
+	Reference transmat plugin.
+
+	Serves the builtin tar transmat over the plugin protocol, under the
+	kind "reftar".  It's not useful for anything in production (you'd just
+	use "tar"), but it demonstrates how little is needed to write a plugin,
+	and it's what the plugin protocol tests drive.
+
+	Install it somewhere on your `$PATH` to try it:
+
+		go build -o ~/bin/repeatr-transmat-reftar go.polydawn.net/repeatr/rio/transmat/impl/plugin/repeatr-transmat-reftar
+*/
+package main
+
+import (
+	"os"
+
+	"go.polydawn.net/repeatr/rio/transmat/impl/plugin"
+	"go.polydawn.net/repeatr/rio/transmat/impl/tar"
+)
+
+func main() {
+	os.Exit(plugin.Serve(tar.Kind, tar.New, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
@@ -177,6 +177,7 @@ func (t S3Transmat) Scan(
 		// Basic validation and config
 		mixins.MustBeType(Kind, kind)
 		config := rio.EvaluateConfig(options...)
+		compression := tartrans.ParseCompression(config.Compression)
 
 		// If scan area doesn't exist, bail immediately.
 		// No need to even start dialing warehouses if we've got nothing for em.
@@ -192,7 +193,7 @@ func (t S3Transmat) Scan(
 		// First... no save locations is a special case: still need to hash.
 		if len(siloURIs) == 0 {
 			// walk, fwrite, hash
-			commitID = rio.CommitID(tartrans.Save(ioutil.Discard, subjectPath, config.FilterSet, hasherFactory))
+			commitID = rio.CommitID(tartrans.Save(ioutil.Discard, compression, subjectPath, config.FilterSet, hasherFactory))
 			return // for no-save, that's it, we're done
 		}
 
@@ -238,7 +239,7 @@ func (t S3Transmat) Scan(
 		}
 
 		// walk, fwrite, hash
-		commitID = rio.CommitID(tartrans.Save(stream, subjectPath, config.FilterSet, hasherFactory))
+		commitID = rio.CommitID(tartrans.Save(stream, compression, subjectPath, config.FilterSet, hasherFactory))
 
 		// commit
 		for _, controller := range controllers {
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/rlmcpherson/s3gof3r"
@@ -28,6 +29,8 @@ var s3Conf = &s3gof3r.Config{
 	Client:      s3gof3r.ClientWithTimeout(15 * time.Second),
 }
 
+var _ rio.BlobWarehouse = &Warehouse{}
+
 type Warehouse struct {
 	coord      def.WarehouseCoord // user's string retained for messages
 	bucketName string             // s3 bucket name
@@ -68,6 +71,18 @@ func NewWarehouse(coords rio.SiloURI, keys s3gof3r.Keys) *Warehouse {
 	return wh
 }
 
+/*
+	Like `NewWarehouse`, but loads keys from the host environment,
+	the same way the transmat does.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the URI is bad or keys are missing.
+*/
+func NewWarehouseFromEnv(coords rio.SiloURI) *Warehouse {
+	return NewWarehouse(coords, mustLoadKeys())
+}
+
 /*
 	Returns nil if the warehouse is expected to be readable;
 	returns `*def.ErrWarehouseUnavailable` if not.
@@ -110,9 +125,9 @@ func (wh *Warehouse) getShelf(dataHash rio.CommitID) string {
 */
 func (wh *Warehouse) getStageShelf() string {
 	if wh.ctntAddr {
-		return filepath.Join(wh.pathPrefix, ".tmp.upload."+guid.New())
+		return filepath.Join(wh.pathPrefix, rio.UploadStagePrefix+guid.New())
 	}
-	return filepath.Join(path.Dir(wh.pathPrefix), ".tmp.upload."+path.Base(wh.pathPrefix)+"."+guid.New())
+	return filepath.Join(path.Dir(wh.pathPrefix), rio.UploadStagePrefix+path.Base(wh.pathPrefix)+"."+guid.New())
 }
 
 /*
@@ -145,12 +160,73 @@ func (wh *Warehouse) openReader(dataHash rio.CommitID) io.ReadCloser {
 	})
 }
 
+/*
+	Return a reader for the raw binary content of the ware.
+	See `openReader`.
+*/
+func (wh *Warehouse) OpenReader(dataHash rio.CommitID) io.ReadCloser {
+	return wh.openReader(dataHash)
+}
+
+/*
+	Returns true if the warehouse already has an object stored under the hash.
+	Always false for warehouses that aren't content-addressable.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- if the warehouse can't give a clear answer.
+*/
+func (wh *Warehouse) Has(dataHash rio.CommitID) bool {
+	if !wh.ctntAddr {
+		return false
+	}
+	// s3gof3r doesn't expose HEAD requests, so this is another custom api method.
+	s3 := s3gof3r.New("s3.amazonaws.com", wh.keys)
+	req, err := http.NewRequest("HEAD", "", nil)
+	if err != nil {
+		panic(err)
+	}
+	req.URL.Scheme = s3Conf.Scheme
+	req.URL.Host = fmt.Sprintf("%s.%s", wh.bucketName, s3.Domain)
+	req.URL.Path = path.Clean(fmt.Sprintf("/%s", wh.getShelf(dataHash)))
+	s3.Bucket(wh.bucketName).Sign(req)
+	resp, err := s3Conf.Client.Do(req)
+	if err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:       err.Error(),
+			During:    "fetch",
+			Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+			From:      wh.coord,
+			Transient: true,
+		})
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true
+	case 404:
+		return false
+	default:
+		panic(&def.ErrWarehouseProblem{
+			Msg:       fmt.Sprintf("http status %s", resp.Status),
+			During:    "fetch",
+			Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+			From:      wh.coord,
+			Transient: resp.StatusCode >= 500,
+		})
+	}
+}
+
 type writeController struct {
 	warehouse *Warehouse
 	writer    io.WriteCloser
 	stagePath string // may be empty if !ctntAddr -- we upload in place because obj writes are already atomic in s3.
 }
 
+func (wh *Warehouse) OpenWriter() rio.BlobWriteController {
+	return wh.openWriter()
+}
+
 func (wh *Warehouse) openWriter() *writeController {
 	wc := &writeController{
 		warehouse: wh,
@@ -208,6 +284,26 @@ func (wc *writeController) Commit(saveAs rio.CommitID) {
 	}
 }
 
+func (wc *writeController) Write(p []byte) (int, error) {
+	return wc.writer.Write(p)
+}
+
+/*
+	Discard the current data.
+	Closes the writer and invalidates any future use.
+
+	s3gof3r offers no way to abandon an upload, so this finishes it and then
+	removes the stage object.  Without a stage object (non-content-addressable
+	warehouses), the data has already landed; there's nothing we can do.
+*/
+func (wc *writeController) Abort() {
+	wc.writer.Close()
+	if wc.stagePath != "" {
+		s3 := s3gof3r.New("s3.amazonaws.com", wc.warehouse.keys)
+		s3.Bucket(wc.warehouse.bucketName).Delete(wc.stagePath)
+	}
+}
+
 // as close as we can get to `mv` on an s3 object.
 func reloc(bucketName, oldPath, newPath string, keys s3gof3r.Keys) error {
 	s3 := s3gof3r.New("s3.amazonaws.com", keys)
@@ -250,3 +346,142 @@ func newRespError(r *http.Response) *s3gof3r.RespError {
 	r.Body.Close()
 	return e
 }
+
+var _ rio.BlobInventory = &Warehouse{}
+
+/*
+	List the objects in a content-addressable warehouse.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the warehouse isn't content-addressable.
+	  - `*def.ErrWarehouseProblem` -- if the listing can't be read.
+*/
+func (wh *Warehouse) List() []rio.BlobInfo {
+	if !wh.ctntAddr {
+		panic(&def.ErrConfigValidation{
+			Msg: "only content-addressable warehouses can be listed",
+		})
+	}
+	prefix := strings.TrimPrefix(path.Clean("/"+wh.pathPrefix), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	var infos []rio.BlobInfo
+	var continuation string
+	for {
+		page, err := listObjects(wh.bucketName, prefix, continuation, wh.keys)
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    err.Error(),
+				During: "fetch",
+				From:   wh.coord,
+			})
+		}
+		for _, obj := range page.Contents {
+			infos = append(infos, rio.BlobInfo{
+				Name:    strings.TrimPrefix(obj.Key, prefix),
+				ModTime: obj.LastModified,
+			})
+		}
+		if !page.IsTruncated {
+			return infos
+		}
+		continuation = page.NextContinuationToken
+	}
+}
+
+/*
+	Move an object into the warehouse's quarantine prefix.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the warehouse isn't content-addressable.
+	  - `*def.ErrWarehouseProblem` -- in the event of IO errors.
+*/
+func (wh *Warehouse) Quarantine(name string) {
+	if !wh.ctntAddr {
+		panic(&def.ErrConfigValidation{
+			Msg: "only content-addressable warehouses have a quarantine",
+		})
+	}
+	oldPath := filepath.Join(wh.pathPrefix, name)
+	newPath := filepath.Join(wh.pathPrefix, rio.QuarantineDir, name)
+	if err := reloc(wh.bucketName, oldPath, newPath, wh.keys); err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    fmt.Sprintf("failed to quarantine: %s", err),
+			During: "save",
+			Ware:   def.Ware{Type: string(Kind), Hash: name},
+			From:   wh.coord,
+		})
+	}
+}
+
+/*
+	Remove an object from the warehouse.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the warehouse isn't content-addressable.
+	  - `*def.ErrWarehouseProblem` -- in the event of IO errors.
+*/
+func (wh *Warehouse) Delete(name string) {
+	if !wh.ctntAddr {
+		panic(&def.ErrConfigValidation{
+			Msg: "only content-addressable warehouses can have objects removed",
+		})
+	}
+	s3 := s3gof3r.New("s3.amazonaws.com", wh.keys)
+	if err := s3.Bucket(wh.bucketName).Delete(filepath.Join(wh.pathPrefix, name)); err != nil {
+		panic(&def.ErrWarehouseProblem{
+			Msg:    fmt.Sprintf("failed to remove: %s", err),
+			During: "save",
+			Ware:   def.Ware{Type: string(Kind), Hash: name},
+			From:   wh.coord,
+		})
+	}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// one page of the aws list api; s3gof3r doesn't offer this either.
+// the delimiter keeps us from descending into "subdirs" (like the quarantine).
+func listObjects(bucketName, prefix, continuation string, keys s3gof3r.Keys) (*listBucketResult, error) {
+	s3 := s3gof3r.New("s3.amazonaws.com", keys)
+	req, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Scheme = s3Conf.Scheme
+	req.URL.Host = fmt.Sprintf("%s.%s", bucketName, s3.Domain)
+	req.URL.Path = "/"
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	query.Set("delimiter", "/")
+	if continuation != "" {
+		query.Set("continuation-token", continuation)
+	}
+	req.URL.RawQuery = query.Encode()
+	s3.Bucket(bucketName).Sign(req)
+	resp, err := s3Conf.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, newRespError(resp)
+	}
+	defer resp.Body.Close()
+	result := &listBucketResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
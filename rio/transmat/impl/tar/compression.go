@@ -8,7 +8,12 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/klauspost/compress/zstd"
+	xzw "github.com/ulikunitz/xz"
+	"go.polydawn.net/meep"
 	"xi2.org/x/xz"
+
+	"go.polydawn.net/repeatr/api/def"
 )
 
 type Compression int
@@ -18,6 +23,7 @@ const (
 	Bzip2
 	Gzip
 	Xz
+	Zstd
 )
 
 func (compression *Compression) Extension() string {
@@ -30,6 +36,8 @@ func (compression *Compression) Extension() string {
 		return "tar.gz"
 	case Xz:
 		return "tar.xz"
+	case Zstd:
+		return "tar.zst"
 	}
 	return "[unknown]"
 }
@@ -40,6 +48,7 @@ func DetectCompression(source []byte) Compression {
 		Bzip2: {0x42, 0x5A, 0x68},
 		Gzip:  {0x1F, 0x8B, 0x08},
 		Xz:    {0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00},
+		Zstd:  {0x28, 0xB5, 0x2F, 0xFD},
 	} {
 		if bytes.Compare(m, source[:len(m)]) == 0 {
 			return compression
@@ -65,7 +74,116 @@ func Decompress(stream io.Reader) (io.Reader, error) {
 		return bzip2.NewReader(buf), nil
 	case Xz:
 		return xz.NewReader(buf, 0)
+	case Zstd:
+		// Single-threaded decoding doesn't start any goroutines, so there's nothing to leak if the caller never closes it.
+		return zstd.NewReader(buf, zstd.WithDecoderConcurrency(1))
 	default:
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
 	}
 }
+
+/*
+	A compression algorithm and level to use when writing tars.
+
+	Every choice here produces the same bytes for the same tar stream, no matter
+	the host or how many cores it has; that way a `+ca` warehouse ends up with
+	the same blob for the same ware wherever it was packed.
+	(Different builds of repeatr may still compress differently, if the
+	compression libraries they were built with changed their minds.)
+
+	The choice never affects the ware's hash, which covers the files only.
+*/
+type CompressionChoice struct {
+	Format Compression
+	Level  int
+}
+
+/*
+	Gzip at level 6: what we've always written.
+
+	Per http://tukaani.org/lzma/benchmarks.html this appears quite reasonable:
+	higher levels appear to have minimal size payoffs, but significantly rising compress time costs;
+	decompression time does not vary with compression level.
+*/
+var DefaultCompression = CompressionChoice{Gzip, 6}
+
+var compressionNames = map[Compression]string{
+	Uncompressed: "none",
+	Gzip:         "gzip",
+	Zstd:         "zstd",
+	Xz:           "xz",
+}
+
+/*
+	Parses a compression choice as written in an output's configuration
+	(see `def.ParseCompress`), e.g. "zstd:19".
+	An empty string means `DefaultCompression`.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the algorithm is unknown or the level out of range.
+*/
+func ParseCompression(spec string) CompressionChoice {
+	name, level := def.ParseCompress(spec)
+	if name == "" {
+		return DefaultCompression
+	}
+	for format, formatName := range compressionNames {
+		if formatName == name {
+			return CompressionChoice{format, level}
+		}
+	}
+	panic(meep.Meep(
+		&meep.ErrProgrammer{},
+		meep.Cause(fmt.Errorf("def knows compression %q but tar doesn't", name)),
+	))
+}
+
+func (c CompressionChoice) String() string {
+	if c.Format == Uncompressed {
+		return "none"
+	}
+	return fmt.Sprintf("%s:%d", compressionNames[c.Format], c.Level)
+}
+
+// Dictionary sizes of xz's presets 0-9, since the xz writer here has no notion of presets.
+var xzDictCaps = [10]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+/*
+	Wraps `w` in a compressor for the chosen algorithm.
+	The caller must close the returned writer to flush it (it does not close `w`).
+
+	Encoders are configured explicitly, and never to use more than one
+	thread, since their output must depend on nothing but the input.
+*/
+func Compress(w io.Writer, choice CompressionChoice) (io.WriteCloser, error) {
+	switch choice.Format {
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		// Go's gzip header has no name or mtime unless asked; good.
+		return gzip.NewWriterLevel(w, choice.Level)
+	case Zstd:
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(choice.Level)),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderCRC(true),
+		)
+	case Xz:
+		return xzw.WriterConfig{
+			DictCap:  xzDictCaps[choice.Level],
+			CheckSum: xzw.CRC64,
+		}.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("Unsupported compression format %s", (&choice.Format).Extension())
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
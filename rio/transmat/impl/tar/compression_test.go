@@ -0,0 +1,84 @@
+package tar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+)
+
+func TestParseCompression(t *testing.T) {
+	Convey("Parsing compression choices", t, func() {
+		So(ParseCompression(""), ShouldResemble, DefaultCompression)
+		So(ParseCompression("none"), ShouldResemble, CompressionChoice{Uncompressed, 0})
+		So(ParseCompression("gzip"), ShouldResemble, CompressionChoice{Gzip, 6})
+		So(ParseCompression("zstd"), ShouldResemble, CompressionChoice{Zstd, 3})
+		So(ParseCompression("zstd:19"), ShouldResemble, CompressionChoice{Zstd, 19})
+		So(ParseCompression("xz:0"), ShouldResemble, CompressionChoice{Xz, 0})
+		So(ParseCompression("xz:9").String(), ShouldEqual, "xz:9")
+
+		Convey("Nonsense should be rejected", func() {
+			for _, spec := range []string{"lz4", "gzip:0", "gzip:10", "zstd:fast", "none:1", "xz:"} {
+				err := meep.RecoverPanics(func() { ParseCompression(spec) })
+				So(err, ShouldHaveSameTypeAs, &def.ErrConfigValidation{})
+			}
+		})
+	})
+}
+
+func TestCompressedOutput(t *testing.T) {
+	Convey("Given a fixture and a tar transmat", t,
+		testutil.Requires(
+			testutil.RequiresRoot,
+			testutil.WithTmpdir(func(c C) {
+				filefixture.Gamma.Create("./data")
+				transmat := New("./workdir")
+				log := testutil.TestLogger(c)
+				defaultHash := transmat.Scan(Kind, "./data", nil, log)
+
+				for _, spec := range []string{"none", "gzip:1", "zstd", "zstd:19", "xz", "xz:0"} {
+					Convey("Scanning with compression "+spec, func() {
+						choice := ParseCompression(spec)
+						os.Mkdir("./wh1", 0755)
+						os.Mkdir("./wh2", 0755)
+						hash1 := transmat.Scan(Kind, "./data", []rio.SiloURI{"file+ca://wh1"}, log, rio.UseCompression(spec))
+						hash2 := transmat.Scan(Kind, "./data", []rio.SiloURI{"file+ca://wh2"}, log, rio.UseCompression(spec))
+
+						Convey("The hash should not depend on the compression", func() {
+							So(hash1, ShouldEqual, defaultHash)
+							So(hash2, ShouldEqual, defaultHash)
+						})
+
+						Convey("Repeated scans should store byte-identical blobs", func() {
+							// In a content-addressable warehouse, the blob is named by the hash.
+							body1, err := ioutil.ReadFile(filepath.Join("./wh1", string(hash1)))
+							So(err, ShouldBeNil)
+							body2, err := ioutil.ReadFile(filepath.Join("./wh2", string(hash2)))
+							So(err, ShouldBeNil)
+							So(bytes.Equal(body1, body2), ShouldBeTrue)
+							So(DetectCompression(body1), ShouldEqual, choice.Format)
+						})
+
+						Convey("The blob should materialize again", func() {
+							arena := transmat.Materialize(Kind, hash1, []rio.SiloURI{"file+ca://wh1"}, log)
+							defer arena.Teardown()
+							So(arena.Hash(), ShouldEqual, hash1)
+							rescan := filefixture.Scan(arena.Path())
+							comparisonLevel := filefixture.CompareDefaults &^ filefixture.CompareSubsecond
+							So(rescan.Describe(comparisonLevel), ShouldEqual, filefixture.Gamma.Describe(comparisonLevel))
+						})
+					})
+				}
+			}),
+		),
+	)
+}
@@ -0,0 +1,182 @@
+package tar
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	How many times in a row we'll try to resume a download without
+	getting any further before giving up.
+	(Attempts that make progress don't count against this, so a very
+	large ware can survive any number of dropped connections.)
+*/
+var httpMaxStalls = 5
+
+/*
+	Reads an http response body, and if the connection drops partway,
+	reconnects with a `Range` request to pick up where it left off.
+
+	If the server ignores the range (answering with the whole object again),
+	we skip forward to where we were.  If the object has changed since we
+	started (per its ETag or Last-Modified), that's a problem: we won't splice
+	together two different objects.
+
+	Note that if the server doesn't report a length, a dropped connection
+	may look just like the end of the object; that case is left to the
+	hash verification which always follows reading a ware.
+
+	Read may panic with:
+
+	  - `*def.ErrWarehouseProblem` -- if resuming fails.
+*/
+type resumingReader struct {
+	warehouse *Warehouse
+	dataHash  rio.CommitID
+	url       string
+	body      io.ReadCloser
+	offset    int64  // bytes delivered so far.
+	total     int64  // -1 if unknown.
+	validator string // ETag or Last-Modified of the first response; for `If-Range`.
+	stalls    int
+}
+
+func newResumingReader(wh *Warehouse, dataHash rio.CommitID, url string, resp *http.Response) *resumingReader {
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	return &resumingReader{
+		warehouse: wh,
+		dataHash:  dataHash,
+		url:       url,
+		body:      resp.Body,
+		total:     resp.ContentLength,
+		validator: validator,
+	}
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.stalls = 0
+		}
+		switch {
+		case err == nil:
+			return n, nil
+		case err == io.EOF && (r.total < 0 || r.offset >= r.total):
+			return n, io.EOF
+		}
+		// The connection dropped.  Whatever we got is good; pick up after it.
+		r.body.Close()
+		r.resume(err)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+func (r *resumingReader) resume(cause error) {
+	if cause == io.EOF {
+		cause = io.ErrUnexpectedEOF
+	}
+	r.stalls++
+	if r.stalls > httpMaxStalls {
+		r.problem(fmt.Sprintf("download failed at byte %d, and resuming made no progress: %s", r.offset, cause))
+	}
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		r.problem(err.Error())
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	if r.validator != "" {
+		req.Header.Set("If-Range", r.validator)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Leave a body that fails immediately, so the next read tries again.
+		r.body = ioutil.NopCloser(&failingReader{err})
+		return
+	}
+	switch resp.StatusCode {
+	case 206:
+		if start := contentRangeStart(resp.Header.Get("Content-Range")); start != r.offset {
+			resp.Body.Close()
+			r.problem(fmt.Sprintf("resuming download at byte %d, server answered from byte %d", r.offset, start))
+		}
+		r.body = resp.Body
+	case 200:
+		// Range was ignored (or the object changed; see below).  Start over, and skip what we've already delivered.
+		if r.validator != "" && resp.Header.Get("ETag") != "" && resp.Header.Get("ETag") != r.validator {
+			resp.Body.Close()
+			r.problem("object changed while downloading")
+		}
+		if resp.ContentLength != r.total {
+			resp.Body.Close()
+			r.problem(fmt.Sprintf("object changed while downloading (length was %d, now %d)", r.total, resp.ContentLength))
+		}
+		skipped, err := io.CopyN(ioutil.Discard, resp.Body, r.offset)
+		if err != nil {
+			// Didn't even get back to where we were.  Count it as a stall, and try again.
+			resp.Body.Close()
+			r.body = ioutil.NopCloser(&failingReader{fmt.Errorf("lost connection after re-reading %d bytes: %s", skipped, err)})
+			return
+		}
+		r.body = resp.Body
+	default:
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			// Possibly transient; the next read tries again.
+			r.body = ioutil.NopCloser(&failingReader{fmt.Errorf("http status %s", resp.Status)})
+			return
+		}
+		r.problem(fmt.Sprintf("resuming download: http status %s", resp.Status))
+	}
+}
+
+func (r *resumingReader) problem(msg string) {
+	panic(&def.ErrWarehouseProblem{
+		Msg:    msg,
+		During: "fetch",
+		Ware:   def.Ware{Type: string(Kind), Hash: string(r.dataHash)},
+		From:   r.warehouse.coord,
+	})
+}
+
+// Parses the start offset from a "bytes start-end/total" header; -1 if unparsable.
+func contentRangeStart(header string) int64 {
+	if !strings.HasPrefix(header, "bytes ") {
+		return -1
+	}
+	spec := strings.TrimPrefix(header, "bytes ")
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return -1
+	}
+	start, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,90 @@
+package tar
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/rio"
+)
+
+/*
+	Serves objects from a dir, but never sends more than `chunk` bytes in
+	one response: it declares the full length, then hangs up early.
+	If `honorRange` is false, Range headers are ignored.
+*/
+func truncatingServer(dir string, chunk int, honorRange bool, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(requests, 1)
+		body, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(req.URL.Path)))
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		start := 0
+		if rng := req.Header.Get("Range"); honorRange && strings.HasPrefix(rng, "bytes=") {
+			start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)-start))
+			w.WriteHeader(206)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(200)
+		}
+		end := start + chunk
+		if end > len(body) {
+			end = len(body)
+		}
+		w.Write(body[start:end])
+	}))
+}
+
+func TestResumingDownload(t *testing.T) {
+	Convey("Given a ware in a content-addressable warehouse", t, testutil.WithTmpdir(func(c C) {
+		cwd, _ := os.Getwd()
+		os.Mkdir("wh", 0755)
+		filefixture.Beta.Create("fixture")
+		hash := New("work").Scan(Kind, "fixture", []rio.SiloURI{rio.SiloURI("file+ca://" + filepath.Join(cwd, "wh"))}, testutil.TestLogger(c))
+		stat, _ := os.Stat(filepath.Join("wh", string(hash)))
+		chunk := 64
+		So(stat.Size(), ShouldBeGreaterThan, 3*chunk) // or this test isn't testing much.
+		var requests int32
+
+		Convey("Served by a server that keeps dropping connections", func() {
+			server := truncatingServer("wh", chunk, true, &requests)
+			defer server.Close()
+
+			Convey("Materialize should resume until it has the whole ware", func() {
+				arena := New("work").Materialize(Kind, hash, []rio.SiloURI{rio.SiloURI("http+ca://" + strings.TrimPrefix(server.URL, "http://"))}, testutil.TestLogger(c))
+				So(arena.Hash(), ShouldEqual, hash)
+				So(int(atomic.LoadInt32(&requests)), ShouldBeGreaterThan, 3)
+			})
+		})
+
+		Convey("Served by a server that drops connections and can't resume", func() {
+			server := truncatingServer("wh", chunk, false, &requests)
+			defer server.Close()
+
+			Convey("Materialize should give up with a warehouse problem", func() {
+				err := meep.RecoverPanics(func() {
+					New("work").Materialize(Kind, hash, []rio.SiloURI{rio.SiloURI("http+ca://" + strings.TrimPrefix(server.URL, "http://"))}, testutil.TestLogger(c))
+				})
+				So(err, ShouldHaveSameTypeAs, &def.ErrWarehouseProblem{})
+				So(int(atomic.LoadInt32(&requests)), ShouldEqual, 1+httpMaxStalls)
+			})
+		})
+	}))
+}
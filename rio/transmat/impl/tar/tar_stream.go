@@ -2,7 +2,6 @@ package tar
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"encoding/base64"
 	"fmt"
 	"hash"
@@ -21,22 +20,24 @@ import (
 	"go.polydawn.net/repeatr/lib/fs"
 	"go.polydawn.net/repeatr/lib/fshash"
 	"go.polydawn.net/repeatr/lib/treewalk"
+	"go.polydawn.net/repeatr/rio"
 	"go.polydawn.net/repeatr/rio/filter"
 )
 
 /*
-	Walks `basePath`, hashing it, encoding the contents as a tar and sending the gzip'd
-	stream to `file`, and returning the final hash after all files have been walked.
+	Walks `basePath`, hashing it, encoding the contents as a tar and sending the
+	stream to `file` compressed as chosen, and returning the final hash after all files have been walked.
+	The hash depends only on the files; the compression choice never changes it.
 */
-func Save(file io.Writer, basePath string, filterset filter.FilterSet, hasherFactory func() hash.Hash) string {
+func Save(file io.Writer, compression CompressionChoice, basePath string, filterset filter.FilterSet, hasherFactory func() hash.Hash) string {
 	// Stream the tar and compress on the way out.
-	//  Note on compression levels: The default is 6; and per per http://tukaani.org/lzma/benchmarks.html
-	//  this appears quite reasonable: higher levels appear to have minimal size payoffs, but significantly rising compress time costs;
-	//  decompression time does not vary with compression level.
-	// Save a gzip reference just to close it; tar.Writer doesn't passthru its own close.
-	gzWriter := gzip.NewWriter(file)
-	defer gzWriter.Close()
-	tarWriter := tar.NewWriter(gzWriter)
+	// Save a compressor reference just to close it; tar.Writer doesn't passthru its own close.
+	compWriter, err := Compress(file, compression)
+	if err != nil {
+		panic(err)
+	}
+	defer compWriter.Close()
+	tarWriter := tar.NewWriter(compWriter)
 	defer tarWriter.Close()
 	// walk filesystem, copying and accumulating data for integrity check
 	bucket := &fshash.MemoryBucket{}
@@ -95,28 +96,7 @@ func Extract(tr *tar.Reader, destBasePath string, bucket fshash.Bucket, hasherFa
 				// From // TODO plz
 			})
 		}
-		hdr := fs.Metadata(*thdr)
-		// filter/sanify values:
-		// - names must be clean, relative dot-slash prefixed, and dirs slash-suffixed
-		// - times should never be go's zero value; replace those with epoch
-		// Note that names at this point should be handled by `path` (not `filepath`; these are canonical form for feed to hashing)
-		hdr.Name = path.Clean(hdr.Name)
-		if strings.HasPrefix(hdr.Name, "../") {
-			panic(&def.ErrWareCorrupt{
-				Msg: "corrupt tar: paths that use '../' to leave the base dir are invalid",
-				// Ware // TODO we should be able to get, this abstraction is just silly
-				// From // TODO plz
-			})
-		}
-		if hdr.Name != "." {
-			hdr.Name = "./" + hdr.Name
-		}
-		if hdr.ModTime.IsZero() {
-			hdr.ModTime = fs.Epochwhen
-		}
-		if hdr.AccessTime.IsZero() {
-			hdr.AccessTime = fs.Epochwhen
-		}
+		hdr := NormalizeHeader(thdr)
 		// conjure parents, if necessary.  tar format allows implicit parent dirs.
 		// Note that if any of the implicitly conjured dirs is specified later, unpacking won't notice,
 		// but bucket hashing iteration will (correctly) blow up for repeat entries.
@@ -168,3 +148,132 @@ func Extract(tr *tar.Reader, destBasePath string, bucket fshash.Bucket, hasherFa
 		panic(err)
 	}
 }
+
+/*
+	Convert a tar header into the normalized form used for placement and hashing.
+
+	May panic with:
+
+	  - `*def.ErrWareCorrupt` -- if the header's path is unacceptable.
+*/
+func NormalizeHeader(thdr *tar.Header) fs.Metadata {
+	hdr := fs.Metadata(*thdr)
+	// filter/sanify values:
+	// - names must be clean, relative dot-slash prefixed, and dirs slash-suffixed
+	// - times should never be go's zero value; replace those with epoch
+	// Note that names at this point should be handled by `path` (not `filepath`; these are canonical form for feed to hashing)
+	hdr.Name = path.Clean(hdr.Name)
+	if strings.HasPrefix(hdr.Name, "../") {
+		panic(&def.ErrWareCorrupt{
+			Msg: "corrupt tar: paths that use '../' to leave the base dir are invalid",
+			// Ware // TODO we should be able to get, this abstraction is just silly
+			// From // TODO plz
+		})
+	}
+	if hdr.Name != "." {
+		hdr.Name = "./" + hdr.Name
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = fs.Epochwhen
+	}
+	if hdr.AccessTime.IsZero() {
+		hdr.AccessTime = fs.Epochwhen
+	}
+	return hdr
+}
+
+/*
+	Like `Extract`, but only hashes: walks the tar stream accumulating
+	hashes and metadata into the bucket without placing anything on
+	the filesystem.  The tree hash that `Extract` would have verified
+	can be computed from the bucket afterwards with `fshash.Hash`.
+
+	May panic with:
+
+	  - `*def.ErrWareCorrupt` -- if the tar stream is malformed.
+*/
+func HashStream(tr *tar.Reader, bucket fshash.Bucket, hasherFactory func() hash.Hash, log log15.Logger) {
+	seen := map[string]struct{}{".": {}}
+	for {
+		thdr, err := tr.Next()
+		if err == io.EOF {
+			break // end of archive
+		}
+		if err != nil {
+			panic(&def.ErrWareCorrupt{
+				Msg: fmt.Sprintf("corrupt tar: %s", err),
+			})
+		}
+		hdr := NormalizeHeader(thdr)
+		// conjure parents, if necessary; same as `Extract` does, but we
+		//  track what exists in memory instead of asking the filesystem.
+		parts := strings.Split(hdr.Name, "/")
+		for i := range parts[:len(parts)-1] {
+			i++
+			name := strings.Join(parts[:i], "/")
+			if _, exists := seen[name]; exists {
+				continue
+			}
+			seen[name] = struct{}{}
+			conjuredHdr := fshash.DefaultDirRecord().Metadata
+			conjuredHdr.Name = name + "/"
+			bucket.Record(conjuredHdr, nil)
+		}
+		seen[hdr.Name] = struct{}{}
+		// record the file
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			hasher := hasherFactory()
+			if _, err := io.Copy(hasher, tr); err != nil {
+				panic(&def.ErrWareCorrupt{
+					Msg: fmt.Sprintf("corrupt tar: %s", err),
+				})
+			}
+			hdr.Typeflag = tar.TypeReg
+			bucket.Record(hdr, hasher.Sum(nil))
+		case tar.TypeDir:
+			hdr.Name += "/"
+			bucket.Record(hdr, nil)
+		case tar.TypeSymlink, tar.TypeLink, tar.TypeBlock, tar.TypeChar, tar.TypeFifo:
+			bucket.Record(hdr, nil)
+		case tar.TypeCont, tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink, tar.TypeGNUSparse:
+			log.Warn(fmt.Sprintf("tar hash: ignoring entry type %q", hdr.Typeflag))
+		default:
+			panic(errors.NotImplementedError.New("Unknown file mode %q", hdr.Typeflag))
+		}
+	}
+}
+
+/*
+	Compute the hash of a packed ware from its raw (possibly compressed)
+	stream, without unpacking it.  This is the same hash `Materialize`
+	would verify.
+
+	May panic with:
+
+	  - `*def.ErrWareCorrupt` -- if the stream can't be decompressed or untarred.
+*/
+func HashPacked(stream io.Reader, log log15.Logger) rio.CommitID {
+	return ScanPacked(stream, &fshash.MemoryBucket{}, log)
+}
+
+/*
+	Like `HashPacked`, but also leaves the metadata and content hash of every
+	file in `bucket` -- the same records `Materialize` would have produced,
+	root included -- so the ware can be examined without touching disk.
+	Content hashes are sha384, as everywhere else.
+
+	May panic with:
+
+	  - `*def.ErrWareCorrupt` -- if the stream can't be decompressed or untarred.
+*/
+func ScanPacked(stream io.Reader, bucket fshash.Bucket, log log15.Logger) rio.CommitID {
+	reader, err := Decompress(stream)
+	if err != nil {
+		panic(&def.ErrWareCorrupt{
+			Msg: fmt.Sprintf("could not start decompressing: %s", err),
+		})
+	}
+	HashStream(tar.NewReader(reader), bucket, hasherFactory, log)
+	return rio.CommitID(base64.URLEncoding.EncodeToString(fshash.Hash(bucket, hasherFactory)))
+}
@@ -168,6 +168,7 @@ func (t TarTransmat) Scan(
 		// Basic validation and config
 		mixins.MustBeType(Kind, kind)
 		config := rio.EvaluateConfig(options...)
+		compression := ParseCompression(config.Compression)
 
 		// If scan area doesn't exist, bail immediately.
 		// No need to even start dialing warehouses if we've got nothing for em.
@@ -183,7 +184,7 @@ func (t TarTransmat) Scan(
 		// First... no save locations is a special case: still need to hash.
 		if len(siloURIs) == 0 {
 			// walk, fwrite, hash
-			commitID = rio.CommitID(Save(ioutil.Discard, subjectPath, config.FilterSet, hasherFactory))
+			commitID = rio.CommitID(Save(ioutil.Discard, compression, subjectPath, config.FilterSet, hasherFactory))
 			return // for no-save, that's it, we're done
 		}
 
@@ -227,7 +228,7 @@ func (t TarTransmat) Scan(
 		}
 
 		// walk, fwrite, hash
-		commitID = rio.CommitID(Save(stream, subjectPath, config.FilterSet, hasherFactory))
+		commitID = rio.CommitID(Save(stream, compression, subjectPath, config.FilterSet, hasherFactory))
 
 		// commit
 		for _, controller := range controllers {
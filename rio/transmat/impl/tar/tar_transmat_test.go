@@ -3,10 +3,19 @@ package tar
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/meep"
+
+	"go.polydawn.net/repeatr/api/def"
+	"go.polydawn.net/repeatr/lib/fshash"
 	"go.polydawn.net/repeatr/lib/testutil"
+	"go.polydawn.net/repeatr/lib/testutil/filefixture"
+	"go.polydawn.net/repeatr/lib/treewalk"
+	"go.polydawn.net/repeatr/rio"
+	"go.polydawn.net/repeatr/rio/filter"
 	"go.polydawn.net/repeatr/rio/tests"
 )
 
@@ -28,3 +37,59 @@ func TestCoreCompliance(t *testing.T) {
 		tests.CheckRoundTrip(Kind, New, "file+ca://bounce", "content-addressible")
 	}))
 }
+
+func TestScanPacked(t *testing.T) {
+	Convey("Given a packed tarball", t,
+		testutil.Requires(
+			testutil.RequiresRoot,
+			testutil.WithTmpdir(func(c C) {
+				filefixture.Gamma.Create("./data")
+				transmat := New("./workdir")
+				log := testutil.TestLogger(c)
+				hash := transmat.Scan(Kind, "./data", []rio.SiloURI{"file://packed.tgz"}, log)
+
+				Convey("Scanning the stream should give the same hash and records as unpacking it", func() {
+					file, err := os.Open("packed.tgz")
+					So(err, ShouldBeNil)
+					defer file.Close()
+					bucket := &fshash.MemoryBucket{}
+					So(ScanPacked(file, bucket, log), ShouldEqual, hash)
+
+					arena := transmat.Materialize(Kind, hash, []rio.SiloURI{"file://packed.tgz"}, log)
+					defer arena.Teardown()
+					unpacked := &fshash.MemoryBucket{}
+					So(fshash.FillBucket(arena.Path(), "", unpacked, filter.FilterSet{}, hasherFactory), ShouldBeNil)
+					records, unpackedRecords := bucketRecords(bucket), bucketRecords(unpacked)
+					So(len(records), ShouldEqual, len(unpackedRecords))
+					for i, record := range records {
+						other := unpackedRecords[i]
+						So(record.Metadata.Name, ShouldEqual, other.Metadata.Name)
+						So(record.Metadata.Typeflag, ShouldEqual, other.Metadata.Typeflag)
+						So(record.Metadata.Mode&07777, ShouldEqual, other.Metadata.Mode&07777)
+						So(record.Metadata.Linkname, ShouldEqual, other.Metadata.Linkname)
+						So(record.Metadata.ModTime.Unix(), ShouldEqual, other.Metadata.ModTime.Unix())
+						So(record.ContentHash, ShouldResemble, other.ContentHash)
+					}
+				})
+
+				Convey("Garbage should be rejected as corrupt", func() {
+					err := meep.RecoverPanics(func() {
+						ScanPacked(strings.NewReader("not a tarball at all"), &fshash.MemoryBucket{}, log)
+					})
+					So(err, ShouldHaveSameTypeAs, &def.ErrWareCorrupt{})
+				})
+			}),
+		),
+	)
+}
+
+func bucketRecords(bucket fshash.Bucket) []fshash.Record {
+	var records []fshash.Record
+	if err := treewalk.Walk(bucket.Iterator(), func(node treewalk.Node) error {
+		records = append(records, node.(fshash.RecordIterator).Record())
+		return nil
+	}, nil); err != nil {
+		panic(err)
+	}
+	return records
+}
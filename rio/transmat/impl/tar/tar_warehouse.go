@@ -3,11 +3,14 @@ package tar
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"go.polydawn.net/meep"
 
@@ -16,6 +19,8 @@ import (
 	"go.polydawn.net/repeatr/rio"
 )
 
+var _ rio.BlobWarehouse = &Warehouse{}
+
 type Warehouse struct {
 	coord    def.WarehouseCoord // user's string retained for messages
 	url      *url.URL
@@ -107,15 +112,16 @@ func (wh *Warehouse) makeReader(dataHash rio.CommitID) io.ReadCloser {
 		resp, err := http.Get(u.String())
 		if err != nil {
 			panic(&def.ErrWarehouseProblem{
-				Msg:    err.Error(),
-				During: "fetch",
-				Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
-				From:   wh.coord,
+				Msg:       err.Error(),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: true,
 			})
 		}
 		switch resp.StatusCode {
 		case 200:
-			return resp.Body
+			return newResumingReader(wh, dataHash, u.String(), resp)
 		case 404:
 			panic(&def.ErrWareDNE{
 				Ware: def.Ware{Type: string(Kind), Hash: string(dataHash)},
@@ -123,12 +129,114 @@ func (wh *Warehouse) makeReader(dataHash rio.CommitID) io.ReadCloser {
 			})
 		default:
 			panic(&def.ErrWarehouseProblem{
-				Msg:    fmt.Sprintf("http status %s", resp.Status),
+				Msg:       fmt.Sprintf("http status %s", resp.Status),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: resp.StatusCode >= 500,
+			})
+		}
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Returns nil if the warehouse is expected to be readable;
+	returns `*def.ErrWarehouseUnavailable` if not.
+
+	For http warehouses, this is stubbed to always return success;
+	we find out when we try to fetch.
+*/
+func (wh *Warehouse) PingReadable() error {
+	u := wh.url
+	switch u.Scheme {
+	case "file":
+		pth := filepath.Join(u.Host, u.Path) // file uris don't have hosts
+		if !wh.ctntAddr {
+			pth = filepath.Dir(pth)
+		}
+		if _, err := os.Stat(pth); err != nil {
+			return &def.ErrWarehouseUnavailable{
+				Msg:    fmt.Sprintf("error pinging: %s", err),
+				During: "fetch",
+				From:   wh.coord,
+			}
+		}
+		return nil
+	case "http":
+		fallthrough
+	case "https":
+		return nil
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Returns true if the warehouse already has an object stored under the hash.
+	Always false for warehouses that aren't content-addressable.
+
+	May panic with:
+
+	  - `*def.ErrWarehouseProblem` -- if the warehouse can't give a clear answer.
+*/
+func (wh *Warehouse) Has(dataHash rio.CommitID) bool {
+	if !wh.ctntAddr {
+		return false
+	}
+	u := wh.url
+	switch u.Scheme {
+	case "file":
+		stat, err := os.Stat(wh.getShelf(dataHash))
+		if os.IsNotExist(err) {
+			return false
+		}
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    err.Error(),
 				During: "fetch",
 				Ware:   def.Ware{Type: string(Kind), Hash: string(dataHash)},
 				From:   wh.coord,
 			})
 		}
+		return stat.Mode().IsRegular()
+	case "http":
+		fallthrough
+	case "https":
+		u, _ = url.Parse(u.String()) // copy
+		u.Path = filepath.Join(u.Path, string(dataHash))
+		resp, err := http.Head(u.String())
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:       err.Error(),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: true,
+			})
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case 200:
+			return true
+		case 404:
+			return false
+		default:
+			panic(&def.ErrWarehouseProblem{
+				Msg:       fmt.Sprintf("http status %s", resp.Status),
+				During:    "fetch",
+				Ware:      def.Ware{Type: string(Kind), Hash: string(dataHash)},
+				From:      wh.coord,
+				Transient: resp.StatusCode >= 500,
+			})
+		}
 	default:
 		panic(meep.Meep(
 			&meep.ErrProgrammer{},
@@ -137,6 +245,14 @@ func (wh *Warehouse) makeReader(dataHash rio.CommitID) io.ReadCloser {
 	}
 }
 
+/*
+	Return a reader for the raw binary content of the ware.
+	See `makeReader`.
+*/
+func (wh *Warehouse) OpenReader(dataHash rio.CommitID) io.ReadCloser {
+	return wh.makeReader(dataHash)
+}
+
 /*
 	Returns nil if the warehouse is expected to be writable;
 	returns `*def.ErrWarehouseUnavailable` if not.
@@ -237,6 +353,10 @@ type writeController struct {
 	stageFilePath string
 }
 
+func (wh *Warehouse) OpenWriter() rio.BlobWriteController {
+	return wh.openWriter()
+}
+
 func (wh *Warehouse) openWriter() *writeController {
 	wc := &writeController{warehouse: wh}
 	wc.openStageFile()
@@ -250,9 +370,9 @@ func (wc *writeController) openStageFile() {
 		// Pick a random upload path
 		pth := filepath.Join(u.Host, u.Path) // file uris don't have hosts
 		if wc.warehouse.ctntAddr {
-			wc.stageFilePath = filepath.Join(pth, ".tmp.upload."+guid.New())
+			wc.stageFilePath = filepath.Join(pth, rio.UploadStagePrefix+guid.New())
 		} else {
-			wc.stageFilePath = filepath.Join(path.Dir(pth), ".tmp.upload."+path.Base(pth)+"."+guid.New())
+			wc.stageFilePath = filepath.Join(path.Dir(pth), rio.UploadStagePrefix+path.Base(pth)+"."+guid.New())
 		}
 		// Open file to shovel data into
 		file, err := os.OpenFile(wc.stageFilePath, os.O_CREATE|os.O_WRONLY, 0644)
@@ -299,3 +419,199 @@ func (wc *writeController) Commit(saveAs rio.CommitID) {
 		})
 	}
 }
+
+func (wc *writeController) Write(p []byte) (int, error) {
+	return wc.writer.Write(p)
+}
+
+/*
+	Discard the current data, removing the stage file.
+	Closes the writer and invalidates any future use.
+*/
+func (wc *writeController) Abort() {
+	wc.writer.Close()
+	os.Remove(wc.stageFilePath)
+}
+
+var _ rio.BlobInventory = &Warehouse{}
+
+/*
+	List the objects in a content-addressable warehouse.
+
+	For http warehouses, this relies on the server offering an index page
+	for the warehouse URL (as most static file servers' "autoindex" features do);
+	every relative link in the page that could be an object name is listed.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the warehouse isn't content-addressable.
+	  - `*def.ErrWarehouseProblem` -- if the listing can't be read.
+*/
+func (wh *Warehouse) List() []rio.BlobInfo {
+	if !wh.ctntAddr {
+		panic(&def.ErrConfigValidation{
+			Msg: "only content-addressable warehouses can be listed",
+		})
+	}
+	u := wh.url
+	switch u.Scheme {
+	case "file":
+		pth := filepath.Join(u.Host, u.Path) // file uris don't have hosts
+		entries, err := ioutil.ReadDir(pth)
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    err.Error(),
+				During: "fetch",
+				From:   wh.coord,
+			})
+		}
+		var infos []rio.BlobInfo
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() {
+				continue // includes the quarantine dir.
+			}
+			infos = append(infos, rio.BlobInfo{Name: entry.Name(), ModTime: entry.ModTime()})
+		}
+		return infos
+	case "http":
+		fallthrough
+	case "https":
+		u, _ = url.Parse(u.String()) // copy
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		resp, err := http.Get(u.String())
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:       err.Error(),
+				During:    "fetch",
+				From:      wh.coord,
+				Transient: true,
+			})
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    fmt.Sprintf("http status %s fetching index", resp.Status),
+				During: "fetch",
+				From:   wh.coord,
+			})
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    err.Error(),
+				During: "fetch",
+				From:   wh.coord,
+			})
+		}
+		var infos []rio.BlobInfo
+		seen := map[string]bool{}
+		for _, match := range indexLinkPattern.FindAllSubmatch(body, -1) {
+			name, err := url.QueryUnescape(string(match[1]))
+			if err != nil || name == "" || seen[name] || strings.ContainsAny(name, "/?#:") {
+				continue
+			}
+			seen[name] = true
+			infos = append(infos, rio.BlobInfo{Name: name}) // index pages don't reliably say anything about times.
+		}
+		return infos
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+var indexLinkPattern = regexp.MustCompile(`href="(?:\./)?([^"]*)"`)
+
+/*
+	Move an object into the warehouse's quarantine dir.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the warehouse isn't content-addressable,
+	    or is accessed by http (and is thus read-only).
+	  - `*def.ErrWarehouseProblem` -- in the event of IO errors.
+*/
+func (wh *Warehouse) Quarantine(name string) {
+	if !wh.ctntAddr {
+		panic(&def.ErrConfigValidation{
+			Msg: "only content-addressable warehouses have a quarantine",
+		})
+	}
+	u := wh.url
+	switch u.Scheme {
+	case "file":
+		pth := filepath.Join(u.Host, u.Path) // file uris don't have hosts
+		quarantinePath := filepath.Join(pth, rio.QuarantineDir)
+		if err := os.MkdirAll(quarantinePath, 0755); err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    fmt.Sprintf("failed to make quarantine: %s", err),
+				During: "save",
+				From:   wh.coord,
+			})
+		}
+		if err := os.Rename(filepath.Join(pth, name), filepath.Join(quarantinePath, name)); err != nil {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    fmt.Sprintf("failed to quarantine: %s", err),
+				During: "save",
+				Ware:   def.Ware{Type: string(Kind), Hash: name},
+				From:   wh.coord,
+			})
+		}
+	case "http":
+		fallthrough
+	case "https":
+		panic(&def.ErrConfigValidation{
+			Msg: "http transports are only supported for read-only use",
+		})
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
+
+/*
+	Remove an object from the warehouse.
+
+	May panic with:
+
+	  - `*def.ErrConfigValidation` -- if the warehouse isn't content-addressable,
+	    or is accessed by http (and is thus read-only).
+	  - `*def.ErrWarehouseProblem` -- in the event of IO errors.
+*/
+func (wh *Warehouse) Delete(name string) {
+	if !wh.ctntAddr {
+		panic(&def.ErrConfigValidation{
+			Msg: "only content-addressable warehouses can have objects removed",
+		})
+	}
+	u := wh.url
+	switch u.Scheme {
+	case "file":
+		pth := filepath.Join(u.Host, u.Path) // file uris don't have hosts
+		if err := os.Remove(filepath.Join(pth, name)); err != nil && !os.IsNotExist(err) {
+			panic(&def.ErrWarehouseProblem{
+				Msg:    fmt.Sprintf("failed to remove: %s", err),
+				During: "save",
+				Ware:   def.Ware{Type: string(Kind), Hash: name},
+				From:   wh.coord,
+			})
+		}
+	case "http":
+		fallthrough
+	case "https":
+		panic(&def.ErrConfigValidation{
+			Msg: "http transports are only supported for read-only use",
+		})
+	default:
+		panic(meep.Meep(
+			&meep.ErrProgrammer{},
+			meep.Cause(fmt.Errorf("inconsistent validation")),
+		))
+	}
+}
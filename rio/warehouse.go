@@ -0,0 +1,113 @@
+package rio
+
+import (
+	"io"
+	"time"
+)
+
+/*
+	A BlobWarehouse is a warehouse that stores each ware as a single packed
+	object (e.g. a tarball), and can hand out that object raw.
+
+	This is the common ground of the tar, s3, and gs transmats -- they all
+	share the same packing, and so the same hash space -- and it's what lets
+	wares be copied from one warehouse to another without unpacking them.
+	(See the `rio/mirror` package.)
+
+	Methods may panic with the same errors the transmats document:
+	`*def.ErrWareDNE`, `*def.ErrWarehouseProblem`, and so on.
+*/
+type BlobWarehouse interface {
+	/*
+		Returns nil if the warehouse is expected to be readable;
+		returns `*def.ErrWarehouseUnavailable` if not.
+	*/
+	PingReadable() error
+
+	/*
+		Returns nil if the warehouse is expected to be writable;
+		returns `*def.ErrWarehouseUnavailable` if not.
+	*/
+	PingWritable() error
+
+	/*
+		Returns true if the warehouse already has an object stored under the hash.
+		Only meaningful for content-addressable warehouses; others return false.
+	*/
+	Has(dataHash CommitID) bool
+
+	/*
+		Return a reader for the raw binary content of the ware.
+	*/
+	OpenReader(dataHash CommitID) io.ReadCloser
+
+	/*
+		Begin writing a new object.  The object isn't visible in the warehouse
+		until committed.
+	*/
+	OpenWriter() BlobWriteController
+}
+
+type BlobWriteController interface {
+	io.Writer
+
+	/*
+		Commit the current data as the given hash.
+		Caller must be an adult and specify the hash truthfully.
+		Closes the writer and invalidates any future use.
+	*/
+	Commit(saveAs CommitID)
+
+	/*
+		Discard the current data.
+		Closes the writer and invalidates any future use.
+	*/
+	Abort()
+}
+
+/*
+	A BlobInventory is a content-addressable BlobWarehouse which can also
+	list what it holds, and set aside or remove objects.
+	This is what's needed to check a warehouse's integrity, and to
+	collect its garbage.  (See the `rio/fsck` and `rio/gc` packages.)
+*/
+type BlobInventory interface {
+	BlobWarehouse
+
+	/*
+		Lists every object on the shelf.
+		For content-addressable warehouses, names are the hashes the objects
+		are stored under -- except for any incomplete uploads, which are
+		also listed, and have names starting with `UploadStagePrefix`.
+		Quarantined objects are not listed.
+	*/
+	List() []BlobInfo
+
+	/*
+		Move the named object out of the way, into a quarantine area within
+		the warehouse, where it won't be served.
+	*/
+	Quarantine(name string)
+
+	/*
+		Remove the named object.
+	*/
+	Delete(name string)
+}
+
+type BlobInfo struct {
+	Name    string
+	ModTime time.Time // zero if the warehouse can't say.
+}
+
+/*
+	Name prefix of the staging objects warehouses write uploads into before
+	committing them.  Any left lying around are debris from interrupted uploads.
+*/
+const UploadStagePrefix = ".tmp.upload."
+
+/*
+	Name of the area within a warehouse which `BlobInventory.Quarantine`
+	moves objects into.
+*/
+const QuarantineDir = ".quarantine"